@@ -0,0 +1,265 @@
+package cache
+
+import (
+	"container/list"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type entry struct {
+	key      string
+	msg      *dns.Msg
+	upstream string
+	storedAt time.Time
+	expires  time.Time
+
+	prefetching bool
+}
+
+type Cache struct {
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+	maxSize     int
+	staleWindow time.Duration
+}
+
+func New(maxSize int, staleWindow time.Duration) *Cache {
+	if maxSize <= 0 {
+		maxSize = 4096
+	}
+	return &Cache{
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		maxSize:     maxSize,
+		staleWindow: staleWindow,
+	}
+}
+
+func Key(q dns.Question) string {
+	return strings.ToLower(q.Name) + "|" + dns.Type(q.Qtype).String() + "|" + dns.Class(q.Qclass).String()
+}
+
+func (c *Cache) Get(key string) (*dns.Msg, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	e := el.Value.(*entry)
+	now := time.Now()
+	if !now.Before(e.expires) {
+		return nil, "", false
+	}
+
+	c.lru.MoveToFront(el)
+	elapsed := uint32(now.Sub(e.storedAt).Seconds())
+	return copyWithTTL(e.msg, func(ttl uint32) uint32 {
+		if ttl > elapsed {
+			return ttl - elapsed
+		}
+		return 0
+	}), e.upstream, true
+}
+
+func (c *Cache) ShouldPrefetch(key string, threshold float64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*entry)
+	if e.prefetching {
+		return false
+	}
+
+	total := e.expires.Sub(e.storedAt)
+	remaining := time.Until(e.expires)
+	if total <= 0 || remaining <= 0 || float64(remaining)/float64(total) > threshold {
+		return false
+	}
+
+	e.prefetching = true
+	return true
+}
+
+// ClearPrefetch 清除 ShouldPrefetch 设置的预取标记。预取失败或应答不可缓存时条目未被替换，
+// 不清除的话该条目在过期前再也不会被预取。
+func (c *Cache) ClearPrefetch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*entry).prefetching = false
+	}
+}
+
+func (c *Cache) GetStale(key string, staleTTL uint32) (*dns.Msg, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	e := el.Value.(*entry)
+	if time.Since(e.expires) > c.staleWindow {
+		return nil, "", false
+	}
+
+	return copyWithTTL(e.msg, func(uint32) uint32 { return staleTTL }), e.upstream, true
+}
+
+func (c *Cache) Set(key string, msg *dns.Msg, upstream string) {
+	ttl, ok := MinTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	e := &entry{
+		key:      key,
+		msg:      msg.Copy(),
+		upstream: upstream,
+		storedAt: now,
+		expires:  now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.maxSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// Flush 清空所有缓存条目。
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func MinTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+
+	var minTTL uint32
+	found := false
+	for _, rr := range msg.Answer {
+		if !found || rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+			found = true
+		}
+	}
+	if found {
+		return minTTL, true
+	}
+
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			minTTL = soa.Hdr.Ttl
+			if soa.Minttl < minTTL {
+				minTTL = soa.Minttl
+			}
+			return minTTL, true
+		}
+	}
+	return 0, false
+}
+
+func copyWithTTL(msg *dns.Msg, fn func(uint32) uint32) *dns.Msg {
+	m := msg.Copy()
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = fn(rr.Header().Ttl)
+		}
+	}
+	return m
+}
+
+func requestSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return e
+		}
+	}
+	return nil
+}
+
+func subnetKey(base string, ecs *dns.EDNS0_SUBNET) string {
+	bits, addr := 32, ecs.Address.To4()
+	if ecs.Family == 2 {
+		bits, addr = 128, ecs.Address.To16()
+	}
+	if addr == nil || int(ecs.SourceNetmask) > bits {
+		return ""
+	}
+	network := addr.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits))
+	return base + "|ecs=" + network.String() + "/" + strconv.Itoa(int(ecs.SourceNetmask))
+}
+
+// LookupKeys 返回查询 req 时应依次尝试的缓存键，与 StoreKey 使用相同的推导：按发往上游的 ECS 源子网。
+// 依次为客户端 ECS 原样转发时的键、各上游 ecs_ip 注入的 ECS (injected) 对应的键，最后是全局键。
+func LookupKeys(base string, req *dns.Msg, injected []*dns.EDNS0_SUBNET) []string {
+	keys := make([]string, 0, len(injected)+2)
+	if ecs := requestSubnet(req); ecs != nil {
+		if k := subnetKey(base, ecs); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	for _, ecs := range injected {
+		if k := subnetKey(base, ecs); k != "" && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return append(keys, base)
+}
+
+// StoreKey 根据响应回显的 ECS 决定缓存键。RFC 7871 要求响应原样回显查询中的地址与源前缀，
+// 因此回显的即是实际发往上游的 ECS (客户端自带或由 ecs_ip 注入)：作用域前缀为 0 或无 ECS 时全局缓存，
+// 否则按发往上游的源子网缓存，仅对同一源子网的查询有效。
+func StoreKey(base string, resp *dns.Msg) string {
+	ecs := requestSubnet(resp)
+	if ecs == nil || ecs.SourceScope == 0 {
+		return base
+	}
+	if k := subnetKey(base, ecs); k != "" {
+		return k
+	}
+	return base
+}
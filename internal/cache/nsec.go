@@ -0,0 +1,453 @@
+package cache
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/dnssec"
+
+	"github.com/miekg/dns"
+)
+
+// DenialCache 是 RFC 8198 积极否定缓存：保存经 DNSSEC 验证为 Secure 的否定应答中的 NSEC/NSEC3 证明，
+// 之后落入这些证明所覆盖区间、且通配符同样被否定的名称直接合成 NXDOMAIN，无需再查询上游。
+// 未签名区域、验证失败以及 NSEC3 opt-out 区间的否定应答不会被用于合成。
+type DenialCache struct {
+	mu      sync.RWMutex
+	zones   map[string]*denialZone
+	count   int
+	maxSize int
+	maxTTL  uint32
+}
+
+// denialZone 保存一个区域的证明。proofs 按所有者名称去重，nsec 按规范顺序排序，
+// nsec3 按参数 (盐与迭代次数) 分链、链内按哈希排序，查找时二分定位而不必逐条比较与计算哈希。
+type denialZone struct {
+	soa    *proof
+	proofs map[string]*proof
+	nsec   []*proof
+	nsec3  []*nsec3Chain
+}
+
+// nsec3Chain 是使用相同哈希参数的 NSEC3 记录，按所有者哈希排序。
+type nsec3Chain struct {
+	salt       string
+	iterations uint16
+	proofs     []*proof
+}
+
+// proof 是一条 NSEC/NSEC3 (或区域 SOA) 记录及其 RRSIG。
+type proof struct {
+	rr      dns.RR
+	rrs     []dns.RR
+	hash    string // NSEC3 所有者名称中的哈希
+	expires time.Time
+}
+
+// NewDenialCache 创建最多保存 maxSize 条证明的积极否定缓存，maxTTL 大于 0 时限制证明的缓存时长 (秒)。
+func NewDenialCache(maxSize int, maxTTL uint32) *DenialCache {
+	if maxSize <= 0 {
+		maxSize = 4096
+	}
+	return &DenialCache{
+		zones:   make(map[string]*denialZone),
+		maxSize: maxSize,
+		maxTTL:  maxTTL,
+	}
+}
+
+// Add 保存否定应答 (NXDOMAIN 或 NODATA) 中带签名的 NSEC/NSEC3 记录。调用方须确保 resp 已验证为 Secure。
+// 证明的缓存时长取记录 TTL、SOA TTL 与 SOA MINIMUM 中的最小值 (RFC 9077)。
+func (c *DenialCache) Add(resp *dns.Msg) {
+	if len(resp.Answer) > 0 || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return
+	}
+
+	groups := make(map[string][]dns.RR)
+	signed := make(map[string]bool)
+	var soaKey string
+	for _, rr := range resp.Ns {
+		rtype := rr.Header().Rrtype
+		sig, isSig := rr.(*dns.RRSIG)
+		if isSig {
+			rtype = sig.TypeCovered
+		}
+		switch rtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		key := strings.ToLower(rr.Header().Name) + "|" + strconv.Itoa(int(rtype))
+		groups[key] = append(groups[key], dns.Copy(rr))
+		if isSig {
+			signed[key] = true
+		} else if rtype == dns.TypeSOA {
+			soaKey = key
+		}
+	}
+	if soaKey == "" || !signed[soaKey] {
+		return
+	}
+
+	soaProof := newProof(groups[soaKey])
+	if soaProof == nil {
+		return
+	}
+	soa := soaProof.rr.(*dns.SOA)
+	zone := strings.ToLower(soa.Hdr.Name)
+	ttl := min(soa.Hdr.Ttl, soa.Minttl)
+	if c.maxTTL > 0 {
+		ttl = min(ttl, c.maxTTL)
+	}
+	if ttl == 0 {
+		return
+	}
+	now := time.Now()
+	soaProof.expires = now.Add(time.Duration(ttl) * time.Second)
+
+	var proofs []*proof
+	for key, rrs := range groups {
+		if key == soaKey || !signed[key] {
+			continue
+		}
+		p := newProof(rrs)
+		if p == nil || !dns.IsSubDomain(zone, strings.ToLower(p.rr.Header().Name)) {
+			continue
+		}
+		if n, ok := p.rr.(*dns.NSEC3); ok {
+			if n.Hash != dns.SHA1 || n.Iterations > dnssec.MaxNSEC3Iterations {
+				continue
+			}
+			p.hash = strings.ToUpper(dns.SplitDomainName(n.Hdr.Name)[0])
+		}
+		p.expires = now.Add(time.Duration(min(ttl, p.rr.Header().Ttl)) * time.Second)
+		proofs = append(proofs, p)
+	}
+	if len(proofs) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	z := c.zones[zone]
+	if z == nil {
+		z = &denialZone{proofs: make(map[string]*proof)}
+		c.zones[zone] = z
+	}
+	z.soa = soaProof
+	for _, p := range proofs {
+		owner := strings.ToLower(p.rr.Header().Name)
+		if old, ok := z.proofs[owner]; ok {
+			z.remove(old)
+		} else {
+			c.count++
+		}
+		z.proofs[owner] = p
+		z.insert(p)
+	}
+	c.evict(zone, now)
+}
+
+func ownerOf(p *proof) string {
+	return strings.ToLower(p.rr.Header().Name)
+}
+
+func compareOwner(p *proof, name string) int {
+	return dnssec.CanonicalCompare(ownerOf(p), name)
+}
+
+func compareHash(p *proof, h string) int {
+	return strings.Compare(p.hash, h)
+}
+
+// insert 把证明按顺序加入 nsec 或对应参数的 NSEC3 链。
+func (z *denialZone) insert(p *proof) {
+	switch rr := p.rr.(type) {
+	case *dns.NSEC:
+		i, _ := slices.BinarySearchFunc(z.nsec, ownerOf(p), compareOwner)
+		z.nsec = slices.Insert(z.nsec, i, p)
+	case *dns.NSEC3:
+		chain := z.chain(rr.Salt, rr.Iterations)
+		if chain == nil {
+			chain = &nsec3Chain{salt: rr.Salt, iterations: rr.Iterations}
+			z.nsec3 = append(z.nsec3, chain)
+		}
+		i, _ := slices.BinarySearchFunc(chain.proofs, p.hash, compareHash)
+		chain.proofs = slices.Insert(chain.proofs, i, p)
+	}
+}
+
+// remove 从排序索引中删除证明，NSEC3 链为空时一并删除。
+func (z *denialZone) remove(p *proof) {
+	switch rr := p.rr.(type) {
+	case *dns.NSEC:
+		if i, ok := slices.BinarySearchFunc(z.nsec, ownerOf(p), compareOwner); ok {
+			z.nsec = slices.Delete(z.nsec, i, i+1)
+		}
+	case *dns.NSEC3:
+		chain := z.chain(rr.Salt, rr.Iterations)
+		if chain == nil {
+			return
+		}
+		if i, ok := slices.BinarySearchFunc(chain.proofs, p.hash, compareHash); ok {
+			chain.proofs = slices.Delete(chain.proofs, i, i+1)
+		}
+		if len(chain.proofs) == 0 {
+			z.nsec3 = slices.DeleteFunc(z.nsec3, func(c *nsec3Chain) bool { return c == chain })
+		}
+	}
+}
+
+func (z *denialZone) chain(salt string, iterations uint16) *nsec3Chain {
+	for _, c := range z.nsec3 {
+		if c.salt == salt && c.iterations == iterations {
+			return c
+		}
+	}
+	return nil
+}
+
+// newProof 从同一 RRset 的记录与签名中构造证明，RRset 不是单条记录时返回 nil。
+func newProof(rrs []dns.RR) *proof {
+	p := &proof{rrs: rrs}
+	for _, rr := range rrs {
+		if _, ok := rr.(*dns.RRSIG); ok {
+			continue
+		}
+		if p.rr != nil {
+			return nil
+		}
+		p.rr = rr
+	}
+	if p.rr == nil {
+		return nil
+	}
+	return p
+}
+
+// evict 在证明数超过上限时先删除过期的证明，仍然超出时按区域整体删除，刚写入的区域 keep 最后删除。调用方须持有 c.mu。
+func (c *DenialCache) evict(keep string, now time.Time) {
+	if c.count <= c.maxSize {
+		return
+	}
+	for name, z := range c.zones {
+		for owner, p := range z.proofs {
+			if !now.Before(p.expires) {
+				delete(z.proofs, owner)
+				z.remove(p)
+				c.count--
+			}
+		}
+		if len(z.proofs) == 0 {
+			delete(c.zones, name)
+		}
+	}
+	for name, z := range c.zones {
+		if c.count <= c.maxSize {
+			return
+		}
+		if name != keep {
+			c.count -= len(z.proofs)
+			delete(c.zones, name)
+		}
+	}
+	if z := c.zones[keep]; z != nil && c.count > c.maxSize {
+		c.count -= len(z.proofs)
+		delete(c.zones, keep)
+	}
+}
+
+// Lookup 在缓存的证明足以否定查询名称时返回合成的 NXDOMAIN 应答 (AD 位置位，权威段带 SOA 与证明及其 RRSIG)，
+// 否则返回 nil。
+func (c *DenialCache) Lookup(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	name := strings.ToLower(dns.Fqdn(q.Name))
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	zone, z := c.findZone(name)
+	if z == nil || !now.Before(z.soa.expires) {
+		return nil
+	}
+
+	used := z.denyNSEC(zone, name, now)
+	for _, chain := range z.nsec3 {
+		if used != nil {
+			break
+		}
+		used = chain.deny(zone, name, now)
+	}
+	if used == nil {
+		return nil
+	}
+
+	expires := z.soa.expires
+	for _, p := range used {
+		if p.expires.Before(expires) {
+			expires = p.expires
+		}
+	}
+	ttl := uint32(expires.Sub(now) / time.Second)
+	if ttl == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNameError)
+	m.RecursionAvailable = true
+	m.AuthenticatedData = true
+	for _, p := range append([]*proof{z.soa}, used...) {
+		for _, rr := range p.rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = ttl
+			m.Ns = append(m.Ns, rr)
+		}
+	}
+	return m
+}
+
+// findZone 返回缓存中包含 name 的最近的区域。调用方须持有 c.mu (读锁即可)。
+func (c *DenialCache) findZone(name string) (string, *denialZone) {
+	for _, off := range dns.Split(name) {
+		if z := c.zones[name[off:]]; z != nil {
+			return name[off:], z
+		}
+	}
+	if z := c.zones["."]; z != nil {
+		return ".", z
+	}
+	return "", nil
+}
+
+// Len 返回缓存的证明条数。
+func (c *DenialCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.count
+}
+
+// denyNSEC 寻找覆盖 name 的 NSEC 以及覆盖最近祖先 (closest encloser) 下通配符的 NSEC (RFC 4035 5.4)。
+func (z *denialZone) denyNSEC(zone, name string, now time.Time) []*proof {
+	cover := z.nsecCover(zone, name, now)
+	if cover == nil {
+		return nil
+	}
+
+	ce := dnssec.NSECClosestEncloser(cover.rr.(*dns.NSEC), zone, name)
+	wc := z.nsecCover(zone, "*."+strings.TrimPrefix(ce, "."), now)
+	switch {
+	case wc == nil:
+		return nil
+	case wc == cover:
+		return []*proof{cover}
+	}
+	return []*proof{cover, wc}
+}
+
+// nsecCover 返回按规范顺序位于 name 之前的最后一条 NSEC (name 位于所有 NSEC 之前时为回绕的最后一条)，
+// 它未过期且确实覆盖 name 时才返回。
+func (z *denialZone) nsecCover(zone, name string, now time.Time) *proof {
+	if len(z.nsec) == 0 {
+		return nil
+	}
+	i, found := slices.BinarySearchFunc(z.nsec, name, compareOwner)
+	if found {
+		return nil
+	}
+	if i == 0 {
+		i = len(z.nsec)
+	}
+	p := z.nsec[i-1]
+	if !now.Before(p.expires) || !dnssec.NSECCovers(p.rr.(*dns.NSEC), zone, name) {
+		return nil
+	}
+	return p
+}
+
+// deny 按 RFC 5155 8.4 构造最近祖先证明：一条 NSEC3 匹配最近祖先 (且它不是委派点或 DNAME)，
+// 一条非 opt-out 的 NSEC3 覆盖 next closer 名称，一条覆盖最近祖先下的通配符。
+func (c *nsec3Chain) deny(zone, name string, now time.Time) []*proof {
+	if c.match(name, now) != nil {
+		return nil
+	}
+	idx := dns.Split(name)
+	for i := 1; i <= len(idx); i++ {
+		ce := "."
+		if i < len(idx) {
+			ce = name[idx[i]:]
+		}
+		if !dns.IsSubDomain(zone, ce) {
+			return nil
+		}
+		m := c.match(ce, now)
+		if m == nil {
+			continue
+		}
+		bitmap := m.rr.(*dns.NSEC3).TypeBitMap
+		if dnssec.HasType(bitmap, dns.TypeDNAME) || dnssec.IsDelegation(bitmap) {
+			return nil
+		}
+		nc := c.cover(name[idx[i-1]:], false, now)
+		wc := c.cover("*."+strings.TrimPrefix(ce, "."), true, now)
+		if nc == nil || wc == nil {
+			return nil
+		}
+		used := []*proof{m}
+		for _, p := range []*proof{nc, wc} {
+			if !containsProof(used, p) {
+				used = append(used, p)
+			}
+		}
+		return used
+	}
+	return nil
+}
+
+func (c *nsec3Chain) hash(name string) string {
+	return dns.HashName(name, dns.SHA1, c.iterations, c.salt)
+}
+
+// match 返回所有者哈希等于 name 哈希的未过期 NSEC3。
+func (c *nsec3Chain) match(name string, now time.Time) *proof {
+	i, found := slices.BinarySearchFunc(c.proofs, c.hash(name), compareHash)
+	if !found || !now.Before(c.proofs[i].expires) {
+		return nil
+	}
+	return c.proofs[i]
+}
+
+// cover 返回哈希位于 name 哈希之前的最后一条 NSEC3 (回绕到链尾)，它未过期、覆盖该哈希
+// 且 (optOut 为 false 时) 未设置 opt-out 标志时才返回。
+func (c *nsec3Chain) cover(name string, optOut bool, now time.Time) *proof {
+	h := c.hash(name)
+	i, found := slices.BinarySearchFunc(c.proofs, h, compareHash)
+	if found || len(c.proofs) == 0 {
+		return nil
+	}
+	if i == 0 {
+		i = len(c.proofs)
+	}
+	p := c.proofs[i-1]
+	rr := p.rr.(*dns.NSEC3)
+	if !now.Before(p.expires) || (!optOut && rr.Flags&1 != 0) || !dnssec.NSEC3Covers(p.hash, strings.ToUpper(rr.NextDomain), h) {
+		return nil
+	}
+	return p
+}
+
+func containsProof(proofs []*proof, p *proof) bool {
+	for _, q := range proofs {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
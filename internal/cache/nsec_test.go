@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// signed 为记录附上一条 RRSIG。DenialCache 不做验证，只要求证明带签名。
+func signed(rr dns.RR) []dns.RR {
+	h := rr.Header()
+	sig := &dns.RRSIG{
+		Hdr:         dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		TypeCovered: h.Rrtype,
+		SignerName:  "example.",
+	}
+	return []dns.RR{rr, sig}
+}
+
+// nsec3Response 构造 example. 区域的否定应答，names 中的每个名称按其类型位图组成一条完整的 NSEC3 链。
+func nsec3Response(names map[string][]uint16) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:  "ns.example.", Mbox: "hostmaster.example.", Minttl: 300,
+	}
+	resp.Ns = signed(soa)
+
+	hashes := make(map[string]string)
+	var sorted []string
+	for name := range names {
+		h := dns.HashName(name, dns.SHA1, 0, "")
+		hashes[h] = name
+		sorted = append(sorted, h)
+	}
+	slices.Sort(sorted)
+	for i, h := range sorted {
+		rr := &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: h + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			NextDomain: sorted[(i+1)%len(sorted)],
+			TypeBitMap: names[hashes[h]],
+		}
+		resp.Ns = append(resp.Ns, signed(rr)...)
+	}
+	return resp
+}
+
+func lookup(c *DenialCache, name string) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	return c.Lookup(req)
+}
+
+func TestDenialCacheNSEC3(t *testing.T) {
+	c := NewDenialCache(100, 0)
+	c.Add(nsec3Response(map[string][]uint16{
+		"example.":       {dns.TypeNS, dns.TypeSOA, dns.TypeRRSIG, dns.TypeDNSKEY, dns.TypeNSEC3PARAM},
+		"sub.example.":   {dns.TypeNS},
+		"dname.example.": {dns.TypeDNAME, dns.TypeRRSIG},
+	}))
+
+	if m := lookup(c, "missing.example."); m == nil || m.Rcode != dns.RcodeNameError || !m.AuthenticatedData {
+		t.Fatalf("missing.example. not denied: %v", m)
+	}
+	// 最近祖先是委派点或 DNAME 时，下方的名称不在本区域内，不能据此合成 NXDOMAIN。
+	for _, name := range []string{"host.sub.example.", "host.dname.example."} {
+		if m := lookup(c, name); m != nil {
+			t.Errorf("%s denied through %v", name, m.Ns)
+		}
+	}
+	// 存在的名称本身不能被否定。
+	if m := lookup(c, "sub.example."); m != nil {
+		t.Errorf("existing name denied: %v", m.Ns)
+	}
+}
+
+func TestDenialCacheNSEC(t *testing.T) {
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+	resp.Ns = signed(&dns.SOA{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:  "ns.example.", Mbox: "hostmaster.example.", Minttl: 300,
+	})
+	for _, n := range [][2]string{{"example.", "b.example."}, {"b.example.", "d.example."}, {"d.example.", "example."}} {
+		resp.Ns = append(resp.Ns, signed(&dns.NSEC{
+			Hdr:        dns.RR_Header{Name: n[0], Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: n[1],
+			TypeBitMap: []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC},
+		})...)
+	}
+	c := NewDenialCache(100, 0)
+	c.Add(resp)
+
+	for _, name := range []string{"c.example.", "z.example.", "x.b.example."} {
+		if m := lookup(c, name); m == nil || m.Rcode != dns.RcodeNameError {
+			t.Errorf("%s not denied", name)
+		}
+	}
+	for _, name := range []string{"b.example.", "d.example.", "other."} {
+		if m := lookup(c, name); m != nil {
+			t.Errorf("%s denied: %v", name, m.Ns)
+		}
+	}
+}
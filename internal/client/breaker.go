@@ -0,0 +1,115 @@
+package client
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// circuitBreaker 在窗口期内连续失败达到阈值后打开，冷却期内直接跳过该上游；
+// 冷却结束后进入半开状态，只放行一个探测查询，成功则关闭，失败则重新打开。
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	firstFail time.Time
+	openedAt  time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = 5
+	}
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	if cooldown <= 0 {
+		cooldown = 30 * time.Second
+	}
+	return &circuitBreaker{threshold: threshold, window: window, cooldown: cooldown, state: breakerClosed}
+}
+
+// open 报告选择上游时是否应跳过：冷却期内，或半开状态下已有探测查询在进行。
+func (b *circuitBreaker) open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) < b.cooldown
+	case breakerHalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+// begin 在查询发出前调用。冷却结束后的第一个查询作为半开探测，返回 true 时调用方必须以 done 报告结果。
+// 熔断打开时查询不会被拒绝：只有组内上游全部熔断时才会被选中，此时仍照常查询。
+func (b *circuitBreaker) begin() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.state = breakerHalfOpen
+	}
+	if b.state == breakerHalfOpen && !b.probing {
+		b.probing = true
+		return true
+	}
+	return false
+}
+
+// done 记录一次查询结果。canceled 表示查询被取消 (如竞速中其他上游已先返回)，不计入成败。
+func (b *circuitBreaker) done(probe, failed, canceled bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if canceled {
+		return
+	}
+
+	now := time.Now()
+	if !failed {
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		if probe {
+			b.state, b.openedAt = breakerOpen, now
+		}
+		return
+	case breakerOpen:
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFail) > b.window {
+		b.failures, b.firstFail = 0, now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.state, b.openedAt = breakerOpen, now
+		b.failures = 0
+	}
+}
+
+// status 返回当前状态，冷却已结束但尚未探测时显示为半开。
+func (b *circuitBreaker) status() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := b.state
+	if state == breakerOpen && time.Since(b.openedAt) >= b.cooldown {
+		state = breakerHalfOpen
+	}
+	return state
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Canary 直接向上游查询已知存在的域名 (不计入查询统计)，记录结果并返回状态是否发生变化。
+func (s *StatsClient) Canary(ctx context.Context, domain string) (ok bool, changed bool, err error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	req.RecursionDesired = true
+
+	resp, err := s.Client.Resolve(ctx, req)
+	if err == nil {
+		switch {
+		case resp == nil:
+			err = fmt.Errorf("无响应")
+		case resp.Rcode != dns.RcodeSuccess:
+			err = fmt.Errorf("返回 %s", dns.RcodeToString[resp.Rcode])
+		case !hasAddress(resp):
+			err = fmt.Errorf("应答中没有 A 记录")
+		}
+	}
+	ok = err == nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prevOK := s.canaryChecked.IsZero() || s.canaryOK
+	s.canaryOK = ok
+	s.canaryChecked = time.Now()
+	s.canaryErr = ""
+	if err != nil {
+		s.canaryErr = err.Error()
+	}
+	return ok, prevOK != ok, err
+}
+
+func hasAddress(resp *dns.Msg) bool {
+	for _, rr := range resp.Answer {
+		if _, ok := rr.(*dns.A); ok {
+			return true
+		}
+	}
+	return false
+}
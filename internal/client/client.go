@@ -7,6 +7,7 @@ import (
 
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/util"
 
 	"github.com/miekg/dns"
 )
@@ -16,6 +17,15 @@ type DNSClient interface {
 }
 
 func NewDNSClient(cfg config.UpstreamServer, bootstrapper *resolver.Bootstrapper) (DNSClient, error) {
+	if cfg.Proxy != "" {
+		if _, err := newProxyDialer(cfg.Proxy); err != nil {
+			return nil, err
+		}
+		if cfg.Protocol == "doq" {
+			return nil, fmt.Errorf("DoQ 上游不支持通过代理连接: %s", cfg.Address)
+		}
+	}
+
 	switch cfg.Protocol {
 	case "udp":
 		return NewUDPClient(cfg, bootstrapper), nil
@@ -24,6 +34,9 @@ func NewDNSClient(cfg config.UpstreamServer, bootstrapper *resolver.Bootstrapper
 	case "dot":
 		return NewDoTClient(cfg, bootstrapper), nil
 	case "doh":
+		if _, err := parseDoHURL(cfg.Address); err != nil {
+			return nil, err
+		}
 		return NewDoHClient(cfg, bootstrapper), nil
 	case "doq":
 		return NewDoQClient(cfg, bootstrapper), nil
@@ -32,19 +45,68 @@ func NewDNSClient(cfg config.UpstreamServer, bootstrapper *resolver.Bootstrapper
 	}
 }
 
-func ensureECS(req *dns.Msg, ecsIP string) {
-	if ecsIP == "" {
-		return
+func exchangeContext(ctx context.Context, cli *dns.Client, req *dns.Msg, addr string, dial dialFunc) (*dns.Msg, error) {
+	conn, err := dialDNSConn(ctx, cli, addr, dial)
+	if err != nil {
+		return nil, err
 	}
+	defer conn.Close()
 
-	ip := net.ParseIP(ecsIP)
-	if ip == nil {
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	resp, _, err := cli.ExchangeWithConnContext(ctx, req, conn)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return nil, ctxErr
+	}
+	return resp, err
+}
+
+// tlsServerName 返回 TLS 握手使用的 SNI：配置了 servername 时使用它 (地址可直接写 IP)，否则使用地址中的主机名。
+func tlsServerName(cfg config.UpstreamServer, host string) string {
+	if cfg.ServerName != "" {
+		return cfg.ServerName
+	}
+	return host
+}
+
+// prepareEDNS 在保留客户端 EDNS 版本、DO 位及其他选项的前提下，
+// 移除仅对单跳有效的选项 (Cookie、TCP Keepalive)，并按配置覆盖或剥离 ECS。
+// 客户端通告的 UDP 缓冲区大于 edns_buffer_size 时降为该值，避免上游发出会被分片的大应答。
+func prepareEDNS(req *dns.Msg, cfg config.UpstreamServer) {
+	strip := cfg.StripECS && cfg.ECSIP == ""
+	if opt := req.IsEdns0(); opt != nil {
+		if size := util.EDNSBufferSize(); opt.UDPSize() > size || opt.UDPSize() < dns.MinMsgSize {
+			opt.SetUDPSize(size)
+		}
+		var options []dns.EDNS0
+		for _, o := range opt.Option {
+			switch o.Option() {
+			case dns.EDNS0COOKIE, dns.EDNS0TCPKEEPALIVE:
+				continue
+			case dns.EDNS0SUBNET:
+				if strip {
+					continue
+				}
+			}
+			options = append(options, o)
+		}
+		opt.Option = options
+	}
+	ensureECS(req, cfg.ECSIP)
+}
+
+func ensureECS(req *dns.Msg, ecsIP string) {
+	e := ECSOption(ecsIP)
+	if e == nil {
 		return
 	}
 
 	opt := req.IsEdns0()
 	if opt == nil {
-		req.SetEdns0(4096, false)
+		req.SetEdns0(util.EDNSBufferSize(), false)
 		opt = req.IsEdns0()
 	}
 
@@ -58,6 +120,16 @@ func ensureECS(req *dns.Msg, ecsIP string) {
 			newOptions = append(newOptions, o)
 		}
 	}
+	newOptions = append(newOptions, e)
+	opt.Option = newOptions
+}
+
+// ECSOption 返回配置 ecs_ip 时发往上游的 ECS 选项 (IPv4 /24，IPv6 /56)，ecsIP 为空或无效时返回 nil。
+func ECSOption(ecsIP string) *dns.EDNS0_SUBNET {
+	ip := net.ParseIP(ecsIP)
+	if ip == nil {
+		return nil
+	}
 
 	e := new(dns.EDNS0_SUBNET)
 	e.Code = dns.EDNS0SUBNET
@@ -70,6 +142,5 @@ func ensureECS(req *dns.Msg, ecsIP string) {
 		e.SourceNetmask = 56
 		e.Address = ip
 	}
-	newOptions = append(newOptions, e)
-	opt.Option = newOptions
+	return e
 }
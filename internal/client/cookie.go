@@ -0,0 +1,78 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"doh-autoproxy/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+type cookieJar struct {
+	mu           sync.Mutex
+	clientCookie string
+	serverCookie string
+}
+
+func newCookieJar() *cookieJar {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return &cookieJar{clientCookie: hex.EncodeToString(b)}
+}
+
+func (j *cookieJar) apply(req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(util.EDNSBufferSize(), false)
+		opt = req.IsEdns0()
+	}
+
+	j.mu.Lock()
+	cookie := j.clientCookie + j.serverCookie
+	j.mu.Unlock()
+
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	options = append(options, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	opt.Option = options
+}
+
+func (j *cookieJar) validate(resp *dns.Msg) error {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return fmt.Errorf("响应缺少 DNS Cookie")
+	}
+
+	var cookie *dns.EDNS0_COOKIE
+	var options []dns.EDNS0
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			cookie = c
+			continue
+		}
+		options = append(options, o)
+	}
+	if cookie == nil {
+		return fmt.Errorf("响应缺少 DNS Cookie")
+	}
+
+	value := strings.ToLower(cookie.Cookie)
+	if len(value) < 16 || value[:16] != j.clientCookie {
+		return fmt.Errorf("DNS Cookie 不匹配")
+	}
+
+	j.mu.Lock()
+	j.serverCookie = value[16:]
+	j.mu.Unlock()
+
+	opt.Option = options
+	return nil
+}
@@ -4,16 +4,20 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/util"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
@@ -23,30 +27,52 @@ import (
 type DoHClient struct {
 	cfg          config.UpstreamServer
 	bootstrapper *resolver.Bootstrapper
+	dial         dialFunc
 	httpClient   *http.Client
+	endpoint     *url.URL
+	endpointErr  error
 }
 
 func NewDoHClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *DoHClient {
 	client := &DoHClient{
 		cfg:          cfg,
 		bootstrapper: b,
+		dial:         mustProxyDialer(cfg.Proxy),
 	}
+	client.endpoint, client.endpointErr = parseDoHURL(cfg.Address)
 	client.initHTTPClient()
 	return client
 }
 
 func (c *DoHClient) initHTTPClient() {
+	// ServerName 为空时 HTTP/2 与 HTTP/3 传输按 URL 中的主机名设置 SNI
 	tlsConfig := &tls.Config{
+		ServerName:         c.cfg.ServerName,
 		InsecureSkipVerify: c.cfg.InsecureSkipVerify,
 	}
 
-	if c.cfg.EnableH3 {
+	switch strings.ToLower(c.cfg.Method) {
+	case "", "post", "get":
+	default:
+		log.Printf("DoH 上游 %s 的 method 无效: %s，使用 POST", c.cfg.Address, c.cfg.Method)
+	}
+
+	if len(c.cfg.Headers) > 0 {
+		log.Printf("DoH 上游 %s 附加自定义请求头: %s", c.cfg.Address, redactHeaders(c.cfg.Headers))
+	}
+
+	if c.cfg.EnableH3 && c.dial != nil {
+		log.Printf("DoH 上游 %s 配置了代理，HTTP/3 无法经由代理传输，回退到 HTTP/2", c.cfg.Address)
+	}
+
+	if c.cfg.EnableH3 && c.dial == nil {
 		c.httpClient = &http.Client{
 			Transport: &http3.Transport{
 				TLSClientConfig: tlsConfig,
 				QUICConfig: &quic.Config{
 					MaxIdleTimeout: 30 * time.Second,
 				},
+				Dial: c.dialQUIC,
 			},
 			Timeout: 10 * time.Second,
 		}
@@ -55,7 +81,7 @@ func (c *DoHClient) initHTTPClient() {
 
 	c.httpClient = &http.Client{
 		Transport: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
+			Proxy: proxyFromEnvironment(c.dial),
 			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
 				host, port, err := net.SplitHostPort(addr)
 				if err != nil {
@@ -65,6 +91,9 @@ func (c *DoHClient) initHTTPClient() {
 				if err != nil {
 					return nil, err
 				}
+				if c.dial != nil {
+					return c.dial(ctx, network, net.JoinHostPort(ip, port))
+				}
 				d := net.Dialer{
 					Timeout:   30 * time.Second,
 					KeepAlive: 30 * time.Second,
@@ -82,37 +111,92 @@ func (c *DoHClient) initHTTPClient() {
 	}
 }
 
+// parseDoHURL 把上游地址解析为 DoH 端点：缺少协议时补全 https://，路径为空时补全 /dns-query，
+// 其余部分 (端口、路径、查询参数) 原样保留，如 https://doh.example/resolve?key=x。
+func parseDoHURL(address string) (*url.URL, error) {
+	s := strings.TrimSpace(address)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 DoH 地址 %s: %w", address, err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("DoH 地址只支持 https:// 或 http://: %s", address)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("DoH 地址缺少主机名: %s", address)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path, u.RawPath = "/dns-query", ""
+	}
+	u.Fragment = ""
+	return u, nil
+}
+
+// dialQUIC 是 HTTP/3 的拨号函数：与 HTTP/2 一样经 Bootstrap DNS 解析上游主机名。SNI 由 http3.Transport 按主机名设置。
+// 每个 QUIC 连接使用自己的 UDP socket 并随连接关闭，重载后被丢弃的客户端在连接空闲超时后不会遗留 socket。
+func (c *DoHClient) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := c.bootstrapper.LookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return quic.DialAddrEarly(ctx, net.JoinHostPort(ip, port), tlsCfg, cfg)
+}
+
+func proxyFromEnvironment(dial dialFunc) func(*http.Request) (*url.URL, error) {
+	if dial != nil {
+		return nil
+	}
+	return http.ProxyFromEnvironment
+}
+
 func (c *DoHClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
+	prepareEDNS(req, c.cfg)
 
+	// GET 请求按 RFC 8484 §4.1 把 ID 置 0，使相同查询的 URL 一致，便于 HTTP 缓存
+	get := strings.EqualFold(c.cfg.Method, "get")
+	id := req.Id
+	if get {
+		req.Id = 0
+	}
 	msgBuf, err := req.Pack()
+	req.Id = id
 	if err != nil {
 		return nil, fmt.Errorf("打包DNS消息失败: %w", err)
 	}
 
-	urlStr := c.cfg.Address
-	if !strings.HasPrefix(urlStr, "https://") && !strings.HasPrefix(urlStr, "http://") {
-		urlStr = "https://" + urlStr
+	if c.endpointErr != nil {
+		return nil, c.endpointErr
 	}
 
-	if u, err := url.Parse(urlStr); err == nil {
-		if u.Path == "" || u.Path == "/" {
-			u.Path = "/dns-query"
-			urlStr = u.String()
+	var request *http.Request
+	if get {
+		// 保留地址中已有的查询参数，只追加 dns 参数
+		u := *c.endpoint
+		param := "dns=" + base64.RawURLEncoding.EncodeToString(msgBuf)
+		if u.RawQuery != "" {
+			u.RawQuery += "&" + param
+		} else {
+			u.RawQuery = param
 		}
+		request, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	} else {
-		slashIdx := strings.Index(strings.TrimPrefix(urlStr, "https://"), "/")
-		if slashIdx == -1 {
-			urlStr += "/dns-query"
-		}
+		request, err = http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint.String(), bytes.NewReader(msgBuf))
 	}
-
-	request, err := http.NewRequestWithContext(ctx, http.MethodPost, urlStr, bytes.NewReader(msgBuf))
 	if err != nil {
 		return nil, fmt.Errorf("创建HTTP请求失败: %w", err)
 	}
-	request.Header.Set("Content-Type", "application/dns-message")
+	if !get {
+		request.Header.Set("Content-Type", "application/dns-message")
+	}
 	request.Header.Set("Accept", "application/dns-message")
+	c.applyHeaders(request)
 
 	resp, err := c.httpClient.Do(request)
 	if err != nil {
@@ -135,6 +219,32 @@ func (c *DoHClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	if err != nil {
 		return nil, fmt.Errorf("解包DoH响应消息失败: %w", err)
 	}
+	responseMsg.Id = id
 
 	return responseMsg, nil
 }
+
+// applyHeaders 把 http_user_agent 与上游配置的自定义头写入请求 (HTTP/2 与 HTTP/3 共用)，自定义头优先。
+// Host 需要通过 request.Host 设置，net/http 会忽略 Header 中的 Host。
+func (c *DoHClient) applyHeaders(request *http.Request) {
+	if ua := util.UserAgent(); ua != "" {
+		request.Header.Set("User-Agent", ua)
+	}
+	for k, v := range c.cfg.Headers {
+		if strings.EqualFold(k, "Host") {
+			request.Host = v
+			continue
+		}
+		request.Header.Set(k, v)
+	}
+}
+
+// redactHeaders 仅输出头名称，隐藏取值 (可能包含认证令牌)。
+func redactHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, http.CanonicalHeaderKey(k)+"=***")
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
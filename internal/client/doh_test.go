@@ -0,0 +1,87 @@
+package client
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseDoHURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		want    string
+		wantErr bool
+	}{
+		{name: "bare host", address: "dns.example", want: "https://dns.example/dns-query"},
+		{name: "host and port", address: "dns.example:8443", want: "https://dns.example:8443/dns-query"},
+		{name: "root path", address: "https://dns.example/", want: "https://dns.example/dns-query"},
+		{name: "custom path and query", address: "https://dns.example/resolve?key=x#frag", want: "https://dns.example/resolve?key=x"},
+		{name: "http scheme", address: "http://127.0.0.1:8080", want: "http://127.0.0.1:8080/dns-query"},
+		{name: "surrounding spaces", address: "  dns.example/custom  ", want: "https://dns.example/custom"},
+		{name: "unsupported scheme", address: "tls://dns.example", wantErr: true},
+		{name: "missing host", address: "https:///dns-query", wantErr: true},
+		{name: "empty url", address: "https://", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := parseDoHURL(tt.address)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, want error", u)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.String(); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDoHGetKeepsQuery 检查 GET 模式在地址已有的查询参数之后追加 dns 参数，并按 RFC 8484 把 ID 置 0。
+func TestDoHGetKeepsQuery(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/resolve" || r.URL.Query().Get("key") != "x" {
+			http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		buf, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		req := new(dns.Msg)
+		if err == nil {
+			err = req.Unpack(buf)
+		}
+		if err != nil || req.Id != 0 {
+			http.Error(w, "bad dns parameter", http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		out, _ := resp.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	defer srv.Close()
+
+	c := NewDoHClient(config.UpstreamServer{Address: srv.URL + "/resolve?key=x", Protocol: "doh", Method: "get"}, nil)
+	req := new(dns.Msg)
+	req.SetQuestion("get.test.", dns.TypeA)
+	id := req.Id
+	resp, err := c.Resolve(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Id != id || req.Id != id {
+		t.Fatalf("query id not restored: request %d, response %d, want %d", req.Id, resp.Id, id)
+	}
+}
@@ -12,11 +12,14 @@ import (
 
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/util"
 
 	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 )
 
+const doqRequestCancelled = 0x3
+
 type DoQClient struct {
 	cfg          config.UpstreamServer
 	bootstrapper *resolver.Bootstrapper
@@ -30,9 +33,12 @@ func NewDoQClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *DoQClien
 }
 
 func (c *DoQClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
+	prepareEDNS(req, c.cfg)
+
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
 
-	msgBuf, err := req.Pack()
+	msgBuf, err := req.PackBuffer(*buf)
 	if err != nil {
 		return nil, fmt.Errorf("打包DNS消息失败: %w", err)
 	}
@@ -55,7 +61,7 @@ func (c *DoQClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	targetAddr := net.JoinHostPort(ip, port)
 
 	tlsConfig := &tls.Config{
-		ServerName:         host,
+		ServerName:         tlsServerName(c.cfg, host),
 		InsecureSkipVerify: c.cfg.InsecureSkipVerify,
 		NextProtos:         []string{"doq"},
 	}
@@ -70,6 +76,11 @@ func (c *DoQClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	}
 	defer conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "Connection closed")
 
+	stop := context.AfterFunc(ctx, func() {
+		conn.CloseWithError(quic.ApplicationErrorCode(doqRequestCancelled), "request cancelled")
+	})
+	defer stop()
+
 	stream, err := conn.OpenStreamSync(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("打开QUIC流失败: %w", err)
@@ -91,10 +102,13 @@ func (c *DoQClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
 	}
 	responseLength := binary.BigEndian.Uint16(responseLengthBytes)
 
-	respBuf := make([]byte, responseLength)
+	respBuf := (*buf)[:responseLength]
 	if _, err := io.ReadFull(stream, respBuf); err != nil {
 		return nil, fmt.Errorf("读取DoQ响应体失败: %w", err)
 	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
 	responseMsg := new(dns.Msg)
 	err = responseMsg.Unpack(respBuf)
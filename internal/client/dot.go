@@ -5,7 +5,6 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
-	"sync"
 	"time"
 
 	"doh-autoproxy/internal/config"
@@ -17,24 +16,41 @@ import (
 type DoTClient struct {
 	cfg          config.UpstreamServer
 	bootstrapper *resolver.Bootstrapper
-	pool         chan *dns.Conn
-	poolInit     sync.Once
+	dial         dialFunc
+	pool         *connPool
 }
 
 func NewDoTClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *DoTClient {
-	return &DoTClient{
+	maxAge := time.Duration(cfg.PipelineMaxAge) * time.Second
+	if maxAge <= 0 {
+		maxAge = 5 * time.Minute
+	}
+	c := &DoTClient{
 		cfg:          cfg,
 		bootstrapper: b,
+		dial:         mustProxyDialer(cfg.Proxy),
 	}
+	c.pool = newConnPool(cfg.PoolSize, cfg.PipelineIdleTimeout, maxAge, c.dialConn)
+	return c
 }
 
 func (c *DoTClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
+	prepareEDNS(req, c.cfg)
+
+	if !c.cfg.EnablePipeline {
+		return c.resolveOneshot(ctx, req)
+	}
 
-	if c.cfg.EnablePipeline {
-		return c.resolvePipeline(ctx, req)
+	resp, err := c.resolvePipeline(ctx, req)
+	if err == nil || ctx.Err() != nil || !c.cfg.PipelineFallbackEnabled() {
+		return resp, err
 	}
-	return c.resolveOneshot(ctx, req)
+	// 复用连接失败 (包括重连后仍失败，如 TLS 会话异常) 时，改用全新握手的一次性连接再试一次
+	resp, oneshotErr := c.resolveOneshot(ctx, req)
+	if oneshotErr != nil {
+		return nil, fmt.Errorf("%v; 回退到一次性连接也失败: %w", err, oneshotErr)
+	}
+	return resp, nil
 }
 
 func (c *DoTClient) resolveOneshot(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
@@ -49,75 +65,22 @@ func (c *DoTClient) resolveOneshot(ctx context.Context, req *dns.Msg) (*dns.Msg,
 		TLSConfig: tlsConfig,
 	}
 
-	resp, _, err := cli.ExchangeContext(ctx, req, addr)
+	resp, err := exchangeContext(ctx, cli, req, addr, c.dial)
 	if err != nil {
 		return nil, fmt.Errorf("DoT查询失败: %w", err)
 	}
 	return resp, nil
 }
 
-func (c *DoTClient) initPool() {
-	c.poolInit.Do(func() {
-		c.pool = make(chan *dns.Conn, 10)
-		for i := 0; i < 10; i++ {
-			c.pool <- nil
-		}
-	})
+func (c *DoTClient) PoolStats() (PoolStats, bool) {
+	if !c.cfg.EnablePipeline {
+		return PoolStats{}, false
+	}
+	return c.pool.stats(), true
 }
 
 func (c *DoTClient) resolvePipeline(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	c.initPool()
-
-	var conn *dns.Conn
-	select {
-	case conn = <-c.pool:
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
-
-	defer func() {
-		c.pool <- conn
-	}()
-
-	var err error
-	if conn == nil {
-		conn, err = c.dialConn(ctx)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	if err := conn.WriteMsg(req); err != nil {
-		conn.Close()
-		conn = nil
-		conn, err = c.dialConn(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("重连失败: %w", err)
-		}
-		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		if err := conn.WriteMsg(req); err != nil {
-			conn.Close()
-			conn = nil
-			return nil, fmt.Errorf("写入失败: %w", err)
-		}
-	}
-
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	resp, err := conn.ReadMsg()
-	if err != nil {
-		conn.Close()
-		conn = nil
-		return nil, fmt.Errorf("读取失败: %w", err)
-	}
-
-	if resp.Id != req.Id {
-		conn.Close()
-		conn = nil
-		return nil, fmt.Errorf("ID mismatch")
-	}
-
-	return resp, nil
+	return c.pool.exchange(ctx, req)
 }
 
 func (c *DoTClient) prepare(ctx context.Context) (string, *tls.Config, error) {
@@ -142,7 +105,7 @@ func (c *DoTClient) prepare(ctx context.Context) (string, *tls.Config, error) {
 
 	addr := net.JoinHostPort(ip, port)
 	tlsConfig := &tls.Config{
-		ServerName:         host,
+		ServerName:         tlsServerName(c.cfg, host),
 		InsecureSkipVerify: c.cfg.InsecureSkipVerify,
 	}
 
@@ -160,7 +123,7 @@ func (c *DoTClient) dialConn(ctx context.Context) (*dns.Conn, error) {
 		Timeout:   5 * time.Second,
 		TLSConfig: tlsConfig,
 	}
-	conn, err := cli.Dial(addr)
+	conn, err := dialDNSConn(ctx, cli, addr, c.dial)
 	if err != nil {
 		return nil, err
 	}
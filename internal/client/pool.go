@@ -0,0 +1,439 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultPoolSize        = 10
+	defaultPoolIdleTimeout = 30 * time.Second
+	pipelineQueryTimeout   = 5 * time.Second
+)
+
+// errConnBroken 表示查询因连接断开而失败 (写入失败或等待应答期间连接关闭)，可以换一条连接重试。
+var errConnBroken = errors.New("pipeline 连接已断开")
+
+var errConnClosed = errors.New("连接已关闭")
+
+// PoolStats 描述 pipeline 连接池的使用情况。
+// InUse 为有查询正在等待应答的连接数，Idle 为已建立但当前没有查询的连接数，
+// InFlight 为所有连接上正在等待应答的查询总数。Size 为连接数上限。
+type PoolStats struct {
+	Size     int `json:"size"`
+	InUse    int `json:"in_use"`
+	Idle     int `json:"idle"`
+	InFlight int `json:"in_flight"`
+}
+
+// pooledClient 由使用连接池的客户端实现，未启用 pipeline 时 ok 为 false。
+type pooledClient interface {
+	PoolStats() (stats PoolStats, ok bool)
+}
+
+// muxConn 是支持真正 pipelining 的 TCP/DoT 连接 (或池中的 connected UDP socket)：多个查询可以同时在同一连接上等待应答。
+// 每个查询在发送前被分配一个连接内唯一的 ID，由唯一的读取协程按 ID 把应答分发给对应的查询。
+type muxConn struct {
+	conn    *dns.Conn
+	created time.Time
+	packet  bool   // 数据报连接 (UDP)：每次读取是一个独立的报文，无法解析的报文可以跳过
+	rbuf    []byte // UDP 读取缓冲区，只由读取协程使用
+
+	wmu sync.Mutex // 串行化写入
+
+	mu       sync.Mutex
+	pending  map[uint16]chan *dns.Msg
+	nextID   uint16
+	randomID bool // 每个查询使用随机 ID 而非递增 ID (UDP)，避免 ID 可被预测
+	lastRead time.Time
+	err      error
+	done     chan struct{}
+
+	// 以下字段由 connPool.mu 保护
+	inflight int
+	lastUsed time.Time
+	retired  bool // 超过 maxAge，不再分配新查询，最后一个查询结束后关闭
+}
+
+func newMuxConn(conn *dns.Conn, randomID bool) *muxConn {
+	now := time.Now()
+	c := &muxConn{
+		conn:     conn,
+		created:  now,
+		pending:  make(map[uint16]chan *dns.Msg),
+		nextID:   uint16(rand.Uint32()),
+		randomID: randomID,
+		packet:   isPacketConn(conn),
+		lastRead: now,
+		done:     make(chan struct{}),
+		lastUsed: now,
+	}
+	go c.readLoop()
+	return c
+}
+
+func isPacketConn(conn *dns.Conn) bool {
+	_, ok := conn.Conn.(net.PacketConn)
+	return ok
+}
+
+func (c *muxConn) readLoop() {
+	for {
+		resp, err := c.readMsg()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if resp == nil {
+			continue
+		}
+		c.mu.Lock()
+		c.lastRead = time.Now()
+		ch := c.pending[resp.Id]
+		delete(c.pending, resp.Id)
+		c.mu.Unlock()
+		// 已超时或被取消的查询的迟到应答直接丢弃
+		if ch != nil {
+			ch <- resp
+		}
+	}
+}
+
+// readMsg 读取下一条应答。TCP/DoT 流中的报文无法解析时流已失去同步，返回错误；
+// UDP 按最大报文长度读取，不会被截断，无法解析的数据报 (如伪造或损坏的报文) 被丢弃并返回 nil，
+// 只有 socket 本身的读取错误才会使连接失效。
+func (c *muxConn) readMsg() (*dns.Msg, error) {
+	if !c.packet {
+		return c.conn.ReadMsg()
+	}
+	if c.rbuf == nil {
+		c.rbuf = make([]byte, dns.MaxMsgSize)
+	}
+	n, err := c.conn.Conn.Read(c.rbuf)
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if resp.Unpack(c.rbuf[:n]) != nil {
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// fail 关闭连接并使所有等待中的查询以 errConnBroken 失败。
+func (c *muxConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.done)
+	c.conn.Close()
+}
+
+func (c *muxConn) close() {
+	c.fail(errConnClosed)
+}
+
+func (c *muxConn) broken() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// register 为查询分配一个连接内未被占用的 ID。
+func (c *muxConn) register() (uint16, chan *dns.Msg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, nil, fmt.Errorf("%w: %v", errConnBroken, c.err)
+	}
+	if len(c.pending) >= 0xffff {
+		return 0, nil, fmt.Errorf("连接上等待应答的查询过多")
+	}
+	for {
+		if c.randomID {
+			c.nextID = uint16(rand.Uint32())
+		} else {
+			c.nextID++
+		}
+		if _, used := c.pending[c.nextID]; !used {
+			break
+		}
+	}
+	ch := make(chan *dns.Msg, 1)
+	c.pending[c.nextID] = ch
+	return c.nextID, ch, nil
+}
+
+func (c *muxConn) unregister(id uint16) {
+	c.mu.Lock()
+	delete(c.pending, id)
+	c.mu.Unlock()
+}
+
+// exchange 在连接上发送 req 并等待对应的应答。req 本身不会被修改，应答的 ID 会被还原为 req.Id。
+func (c *muxConn) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	id, ch, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(id)
+
+	msg := *req
+	msg.Id = id
+	sent := time.Now()
+
+	c.wmu.Lock()
+	c.conn.SetWriteDeadline(time.Now().Add(pipelineQueryTimeout))
+	err = c.conn.WriteMsg(&msg)
+	c.wmu.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, fmt.Errorf("%w: 写入失败: %v", errConnBroken, err)
+	}
+
+	// UDP 的等待时间以调用方的截止时间为准 (没有截止时间时使用 pipelineQueryTimeout)；
+	// TCP/DoT 固定使用 pipelineQueryTimeout，以便在调用方截止时间较长时也能及时发现失效的连接
+	wait := pipelineQueryTimeout
+	if deadline, ok := ctx.Deadline(); ok && c.packet {
+		wait = time.Until(deadline)
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		resp.Id = req.Id
+		return resp, nil
+	case <-c.done:
+		return nil, fmt.Errorf("%w: 读取失败: %v", errConnBroken, c.err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		// UDP 丢包是正常现象，只放弃这个查询的 ID (defer 中注销)，socket 与其上的其他查询不受影响
+		if c.packet {
+			return nil, fmt.Errorf("读取失败: 等待应答超时")
+		}
+		// 发送后该连接上再没有收到过任何应答，视为连接已失效
+		c.mu.Lock()
+		stale := !c.lastRead.After(sent)
+		c.mu.Unlock()
+		if stale {
+			c.fail(errors.New("等待应答超时"))
+		}
+		return nil, fmt.Errorf("读取失败: 等待应答超时")
+	}
+}
+
+// connPool 是 TCP、DoT 与 UDP 客户端共用的 pipeline 连接池，最多维持 size 条连接 (UDP 为 connected socket)。
+// 查询优先使用没有进行中查询的连接；所有连接都在使用中且未达上限时新建连接，
+// 达到上限后分配给进行中查询最少的连接，与其他查询在同一连接上并发等待应答。
+// 空闲超过 idleTimeout 的连接由后台回收协程关闭，避免复用已被 NAT 或上游静默断开的连接。
+// 回收协程只在池中有连接时运行，全部回收后退出，客户端被丢弃 (如配置重载) 后不会残留。
+type connPool struct {
+	size        int
+	idleTimeout time.Duration
+	maxAge      time.Duration // 连接最长复用时间，0 表示不限
+	dial        func(ctx context.Context) (*dns.Conn, error)
+	randomIDs   bool // 新连接上的查询使用随机 ID，见 muxConn.randomID
+
+	mu      sync.Mutex
+	conns   []*muxConn
+	dialing int
+	changed chan struct{} // 拨号结束时关闭，唤醒等待空位的查询
+	reaping atomic.Bool
+}
+
+func newConnPool(size, idleTimeoutSeconds int, maxAge time.Duration, dial func(ctx context.Context) (*dns.Conn, error)) *connPool {
+	return &connPool{
+		size:        poolSize(size),
+		idleTimeout: poolIdleTimeout(idleTimeoutSeconds),
+		maxAge:      maxAge,
+		dial:        dial,
+		changed:     make(chan struct{}),
+	}
+}
+
+func poolSize(size int) int {
+	if size <= 0 {
+		return defaultPoolSize
+	}
+	return size
+}
+
+func poolIdleTimeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultPoolIdleTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// exchange 通过池中的连接发送查询。复用的连接已经断开时换一条新连接重试一次。
+func (p *connPool) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, fresh, err := p.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := conn.exchange(ctx, req)
+	p.release(conn)
+	if err == nil || fresh || !errors.Is(err, errConnBroken) || ctx.Err() != nil {
+		return resp, err
+	}
+
+	conn, _, err = p.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("重连失败: %w", err)
+	}
+	resp, err = conn.exchange(ctx, req)
+	p.release(conn)
+	return resp, err
+}
+
+// acquire 选出一条连接并计入其进行中查询，fresh 表示该连接是本次新建的。调用方必须以 release 归还。
+func (p *connPool) acquire(ctx context.Context) (conn *muxConn, fresh bool, err error) {
+	for {
+		p.mu.Lock()
+		p.prune()
+
+		var best *muxConn
+		for _, c := range p.conns {
+			if best == nil || c.inflight < best.inflight {
+				best = c
+			}
+		}
+		full := len(p.conns)+p.dialing >= p.size
+		if best != nil && (best.inflight == 0 || full) {
+			best.inflight++
+			p.mu.Unlock()
+			return best, false, nil
+		}
+
+		if !full {
+			p.dialing++
+			p.mu.Unlock()
+			raw, err := p.dial(ctx)
+
+			p.mu.Lock()
+			p.dialing--
+			close(p.changed)
+			p.changed = make(chan struct{})
+			if err != nil {
+				p.mu.Unlock()
+				return nil, false, err
+			}
+			conn := newMuxConn(raw, p.randomIDs)
+			conn.inflight = 1
+			p.conns = append(p.conns, conn)
+			p.mu.Unlock()
+
+			if p.reaping.CompareAndSwap(false, true) {
+				go p.reap()
+			}
+			return conn, true, nil
+		}
+
+		// 所有名额都在拨号中，等待其中之一完成
+		changed := p.changed
+		p.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+}
+
+func (p *connPool) release(conn *muxConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	conn.inflight--
+	conn.lastUsed = time.Now()
+	if conn.retired && conn.inflight == 0 {
+		conn.close()
+	}
+}
+
+// prune 移除已断开的连接，并让超过 maxAge 的连接退役。调用方须持有 p.mu。
+func (p *connPool) prune() {
+	kept := p.conns[:0]
+	for _, c := range p.conns {
+		switch {
+		case c.broken():
+		case p.maxAge > 0 && time.Since(c.created) > p.maxAge:
+			c.retired = true
+			if c.inflight == 0 {
+				c.close()
+			}
+		default:
+			kept = append(kept, c)
+		}
+	}
+	clear(p.conns[len(kept):])
+	p.conns = kept
+}
+
+func (p *connPool) reap() {
+	interval := max(p.idleTimeout/2, time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if p.reapIdle() > 0 {
+			continue
+		}
+		p.reaping.Store(false)
+		// 退出前可能恰好有新连接建立，此时由本协程继续回收
+		if p.reapIdle() == 0 || !p.reaping.CompareAndSwap(false, true) {
+			return
+		}
+	}
+}
+
+// reapIdle 关闭没有进行中查询且空闲超时的连接，返回池中剩余的连接数。
+func (p *connPool) reapIdle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prune()
+	kept := p.conns[:0]
+	for _, c := range p.conns {
+		if c.inflight == 0 && time.Since(c.lastUsed) > p.idleTimeout {
+			c.close()
+			continue
+		}
+		kept = append(kept, c)
+	}
+	clear(p.conns[len(kept):])
+	p.conns = kept
+	return len(p.conns)
+}
+
+func (p *connPool) stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := PoolStats{Size: p.size}
+	for _, c := range p.conns {
+		if c.broken() {
+			continue
+		}
+		if c.inflight > 0 {
+			s.InUse++
+			s.InFlight += c.inflight
+		} else {
+			s.Idle++
+		}
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/proxy"
+)
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func newProxyDialer(proxyAddr string) (dialFunc, error) {
+	if proxyAddr == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("无效的代理地址 %s: %w", proxyAddr, err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, &net.Dialer{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("无法创建 SOCKS5 代理: %w", err)
+		}
+		cd, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("SOCKS5 代理不支持 context")
+		}
+		return cd.DialContext, nil
+	case "http":
+		return httpConnectDialer(u), nil
+	default:
+		return nil, fmt.Errorf("不支持的代理协议: %s", u.Scheme)
+	}
+}
+
+func mustProxyDialer(proxyAddr string) dialFunc {
+	dial, err := newProxyDialer(proxyAddr)
+	if err != nil {
+		log.Printf("忽略无效的上游代理 %s: %v", proxyAddr, err)
+		return nil
+	}
+	return dial
+}
+
+func httpConnectDialer(u *url.URL) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := net.Dialer{Timeout: 5 * time.Second}
+		conn, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(deadline)
+		}
+
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			conn.Close()
+			return nil, fmt.Errorf("HTTP 代理 CONNECT 失败: %s", resp.Status)
+		}
+
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+}
+
+func dialDNSConn(ctx context.Context, cli *dns.Client, addr string, dial dialFunc) (*dns.Conn, error) {
+	if dial == nil {
+		return cli.DialContext(ctx, addr)
+	}
+
+	raw, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("通过代理连接 %s 失败: %w", addr, err)
+	}
+
+	if cli.Net == "tcp-tls" {
+		tlsConn := tls.Client(raw, cli.TLSConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			raw.Close()
+			return nil, err
+		}
+		return &dns.Conn{Conn: tlsConn}, nil
+	}
+	return &dns.Conn{Conn: raw}, nil
+}
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CheckQuestion 校验响应的问题部分与请求一致 (名称、类型、类别)。
+// miekg/dns 只校验报文 ID，上游实现有误或伪造的响应可能携带其他名称的应答。
+// 不带问题部分的错误响应 (如 REFUSED、FORMERR) 只要没有应答记录即放行。
+func CheckQuestion(req, resp *dns.Msg) error {
+	if len(req.Question) == 0 {
+		return nil
+	}
+	if len(resp.Question) == 0 {
+		if len(resp.Answer) == 0 {
+			return nil
+		}
+		return fmt.Errorf("响应缺少问题部分却包含 %d 条应答", len(resp.Answer))
+	}
+	q, r := req.Question[0], resp.Question[0]
+	if !strings.EqualFold(q.Name, r.Name) || q.Qtype != r.Qtype || q.Qclass != r.Qclass {
+		return fmt.Errorf("响应问题 %s %s 与请求 %s %s 不匹配",
+			r.Name, dns.Type(r.Qtype), q.Name, dns.Type(q.Qtype))
+	}
+	return nil
+}
+
+func clientName(c DNSClient) string {
+	if sc, ok := c.(*StatsClient); ok {
+		return sc.Group + "/" + sc.Address
+	}
+	return fmt.Sprintf("%T", c)
+}
@@ -3,12 +3,23 @@ package client
 import (
 	"context"
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+type RaceOptions struct {
+	EmptyAnswerWait time.Duration
+	// SoftFailEmpty 将 A/AAAA 查询中不带 SOA 的空应答视为软失败，优先等待其他上游的结果
+	SoftFailEmpty bool
+}
+
 func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.Msg, error) {
+	return RaceResolveWithOptions(ctx, req, clients, RaceOptions{})
+}
+
+func RaceResolveWithOptions(ctx context.Context, req *dns.Msg, clients []DNSClient, opts RaceOptions) (*dns.Msg, error) {
 	if len(clients) == 0 {
 		return nil, fmt.Errorf("没有可用的上游客户端")
 	}
@@ -28,6 +39,11 @@ func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.M
 				errs <- err
 				return
 			}
+			if err := CheckQuestion(req, resp); err != nil {
+				log.Printf("丢弃上游 %s 的响应: %v", clientName(cl), err)
+				errs <- err
+				return
+			}
 			select {
 			case results <- resp:
 			case <-raceCtx.Done():
@@ -36,21 +52,68 @@ func RaceResolve(ctx context.Context, req *dns.Msg, clients []DNSClient) (*dns.M
 	}
 
 	var lastErr error
+	var fallback *dns.Msg
+	var graceC <-chan time.Time
 	for i := 0; i < len(clients); i++ {
 		select {
 		case resp := <-results:
+			if opts.SoftFailEmpty && IsSoftEmpty(req, resp) {
+				if fallback == nil {
+					fallback = resp
+				}
+				continue
+			}
+			if opts.EmptyAnswerWait > 0 && isEmptyAnswer(resp) {
+				if fallback == nil {
+					fallback = resp
+					graceC = time.After(opts.EmptyAnswerWait)
+				}
+				continue
+			}
 			return resp, nil
 		case err := <-errs:
 			lastErr = err
+		case <-graceC:
+			return fallback, nil
 		case <-ctx.Done():
+			if fallback != nil {
+				return fallback, nil
+			}
 			return nil, ctx.Err()
 		case <-time.After(5 * time.Second):
+			if fallback != nil {
+				return fallback, nil
+			}
 			return nil, fmt.Errorf("并发查询超时")
 		}
 	}
 
+	if fallback != nil {
+		return fallback, nil
+	}
 	if lastErr != nil {
 		return nil, fmt.Errorf("所有上游查询均失败: %w", lastErr)
 	}
 	return nil, fmt.Errorf("未知错误：未收到任何响应")
 }
+
+func isEmptyAnswer(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0
+}
+
+// IsSoftEmpty 判断 A/AAAA 查询是否得到了不带 SOA 的 NOERROR 空应答。
+// 合法的 NODATA 响应会在 Authority 部分携带 SOA，因此不在此列。
+func IsSoftEmpty(req, resp *dns.Msg) bool {
+	if len(req.Question) == 0 || !isEmptyAnswer(resp) {
+		return false
+	}
+	if qtype := req.Question[0].Qtype; qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		return false
+	}
+	for _, rr := range resp.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// fastClient 等到慢上游收到查询后立即应答，保证比赛开始时败者已经阻塞在读取上。
+type fastClient struct {
+	ready <-chan struct{}
+}
+
+func (f fastClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	select {
+	case <-f.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	return resp, nil
+}
+
+// trackedClient 记录被包装客户端的 Resolve 何时返回。
+type trackedClient struct {
+	DNSClient
+	done chan error
+}
+
+func (t trackedClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := t.DNSClient.Resolve(ctx, req)
+	t.done <- err
+	return resp, err
+}
+
+// silentTCP 接受连接并读取查询但从不应答；closed 在对端关闭连接时收到信号。
+func silentTCP(t *testing.T) (addr string, ready, closed <-chan struct{}) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	readyC, closedC := make(chan struct{}), make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 512)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		close(readyC)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				close(closedC)
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), readyC, closedC
+}
+
+// silentUDP 读取查询但从不应答。
+func silentUDP(t *testing.T) (addr string, ready <-chan struct{}) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	readyC := make(chan struct{})
+	go func() {
+		buf := make([]byte, 512)
+		if _, _, err := pc.ReadFrom(buf); err == nil {
+			close(readyC)
+		}
+	}()
+	return pc.LocalAddr().String(), readyC
+}
+
+func TestRaceResolveAbortsSlowLosers(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		pipeline bool
+	}{
+		{name: "tcp", protocol: "tcp"},
+		{name: "tcp-pipeline", protocol: "tcp", pipeline: true},
+		{name: "udp", protocol: "udp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addr string
+			var ready, closed <-chan struct{}
+			var slow DNSClient
+			if tt.protocol == "tcp" {
+				addr, ready, closed = silentTCP(t)
+				slow = NewTCPClient(config.UpstreamServer{Address: addr, Protocol: "tcp", EnablePipeline: tt.pipeline}, nil)
+			} else {
+				addr, ready = silentUDP(t)
+				slow = NewUDPClient(config.UpstreamServer{Address: addr, Protocol: "udp"}, nil)
+			}
+			loser := trackedClient{DNSClient: slow, done: make(chan error, 1)}
+
+			req := new(dns.Msg)
+			req.SetQuestion("race.test.", dns.TypeA)
+			if _, err := RaceResolve(context.Background(), req, []DNSClient{loser, fastClient{ready: ready}}); err != nil {
+				t.Fatalf("RaceResolve: %v", err)
+			}
+
+			// 客户端自身的读超时为 5 秒，败者必须在此之前因取消而返回
+			select {
+			case err := <-loser.done:
+				if err == nil {
+					t.Fatal("slow loser returned without error")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("slow loser was not aborted after the race finished")
+			}
+
+			// 非复用连接在取消时应当被关闭；复用连接由连接池继续持有
+			if closed != nil && !tt.pipeline {
+				select {
+				case <-closed:
+				case <-time.After(time.Second):
+					t.Fatal("losing TCP connection was not closed")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *StatsClient) resolveWithRetry(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	resp, err := s.Client.Resolve(ctx, req)
+	backoff := s.retryBackoff
+	for attempt := 0; attempt < s.maxRetries && isRetryable(err); attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+
+		s.mu.Lock()
+		s.TotalRetries++
+		s.mu.Unlock()
+
+		resp, err = s.Client.Resolve(ctx, req)
+	}
+	return resp, err
+}
@@ -6,20 +6,44 @@ import (
 	"sync"
 	"time"
 
+	"doh-autoproxy/internal/tracing"
+	"doh-autoproxy/internal/util"
+
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
+const UnhealthyThreshold = 3
+
 type StatsClient struct {
 	Client   DNSClient
 	Address  string
 	Protocol string
 	Group    string
+	Weight   int
+	Tier     int
 
 	mu            sync.RWMutex
 	TotalQueries  int64
 	TotalErrors   int64
 	TotalCanceled int64
 	TotalDuration int64
+	TotalRetries  int64
+	TotalSelected int64 // weighted 策略下被抽中为首选上游的次数
+
+	maxRetries   int
+	retryBackoff time.Duration
+
+	consecutiveFailures int64
+	latency             *util.LatencyHistogram
+
+	canaryOK      bool
+	canaryChecked time.Time
+	canaryErr     string
+
+	healthHook func(healthy bool)
+	breaker    *circuitBreaker
 }
 
 func NewStatsClient(c DNSClient, address, protocol, group string) *StatsClient {
@@ -28,31 +52,122 @@ func NewStatsClient(c DNSClient, address, protocol, group string) *StatsClient {
 		Address:  address,
 		Protocol: protocol,
 		Group:    group,
+		Weight:   1,
+		latency:  util.NewLatencyHistogram(),
 	}
 }
 
 func (s *StatsClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	var probe bool
+	if s.breaker != nil {
+		probe = s.breaker.begin()
+	}
+
+	ctx, span := tracing.Start(ctx, "upstream.resolve")
+	defer span.End()
+
 	start := time.Now()
-	resp, err := s.Client.Resolve(ctx, req)
+	resp, err := s.resolveWithRetry(ctx, req)
 	duration := time.Since(start).Microseconds()
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("upstream.address", s.Address),
+			attribute.String("upstream.protocol", s.Protocol),
+			attribute.String("upstream.group", s.Group),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if resp != nil {
+			span.SetAttributes(attribute.String("dns.response_code", dns.RcodeToString[resp.Rcode]))
+		}
+	}
+	canceled := err != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil)
+	// 延迟分位数只统计成功的查询：失败与被取消的查询 (如竞速中落败者) 的耗时不代表上游的应答延迟
+	if err == nil {
+		s.latency.Observe(duration / 1000)
+	}
+	if s.breaker != nil {
+		s.breaker.done(probe, err != nil, canceled)
+	}
 
+	s.mu.Lock()
+	wasHealthy := s.consecutiveFailures < UnhealthyThreshold
 	s.TotalQueries++
 	s.TotalDuration += duration
 	if err != nil {
-		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		if canceled {
 			s.TotalCanceled++
 		} else {
 			s.TotalErrors++
+			s.consecutiveFailures++
 		}
 	} else {
+		s.consecutiveFailures = 0
+	}
+	healthy := s.consecutiveFailures < UnhealthyThreshold
+	hook := s.healthHook
+	s.mu.Unlock()
+
+	if hook != nil && healthy != wasHealthy {
+		hook(healthy)
 	}
 
 	return resp, err
 }
 
+// SetHealthHook 设置健康状态 (连续失败次数越过阈值或恢复) 变化时的回调。
+func (s *StatsClient) SetHealthHook(hook func(healthy bool)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthHook = hook
+}
+
+func (s *StatsClient) SetRetryPolicy(retries int, backoff time.Duration) {
+	if backoff <= 0 {
+		backoff = 50 * time.Millisecond
+	}
+	s.maxRetries = retries
+	s.retryBackoff = backoff
+}
+
+// SetCircuitBreaker 启用熔断：window 内连续失败 threshold 次后在 cooldown 内跳过该上游。
+// 需在开始处理查询前调用。
+func (s *StatsClient) SetCircuitBreaker(threshold int, window, cooldown time.Duration) {
+	s.breaker = newCircuitBreaker(threshold, window, cooldown)
+}
+
+// CircuitOpen 报告熔断器是否处于冷却期 (未启用熔断时始终为 false)。
+func (s *StatsClient) CircuitOpen() bool {
+	return s.breaker != nil && s.breaker.open()
+}
+
+// MarkSelected 记录一次 weighted 策略把该上游抽为首选。
+func (s *StatsClient) MarkSelected() {
+	s.mu.Lock()
+	s.TotalSelected++
+	s.mu.Unlock()
+}
+
+// Selected 返回 weighted 策略把该上游抽为首选的次数。
+func (s *StatsClient) Selected() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.TotalSelected
+}
+
+func (s *StatsClient) Healthy() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.consecutiveFailures < UnhealthyThreshold
+}
+
+// Latency 返回该上游的查询耗时直方图。
+func (s *StatsClient) Latency() *util.LatencyHistogram {
+	return s.latency
+}
+
 func (s *StatsClient) GetStats() map[string]interface{} {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -62,13 +177,37 @@ func (s *StatsClient) GetStats() map[string]interface{} {
 		avg = s.TotalDuration / s.TotalQueries / 1000
 	}
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"address":         s.Address,
 		"protocol":        s.Protocol,
 		"group":           s.Group,
+		"weight":          s.Weight,
+		"tier":            s.Tier,
 		"total_queries":   s.TotalQueries,
 		"total_errors":    s.TotalErrors,
 		"total_canceled":  s.TotalCanceled,
+		"total_retries":   s.TotalRetries,
+		"total_selected":  s.TotalSelected,
+		"healthy":         s.consecutiveFailures < UnhealthyThreshold,
 		"avg_duration_ms": avg,
+		"p50_ms":          s.latency.Percentile(0.50),
+		"p90_ms":          s.latency.Percentile(0.90),
+		"p95_ms":          s.latency.Percentile(0.95),
+		"p99_ms":          s.latency.Percentile(0.99),
+		"latency_buckets": s.latency.Buckets(),
+	}
+	if s.breaker != nil {
+		stats["breaker"] = s.breaker.status()
+	}
+	if p, ok := s.Client.(pooledClient); ok {
+		if ps, ok := p.PoolStats(); ok {
+			stats["pool"] = ps
+		}
+	}
+	if !s.canaryChecked.IsZero() {
+		stats["canary_ok"] = s.canaryOK
+		stats["canary_time"] = s.canaryChecked
+		stats["canary_error"] = s.canaryErr
 	}
+	return stats
 }
@@ -0,0 +1,46 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type stubClient struct {
+	err error
+}
+
+func (c stubClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	return resp, nil
+}
+
+// TestStatsLatencyCountsSuccessOnly 检查失败与被取消的查询不计入延迟分位数。
+func TestStatsLatencyCountsSuccessOnly(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("latency.test.", dns.TypeA)
+
+	for _, tt := range []struct {
+		name string
+		err  error
+		want int64
+	}{
+		{name: "success", want: 1},
+		{name: "failure", err: errors.New("upstream down")},
+		{name: "canceled", err: context.Canceled},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStatsClient(stubClient{err: tt.err}, "127.0.0.1:53", "udp", "overseas")
+			s.Resolve(context.Background(), req)
+			if _, _, count, _ := s.Latency().Snapshot(); count != tt.want {
+				t.Fatalf("latency samples = %d, want %d", count, tt.want)
+			}
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"sync"
 	"time"
 
 	"doh-autoproxy/internal/config"
@@ -16,19 +15,22 @@ import (
 type TCPClient struct {
 	cfg          config.UpstreamServer
 	bootstrapper *resolver.Bootstrapper
-	pool         chan *dns.Conn
-	poolInit     sync.Once
+	dial         dialFunc
+	pool         *connPool
 }
 
 func NewTCPClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *TCPClient {
-	return &TCPClient{
+	c := &TCPClient{
 		cfg:          cfg,
 		bootstrapper: b,
+		dial:         mustProxyDialer(cfg.Proxy),
 	}
+	c.pool = newConnPool(cfg.PoolSize, cfg.PipelineIdleTimeout, 0, c.dialConn)
+	return c
 }
 
 func (c *TCPClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	ensureECS(req, c.cfg.ECSIP)
+	prepareEDNS(req, c.cfg)
 
 	if c.cfg.EnablePipeline {
 		return c.resolvePipeline(ctx, req)
@@ -47,75 +49,22 @@ func (c *TCPClient) resolveOneshot(ctx context.Context, req *dns.Msg) (*dns.Msg,
 		Timeout: 5 * time.Second,
 	}
 
-	resp, _, err := cli.ExchangeContext(ctx, req, addr)
+	resp, err := exchangeContext(ctx, cli, req, addr, c.dial)
 	if err != nil {
 		return nil, fmt.Errorf("TCP查询失败: %w", err)
 	}
 	return resp, nil
 }
 
-func (c *TCPClient) initPool() {
-	c.poolInit.Do(func() {
-		c.pool = make(chan *dns.Conn, 10)
-		for i := 0; i < 10; i++ {
-			c.pool <- nil
-		}
-	})
+func (c *TCPClient) PoolStats() (PoolStats, bool) {
+	if !c.cfg.EnablePipeline {
+		return PoolStats{}, false
+	}
+	return c.pool.stats(), true
 }
 
 func (c *TCPClient) resolvePipeline(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	c.initPool()
-
-	var conn *dns.Conn
-	select {
-	case conn = <-c.pool:
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	}
-
-	defer func() {
-		c.pool <- conn
-	}()
-
-	var err error
-	if conn == nil {
-		conn, err = c.dialConn(ctx)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-	if err := conn.WriteMsg(req); err != nil {
-		conn.Close()
-		conn = nil
-		conn, err = c.dialConn(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("重连失败: %w", err)
-		}
-		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		if err := conn.WriteMsg(req); err != nil {
-			conn.Close()
-			conn = nil
-			return nil, fmt.Errorf("写入失败: %w", err)
-		}
-	}
-
-	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	resp, err := conn.ReadMsg()
-	if err != nil {
-		conn.Close()
-		conn = nil
-		return nil, fmt.Errorf("读取失败: %w", err)
-	}
-
-	if resp.Id != req.Id {
-		conn.Close()
-		conn = nil
-		return nil, fmt.Errorf("ID mismatch")
-	}
-
-	return resp, nil
+	return c.pool.exchange(ctx, req)
 }
 
 func (c *TCPClient) dialConn(ctx context.Context) (*dns.Conn, error) {
@@ -125,7 +74,7 @@ func (c *TCPClient) dialConn(ctx context.Context) (*dns.Conn, error) {
 	}
 
 	cli := &dns.Client{Net: "tcp", Timeout: 5 * time.Second}
-	conn, err := cli.Dial(addr)
+	conn, err := dialDNSConn(ctx, cli, addr, c.dial)
 	if err != nil {
 		return nil, err
 	}
@@ -8,54 +8,135 @@ import (
 
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/util"
 
 	"github.com/miekg/dns"
 )
 
+// defaultUDPSocketMaxAge 是 UDP socket 池中每个 socket 的默认最长复用时间。
+// 复用 socket 意味着源端口固定，定期更换以保留源端口随机化对伪造应答的防护。
+const defaultUDPSocketMaxAge = time.Minute
+
 type UDPClient struct {
 	cfg          config.UpstreamServer
 	bootstrapper *resolver.Bootstrapper
+	dial         dialFunc
+	cookies      *cookieJar
+	pool         *connPool
 }
 
 func NewUDPClient(cfg config.UpstreamServer, b *resolver.Bootstrapper) *UDPClient {
-	return &UDPClient{
+	c := &UDPClient{
 		cfg:          cfg,
 		bootstrapper: b,
+		dial:         mustProxyDialer(cfg.Proxy),
+	}
+	if cfg.DNSCookie {
+		c.cookies = newCookieJar()
+	}
+	if cfg.UDPSocketPool {
+		maxAge := time.Duration(cfg.PipelineMaxAge) * time.Second
+		if maxAge <= 0 {
+			maxAge = defaultUDPSocketMaxAge
+		}
+		c.pool = newConnPool(cfg.PoolSize, cfg.PipelineIdleTimeout, maxAge, c.dialConn)
+		c.pool.randomIDs = true
 	}
+	return c
 }
 
 func (c *UDPClient) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
-	rawAddr := c.cfg.Address
-	host, port, err := net.SplitHostPort(rawAddr)
+	prepareEDNS(req, c.cfg)
+
+	if c.cookies != nil {
+		c.cookies.apply(req)
+	}
+
+	exchange := c.resolveOneshot
+	if c.pool != nil {
+		exchange = c.pool.exchange
+	}
+
+	resp, err := exchange(ctx, req)
 	if err != nil {
-		rawAddr = net.JoinHostPort(rawAddr, "53")
-		host, port, err = net.SplitHostPort(rawAddr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid address %s: %w", c.cfg.Address, err)
+		return nil, fmt.Errorf("UDP查询失败: %w", err)
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("UDP查询无响应")
+	}
+
+	if c.cookies != nil {
+		if err := c.cookies.validate(resp); err != nil {
+			return nil, fmt.Errorf("UDP响应被拒绝 (%s): %w", c.cfg.Address, err)
+		}
+		if resp.Rcode == dns.RcodeBadCookie {
+			c.cookies.apply(req)
+			resp, err = exchange(ctx, req)
+			if err != nil {
+				return nil, fmt.Errorf("UDP查询失败: %w", err)
+			}
+			if err := c.cookies.validate(resp); err != nil {
+				return nil, fmt.Errorf("UDP响应被拒绝 (%s): %w", c.cfg.Address, err)
+			}
 		}
 	}
 
-	ip, err := c.bootstrapper.LookupIP(ctx, host)
+	return resp, nil
+}
+
+func (c *UDPClient) resolveOneshot(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	addr, err := c.resolveAddr(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("bootstrap failed for %s: %w", host, err)
+		return nil, err
 	}
+	return exchangeContext(ctx, c.newDNSClient(), req, addr, c.dial)
+}
 
-	addr := net.JoinHostPort(ip, port)
+// PoolStats 在启用 udp_socket_pool (connected UDP socket 池) 时返回 socket 池的使用情况。
+func (c *UDPClient) PoolStats() (PoolStats, bool) {
+	if c.pool == nil {
+		return PoolStats{}, false
+	}
+	return c.pool.stats(), true
+}
 
-	cli := &dns.Client{
-		Net:     "udp",
-		Timeout: 5 * time.Second,
+// dialConn 建立一个 connected UDP socket：只接收来自上游地址的数据报，多个查询按 ID 复用同一 socket。
+// 配置了代理时与一次性查询一样改用 TCP。
+func (c *UDPClient) dialConn(ctx context.Context) (*dns.Conn, error) {
+	addr, err := c.resolveAddr(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialDNSConn(ctx, c.newDNSClient(), addr, c.dial)
+	if err != nil {
+		return nil, err
 	}
+	conn.UDPSize = util.EDNSBufferSize()
+	return conn, nil
+}
 
-	ensureECS(req, c.cfg.ECSIP)
+func (c *UDPClient) newDNSClient() *dns.Client {
+	network := "udp"
+	if c.dial != nil {
+		network = "tcp"
+	}
+	return &dns.Client{Net: network, Timeout: 5 * time.Second}
+}
 
-	resp, _, err := cli.ExchangeContext(ctx, req, addr)
+func (c *UDPClient) resolveAddr(ctx context.Context) (string, error) {
+	rawAddr := c.cfg.Address
+	host, port, err := net.SplitHostPort(rawAddr)
 	if err != nil {
-		return nil, fmt.Errorf("UDP查询失败: %w", err)
-	}
-	if resp == nil {
-		return nil, fmt.Errorf("UDP查询无响应")
+		rawAddr = net.JoinHostPort(rawAddr, "53")
+		host, port, err = net.SplitHostPort(rawAddr)
+		if err != nil {
+			return "", fmt.Errorf("invalid address %s: %w", c.cfg.Address, err)
+		}
 	}
 
-	return resp, nil
+	ip, err := c.bootstrapper.LookupIP(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("bootstrap failed for %s: %w", host, err)
+	}
+	return net.JoinHostPort(ip, port), nil
 }
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// TestUDPSocketPoolSkipsBadDatagrams 检查 socket 池在收到无法解析的数据报与超过 512 字节的应答时
+// 仍能正常完成查询，且 socket 不会因此被关闭重建。
+func TestUDPSocketPoolSkipsBadDatagrams(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	peers := make(chan net.Addr, 8)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			peers <- from
+			pc.WriteTo([]byte("junk"), from)
+
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{strings.Repeat("x", 250), strings.Repeat("y", 250), strings.Repeat("z", 250)},
+			})
+			out, _ := resp.Pack()
+			pc.WriteTo(out, from)
+		}
+	}()
+
+	c := NewUDPClient(config.UpstreamServer{Address: pc.LocalAddr().String(), Protocol: "udp", UDPSocketPool: true, PoolSize: 1}, nil)
+	for i := range 3 {
+		req := new(dns.Msg)
+		req.SetQuestion("big.test.", dns.TypeTXT)
+		resp, err := c.Resolve(context.Background(), req)
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		if len(resp.Answer) != 1 || resp.Id != req.Id {
+			t.Fatalf("query %d: unexpected response %v", i, resp)
+		}
+	}
+
+	first := <-peers
+	for range 2 {
+		if from := <-peers; from.String() != first.String() {
+			t.Fatalf("socket replaced: %s then %s", first, from)
+		}
+	}
+	if stats, ok := c.PoolStats(); !ok || stats.Idle != 1 {
+		t.Fatalf("pool stats = %+v, %v", stats, ok)
+	}
+}
+
+// TestUDPSocketPoolSurvivesLoss 检查一个查询的数据报丢失 (等待超时) 时 socket 保持可用，
+// 同一 socket 上的其他查询照常完成。
+func TestUDPSocketPoolSurvivesLoss(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	peers := make(chan string, 8)
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			peers <- from.String()
+			if req.Question[0].Name == "drop.test." {
+				continue
+			}
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			out, _ := resp.Pack()
+			pc.WriteTo(out, from)
+		}
+	}()
+
+	c := NewUDPClient(config.UpstreamServer{Address: pc.LocalAddr().String(), Protocol: "udp", UDPSocketPool: true, PoolSize: 1}, nil)
+	query := func(name string, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		_, err := c.Resolve(ctx, req)
+		return err
+	}
+
+	if err := query("drop.test.", 100*time.Millisecond); err == nil {
+		t.Fatal("dropped query succeeded")
+	}
+	if err := query("ok.test.", time.Second); err != nil {
+		t.Fatalf("query after loss: %v", err)
+	}
+	if first, second := <-peers, <-peers; first != second {
+		t.Fatalf("socket replaced after loss: %s then %s", first, second)
+	}
+}
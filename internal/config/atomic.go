@@ -0,0 +1,131 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxConfigBackups 为保留的配置备份数量。
+const maxConfigBackups = 5
+
+const backupSuffix = ".bak-"
+
+// writeFileAtomic 先写入同目录下的临时文件并 fsync，再重命名覆盖 path，
+// 避免写入中途崩溃或磁盘写满时留下不完整的文件。已存在的文件权限会被保留。
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	success := false
+	defer func() {
+		if !success {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	success = true
+	return nil
+}
+
+// backupConfig 在覆盖前把现有配置复制为 path.bak-时间戳，内容未变化时不备份。
+// 只保留最近 maxConfigBackups 份备份。
+func backupConfig(path string, next []byte) error {
+	cur, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if bytes.Equal(cur, next) {
+		return nil
+	}
+
+	backup := path + backupSuffix + time.Now().Format("20060102-150405.000")
+	if err := writeFileAtomic(backup, func(w io.Writer) error {
+		_, err := w.Write(cur)
+		return err
+	}); err != nil {
+		return err
+	}
+
+	backups := configBackups(path)
+	for _, old := range backups[min(len(backups), maxConfigBackups):] {
+		os.Remove(old)
+	}
+	return nil
+}
+
+// configBackups 返回 path 的所有备份，最新的在前。
+func configBackups(path string) []string {
+	matches, _ := filepath.Glob(path + backupSuffix + "*")
+	backups := matches[:0]
+	for _, m := range matches {
+		if !strings.Contains(filepath.Base(m), ".tmp") {
+			backups = append(backups, m)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+// RestoreConfigBackup 用最近的一份备份覆盖配置文件，并删除该备份，
+// 因此连续调用会依次回退到更早的版本。返回所使用的备份文件路径。
+// 备份只包含主配置文件，不包含 hosts.txt 与 rule.txt。
+func RestoreConfigBackup(configPath string) (string, error) {
+	absPath, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", err
+	}
+	backups := configBackups(absPath)
+	if len(backups) == 0 {
+		return "", os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(backups[0])
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(absPath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("无法恢复配置文件 %s: %w", absPath, err)
+	}
+	os.Remove(backups[0])
+	return backups[0], nil
+}
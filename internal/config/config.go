@@ -3,7 +3,8 @@ package config
 import (
 	"bufio"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,17 +13,55 @@ import (
 )
 
 type Config struct {
-	Listen          ListenConfig      `yaml:"listen" json:"listen"`
-	BootstrapDNS    []string          `yaml:"bootstrap_dns" json:"bootstrap_dns"`
-	Upstreams       UpstreamsConfig   `yaml:"upstreams" json:"upstreams"`
-	Hosts           map[string]string `yaml:"-" json:"hosts"`
-	Rules           map[string]string `yaml:"-" json:"rules"`
-	GeoData         GeoDataConfig     `yaml:"geo_data" json:"geo_data"`
-	AutoCert        AutoCertConfig    `yaml:"auto_cert" json:"auto_cert"`
-	TLSCertificates []TLSCertConfig   `yaml:"tls_certificates" json:"tls_certificates"`
-	WebUI           WebUIConfig       `yaml:"web_ui" json:"web_ui"`
-	QueryLog        QueryLogConfig    `yaml:"query_log" json:"query_log"`
-	ConfigDir       string            `yaml:"-" json:"-"`
+	Include           []string                `yaml:"include,omitempty" json:"include,omitempty"`
+	Listen            ListenConfig            `yaml:"listen" json:"listen"`
+	BootstrapDNS      []string                `yaml:"bootstrap_dns" json:"bootstrap_dns"`
+	BootstrapProbe    bool                    `yaml:"bootstrap_probe,omitempty" json:"bootstrap_probe,omitempty"`
+	Upstreams         UpstreamsConfig         `yaml:"upstreams" json:"upstreams"`
+	Hosts             map[string]string       `yaml:"-" json:"hosts"`
+	Rules             map[string]string       `yaml:"-" json:"rules"`
+	GeoData           GeoDataConfig           `yaml:"geo_data" json:"geo_data"`
+	AutoCert          AutoCertConfig          `yaml:"auto_cert" json:"auto_cert"`
+	TLSCertificates   []TLSCertConfig         `yaml:"tls_certificates" json:"tls_certificates"`
+	WebUI             WebUIConfig             `yaml:"web_ui" json:"web_ui"`
+	QueryLog          QueryLogConfig          `yaml:"query_log" json:"query_log"`
+	Cache             CacheConfig             `yaml:"cache" json:"cache"`
+	DoQLimits         DoQLimitsConfig         `yaml:"doq_limits" json:"doq_limits"`
+	Timeouts          TimeoutsConfig          `yaml:"timeouts,omitempty" json:"timeouts,omitempty"`
+	ZoneFiles         []ZoneFileConfig        `yaml:"zone_files" json:"zone_files"`
+	LocalDomains      []string                `yaml:"local_domains,omitempty" json:"local_domains,omitempty"`
+	ServerIdentity    *ServerIdentityConfig   `yaml:"server_identity,omitempty" json:"server_identity,omitempty"`
+	Race              RaceConfig              `yaml:"race" json:"race"`
+	CircuitBreaker    CircuitBreakerConfig    `yaml:"circuit_breaker" json:"circuit_breaker"`
+	DGADetection      DGADetectionConfig      `yaml:"dga_detection" json:"dga_detection"`
+	BlocklistURLs     []string                `yaml:"blocklist_urls,omitempty" json:"blocklist_urls,omitempty"`
+	BlocklistCacheDir string                  `yaml:"blocklist_cache_dir,omitempty" json:"blocklist_cache_dir,omitempty"` // 默认 blocklists
+	BlocklistRefresh  int                     `yaml:"blocklist_refresh,omitempty" json:"blocklist_refresh,omitempty"`     // 刷新间隔 (小时)，默认 24
+	ClientPolicies    []ClientPolicyConfig    `yaml:"client_policies" json:"client_policies"`
+	InterfacePolicies []InterfacePolicyConfig `yaml:"interface_policies,omitempty" json:"interface_policies,omitempty"`
+	DNSSEC            DNSSECConfig            `yaml:"dnssec" json:"dnssec"`
+	Canary            CanaryConfig            `yaml:"canary" json:"canary"`
+	Notifications     NotificationsConfig     `yaml:"notifications" json:"notifications"`
+	Tracing           TracingConfig           `yaml:"tracing,omitempty" json:"tracing,omitempty"`
+	Watch             WatchConfig             `yaml:"watch,omitempty" json:"watch,omitempty"`
+	RotateAnswers     bool                    `yaml:"rotate_answers" json:"rotate_answers"`
+	Chaos             ChaosConfig             `yaml:"chaos" json:"chaos"`
+	AnswerMode        string                  `yaml:"answer_mode" json:"answer_mode"`                                     // dual (默认), ipv4_only, ipv6_only
+	AnyQuery          string                  `yaml:"any_query" json:"any_query"`                                         // minimal (默认) 或 forward
+	GeoIPProbe        string                  `yaml:"geoip_probe,omitempty" json:"geoip_probe,omitempty"`                 // A (默认), AAAA 或 none
+	DefaultGroup      string                  `yaml:"default_group,omitempty" json:"default_group,omitempty"`             // overseas (默认) 或 cn
+	RuleBlockResponse string                  `yaml:"rule_block_response,omitempty" json:"rule_block_response,omitempty"` // block 规则的应答: nxdomain (默认) 或 empty
+	Download          DownloadConfig          `yaml:"download,omitempty" json:"download,omitempty"`
+	HTTPUserAgent     string                  `yaml:"http_user_agent,omitempty" json:"http_user_agent,omitempty"`   // 下载 Geo 数据/屏蔽列表与 DoH 请求使用的 User-Agent
+	EDNSBufferSize    int                     `yaml:"edns_buffer_size,omitempty" json:"edns_buffer_size,omitempty"` // 向上游与客户端通告的 EDNS UDP 缓冲区大小，默认 1232
+	DebugUpstream     *DebugUpstreamConfig    `yaml:"debug_upstream,omitempty" json:"debug_upstream,omitempty"`
+	ConfigDir         string                  `yaml:"-" json:"-"`
+}
+
+// DownloadConfig 控制 Geo 数据与屏蔽列表的下载。
+type DownloadConfig struct {
+	Retries int `yaml:"retries,omitempty" json:"retries,omitempty"` // 失败后的重试次数，默认 3
+	Timeout int `yaml:"timeout,omitempty" json:"timeout,omitempty"` // 单个文件的整体超时 (秒，含重试)，默认 600
 }
 
 type TLSCertConfig struct {
@@ -35,6 +74,172 @@ type QueryLogConfig struct {
 	File       string `yaml:"file" json:"file"`
 	MaxSizeMB  int    `yaml:"max_size_mb" json:"max_size_mb"`
 	SaveToFile bool   `yaml:"save_to_file" json:"save_to_file"`
+	Backend    string `yaml:"backend" json:"backend"` // file (默认) 或 sqlite
+
+	AnonymizeIP bool `yaml:"anonymize_ip" json:"anonymize_ip"`
+
+	Remote *RemoteLogConfig `yaml:"remote,omitempty" json:"remote,omitempty"`
+	Syslog *SyslogConfig    `yaml:"syslog,omitempty" json:"syslog,omitempty"`
+}
+
+// SyslogConfig 把查询日志 (可选连同程序运行日志) 发送到本机或远程 syslog。
+type SyslogConfig struct {
+	Enabled    bool   `yaml:"enabled" json:"enabled"`
+	Network    string `yaml:"network,omitempty" json:"network,omitempty"`         // udp、tcp，留空连接本机 syslog
+	Address    string `yaml:"address,omitempty" json:"address,omitempty"`         // 如 192.168.1.10:514
+	Facility   string `yaml:"facility,omitempty" json:"facility,omitempty"`       // 默认 daemon
+	Tag        string `yaml:"tag,omitempty" json:"tag,omitempty"`                 // 默认 doh-autoproxy
+	ServiceLog bool   `yaml:"service_log,omitempty" json:"service_log,omitempty"` // 同时发送程序运行日志
+}
+
+// RemoteLogConfig 把查询日志批量发送到远程 HTTP 端点，与本地日志互不影响。
+type RemoteLogConfig struct {
+	URL           string            `yaml:"url" json:"url"`
+	Format        string            `yaml:"format,omitempty" json:"format,omitempty"`                 // ndjson (默认) 或 loki
+	BatchSize     int               `yaml:"batch_size,omitempty" json:"batch_size,omitempty"`         // 每批最多条数，默认 100
+	FlushInterval int               `yaml:"flush_interval,omitempty" json:"flush_interval,omitempty"` // 最长发送间隔 (秒)，默认 5
+	BufferSize    int               `yaml:"buffer_size,omitempty" json:"buffer_size,omitempty"`       // 待发送日志上限，超出后丢弃，默认 10000
+	Headers       map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`               // 附加的 HTTP 头，如 Authorization
+	Labels        map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`                 // 仅 loki: 附加的流标签 (默认已有 job=doh-autoproxy)
+}
+
+// LogFile 返回持久化日志的路径，未配置时按后端取默认文件名。
+func (q QueryLogConfig) LogFile() string {
+	if q.File != "" {
+		return q.File
+	}
+	if q.Backend == "sqlite" {
+		return "query.db"
+	}
+	return "query.log"
+}
+
+type CacheConfig struct {
+	Enabled     bool `yaml:"enabled" json:"enabled"`
+	Size        int  `yaml:"size" json:"size"`
+	ServeStale  bool `yaml:"serve_stale" json:"serve_stale"`
+	StaleTTL    int  `yaml:"stale_ttl" json:"stale_ttl"`
+	StaleWindow int  `yaml:"stale_window" json:"stale_window"`
+	MinTTL      int  `yaml:"min_ttl" json:"min_ttl"`
+	MaxTTL      int  `yaml:"max_ttl" json:"max_ttl"`
+	NegativeTTL int  `yaml:"negative_ttl,omitempty" json:"negative_ttl,omitempty"` // 否定应答 (NXDOMAIN/NODATA) 的最大 TTL，0 表示不限制
+
+	Prefetch          bool    `yaml:"prefetch" json:"prefetch"`
+	PrefetchThreshold float64 `yaml:"prefetch_threshold" json:"prefetch_threshold"`
+	PrefetchMinHits   int64   `yaml:"prefetch_min_hits" json:"prefetch_min_hits"`
+}
+
+type ClientPolicyConfig struct {
+	Name       string `yaml:"name" json:"name"`
+	CIDR       string `yaml:"cidr" json:"cidr"`
+	ForceGroup string `yaml:"force_group" json:"force_group"`
+	RulesFile  string `yaml:"rules_file" json:"rules_file"`
+}
+
+// InterfacePolicyConfig 按查询到达的本地地址 (监听接口) 选择策略，local_addr 可为 IP 或 CIDR，逗号分隔。
+type InterfacePolicyConfig struct {
+	Name       string `yaml:"name" json:"name"`
+	LocalAddr  string `yaml:"local_addr" json:"local_addr"`
+	ForceGroup string `yaml:"force_group" json:"force_group"`
+	RulesFile  string `yaml:"rules_file,omitempty" json:"rules_file,omitempty"`
+}
+
+// DebugUpstreamConfig 是临时的调试上游，启用后匹配的查询绕过分流规则直接发往该上游。
+type DebugUpstreamConfig struct {
+	UpstreamServer `yaml:",inline"`
+	Domains        []string `yaml:"domains,omitempty" json:"domains,omitempty"`
+}
+
+type ChaosConfig struct {
+	Version  string `yaml:"version" json:"version"`
+	Hostname string `yaml:"hostname" json:"hostname"`
+}
+
+type NotificationsConfig struct {
+	WebhookURL string `yaml:"webhook_url" json:"webhook_url"`
+}
+
+// TracingConfig 开启 OpenTelemetry 追踪，经 OTLP/HTTP 把 span 发送到 Endpoint。
+type TracingConfig struct {
+	Enabled     bool              `yaml:"enabled" json:"enabled"`
+	Endpoint    string            `yaml:"endpoint" json:"endpoint"`                             // 如 http://127.0.0.1:4318，未写路径时使用 /v1/traces
+	ServiceName string            `yaml:"service_name,omitempty" json:"service_name,omitempty"` // 默认 doh-autoproxy
+	SampleRatio float64           `yaml:"sample_ratio,omitempty" json:"sample_ratio,omitempty"` // 采样比例 (0~1]，默认 1
+	Headers     map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`           // 附加的 HTTP 头，如认证信息
+}
+
+// WatchConfig 列出需要关注的域名，查询到这些域名时向 webhook 发送告警。
+type WatchConfig struct {
+	Domains    []string `yaml:"domains" json:"domains"`                       // 匹配域名及其子域名，full: 前缀表示只匹配域名本身
+	WebhookURL string   `yaml:"webhook_url" json:"webhook_url"`               // 为空时使用 notifications.webhook_url
+	Cooldown   int      `yaml:"cooldown,omitempty" json:"cooldown,omitempty"` // 同一域名与客户端重复告警的最小间隔 (秒)，默认 300
+}
+
+type CanaryConfig struct {
+	Enabled        bool   `yaml:"enabled" json:"enabled"`
+	Interval       int    `yaml:"interval" json:"interval"`
+	CNDomain       string `yaml:"cn_domain" json:"cn_domain"`
+	OverseasDomain string `yaml:"overseas_domain" json:"overseas_domain"`
+	WebhookURL     string `yaml:"webhook_url" json:"webhook_url"`
+}
+
+type DNSSECConfig struct {
+	Validate        bool   `yaml:"validate" json:"validate"`
+	TrustAnchorFile string `yaml:"trust_anchor_file" json:"trust_anchor_file"`
+	Group           string `yaml:"group" json:"group"`
+}
+
+type RaceConfig struct {
+	EmptyAnswerWaitMs  int `yaml:"empty_answer_wait_ms" json:"empty_answer_wait_ms"`
+	EmptyAnswerRetries int `yaml:"empty_answer_retries" json:"empty_answer_retries"`
+}
+
+// CircuitBreakerConfig 控制上游熔断，时间单位为秒。
+type CircuitBreakerConfig struct {
+	Enabled  bool `yaml:"enabled" json:"enabled"`
+	Failures int  `yaml:"failures" json:"failures"` // 窗口期内连续失败次数阈值，默认 5
+	Window   int  `yaml:"window" json:"window"`     // 默认 10
+	Cooldown int  `yaml:"cooldown" json:"cooldown"` // 默认 30
+}
+
+// DGADetectionConfig 按二级域名标签的香农熵识别疑似 DGA (恶意软件随机生成) 的域名。
+type DGADetectionConfig struct {
+	Enabled    bool    `yaml:"enabled" json:"enabled"`
+	Action     string  `yaml:"action" json:"action"`           // log (默认), block, cn, overseas
+	MinEntropy float64 `yaml:"min_entropy" json:"min_entropy"` // 默认 3.8
+	MinLength  int     `yaml:"min_length" json:"min_length"`   // 标签短于该长度时不检测，默认 12
+}
+
+// ServerIdentityConfig 使本服务器对自身名称的 SOA/NS/A 查询作出权威应答。
+type ServerIdentityConfig struct {
+	Name string `yaml:"name" json:"name"`
+	IP   string `yaml:"ip" json:"ip"`
+}
+
+type ZoneFileConfig struct {
+	Origin      string `yaml:"origin" json:"origin"`
+	File        string `yaml:"file" json:"file"`
+	Fallthrough bool   `yaml:"fallthrough" json:"fallthrough"`
+}
+
+type DoQLimitsConfig struct {
+	MaxConnections    int `yaml:"max_connections" json:"max_connections"`
+	MaxStreamsPerConn int `yaml:"max_streams_per_conn" json:"max_streams_per_conn"`
+	MaxStreams        int `yaml:"max_streams" json:"max_streams"`
+}
+
+// TimeoutsConfig 是各协议服务端的连接超时 (秒)，未设置的项使用默认值。
+type TimeoutsConfig struct {
+	DNS ServerTimeouts `yaml:"dns,omitempty" json:"dns,omitempty"` // 默认读写 5，空闲 8 (仅 TCP)
+	DoT ServerTimeouts `yaml:"dot,omitempty" json:"dot,omitempty"` // 默认读写 10，空闲 8
+	DoH ServerTimeouts `yaml:"doh,omitempty" json:"doh,omitempty"` // 默认读写 10，空闲 30 (HTTP/3 只使用空闲)
+	DoQ ServerTimeouts `yaml:"doq,omitempty" json:"doq,omitempty"` // 默认空闲 30，不使用读写
+}
+
+type ServerTimeouts struct {
+	Read  int `yaml:"read,omitempty" json:"read,omitempty"`
+	Write int `yaml:"write,omitempty" json:"write,omitempty"`
+	Idle  int `yaml:"idle,omitempty" json:"idle,omitempty"`
 }
 
 type WebUIConfig struct {
@@ -45,6 +250,8 @@ type WebUIConfig struct {
 	CertFile  string `yaml:"cert_file" json:"cert_file"`
 	KeyFile   string `yaml:"key_file" json:"key_file"`
 	GuestMode bool   `yaml:"guest_mode" json:"guest_mode"`
+
+	TrustedCIDRs []string `yaml:"trusted_cidrs,omitempty" json:"trusted_cidrs,omitempty"`
 }
 
 type AutoCertConfig struct {
@@ -55,26 +262,76 @@ type AutoCertConfig struct {
 }
 
 type ListenConfig struct {
-	DNSUDP  string `yaml:"dns_udp" json:"dns_udp"`
-	DNSTCP  string `yaml:"dns_tcp" json:"dns_tcp"`
-	DOH     string `yaml:"doh" json:"doh"`
-	DoHPath string `yaml:"doh_path" json:"doh_path"`
-	DOT     string `yaml:"dot" json:"dot"`
-	DOQ     string `yaml:"doq" json:"doq"`
+	DNSUDP       string `yaml:"dns_udp" json:"dns_udp"`
+	DNSTCP       string `yaml:"dns_tcp" json:"dns_tcp"`
+	DOH          string `yaml:"doh" json:"doh"`
+	DoHPath      string `yaml:"doh_path" json:"doh_path"`
+	DoHPlaintext bool   `yaml:"doh_plaintext" json:"doh_plaintext"`
+	DoHHTTP3     *bool  `yaml:"doh_http3,omitempty" json:"doh_http3,omitempty"` // 未设置时视为启用
+	DOT          string `yaml:"dot" json:"dot"`
+	DOQ          string `yaml:"doq" json:"doq"`
+
+	// DoH: 信任其 X-Forwarded-For 的反向代理地址 (IP 或 CIDR)，其他来源的该请求头被忽略
+	DoHTrustedProxies []string `yaml:"doh_trusted_proxies,omitempty" json:"doh_trusted_proxies,omitempty"`
+
+	Interface    string `yaml:"interface" json:"interface"`
+	ReusePort    bool   `yaml:"reuse_port" json:"reuse_port"`
+	UDPListeners int    `yaml:"udp_listeners" json:"udp_listeners"`
+}
+
+// DoHHTTP3Enabled 报告 DoH 服务器是否同时在 UDP 端口上提供 HTTP/3。
+func (l ListenConfig) DoHHTTP3Enabled() bool {
+	return l.DoHHTTP3 == nil || *l.DoHHTTP3
 }
 
 type UpstreamsConfig struct {
 	CN       []UpstreamServer `yaml:"cn" json:"cn"`
 	Overseas []UpstreamServer `yaml:"overseas" json:"overseas"`
+
+	Strategy string `yaml:"strategy,omitempty" json:"strategy,omitempty"` // race (默认) 或 weighted
+
+	CNECS       GroupECSConfig `yaml:"cn_ecs" json:"cn_ecs"`
+	OverseasECS GroupECSConfig `yaml:"overseas_ecs" json:"overseas_ecs"`
+}
+
+type GroupECSConfig struct {
+	ECSIP    string `yaml:"ecs_ip" json:"ecs_ip"`
+	StripECS bool   `yaml:"strip_ecs" json:"strip_ecs"`
 }
 
 type UpstreamServer struct {
-	Address            string `yaml:"address" json:"address"`
-	Protocol           string `yaml:"protocol" json:"protocol"`
-	ECSIP              string `yaml:"ecs_ip" json:"ecs_ip"`
-	EnablePipeline     bool   `yaml:"pipeline" json:"pipeline"`
-	EnableH3           bool   `yaml:"http3" json:"http3"`
-	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	Enabled             *bool  `yaml:"enabled,omitempty" json:"enabled,omitempty"` // 未设置时视为启用
+	Address             string `yaml:"address" json:"address"`
+	Protocol            string `yaml:"protocol" json:"protocol"`
+	ECSIP               string `yaml:"ecs_ip" json:"ecs_ip"`
+	StripECS            bool   `yaml:"strip_ecs" json:"strip_ecs"`
+	EnablePipeline      bool   `yaml:"pipeline" json:"pipeline"`
+	UDPSocketPool       bool   `yaml:"udp_socket_pool,omitempty" json:"udp_socket_pool,omitempty"`             // 仅 UDP: 复用 connected socket (源端口固定)，默认每个查询新建 socket
+	PipelineFallback    *bool  `yaml:"pipeline_fallback,omitempty" json:"pipeline_fallback,omitempty"`         // 仅 DoT: 复用连接失败后改用新连接重试，默认开启
+	PipelineMaxAge      int    `yaml:"pipeline_max_age,omitempty" json:"pipeline_max_age,omitempty"`           // 仅 DoT/UDP socket 池: 连接最长复用时间 (秒)，DoT 默认 300，UDP 默认 60
+	PoolSize            int    `yaml:"pool_size,omitempty" json:"pool_size,omitempty"`                         // 仅 TCP/DoT pipeline 与 UDP socket 池: 连接池大小，默认 10
+	PipelineIdleTimeout int    `yaml:"pipeline_idle_timeout,omitempty" json:"pipeline_idle_timeout,omitempty"` // 仅 TCP/DoT pipeline 与 UDP socket 池: 空闲连接回收时间 (秒)，默认 30
+	EnableH3            bool   `yaml:"http3" json:"http3"`
+	InsecureSkipVerify  bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	ServerName          string `yaml:"servername,omitempty" json:"servername,omitempty"` // DoT/DoQ/DoH: 覆盖 TLS SNI 与证书校验使用的名称，默认取地址中的主机名
+	Proxy               string `yaml:"proxy" json:"proxy"`
+	DNSCookie           bool   `yaml:"dns_cookie" json:"dns_cookie"`
+	Retries             int    `yaml:"retries" json:"retries"`
+	RetryBackoffMs      int    `yaml:"retry_backoff_ms" json:"retry_backoff_ms"`
+	Weight              int    `yaml:"weight,omitempty" json:"weight,omitempty"` // strategy 为 weighted 时的权重，默认 1
+	Tier                int    `yaml:"tier,omitempty" json:"tier,omitempty"`     // 优先级层级，数值小的先用，整层失败后才使用下一层，默认 0
+
+	Headers map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"` // 仅 DoH: 每个请求附加的 HTTP 头
+	Method  string            `yaml:"method,omitempty" json:"method,omitempty"`   // 仅 DoH: post (默认) 或 get
+}
+
+func (u UpstreamServer) IsEnabled() bool {
+	return u.Enabled == nil || *u.Enabled
+}
+
+// PipelineFallbackEnabled 报告 DoT pipeline 失败后是否回退到一次性连接，未设置时视为开启。
+func (u UpstreamServer) PipelineFallbackEnabled() bool {
+	return u.PipelineFallback == nil || *u.PipelineFallback
 }
 
 type GeoDataConfig struct {
@@ -83,6 +340,12 @@ type GeoDataConfig struct {
 	GeoIPDownloadURL   string `yaml:"geoip_download_url" json:"geoip_download_url"`
 	GeoSiteDownloadURL string `yaml:"geosite_download_url" json:"geosite_download_url"`
 	AutoUpdate         string `yaml:"auto_update" json:"auto_update"`
+	Required           *bool  `yaml:"required,omitempty" json:"required,omitempty"` // 未设置时视为必需
+}
+
+// IsRequired 报告 Geo 数据加载失败时是否应中止启动。
+func (g GeoDataConfig) IsRequired() bool {
+	return g.Required == nil || *g.Required
 }
 
 func LoadConfig(configPath string) (*Config, error) {
@@ -92,15 +355,15 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 	configDir := filepath.Dir(absPath)
 
-	data, err := ioutil.ReadFile(absPath)
-	if err != nil {
-		return nil, fmt.Errorf("无法读取配置文件 %s: %w", absPath, err)
-	}
-
 	var cfg Config
-	err = yaml.Unmarshal(data, &cfg)
-	if err != nil {
-		return nil, fmt.Errorf("无法解析配置文件 %s: %w", absPath, err)
+	if err := decodeConfigFile(absPath, configDir, &cfg, nil, nil); err != nil {
+		return nil, err
+	}
+	if err := recordIncludeBase(absPath, configDir, cfg.Include); err != nil {
+		return nil, err
+	}
+	if err := expandConfigEnv(absPath, &cfg); err != nil {
+		return nil, fmt.Errorf("配置文件 %s 中的环境变量引用无效: %w", absPath, err)
 	}
 
 	cfg.ConfigDir = configDir
@@ -154,6 +417,31 @@ func LoadConfig(configPath string) (*Config, error) {
 	}
 	cfg.GeoData.GeoSiteDat = resolvePath(cfg.GeoData.GeoSiteDat)
 
+	for i := range cfg.ZoneFiles {
+		cfg.ZoneFiles[i].File = resolvePath(cfg.ZoneFiles[i].File)
+	}
+	for i := range cfg.ClientPolicies {
+		cfg.ClientPolicies[i].RulesFile = resolvePath(cfg.ClientPolicies[i].RulesFile)
+	}
+	for i := range cfg.InterfacePolicies {
+		cfg.InterfacePolicies[i].RulesFile = resolvePath(cfg.InterfacePolicies[i].RulesFile)
+	}
+	cfg.DNSSEC.TrustAnchorFile = resolvePath(cfg.DNSSEC.TrustAnchorFile)
+
+	if cfg.BlocklistCacheDir == "" {
+		cfg.BlocklistCacheDir = "blocklists"
+	}
+	cfg.BlocklistCacheDir = resolvePath(cfg.BlocklistCacheDir)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("配置文件 %s 无效: %w", absPath, err)
+	}
+	if len(cfg.InterfacePolicies) > 0 {
+		for _, name := range cfg.Listen.wildcardPacketListeners() {
+			log.Printf("警告: listen.%s 绑定在通配地址上，经由它到达的查询无法匹配 interface_policies，请改为绑定具体 IP", name)
+		}
+	}
+
 	return &cfg, nil
 }
 
@@ -188,12 +476,41 @@ func (c *Config) Save(configPath string) error {
 	saveCfg := *c
 	saveCfg.GeoData.GeoIPDat = relPath(c.GeoData.GeoIPDat)
 	saveCfg.GeoData.GeoSiteDat = relPath(c.GeoData.GeoSiteDat)
+	saveCfg.ZoneFiles = make([]ZoneFileConfig, len(c.ZoneFiles))
+	for i, z := range c.ZoneFiles {
+		z.File = relPath(z.File)
+		saveCfg.ZoneFiles[i] = z
+	}
+	saveCfg.ClientPolicies = make([]ClientPolicyConfig, len(c.ClientPolicies))
+	for i, p := range c.ClientPolicies {
+		p.RulesFile = relPath(p.RulesFile)
+		saveCfg.ClientPolicies[i] = p
+	}
+	saveCfg.InterfacePolicies = make([]InterfacePolicyConfig, len(c.InterfacePolicies))
+	for i, p := range c.InterfacePolicies {
+		p.RulesFile = relPath(p.RulesFile)
+		saveCfg.InterfacePolicies[i] = p
+	}
+	saveCfg.DNSSEC.TrustAnchorFile = relPath(c.DNSSEC.TrustAnchorFile)
+	saveCfg.BlocklistCacheDir = relPath(c.BlocklistCacheDir)
+	restoreConfigEnv(absPath, &saveCfg)
 
-	data, err := yaml.Marshal(saveCfg)
+	var doc yaml.Node
+	if err := doc.Encode(saveCfg); err != nil {
+		return fmt.Errorf("无法序列化配置: %w", err)
+	}
+	stripIncludedFields(absPath, &doc)
+	data, err := yaml.Marshal(&doc)
 	if err != nil {
 		return fmt.Errorf("无法序列化配置: %w", err)
 	}
-	if err := ioutil.WriteFile(absPath, data, 0644); err != nil {
+	if err := backupConfig(absPath, data); err != nil {
+		log.Printf("备份配置文件失败: %v", err)
+	}
+	if err := writeFileAtomic(absPath, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
 		return fmt.Errorf("无法写入配置文件 %s: %w", absPath, err)
 	}
 
@@ -211,35 +528,25 @@ func (c *Config) Save(configPath string) error {
 }
 
 func saveHostsFile(path string, hosts map[string]string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	for domain, ip := range hosts {
-		if _, err := fmt.Fprintf(w, "%s %s\n", ip, domain); err != nil {
-			return err
+	return writeFileAtomic(path, func(w io.Writer) error {
+		for domain, ip := range hosts {
+			if _, err := fmt.Fprintf(w, "%s %s\n", ip, domain); err != nil {
+				return err
+			}
 		}
-	}
-	return w.Flush()
+		return nil
+	})
 }
 
 func saveRulesFile(path string, rules map[string]string) error {
-	f, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	for domain, target := range rules {
-		if _, err := fmt.Fprintf(w, "%s %s\n", domain, target); err != nil {
-			return err
+	return writeFileAtomic(path, func(w io.Writer) error {
+		for domain, target := range rules {
+			if _, err := fmt.Fprintf(w, "%s %s\n", domain, target); err != nil {
+				return err
+			}
 		}
-	}
-	return w.Flush()
+		return nil
+	})
 }
 
 func loadHostsFile(path string, hosts map[string]string) error {
@@ -266,6 +573,14 @@ func loadHostsFile(path string, hosts map[string]string) error {
 	return scanner.Err()
 }
 
+func LoadRulesFile(path string) (map[string]string, error) {
+	rules := make(map[string]string)
+	if err := loadRulesFile(path, rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
 func loadRulesFile(path string, rules map[string]string) error {
 	f, err := os.Open(path)
 	if err != nil {
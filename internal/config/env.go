@@ -0,0 +1,164 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var envRefPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// envRef 记录一个含 ${VAR} 引用的配置值及其展开结果，保存配置时据此写回原始引用，
+// 避免把环境变量中的密码等敏感信息落盘。
+type envRef struct {
+	template string
+	value    string
+}
+
+var (
+	envRefsMu sync.Mutex
+	envRefs   = make(map[string]map[string]envRef) // 配置文件绝对路径 -> 字段路径 -> 引用
+)
+
+// expandEnv 展开 s 中的 ${VAR}，引用的变量未设置时返回错误。
+func expandEnv(s string) (string, error) {
+	var missing []string
+	out := envRefPattern.ReplaceAllStringFunc(s, func(m string) string {
+		name := m[2 : len(m)-1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("环境变量 %s 未设置", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
+
+// expandConfigEnv 展开配置中所有字符串字段里的 ${VAR}，并记录引用以便 Save 时还原。
+func expandConfigEnv(absPath string, cfg *Config) error {
+	refs := make(map[string]envRef)
+	err := walkStrings(reflect.ValueOf(cfg).Elem(), "", func(path, s string) (string, error) {
+		if !strings.Contains(s, "${") {
+			return s, nil
+		}
+		v, err := expandEnv(s)
+		if err != nil {
+			return s, fmt.Errorf("%s: %w", path, err)
+		}
+		refs[path] = envRef{template: s, value: v}
+		return v, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	envRefsMu.Lock()
+	envRefs[absPath] = refs
+	envRefsMu.Unlock()
+	return nil
+}
+
+// restoreConfigEnv 把值未被修改的字段还原为加载时的 ${VAR} 引用。
+func restoreConfigEnv(absPath string, cfg *Config) {
+	envRefsMu.Lock()
+	refs := envRefs[absPath]
+	envRefsMu.Unlock()
+	if len(refs) == 0 {
+		return
+	}
+
+	walkStrings(reflect.ValueOf(cfg).Elem(), "", func(path, s string) (string, error) {
+		if ref, ok := refs[path]; ok && ref.value == s {
+			return ref.template, nil
+		}
+		return s, nil
+	})
+}
+
+// walkStrings 遍历 v 中所有可导出的字符串字段 (含切片、映射与指针)，用 fn 的返回值替换原值。
+// path 使用 yaml 字段名，如 upstreams.cn[0].address。yaml:"-" 的字段不参与遍历。
+// 配置之间通过结构体浅拷贝共享切片、映射与指针，遍历时先复制再修改，避免影响其他副本。
+func walkStrings(v reflect.Value, path string, fn func(path, s string) (string, error)) error {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := fn(path, v.String())
+		if err != nil {
+			return err
+		}
+		if s != v.String() {
+			v.SetString(s)
+		}
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if v.CanSet() {
+			c := reflect.New(v.Elem().Type())
+			c.Elem().Set(v.Elem())
+			v.Set(c)
+		}
+		return walkStrings(v.Elem(), path, fn)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := f.Tag.Get("yaml")
+			name := strings.Split(tag, ",")[0]
+			if name == "-" {
+				continue
+			}
+			fieldPath := path
+			if !strings.Contains(tag, "inline") {
+				if name == "" {
+					name = strings.ToLower(f.Name)
+				}
+				if fieldPath != "" {
+					fieldPath += "."
+				}
+				fieldPath += name
+			}
+			if err := walkStrings(v.Field(i), fieldPath, fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		if v.Len() > 0 && v.CanSet() {
+			c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+			reflect.Copy(c, v)
+			v.Set(c)
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := walkStrings(v.Index(i), path+"["+strconv.Itoa(i)+"]", fn); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			elem := reflect.New(iter.Value().Type()).Elem()
+			elem.Set(iter.Value())
+			if err := walkStrings(elem, path+"."+fmt.Sprint(iter.Key().Interface()), fn); err != nil {
+				return err
+			}
+			c.SetMapIndex(iter.Key(), elem)
+		}
+		if v.CanSet() {
+			v.Set(c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// HostsImportResult 统计批量导入时各类行的数量。
+// Skipped 包含空行、注释以及无法用 hosts 表达的规则 (如 adblock 例外规则、带修饰符的规则)；
+// Removed 仅在替换模式下使用，为导入内容中不再存在而被删除的条目数。
+type HostsImportResult struct {
+	Added   int `json:"added"`
+	Skipped int `json:"skipped"`
+	Invalid int `json:"invalid"`
+	Removed int `json:"removed"`
+}
+
+// blockIP 是 dnsmasq / adblock 屏蔽规则转换为 hosts 条目时使用的地址。
+const blockIP = "0.0.0.0"
+
+// suffixHost 返回 domain 的后缀 hosts 条目名。dnsmasq 的 address=/域名/ 与 adblock 的 ||域名^
+// 都作用于该域名及其所有子域名，导入为以 "." 开头的后缀条目，由路由器按后缀匹配。
+func suffixHost(domain string) string {
+	return "." + domain
+}
+
+// ParseHosts 按 format (hosts、dnsmasq、adblock) 解析文本，把得到的条目写入 hosts。
+// 返回结果中的 Added 为解析出的条目数，由调用方根据已有条目再做区分。
+func ParseHosts(r io.Reader, format string, hosts map[string]string) (HostsImportResult, error) {
+	var parseLine func(line string, hosts map[string]string) (int, bool)
+	switch strings.ToLower(format) {
+	case "", "hosts":
+		parseLine = parseHostsLine
+	case "dnsmasq":
+		parseLine = parseDnsmasqLine
+	case "adblock":
+		parseLine = parseAdblockLine
+	default:
+		return HostsImportResult{}, fmt.Errorf("不支持的 hosts 格式: %s", format)
+	}
+
+	var res HostsImportResult
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			res.Skipped++
+			continue
+		}
+		n, ok := parseLine(line, hosts)
+		switch {
+		case !ok:
+			res.Invalid++
+		case n == 0:
+			res.Skipped++
+		default:
+			res.Added += n
+		}
+	}
+	return res, scanner.Err()
+}
+
+// parseHostsLine 解析 "IP 域名 [域名...]"，行尾的 # 注释会被忽略。
+// 只用于导入：IP 或域名无效的行计为 Invalid。hosts.txt 本身由更宽松的 loadHostsFile 读取。
+func parseHostsLine(line string, hosts map[string]string) (int, bool) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	parts := strings.Fields(line)
+	if len(parts) < 2 || net.ParseIP(parts[0]) == nil {
+		return 0, false
+	}
+	n := 0
+	for _, domain := range parts[1:] {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if !validHostName(domain) {
+			return n, n > 0
+		}
+		hosts[domain] = parts[0]
+		n++
+	}
+	return n, true
+}
+
+// parseDnsmasqLine 解析 address=/域名[/域名...]/IP，每个域名导入为后缀条目。
+// IP 为空或 # (dnsmasq 中表示屏蔽) 时转换为 0.0.0.0；其他指令 (server= 等) 视为跳过。
+func parseDnsmasqLine(line string, hosts map[string]string) (int, bool) {
+	if !strings.HasPrefix(line, "address=") {
+		return 0, true
+	}
+	fields := strings.Split(strings.TrimPrefix(line, "address="), "/")
+	if len(fields) < 3 || fields[0] != "" {
+		return 0, false
+	}
+	ip := strings.TrimSpace(fields[len(fields)-1])
+	if ip == "" || ip == "#" {
+		ip = blockIP
+	} else if net.ParseIP(ip) == nil {
+		return 0, false
+	}
+
+	n := 0
+	for _, domain := range fields[1 : len(fields)-1] {
+		domain = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+		if !validHostName(domain) {
+			return 0, false
+		}
+		hosts[suffixHost(domain)] = ip
+		n++
+	}
+	return n, n > 0
+}
+
+// parseAdblockLine 解析 ||域名^ 形式的屏蔽规则，导入为屏蔽该域名及其所有子域名的后缀条目。
+// 注释、头部、例外规则 (@@)、元素隐藏规则以及带 $ 修饰符的规则无法用 hosts 表达，视为跳过。
+func parseAdblockLine(line string, hosts map[string]string) (int, bool) {
+	switch {
+	case strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["),
+		strings.HasPrefix(line, "@@"), strings.Contains(line, "##"),
+		strings.Contains(line, "#@#"), strings.Contains(line, "$"):
+		return 0, true
+	}
+	if !strings.HasPrefix(line, "||") {
+		return 0, false
+	}
+	domain := strings.TrimPrefix(line, "||")
+	domain = strings.TrimSuffix(strings.TrimSuffix(domain, "|"), "^")
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !validHostName(domain) {
+		return 0, false
+	}
+	hosts[suffixHost(domain)] = blockIP
+	return 1, true
+}
+
+func validHostName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
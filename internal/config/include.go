@@ -0,0 +1,126 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	includeBaseMu sync.Mutex
+	includeBase   = make(map[string]map[string]interface{}) // 主配置绝对路径 -> include 文件合并后的顶层字段
+)
+
+// decodeConfigFile 解析 path 及其 include 的文件到 cfg。
+// include 按顺序先行解析，后面的文件覆盖前面的，文件自身的内容最后解析，因此主配置优先于所有 include。
+// include 路径与 geo_data 等路径一样相对于主配置所在目录解析；stack 用于检测循环引用。
+// keys 不为 nil 时记录解析过的所有文件中出现的顶层字段名。
+func decodeConfigFile(path, configDir string, cfg *Config, stack []string, keys map[string]bool) error {
+	for _, p := range stack {
+		if p == path {
+			return fmt.Errorf("检测到循环 include: %s -> %s", strings.Join(stack, " -> "), path)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("无法读取配置文件 %s: %w", path, err)
+	}
+
+	var header struct {
+		Include []string `yaml:"include"`
+	}
+	if err := yaml.Unmarshal(data, &header); err != nil {
+		return fmt.Errorf("无法解析配置文件 %s: %w", path, err)
+	}
+	for _, inc := range header.Include {
+		if err := decodeConfigFile(includePath(configDir, inc), configDir, cfg, append(stack, path), keys); err != nil {
+			return err
+		}
+	}
+
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("无法解析配置文件 %s: %w", path, err)
+	}
+	if keys != nil {
+		var top map[string]interface{}
+		yaml.Unmarshal(data, &top)
+		for k := range top {
+			keys[k] = true
+		}
+	}
+	return nil
+}
+
+func includePath(configDir, p string) string {
+	if !filepath.IsAbs(p) {
+		return filepath.Join(configDir, p)
+	}
+	return p
+}
+
+// recordIncludeBase 记录 include 文件合并后的顶层字段，Save 时与之相同的字段不写入主配置，
+// 使它们继续由 include 文件维护。
+func recordIncludeBase(absPath, configDir string, includes []string) error {
+	var base Config
+	keys := make(map[string]bool)
+	for _, inc := range includes {
+		if err := decodeConfigFile(includePath(configDir, inc), configDir, &base, []string{absPath}, keys); err != nil {
+			return err
+		}
+	}
+
+	fields, err := topLevelFields(&base)
+	if err != nil {
+		return err
+	}
+	for k := range fields {
+		if !keys[k] || k == "include" {
+			delete(fields, k)
+		}
+	}
+	includeBaseMu.Lock()
+	includeBase[absPath] = fields
+	includeBaseMu.Unlock()
+	return nil
+}
+
+// stripIncludedFields 从编码后的主配置中删除与 include 文件内容相同的顶层字段，保持其余字段顺序不变。
+func stripIncludedFields(absPath string, doc *yaml.Node) {
+	includeBaseMu.Lock()
+	base := includeBase[absPath]
+	includeBaseMu.Unlock()
+	if len(base) == 0 || doc.Kind != yaml.MappingNode {
+		return
+	}
+
+	content := doc.Content[:0]
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, val := doc.Content[i], doc.Content[i+1]
+		if v, ok := base[key.Value]; ok {
+			var cur interface{}
+			if val.Decode(&cur) == nil && reflect.DeepEqual(cur, v) {
+				continue
+			}
+		}
+		content = append(content, key, val)
+	}
+	doc.Content = content
+}
+
+func topLevelFields(cfg *Config) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
@@ -0,0 +1,96 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// SQLiteSupported 表示当前程序是否编译了 SQLite 查询日志后端，由 querylog 包在 -tags sqlite 编译时设置。
+var SQLiteSupported bool
+
+// Validate 检查无法在运行时合理回退的配置取值，LoadConfig 与 WebUI 保存配置前都会调用。
+func (c *Config) Validate() error {
+	switch c.AnswerMode {
+	case "", "dual", "ipv4_only", "ipv6_only":
+	default:
+		return fmt.Errorf("无效的 answer_mode %q，只能是 dual、ipv4_only 或 ipv6_only", c.AnswerMode)
+	}
+	switch c.QueryLog.Backend {
+	case "", "file":
+	case "sqlite":
+		if c.QueryLog.SaveToFile && !SQLiteSupported {
+			return fmt.Errorf("query_log.backend 为 sqlite，但当前程序未编译 SQLite 支持 (需使用 CGO_ENABLED=1 go build -tags sqlite 编译，或 make linux-amd64-sqlite)")
+		}
+	default:
+		return fmt.Errorf("无效的 query_log.backend %q，只能是 file 或 sqlite", c.QueryLog.Backend)
+	}
+	for _, p := range c.Listen.DoHTrustedProxies {
+		if _, err := ParseTrustedProxy(p); err != nil {
+			return fmt.Errorf("无效的 listen.doh_trusted_proxies 项 %q: %w", p, err)
+		}
+	}
+	for _, p := range c.ClientPolicies {
+		if err := validateForceGroup(p.ForceGroup); err != nil {
+			return fmt.Errorf("客户端策略 %s: %w", policyName(p.Name, p.CIDR), err)
+		}
+	}
+	for _, p := range c.InterfacePolicies {
+		if err := validateForceGroup(p.ForceGroup); err != nil {
+			return fmt.Errorf("接口策略 %s: %w", policyName(p.Name, p.LocalAddr), err)
+		}
+	}
+	return nil
+}
+
+// ParseTrustedProxy 把 doh_trusted_proxies 中的一项 (单个 IP 或 CIDR) 解析为网段。
+func ParseTrustedProxy(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// validateForceGroup 只接受 cn 与 overseas (不区分大小写)，留空表示不强制分组。
+func validateForceGroup(g string) error {
+	switch strings.ToLower(g) {
+	case "", "cn", "overseas":
+		return nil
+	}
+	return fmt.Errorf("无效的 force_group %q，只能是 cn 或 overseas", g)
+}
+
+func policyName(name, addr string) string {
+	if name != "" {
+		return name
+	}
+	return addr
+}
+
+// wildcardPacketListeners 返回绑定在 0.0.0.0 / [::] 上的 UDP 类监听 (dns_udp、doq)。
+// 这类套接字上收到的查询只能拿到通配的本地地址，interface_policies 无法按接口区分；
+// TCP 类监听由内核为每个连接给出实际的本地地址，不受影响。
+func (l ListenConfig) wildcardPacketListeners() []string {
+	var names []string
+	for _, ln := range []struct{ name, addr string }{{"dns_udp", l.DNSUDP}, {"doq", l.DOQ}} {
+		if ln.addr == "" {
+			continue
+		}
+		host, _, err := net.SplitHostPort(ln.addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			names = append(names, ln.name)
+		}
+	}
+	return names
+}
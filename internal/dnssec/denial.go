@@ -0,0 +1,288 @@
+package dnssec
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// MaxNSEC3Iterations 是视为可验证的 NSEC3 最大迭代次数 (RFC 9276)，超过时按 Insecure 处理。
+const MaxNSEC3Iterations = 150
+
+// denial 是否定响应权威段中签名已验证的 NSEC / NSEC3 记录，zone 为其签名者区域。
+type denial struct {
+	zone  string
+	nsec  []*dns.NSEC
+	nsec3 []*dns.NSEC3
+}
+
+// verify 检查记录是否确实否定了 name 的 qtype (nxdomain 为 false 时为 NODATA)：
+// NSEC 按 RFC 4035 5.4 / RFC 4592，NSEC3 按 RFC 5155 8.4-8.7。
+// 证明落入 NSEC3 opt-out 区间或使用不支持的 NSEC3 参数时返回 Insecure；证明不成立时返回错误。
+func (d *denial) verify(name string, qtype uint16, nxdomain bool) (Result, error) {
+	if len(d.nsec) == 0 && len(d.nsec3) == 0 {
+		return Insecure, fmt.Errorf("%s 的否定响应缺少 NSEC/NSEC3 证明", name)
+	}
+	if !dns.IsSubDomain(d.zone, name) {
+		return Insecure, fmt.Errorf("否定证明的区域 %s 不包含 %s", d.zone, name)
+	}
+	if len(d.nsec) > 0 {
+		return Secure, d.verifyNSEC(name, qtype, nxdomain)
+	}
+	return d.verifyNSEC3(name, qtype, nxdomain)
+}
+
+func (d *denial) verifyNSEC(name string, qtype uint16, nxdomain bool) error {
+	if !nxdomain {
+		for _, n := range d.nsec {
+			if strings.EqualFold(n.Hdr.Name, name) {
+				return checkNoData(n.TypeBitMap, name, qtype)
+			}
+		}
+		// 空非终端：name 位于某条 NSEC 的区间内，且下一名称是它的子域
+		for _, n := range d.nsec {
+			next := strings.ToLower(n.NextDomain)
+			if next != name && dns.IsSubDomain(name, next) && nsecBetween(n, name) {
+				return nil
+			}
+		}
+	}
+
+	var cover *dns.NSEC
+	for _, n := range d.nsec {
+		if NSECCovers(n, d.zone, name) {
+			cover = n
+			break
+		}
+	}
+	if cover == nil {
+		return fmt.Errorf("没有覆盖 %s 的 NSEC", name)
+	}
+
+	wildcard := "*." + strings.TrimPrefix(NSECClosestEncloser(cover, d.zone, name), ".")
+	if nxdomain {
+		for _, n := range d.nsec {
+			if NSECCovers(n, d.zone, wildcard) {
+				return nil
+			}
+		}
+		return fmt.Errorf("NSEC 未否定通配符 %s", wildcard)
+	}
+	for _, n := range d.nsec {
+		if strings.EqualFold(n.Hdr.Name, wildcard) {
+			return checkNoData(n.TypeBitMap, wildcard, qtype)
+		}
+	}
+	return fmt.Errorf("缺少通配符 %s 的 NODATA 证明", wildcard)
+}
+
+// nsecBetween 报告 name 是否按规范顺序位于 NSEC 的所有者与下一名称之间，含区域最后一条 NSEC 回绕的情况。
+func nsecBetween(n *dns.NSEC, name string) bool {
+	owner, next := strings.ToLower(n.Hdr.Name), strings.ToLower(n.NextDomain)
+	if canonicalLess(owner, next) {
+		return canonicalLess(owner, name) && canonicalLess(name, next)
+	}
+	return canonicalLess(owner, name) || canonicalLess(name, next)
+}
+
+// NSECCovers 报告 n 是否证明 name 不存在：name 位于区间内但不是空非终端，
+// 且 n 不是 name 上级的委派点或 DNAME (此时 NSEC 不能证明子区域中的名称)。
+func NSECCovers(n *dns.NSEC, zone, name string) bool {
+	owner, next := strings.ToLower(n.Hdr.Name), strings.ToLower(n.NextDomain)
+	if owner == name || next == name || dns.IsSubDomain(name, next) {
+		return false
+	}
+	if owner != zone && dns.IsSubDomain(owner, name) && (HasType(n.TypeBitMap, dns.TypeDNAME) || IsDelegation(n.TypeBitMap)) {
+		return false
+	}
+	return nsecBetween(n, name)
+}
+
+// NSECClosestEncloser 返回 name 与覆盖它的 NSEC 的所有者或下一名称共有的最长祖先，不会超出区域顶点。
+func NSECClosestEncloser(n *dns.NSEC, zone, name string) string {
+	labels := max(dns.CompareDomainName(name, n.Hdr.Name), dns.CompareDomainName(name, n.NextDomain), dns.CountLabel(zone))
+	idx := dns.Split(name)
+	if labels >= len(idx) {
+		return name
+	}
+	if labels == 0 {
+		return "."
+	}
+	return name[idx[len(idx)-labels]:]
+}
+
+func (d *denial) verifyNSEC3(name string, qtype uint16, nxdomain bool) (Result, error) {
+	for _, n := range d.nsec3 {
+		if n.Hash != dns.SHA1 || n.Iterations > MaxNSEC3Iterations {
+			return Insecure, nil
+		}
+	}
+
+	if m := d.nsec3Match(name); m != nil {
+		if nxdomain {
+			return Insecure, fmt.Errorf("NXDOMAIN 响应中存在匹配 %s 的 NSEC3", name)
+		}
+		return Secure, checkNoData(m.TypeBitMap, name, qtype)
+	}
+
+	ce, nc, err := d.closestEncloser(name)
+	if err != nil {
+		return Insecure, err
+	}
+	optOut := nc.Flags&1 == 1
+	wildcard := "*." + strings.TrimPrefix(ce, ".")
+
+	if nxdomain {
+		if d.nsec3Cover(wildcard) == nil {
+			return Insecure, fmt.Errorf("NSEC3 未否定通配符 %s", wildcard)
+		}
+		if optOut {
+			return Insecure, nil
+		}
+		return Secure, nil
+	}
+
+	// 没有匹配的 NSEC3：DS 查询可由 opt-out 区间证明为未签名委派 (8.6)，其余只能是通配符 NODATA (8.7)
+	if qtype == dns.TypeDS && optOut {
+		return Insecure, nil
+	}
+	if m := d.nsec3Match(wildcard); m != nil {
+		return Secure, checkNoData(m.TypeBitMap, wildcard, qtype)
+	}
+	return Insecure, fmt.Errorf("缺少 %s 的 NSEC3 NODATA 证明", name)
+}
+
+// verifyWildcard 检查通配符展开的应答所需的证明：name 本身不存在，即有 NSEC 覆盖 name (RFC 4035 5.3.4)，
+// 或有 NSEC3 覆盖 next closer 名称 (RFC 5155 8.8)。next closer 落入 opt-out 区间时返回 Insecure。
+func (d *denial) verifyWildcard(name, nextCloser string) (Result, error) {
+	if !dns.IsSubDomain(d.zone, name) {
+		return Insecure, fmt.Errorf("否定证明的区域 %s 不包含 %s", d.zone, name)
+	}
+	for _, n := range d.nsec {
+		if NSECCovers(n, d.zone, name) {
+			return Secure, nil
+		}
+	}
+	if len(d.nsec3) == 0 {
+		return Insecure, fmt.Errorf("没有证明通配符展开的 %s 不存在的 NSEC", name)
+	}
+	for _, n := range d.nsec3 {
+		if n.Hash != dns.SHA1 || n.Iterations > MaxNSEC3Iterations {
+			return Insecure, nil
+		}
+	}
+	nc := d.nsec3Cover(nextCloser)
+	if nc == nil {
+		return Insecure, fmt.Errorf("NSEC3 未覆盖通配符展开的 %s 的 next closer 名称", name)
+	}
+	if nc.Flags&1 == 1 {
+		return Insecure, nil
+	}
+	return Secure, nil
+}
+
+// closestEncloser 按 RFC 5155 8.3 寻找 name 的最近祖先：有 NSEC3 匹配的最长祖先，
+// 且 next closer 名称被另一条 NSEC3 覆盖。返回最近祖先与覆盖 next closer 的 NSEC3。
+func (d *denial) closestEncloser(name string) (string, *dns.NSEC3, error) {
+	idx := dns.Split(name)
+	for i := 1; i <= len(idx); i++ {
+		ce := "."
+		if i < len(idx) {
+			ce = name[idx[i]:]
+		}
+		if !dns.IsSubDomain(d.zone, ce) {
+			break
+		}
+		m := d.nsec3Match(ce)
+		if m == nil {
+			continue
+		}
+		if HasType(m.TypeBitMap, dns.TypeDNAME) || IsDelegation(m.TypeBitMap) {
+			return "", nil, fmt.Errorf("%s 的最近祖先 %s 是委派点或 DNAME", name, ce)
+		}
+		nc := d.nsec3Cover(name[idx[i-1]:])
+		if nc == nil {
+			return "", nil, fmt.Errorf("NSEC3 未覆盖 %s 的 next closer 名称", name)
+		}
+		return ce, nc, nil
+	}
+	return "", nil, fmt.Errorf("缺少 %s 的最近祖先证明", name)
+}
+
+// nsec3Match 返回所有者哈希等于 name 哈希的 NSEC3。这里不使用 dns.NSEC3.Match：
+// 它要求所有者至少有两个标签，无法处理根区的 NSEC3，且 Cover 在哈希等于所有者哈希时也返回 true。
+func (d *denial) nsec3Match(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if nsec3Hash(n, name) == nsec3Owner(n) {
+			return n
+		}
+	}
+	return nil
+}
+
+// nsec3Cover 返回哈希严格位于所有者哈希与下一哈希之间的 NSEC3，含区域中最后一条 NSEC3 回绕的情况。
+func (d *denial) nsec3Cover(name string) *dns.NSEC3 {
+	for _, n := range d.nsec3 {
+		if NSEC3Covers(nsec3Owner(n), strings.ToUpper(n.NextDomain), nsec3Hash(n, name)) {
+			return n
+		}
+	}
+	return nil
+}
+
+// NSEC3Covers 报告哈希 h 是否严格位于 NSEC3 的所有者哈希与下一哈希 (均为大写 base32hex) 之间，
+// 含区域中最后一条 NSEC3 回绕的情况。
+func NSEC3Covers(owner, next, h string) bool {
+	if h == owner {
+		return false
+	}
+	if owner < next {
+		return owner < h && h < next
+	}
+	return h > owner || h < next
+}
+
+func nsec3Owner(n *dns.NSEC3) string {
+	return strings.ToUpper(dns.SplitDomainName(n.Hdr.Name)[0])
+}
+
+func nsec3Hash(n *dns.NSEC3, name string) string {
+	return dns.HashName(name, n.Hash, n.Iterations, n.Salt)
+}
+
+// checkNoData 检查 NODATA 证明的类型位图：不得包含 qtype 或 CNAME；父区域委派点的 NSEC 只能否定 DS，
+// 子区域顶点的 NSEC 不能否定 DS。
+func checkNoData(bitmap []uint16, name string, qtype uint16) error {
+	if HasType(bitmap, qtype) || HasType(bitmap, dns.TypeCNAME) {
+		return fmt.Errorf("否定证明的类型位图表明 %s 存在 %s 或 CNAME", name, dns.TypeToString[qtype])
+	}
+	if IsDelegation(bitmap) && qtype != dns.TypeDS {
+		return fmt.Errorf("%s 的否定证明来自父区域的委派点", name)
+	}
+	if qtype == dns.TypeDS && HasType(bitmap, dns.TypeSOA) && name != "." {
+		return fmt.Errorf("%s 的 DS 否定证明来自子区域", name)
+	}
+	return nil
+}
+
+// IsDelegation 报告类型位图是否属于委派点 (有 NS 而没有 SOA)。
+func IsDelegation(bitmap []uint16) bool {
+	return HasType(bitmap, dns.TypeNS) && !HasType(bitmap, dns.TypeSOA)
+}
+
+func canonicalLess(a, b string) bool {
+	return CanonicalCompare(a, b) < 0
+}
+
+// CanonicalCompare 按 RFC 4034 6.1 的规范顺序比较两个小写的完整域名：从最右侧的标签开始逐个比较。
+// a 在前时返回负数，相等时返回 0。
+func CanonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
@@ -0,0 +1,660 @@
+package dnssec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+const maxKeyCacheTTL = time.Hour
+
+// sweepInterval 是清理 keys 与 insecure 中过期条目的最小间隔。
+const sweepInterval = time.Minute
+
+type ExchangeFunc func(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+
+type Result int
+
+const (
+	Insecure Result = iota
+	Secure
+)
+
+type keyEntry struct {
+	keys    []*dns.DNSKEY
+	expires time.Time
+}
+
+// Validator 对上游响应执行 DNSSEC 验证：逐级获取 DNSKEY/DS 并校验签名，直至根区信任锚。
+type Validator struct {
+	exchange ExchangeFunc
+	anchors  []*dns.DS
+
+	mu        sync.Mutex
+	keys      map[string]keyEntry
+	insecure  map[string]time.Time
+	nextSweep time.Time
+}
+
+func NewValidator(exchange ExchangeFunc, anchors []*dns.DS) *Validator {
+	if len(anchors) == 0 {
+		anchors = DefaultRootAnchors()
+	}
+	return &Validator{
+		exchange: exchange,
+		anchors:  anchors,
+		keys:     make(map[string]keyEntry),
+		insecure: make(map[string]time.Time),
+	}
+}
+
+func SetDO(req *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(util.EDNSBufferSize(), true)
+		return
+	}
+	opt.SetDo()
+}
+
+func WantsDNSSEC(req *dns.Msg) bool {
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// StripRecords 删除客户端未请求的 DNSSEC 记录 (RRSIG/NSEC/NSEC3)。
+func StripRecords(resp *dns.Msg, qtype uint16) {
+	filter := func(rrs []dns.RR) []dns.RR {
+		out := rrs[:0]
+		for _, rr := range rrs {
+			switch rr.Header().Rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rr.Header().Rrtype != qtype {
+					continue
+				}
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	resp.Answer = filter(resp.Answer)
+	resp.Ns = filter(resp.Ns)
+	resp.Extra = filter(resp.Extra)
+}
+
+type rrsetKey struct {
+	name  string
+	rtype uint16
+}
+
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+func groupRRsets(rrs []dns.RR) (map[rrsetKey]*rrset, []rrsetKey) {
+	sets := make(map[rrsetKey]*rrset)
+	var order []rrsetKey
+	get := func(k rrsetKey) *rrset {
+		s, ok := sets[k]
+		if !ok {
+			s = &rrset{}
+			sets[k] = s
+			order = append(order, k)
+		}
+		return s
+	}
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := strings.ToLower(hdr.Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			s := get(rrsetKey{name, sig.TypeCovered})
+			s.sigs = append(s.sigs, sig)
+			continue
+		}
+		s := get(rrsetKey{name, hdr.Rrtype})
+		s.rrs = append(s.rrs, rr)
+	}
+	return sets, order
+}
+
+// Validate 验证响应。签名链完整、否定应答的 NSEC/NSEC3 证明成立时返回 Secure；若能证明所在区域未签名
+// (或否定证明落入 NSEC3 opt-out 区间) 则返回 Insecure；否则返回错误，即验证结果为 Bogus。
+func (v *Validator) Validate(ctx context.Context, req, resp *dns.Msg) (Result, error) {
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return Insecure, nil
+	}
+	qname := strings.ToLower(req.Question[0].Name)
+
+	answer, answerOrder := groupRRsets(resp.Answer)
+	authority, authorityOrder := groupRRsets(resp.Ns)
+
+	signed := false
+	for _, s := range answer {
+		if len(s.sigs) > 0 {
+			signed = true
+		}
+	}
+	for _, s := range authority {
+		if len(s.sigs) > 0 {
+			signed = true
+		}
+	}
+
+	if !signed {
+		insecure, err := v.provenInsecure(ctx, qname)
+		if err != nil {
+			return Insecure, err
+		}
+		if !insecure {
+			return Insecure, fmt.Errorf("%s 位于已签名区域，但响应缺少 RRSIG", qname)
+		}
+		return Insecure, nil
+	}
+
+	// 先验证带签名的 RRset，再处理没有签名的：DNAME 合成的 CNAME 只有在对应的 DNAME 已验证时才被接受
+	var dnames []*dns.DNAME
+	var expanded []expansion
+	for _, k := range answerOrder {
+		s := answer[k]
+		if len(s.rrs) == 0 || len(s.sigs) == 0 {
+			continue
+		}
+		sig, err := v.verifyRRset(ctx, k.name, s)
+		if err != nil {
+			return Insecure, err
+		}
+		if w, ok := wildcardExpansion(k.name, sig); ok {
+			expanded = append(expanded, w)
+		}
+		if k.rtype == dns.TypeDNAME {
+			for _, rr := range s.rrs {
+				dnames = append(dnames, rr.(*dns.DNAME))
+			}
+		}
+	}
+
+	// insecure 表示应答中有 RRset 因位于未签名区域而未经签名验证，整个应答至多为 Insecure
+	insecure := false
+	for _, k := range answerOrder {
+		s := answer[k]
+		if len(s.rrs) == 0 || len(s.sigs) > 0 {
+			continue
+		}
+		if k.rtype == dns.TypeCNAME && synthesizedCNAME(s.rrs, dnames) {
+			continue
+		}
+		ok, err := v.provenInsecure(ctx, k.name)
+		if err != nil {
+			return Insecure, err
+		}
+		if !ok {
+			return Insecure, fmt.Errorf("%s %s 缺少 RRSIG", k.name, dns.TypeToString[k.rtype])
+		}
+		insecure = true
+	}
+	result := func(r Result, err error) (Result, error) {
+		if err == nil && insecure {
+			r = Insecure
+		}
+		return r, err
+	}
+
+	// 通配符展开的 RRset 还须证明查询名称本身不存在 (RFC 4035 5.3.4)
+	var denials map[string]*denial
+	if len(expanded) > 0 {
+		var err error
+		if denials, err = v.collectDenials(ctx, authority, authorityOrder); err != nil {
+			return Insecure, err
+		}
+	}
+	for _, w := range expanded {
+		d := denials[w.signer]
+		if d == nil {
+			return Insecure, fmt.Errorf("通配符展开的 %s 缺少 NSEC/NSEC3 证明", w.name)
+		}
+		r, err := d.verifyWildcard(w.name, w.nextCloser)
+		if err != nil {
+			return Insecure, err
+		}
+		if r == Insecure {
+			insecure = true
+		}
+	}
+
+	sname, positive := answerTarget(qname, req.Question[0].Qtype, answer)
+	if positive {
+		return result(Secure, nil)
+	}
+
+	// 否定应答 (或 CNAME 链的目标不存在)：SOA、NSEC、NSEC3 必须带有效签名，且 NSEC/NSEC3 必须否定 sname
+	if denials == nil {
+		var err error
+		if denials, err = v.collectDenials(ctx, authority, authorityOrder); err != nil {
+			return Insecure, err
+		}
+	}
+	// CNAME 链可能跨越多个区域，使用包含 sname 的最深区域的证明
+	d := &denial{}
+	for _, dz := range denials {
+		if dns.IsSubDomain(dz.zone, sname) && (d.zone == "" || dns.CountLabel(dz.zone) > dns.CountLabel(d.zone)) {
+			d = dz
+		}
+	}
+	if d.zone == "" && sname != qname {
+		// CNAME 指向未签名区域时，目标的否定应答本身不带证明
+		insecure, err := v.provenInsecure(ctx, sname)
+		if err != nil {
+			return Insecure, err
+		}
+		if insecure {
+			return Insecure, nil
+		}
+	}
+	return result(d.verify(sname, req.Question[0].Qtype, resp.Rcode == dns.RcodeNameError))
+}
+
+// synthesizedCNAME 报告未签名的 CNAME 是否正是某条已验证的 DNAME 对其所有者名称改写的结果 (RFC 6672)。
+func synthesizedCNAME(rrs []dns.RR, dnames []*dns.DNAME) bool {
+	if len(rrs) != 1 {
+		return false
+	}
+	cname := rrs[0].(*dns.CNAME)
+	owner := strings.ToLower(cname.Hdr.Name)
+	for _, d := range dnames {
+		from := strings.ToLower(d.Hdr.Name)
+		if owner == from || !dns.IsSubDomain(from, owner) {
+			continue
+		}
+		prefix := owner[:len(owner)-len(from)]
+		if from == "." {
+			prefix = owner
+		}
+		want := prefix + dns.Fqdn(d.Target)
+		if d.Target == "." {
+			want = prefix
+		}
+		if strings.EqualFold(cname.Target, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectDenials 验证权威段中的 SOA、NSEC、NSEC3 签名，并按签名者区域收集 NSEC/NSEC3 记录。
+func (v *Validator) collectDenials(ctx context.Context, authority map[rrsetKey]*rrset, order []rrsetKey) (map[string]*denial, error) {
+	denials := make(map[string]*denial)
+	for _, k := range order {
+		s := authority[k]
+		switch k.rtype {
+		case dns.TypeSOA, dns.TypeNSEC, dns.TypeNSEC3:
+		default:
+			continue
+		}
+		if len(s.sigs) == 0 {
+			return nil, fmt.Errorf("否定响应中的 %s %s 缺少 RRSIG", k.name, dns.TypeToString[k.rtype])
+		}
+		sig, err := v.verifyRRset(ctx, k.name, s)
+		if err != nil {
+			return nil, err
+		}
+		if k.rtype == dns.TypeSOA {
+			continue
+		}
+		zone := strings.ToLower(sig.SignerName)
+		d := denials[zone]
+		if d == nil {
+			d = &denial{zone: zone}
+			denials[zone] = d
+		}
+		for _, rr := range s.rrs {
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				d.nsec = append(d.nsec, n)
+			case *dns.NSEC3:
+				d.nsec3 = append(d.nsec3, n)
+			}
+		}
+	}
+	return denials, nil
+}
+
+// expansion 是由通配符展开得到的应答 RRset：name 为其所有者，nextCloser 为通配符所在的最近祖先下一级的名称。
+type expansion struct {
+	name       string
+	nextCloser string
+	signer     string
+}
+
+// wildcardExpansion 根据 RRSIG 的 Labels 字段判断 RRset 是否由通配符展开 (RFC 4035 5.3.4)。
+func wildcardExpansion(name string, sig *dns.RRSIG) (expansion, bool) {
+	labels := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		labels--
+	}
+	if int(sig.Labels) >= labels {
+		return expansion{}, false
+	}
+	idx := dns.Split(name)
+	return expansion{
+		name:       name,
+		nextCloser: name[idx[len(idx)-int(sig.Labels)-1]:],
+		signer:     strings.ToLower(sig.SignerName),
+	}, true
+}
+
+// answerTarget 沿应答中的 CNAME 链从 qname 找到最终名称，并报告应答是否已包含该名称的 qtype 记录。
+func answerTarget(qname string, qtype uint16, answer map[rrsetKey]*rrset) (string, bool) {
+	name := qname
+	for range len(answer) + 1 {
+		if qtype == dns.TypeANY {
+			for k, s := range answer {
+				if k.name == name && len(s.rrs) > 0 {
+					return name, true
+				}
+			}
+		}
+		if s, ok := answer[rrsetKey{name, qtype}]; ok && len(s.rrs) > 0 {
+			return name, true
+		}
+		s, ok := answer[rrsetKey{name, dns.TypeCNAME}]
+		if !ok || len(s.rrs) == 0 {
+			break
+		}
+		name = strings.ToLower(s.rrs[0].(*dns.CNAME).Target)
+	}
+	return name, false
+}
+
+// verifyRRset 用签名者区域经验证的 DNSKEY 校验 RRset 的签名，返回验证通过的 RRSIG。
+func (v *Validator) verifyRRset(ctx context.Context, name string, s *rrset) (*dns.RRSIG, error) {
+	var lastErr error
+	for _, sig := range s.sigs {
+		signer := strings.ToLower(sig.SignerName)
+		if !dns.IsSubDomain(signer, name) {
+			lastErr = fmt.Errorf("%s 的签名者 %s 不是其上级区域", name, signer)
+			continue
+		}
+		if !sig.ValidityPeriod(time.Now()) {
+			lastErr = fmt.Errorf("%s 的 RRSIG 不在有效期内", name)
+			continue
+		}
+
+		keys, err := v.zoneKeys(ctx, signer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if err := verifyWithKeys(sig, keys, s.rrs); err != nil {
+			lastErr = fmt.Errorf("%s %s: %w", name, dns.TypeToString[sig.TypeCovered], err)
+			continue
+		}
+		return sig, nil
+	}
+	return nil, lastErr
+}
+
+func verifyWithKeys(sig *dns.RRSIG, keys []*dns.DNSKEY, rrs []dns.RR) error {
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if err := sig.Verify(key, rrs); err == nil {
+			return nil
+		}
+	}
+	return errors.New("签名验证失败")
+}
+
+// zoneKeys 返回经 DS 链验证过的区域 DNSKEY 集合。
+func (v *Validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	v.mu.Lock()
+	if e, ok := v.keys[zone]; ok && time.Now().Before(e.expires) {
+		v.mu.Unlock()
+		return e.keys, nil
+	}
+	v.mu.Unlock()
+
+	var dsSet []*dns.DS
+	if zone == "." {
+		dsSet = v.anchors
+	} else {
+		var err error
+		dsSet, err = v.fetchDS(ctx, zone)
+		if err != nil {
+			return nil, err
+		}
+		if len(dsSet) == 0 {
+			return nil, fmt.Errorf("区域 %s 没有 DS 记录，无法建立信任链", zone)
+		}
+	}
+
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("获取 %s DNSKEY 失败: %w", zone, err)
+	}
+
+	var keys []*dns.DNSKEY
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+	ttl := uint32(maxKeyCacheTTL / time.Second)
+	for _, rr := range resp.Answer {
+		if !strings.EqualFold(rr.Header().Name, zone) {
+			continue
+		}
+		switch k := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, k)
+			rrs = append(rrs, k)
+			if k.Hdr.Ttl < ttl {
+				ttl = k.Hdr.Ttl
+			}
+		case *dns.RRSIG:
+			if k.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, k)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("区域 %s 没有 DNSKEY 记录", zone)
+	}
+
+	var trusted []*dns.DNSKEY
+	for _, k := range keys {
+		if matchDS(k, dsSet) {
+			trusted = append(trusted, k)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("区域 %s 的 DNSKEY 与 DS 不匹配", zone)
+	}
+
+	verified := false
+	for _, sig := range sigs {
+		if sig.ValidityPeriod(time.Now()) && verifyWithKeys(sig, trusted, rrs) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("区域 %s 的 DNSKEY 签名验证失败", zone)
+	}
+
+	v.mu.Lock()
+	now := time.Now()
+	v.sweep(now)
+	v.keys[zone] = keyEntry{keys: keys, expires: now.Add(time.Duration(ttl) * time.Second)}
+	v.mu.Unlock()
+	return keys, nil
+}
+
+func (v *Validator) fetchDS(ctx context.Context, zone string) ([]*dns.DS, error) {
+	resp, err := v.query(ctx, zone, dns.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("获取 %s DS 失败: %w", zone, err)
+	}
+
+	sets, _ := groupRRsets(resp.Answer)
+	s, ok := sets[rrsetKey{strings.ToLower(zone), dns.TypeDS}]
+	if !ok || len(s.rrs) == 0 {
+		return nil, nil
+	}
+	if _, err := v.verifyRRset(ctx, strings.ToLower(zone), s); err != nil {
+		return nil, err
+	}
+
+	dsSet := make([]*dns.DS, 0, len(s.rrs))
+	for _, rr := range s.rrs {
+		dsSet = append(dsSet, rr.(*dns.DS))
+	}
+	return dsSet, nil
+}
+
+// sweep 删除 keys 与 insecure 中已过期的条目，每 sweepInterval 至多执行一次，
+// 避免两个映射随查询过的区域数量无限增长。调用方须持有 v.mu。
+func (v *Validator) sweep(now time.Time) {
+	if now.Before(v.nextSweep) {
+		return
+	}
+	v.nextSweep = now.Add(sweepInterval)
+	for zone, e := range v.keys {
+		if !now.Before(e.expires) {
+			delete(v.keys, zone)
+		}
+	}
+	for cut, expires := range v.insecure {
+		if !now.Before(expires) {
+			delete(v.insecure, cut)
+		}
+	}
+}
+
+// provenInsecure 自根区向下查询 DS，判断 name 是否位于未签名的委派之下。
+func (v *Validator) provenInsecure(ctx context.Context, name string) (bool, error) {
+	labels := dns.SplitDomainName(name)
+
+	v.mu.Lock()
+	for i := range labels {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		if expires, ok := v.insecure[cut]; ok && time.Now().Before(expires) {
+			v.mu.Unlock()
+			return true, nil
+		}
+	}
+	v.mu.Unlock()
+
+	for i := len(labels) - 1; i >= 0; i-- {
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+
+		resp, err := v.query(ctx, cut, dns.TypeDS)
+		if err != nil {
+			return false, fmt.Errorf("获取 %s DS 失败: %w", cut, err)
+		}
+
+		sets, _ := groupRRsets(resp.Answer)
+		if s, ok := sets[rrsetKey{cut, dns.TypeDS}]; ok && len(s.rrs) > 0 {
+			if _, err := v.verifyRRset(ctx, cut, s); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		if resp.Rcode == dns.RcodeNameError {
+			return false, nil
+		}
+
+		insecure, err := v.insecureDelegation(ctx, cut, resp)
+		if err != nil {
+			return false, err
+		}
+		if insecure {
+			v.mu.Lock()
+			now := time.Now()
+			v.sweep(now)
+			v.insecure[cut] = now.Add(maxKeyCacheTTL)
+			v.mu.Unlock()
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// insecureDelegation 检查 DS 查询的 NODATA 响应是否证明 cut 是未签名委派 (存在 NS、不存在 DS)。
+func (v *Validator) insecureDelegation(ctx context.Context, cut string, resp *dns.Msg) (bool, error) {
+	sets, order := groupRRsets(resp.Ns)
+	for _, k := range order {
+		s := sets[k]
+		if k.rtype != dns.TypeNSEC && k.rtype != dns.TypeNSEC3 {
+			continue
+		}
+
+		for _, rr := range s.rrs {
+			var bitmap []uint16
+			optOut := false
+			switch n := rr.(type) {
+			case *dns.NSEC:
+				if !strings.EqualFold(n.Hdr.Name, cut) {
+					continue
+				}
+				bitmap = n.TypeBitMap
+			case *dns.NSEC3:
+				if n.Match(cut) {
+					bitmap = n.TypeBitMap
+				} else if n.Cover(cut) && n.Flags&1 == 1 {
+					optOut = true
+				} else {
+					continue
+				}
+			}
+
+			if len(s.sigs) == 0 {
+				return false, fmt.Errorf("%s 的 DS 否定证明缺少 RRSIG", cut)
+			}
+			if _, err := v.verifyRRset(ctx, k.name, s); err != nil {
+				return false, err
+			}
+			if optOut {
+				return true, nil
+			}
+			return HasType(bitmap, dns.TypeNS) && !HasType(bitmap, dns.TypeDS) && !HasType(bitmap, dns.TypeSOA), nil
+		}
+	}
+	return false, nil
+}
+
+// HasType 报告 NSEC/NSEC3 类型位图中是否包含 t。
+func HasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *Validator) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = true
+	req.CheckingDisabled = true
+	req.SetEdns0(util.EDNSBufferSize(), true)
+
+	resp, err := v.exchange(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("上游返回 %s", dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
@@ -0,0 +1,358 @@
+package dnssec
+
+import (
+	"context"
+	"crypto"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone 是以自签名根区密钥作为信任锚的测试区域，所有记录都位于根区 "." 之下。
+type testZone struct {
+	t    *testing.T
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	ds   map[string][]dns.RR // DS 查询 NODATA 应答的权威段，用于证明未签名委派
+}
+
+func newTestZone(t *testing.T) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: ".", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{t: t, key: key, priv: priv.(crypto.Signer), ds: make(map[string][]dns.RR)}
+}
+
+func (z *testZone) sign(rrs ...dns.RR) []dns.RR {
+	z.t.Helper()
+	hdr := rrs[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: hdr.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: hdr.Ttl},
+		Algorithm:  z.key.Algorithm,
+		SignerName: ".",
+		KeyTag:     z.key.KeyTag(),
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		z.t.Fatal(err)
+	}
+	return append(slices.Clone(rrs), sig)
+}
+
+func (z *testZone) validator() *Validator {
+	exchange := func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		resp := new(dns.Msg)
+		resp.SetReply(req)
+		q := req.Question[0]
+		switch {
+		case q.Qtype == dns.TypeDNSKEY && q.Name == ".":
+			resp.Answer = z.sign(z.key)
+		case q.Qtype == dns.TypeDS:
+			resp.Ns = z.ds[q.Name]
+		}
+		return resp, nil
+	}
+	return NewValidator(exchange, []*dns.DS{z.key.ToDS(dns.SHA256)})
+}
+
+func (z *testZone) soa() []dns.RR {
+	return z.sign(&dns.SOA{
+		Hdr:     dns.RR_Header{Name: ".", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+		Ns:      "ns.",
+		Mbox:    "admin.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  300,
+	})
+}
+
+func (z *testZone) nsec(owner, next string, types ...uint16) []dns.RR {
+	bitmap := append(types, dns.TypeRRSIG, dns.TypeNSEC)
+	slices.Sort(bitmap)
+	return z.sign(&dns.NSEC{
+		Hdr:        dns.RR_Header{Name: owner, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+		NextDomain: next,
+		TypeBitMap: bitmap,
+	})
+}
+
+// nsec3Chain 为 names 生成一条完整的 NSEC3 链 (迭代 0、无盐)，types 给出各名称的类型位图。
+func (z *testZone) nsec3Chain(names []string, types map[string][]uint16, optOut bool) []dns.RR {
+	type hashed struct{ name, hash string }
+	var hs []hashed
+	for _, n := range names {
+		hs = append(hs, hashed{n, dns.HashName(n, dns.SHA1, 0, "")})
+	}
+	slices.SortFunc(hs, func(a, b hashed) int { return strings.Compare(a.hash, b.hash) })
+
+	var out []dns.RR
+	for i, h := range hs {
+		var flags uint8
+		if optOut {
+			flags = 1
+		}
+		out = append(out, z.sign(&dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(h.hash) + ".", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			SaltLength: 0,
+			HashLength: 20,
+			NextDomain: hs[(i+1)%len(hs)].hash,
+			TypeBitMap: slices.Sorted(slices.Values(types[h.name])),
+		})...)
+	}
+	return out
+}
+
+func negative(name string, qtype uint16, rcode int, ns ...[]dns.RR) (*dns.Msg, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	resp := new(dns.Msg)
+	resp.SetRcode(req, rcode)
+	for _, rrs := range ns {
+		resp.Ns = append(resp.Ns, rrs...)
+	}
+	return req, resp
+}
+
+func TestValidateNSECDenial(t *testing.T) {
+	z := newTestZone(t)
+	v := z.validator()
+
+	apex := z.nsec(".", "a.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY)
+	a := z.nsec("a.", "c.", dns.TypeA)
+	deleg := z.nsec("a.", "c.", dns.TypeNS)
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		proofs [][]dns.RR
+		secure bool
+	}{
+		{name: "nxdomain with wildcard proof", qname: "b.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: [][]dns.RR{a, apex}, secure: true},
+		{name: "nxdomain missing wildcard proof", qname: "b.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: [][]dns.RR{a}},
+		{name: "nxdomain nsec does not cover qname", qname: "b.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: [][]dns.RR{apex}},
+		{name: "nodata type absent", qname: "a.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, proofs: [][]dns.RR{a}, secure: true},
+		{name: "nodata type present in bitmap", qname: "a.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, proofs: [][]dns.RR{a}},
+		{name: "nodata for other name", qname: "c.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, proofs: [][]dns.RR{a}},
+		{name: "nxdomain below delegation", qname: "x.a.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: [][]dns.RR{deleg, apex}},
+		{name: "nodata from parent side of delegation", qname: "a.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, proofs: [][]dns.RR{deleg}},
+		{name: "ds nodata at delegation", qname: "a.", qtype: dns.TypeDS, rcode: dns.RcodeSuccess, proofs: [][]dns.RR{deleg}, secure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := negative(tt.qname, tt.qtype, tt.rcode, append([][]dns.RR{z.soa()}, tt.proofs...)...)
+			result, err := v.Validate(context.Background(), req, resp)
+			if tt.secure {
+				if err != nil || result != Secure {
+					t.Fatalf("got (%v, %v), want Secure", result, err)
+				}
+			} else if err == nil {
+				t.Fatalf("got %v, want bogus", result)
+			}
+		})
+	}
+}
+
+func TestValidateNSEC3Denial(t *testing.T) {
+	z := newTestZone(t)
+	v := z.validator()
+
+	types := map[string][]uint16{
+		".":  {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG},
+		"a.": {dns.TypeA, dns.TypeRRSIG},
+		"c.": {dns.TypeA, dns.TypeRRSIG},
+	}
+	chain := z.nsec3Chain([]string{".", "a.", "c."}, types, false)
+	optOut := z.nsec3Chain([]string{".", "a.", "c."}, types, true)
+	deleg := z.nsec3Chain([]string{".", "a.", "c."}, map[string][]uint16{
+		".":  types["."],
+		"a.": {dns.TypeNS},
+		"c.": types["c."],
+	}, false)
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		rcode  int
+		proofs []dns.RR
+		want   Result
+		bogus  bool
+	}{
+		{name: "nxdomain closest encloser proof", qname: "b.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: chain, want: Secure},
+		{name: "nxdomain opt-out", qname: "b.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: optOut, want: Insecure},
+		{name: "nxdomain for existing name", qname: "a.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: chain, bogus: true},
+		{name: "nodata type absent", qname: "a.", qtype: dns.TypeAAAA, rcode: dns.RcodeSuccess, proofs: chain, want: Secure},
+		{name: "nodata type present in bitmap", qname: "a.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, proofs: chain, bogus: true},
+		{name: "nodata without matching nsec3", qname: "b.", qtype: dns.TypeA, rcode: dns.RcodeSuccess, proofs: chain, bogus: true},
+		{name: "closest encloser is a delegation", qname: "x.a.", qtype: dns.TypeA, rcode: dns.RcodeNameError, proofs: deleg, bogus: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := negative(tt.qname, tt.qtype, tt.rcode, z.soa(), tt.proofs)
+			result, err := v.Validate(context.Background(), req, resp)
+			if tt.bogus {
+				if err == nil {
+					t.Fatalf("got %v, want bogus", result)
+				}
+				return
+			}
+			if err != nil || result != tt.want {
+				t.Fatalf("got (%v, %v), want %v", result, err, tt.want)
+			}
+		})
+	}
+}
+
+func positive(name string, qtype uint16, answer ...[]dns.RR) (*dns.Msg, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	for _, rrs := range answer {
+		resp.Answer = append(resp.Answer, rrs...)
+	}
+	return req, resp
+}
+
+func TestValidateUnsignedAnswer(t *testing.T) {
+	z := newTestZone(t)
+	v := z.validator()
+	// u. 是未签名委派
+	z.ds["u."] = z.nsec("u.", "v.", dns.TypeNS)
+
+	cname := func(owner, target string) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: target}
+	}
+	a := func(owner string) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: []byte{192, 0, 2, 1}}
+	}
+	dname := z.sign(&dns.DNAME{Hdr: dns.RR_Header{Name: "d.", Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: 300}, Target: "e."})
+
+	tests := []struct {
+		name   string
+		qname  string
+		answer [][]dns.RR
+		want   Result
+		bogus  bool
+	}{
+		{name: "signed answer", qname: "a.", answer: [][]dns.RR{z.sign(a("a."))}, want: Secure},
+		{name: "signed cname into unsigned zone", qname: "a.", answer: [][]dns.RR{z.sign(cname("a.", "x.u.")), {a("x.u.")}}, want: Insecure},
+		{name: "unsigned record in signed zone", qname: "a.", answer: [][]dns.RR{z.sign(cname("a.", "b.")), {a("b.")}}, bogus: true},
+		{name: "cname synthesized from dname", qname: "x.d.", answer: [][]dns.RR{dname, {cname("x.d.", "x.e.")}, z.sign(a("x.e."))}, want: Secure},
+		{name: "unsigned cname not matching dname", qname: "x.d.", answer: [][]dns.RR{dname, {cname("x.d.", "evil.")}, z.sign(a("evil."))}, bogus: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := positive(tt.qname, dns.TypeA, tt.answer...)
+			result, err := v.Validate(context.Background(), req, resp)
+			if tt.bogus {
+				if err == nil {
+					t.Fatalf("got %v, want bogus", result)
+				}
+				return
+			}
+			if err != nil || result != tt.want {
+				t.Fatalf("got (%v, %v), want %v", result, err, tt.want)
+			}
+		})
+	}
+}
+
+// expand 以 *.w. 为所有者签名 rr，再把记录与签名改写为 owner，模拟权威服务器的通配符展开。
+func (z *testZone) expand(owner string, rr dns.RR) []dns.RR {
+	rr.Header().Name = "*.w."
+	rrs := z.sign(rr)
+	for _, rr := range rrs {
+		rr.Header().Name = owner
+	}
+	return rrs
+}
+
+func TestValidateWildcardAnswer(t *testing.T) {
+	z := newTestZone(t)
+	v := z.validator()
+
+	a := &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: []byte{192, 0, 2, 1}}
+	types := map[string][]uint16{
+		".":    {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM, dns.TypeRRSIG},
+		"w.":   {dns.TypeA, dns.TypeRRSIG},
+		"*.w.": {dns.TypeA, dns.TypeRRSIG},
+	}
+
+	tests := []struct {
+		name  string
+		ns    []dns.RR
+		want  Result
+		bogus bool
+	}{
+		{name: "nsec proves no closer match", ns: z.nsec("*.w.", "z.", dns.TypeA), want: Secure},
+		{name: "nsec3 covers next closer", ns: z.nsec3Chain([]string{".", "w.", "*.w."}, types, false), want: Secure},
+		{name: "nsec3 opt-out", ns: z.nsec3Chain([]string{".", "w.", "*.w."}, types, true), want: Insecure},
+		{name: "missing proof", bogus: true},
+		{name: "nsec does not cover qname", ns: z.nsec("w.", "*.w.", dns.TypeA), bogus: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := positive("x.w.", dns.TypeA, z.expand("x.w.", dns.Copy(a)))
+			resp.Ns = tt.ns
+			result, err := v.Validate(context.Background(), req, resp)
+			if tt.bogus {
+				if err == nil {
+					t.Fatalf("got %v, want bogus", result)
+				}
+				return
+			}
+			if err != nil || result != tt.want {
+				t.Fatalf("got (%v, %v), want %v", result, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatorSweepsExpiredZones(t *testing.T) {
+	z := newTestZone(t)
+	v := z.validator()
+	now := time.Now()
+	v.keys["old."] = keyEntry{expires: now.Add(-time.Second)}
+	v.insecure["old."] = now.Add(-time.Second)
+	v.insecure["fresh."] = now.Add(time.Hour)
+
+	// 验证根区 DNSKEY 时写入缓存，顺带清理过期条目
+	if _, err := v.zoneKeys(context.Background(), "."); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v.keys["old."]; ok {
+		t.Error("expired key entry kept")
+	}
+	if _, ok := v.insecure["old."]; ok {
+		t.Error("expired insecure entry kept")
+	}
+	if _, ok := v.insecure["fresh."]; !ok {
+		t.Error("unexpired insecure entry removed")
+	}
+	if _, ok := v.keys["."]; !ok {
+		t.Error("root keys not cached")
+	}
+}
@@ -0,0 +1,73 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"doh-autoproxy/internal/router"
+	"doh-autoproxy/internal/util"
+)
+
+// RefreshBlocklists 把 blocklist_urls 中的列表下载到本地缓存，有更新时重新合并并热替换到路由器。
+// force 为 false 时只下载缓存不存在或超过 blocklist_refresh 的列表。
+// 下载失败 (或内容中解析不到域名) 时保留原缓存，已有的屏蔽列表不会因此被清空。
+// 返回成功更新的列表数与所有下载错误。同一时间只有一次刷新在进行，其余调用等待其完成。
+func (m *ServiceManager) RefreshBlocklists(force bool) (int, error) {
+	m.blocklistMu.Lock()
+	defer m.blocklistMu.Unlock()
+
+	m.mu.Lock()
+	cfg := m.Config
+	m.mu.Unlock()
+
+	if len(cfg.BlocklistURLs) == 0 {
+		return 0, nil
+	}
+	if err := os.MkdirAll(cfg.BlocklistCacheDir, 0755); err != nil {
+		return 0, fmt.Errorf("无法创建屏蔽列表缓存目录: %w", err)
+	}
+
+	refresh := time.Duration(cfg.BlocklistRefresh) * time.Hour
+	if refresh <= 0 {
+		refresh = 24 * time.Hour
+	}
+
+	updated := 0
+	var errs []error
+	for _, url := range cfg.BlocklistURLs {
+		path := router.BlocklistCachePath(cfg.BlocklistCacheDir, url)
+		if !force {
+			if fi, err := os.Stat(path); err == nil && time.Since(fi.ModTime()) < refresh {
+				continue
+			}
+		}
+		log.Printf("正在更新屏蔽列表: %s", url)
+		if err := util.DownloadFile(path, url, router.VerifyBlocklist); err != nil {
+			log.Printf("更新屏蔽列表 %s 失败，继续使用本地缓存: %v", url, err)
+			m.notify("blocklist_update_failed", fmt.Sprintf("%s: %v", url, err))
+			errs = append(errs, fmt.Errorf("%s: %w", url, err))
+			continue
+		}
+		updated++
+	}
+
+	if updated > 0 {
+		m.mu.Lock()
+		prev := m.blocklist
+		m.mu.Unlock()
+		blocklist := router.LoadBlocklist(cfg.BlocklistURLs, cfg.BlocklistCacheDir, prev)
+		m.mu.Lock()
+		// 下载期间配置可能已重载，订阅列表变化时新路由器会自行从缓存加载
+		if m.Router != nil && slices.Equal(m.Config.BlocklistURLs, cfg.BlocklistURLs) &&
+			m.Config.BlocklistCacheDir == cfg.BlocklistCacheDir {
+			m.blocklist = blocklist
+			m.Router.SetBlocklist(blocklist)
+		}
+		m.mu.Unlock()
+	}
+	return updated, errors.Join(errs...)
+}
@@ -0,0 +1,101 @@
+package manager
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/server"
+)
+
+// listenerChanges 标记重载时需要重建的监听器，未标记的监听器保持运行，只替换路由器。
+type listenerChanges struct {
+	dns  bool
+	dot  bool
+	doq  bool
+	doh  bool
+	acme bool
+}
+
+var allListeners = listenerChanges{dns: true, dot: true, doq: true, doh: true, acme: true}
+
+func (c listenerChanges) any() bool {
+	return c.dns || c.dot || c.doq || c.doh || c.acme
+}
+
+// diffListeners 逐项比较新旧配置中影响各监听器的字段。
+// 证书配置 (auto_cert / tls_certificates) 变化时所有加密监听器与 ACME 服务都需要重建。
+func diffListeners(old, cur *config.Config) listenerChanges {
+	tls := !reflect.DeepEqual(old.AutoCert, cur.AutoCert) ||
+		!reflect.DeepEqual(old.TLSCertificates, cur.TLSCertificates)
+	ol, nl := old.Listen, cur.Listen
+
+	return listenerChanges{
+		dns: ol.DNSUDP != nl.DNSUDP || ol.DNSTCP != nl.DNSTCP || old.Timeouts.DNS != cur.Timeouts.DNS ||
+			ol.Interface != nl.Interface || ol.ReusePort != nl.ReusePort || ol.UDPListeners != nl.UDPListeners,
+		dot: tls || ol.DOT != nl.DOT || old.Timeouts.DoT != cur.Timeouts.DoT,
+		doq: tls || ol.DOQ != nl.DOQ || old.DoQLimits != cur.DoQLimits || old.Timeouts.DoQ != cur.Timeouts.DoQ,
+		doh: tls || ol.DOH != nl.DOH || ol.DoHPath != nl.DoHPath || ol.DoHPlaintext != nl.DoHPlaintext ||
+			ol.DoHHTTP3Enabled() != nl.DoHHTTP3Enabled() || old.Timeouts.DoH != cur.Timeouts.DoH ||
+			!slices.Equal(ol.DoHTrustedProxies, nl.DoHTrustedProxies),
+		acme: tls,
+	}
+}
+
+// certFilesStamp 返回加密监听器所用证书与密钥文件的修改时间和大小。证书在原路径续期 (certbot 等) 时
+// 配置不变，重载时据此发现文件已更新并重建加密监听器。auto_cert 由 CertManager 自行续期，返回空。
+func certFilesStamp(cfg *config.Config) string {
+	if cfg.AutoCert.Enabled {
+		return ""
+	}
+	var files []string
+	for _, c := range cfg.TLSCertificates {
+		files = append(files, c.CertFile, c.KeyFile)
+	}
+	if len(files) == 0 {
+		files = []string{"server.crt", "server.key"}
+	}
+
+	var b strings.Builder
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&b, "%s|%d|%d;", f, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(&b, "%s|-;", f)
+		}
+	}
+	return b.String()
+}
+
+// Listeners 返回各已配置监听器的状态，键为 dns_udp、dns_tcp、dot、doq、doh、doh3。
+// 监听失败只停用该监听器，其余协议照常服务；证书加载失败导致未能创建的监听器同样标记为未监听。
+func (m *ServiceManager) Listeners() map[string]server.ListenerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make(map[string]server.ListenerStatus)
+	notCreated := server.ListenerStatus{Error: "未能创建监听器 (证书加载失败?)"}
+	if m.DNSServer != nil {
+		maps.Copy(status, m.DNSServer.Listeners())
+	}
+	if m.Config.Listen.DOT != "" {
+		status["dot"] = notCreated
+		if m.DoTServer != nil {
+			maps.Copy(status, m.DoTServer.Listeners())
+		}
+	}
+	if m.Config.Listen.DOQ != "" && m.DoQServer != nil {
+		maps.Copy(status, m.DoQServer.Listeners())
+	}
+	if m.Config.Listen.DOH != "" {
+		status["doh"] = notCreated
+		if m.DoHServer != nil {
+			maps.Copy(status, m.DoHServer.Listeners())
+		}
+	}
+	return status
+}
@@ -3,11 +3,14 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 	_ "time/tzdata"
 
@@ -15,6 +18,7 @@ import (
 	"doh-autoproxy/internal/querylog"
 	"doh-autoproxy/internal/router"
 	"doh-autoproxy/internal/server"
+	"doh-autoproxy/internal/tracing"
 	"doh-autoproxy/internal/util"
 )
 
@@ -34,12 +38,35 @@ type ServiceManager struct {
 	ACMEServer *http.Server
 
 	stopAutoUpdate chan struct{}
+	stopTasks      context.CancelFunc // 停止随路由器运行的后台任务 (金丝雀检测、Bootstrap 探测)
+	stopTracing    func(context.Context) error
+	reloading      atomic.Bool
+	geoErr         error
+
+	reloadMu   sync.Mutex
+	reloadInfo ReloadInfo
+
+	certStamp string // 加密监听器创建时证书文件的状态，见 certFilesStamp
+	logStore  string // 当前 QueryLog 的持久化设置，未变化时重载沿用原记录器，不再重放日志
+
+	blocklistMu sync.Mutex        // 串行化 RefreshBlocklists
+	blocklist   *router.Blocklist // 最近一次加载的屏蔽列表，重载时复用缓存未变化的列表
+}
+
+// ReloadInfo 记录配置重载的结果，供 WebUI 确认保存后的配置是否已生效。
+type ReloadInfo struct {
+	Count     int64      `json:"count"`
+	LastTime  *time.Time `json:"last_time,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
 }
 
 func NewServiceManager(initialCfg *config.Config) *ServiceManager {
+	util.SetUserAgent(initialCfg.HTTPUserAgent)
+	util.SetDownloadPolicy(initialCfg.Download.Retries, time.Duration(initialCfg.Download.Timeout)*time.Second)
+	util.SetEDNSBufferSize(initialCfg.EDNSBufferSize)
 	return &ServiceManager{
 		Config:         initialCfg,
-		QueryLog:       querylog.NewQueryLogger(initialCfg.QueryLog.MaxSizeMB, initialCfg.QueryLog.File, initialCfg.QueryLog.SaveToFile),
+		QueryLog:       querylog.NewQueryLogger(initialCfg.QueryLog.MaxSizeMB, "", false, ""),
 		stopAutoUpdate: make(chan struct{}),
 	}
 }
@@ -47,7 +74,7 @@ func NewServiceManager(initialCfg *config.Config) *ServiceManager {
 func (m *ServiceManager) Start() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if err := m.startInternal(); err != nil {
+	if err := m.startInternal(allListeners); err != nil {
 		return err
 	}
 	go m.runAutoUpdate()
@@ -63,51 +90,141 @@ func (m *ServiceManager) Stop() error {
 	default:
 	}
 
-	return m.stopInternal()
+	err := m.stopInternal(allListeners)
+	if m.QueryLog != nil {
+		m.QueryLog.Close()
+	}
+	m.shutdownTracing()
+	return err
+}
+
+// shutdownTracing 发送剩余的 span 并关闭当前的 TracerProvider。
+func (m *ServiceManager) shutdownTracing() {
+	if m.stopTracing == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.stopTracing(ctx); err != nil {
+		log.Printf("关闭 OpenTelemetry 追踪失败: %v", err)
+	}
+	m.stopTracing = nil
 }
 
 func (m *ServiceManager) Reload(newCfg *config.Config) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	m.reloading.Store(true)
+	defer m.reloading.Store(false)
+
 	log.Println("正在重新加载服务配置...")
 
 	geoChanged := m.Config.GeoData.GeoIPDat != newCfg.GeoData.GeoIPDat ||
 		m.Config.GeoData.GeoSiteDat != newCfg.GeoData.GeoSiteDat
 
 	if geoChanged {
-		log.Println("GeoData 配置已更改，将在重新启动期间重新加载 Geo 数据库。")
-		m.GeoManager = nil
-		debug.FreeOSMemory()
+		// 先加载新数据再替换：加载期间以及加载失败时，现有路由器继续使用原有数据分流，
+		// 不会出现没有 Geo 数据的窗口期
+		log.Println("GeoData 配置已更改，正在加载新的 Geo 数据库...")
+		geoManager, err := router.NewGeoDataManager(newCfg.GeoData.GeoIPDat, newCfg.GeoData.GeoSiteDat)
+		switch {
+		case err == nil:
+			m.GeoManager = geoManager
+			m.geoErr = nil
+			debug.FreeOSMemory()
+		case !m.GeoManager.Empty():
+			log.Printf("加载新的 Geo 数据失败，继续使用原有数据: %v", err)
+			m.notify("geo_update_failed", err.Error())
+		default:
+			// 原本就没有可用数据，交由 startInternal 按 geo_data.required 处理
+			m.GeoManager = nil
+		}
 	} else {
 		log.Println("GeoData 配置未更改，保留现有的 Geo 数据库以加快重新加载。")
 	}
 
 	if m.Config.QueryLog.SaveToFile && !newCfg.QueryLog.SaveToFile {
-		logFile := m.Config.QueryLog.File
-		if logFile == "" {
-			logFile = "query.log"
-		}
+		logFile := m.Config.QueryLog.LogFile()
+		m.QueryLog.Close()
 		log.Printf("持久化存储已关闭，正在删除日志文件: %s", logFile)
-		if err := os.Remove(logFile); err != nil && !os.IsNotExist(err) {
-			log.Printf("删除日志文件失败: %v", err)
+		for _, f := range []string{logFile, logFile + "-wal", logFile + "-shm"} {
+			if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+				log.Printf("删除日志文件失败: %v", err)
+			}
 		}
 	}
 
-	if err := m.stopInternal(); err != nil {
+	blocklistChanged := !slices.Equal(m.Config.BlocklistURLs, newCfg.BlocklistURLs)
+
+	changes := diffListeners(m.Config, newCfg)
+	if !changes.dot || !changes.doq || !changes.doh {
+		if certFilesStamp(newCfg) != m.certStamp {
+			log.Println("证书文件已更新，重建加密监听器")
+			changes.dot, changes.doq, changes.doh = true, true, true
+		}
+	}
+	if !changes.any() {
+		log.Println("监听配置未更改，保持现有监听器运行")
+	}
+
+	if err := m.stopInternal(changes); err != nil {
 		log.Printf("Warning: Error stopping services during reload: %v", err)
 	}
 
 	m.Config = newCfg
 
-	if err := m.startInternal(); err != nil {
+	if err := m.startInternal(changes); err != nil {
+		m.recordReload(err)
+		m.notify("reload_failed", err.Error())
 		return fmt.Errorf("failed to restart services: %w", err)
 	}
 
+	if blocklistChanged {
+		// 新增的订阅尚无本地缓存，不等下一次定时检查，立即在后台下载
+		go m.RefreshBlocklists(false)
+	}
+
 	log.Println("服务配置重载完成")
+	m.recordReload(nil)
+	m.notify("reload_success", "")
 	return nil
 }
 
+func (m *ServiceManager) recordReload(err error) {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	now := time.Now()
+	m.reloadInfo.LastTime = &now
+	if err != nil {
+		m.reloadInfo.LastError = err.Error()
+		return
+	}
+	m.reloadInfo.Count++
+	m.reloadInfo.LastError = ""
+}
+
+// ReloadStatus 返回成功重载次数、最近一次重载时间及其错误 (成功时为空)。
+func (m *ServiceManager) ReloadStatus() ReloadInfo {
+	m.reloadMu.Lock()
+	defer m.reloadMu.Unlock()
+	return m.reloadInfo
+}
+
+func (m *ServiceManager) notify(event, detail string) {
+	util.Notify(m.Config.Notifications.WebhookURL, event, detail)
+}
+
+func (m *ServiceManager) downloadGeoFile(kind, path, url string, verify util.Validator) error {
+	err := util.DownloadFile(path, url, verify)
+	if err != nil {
+		m.notify("geo_update_failed", fmt.Sprintf("%s: %v", kind, err))
+	} else {
+		m.notify("geo_update_success", kind)
+	}
+	return err
+}
+
 func (m *ServiceManager) CheckAndDownloadGeoFiles() {
 	shouldDownload := func(path string) bool {
 		fi, err := os.Stat(path)
@@ -122,7 +239,7 @@ func (m *ServiceManager) CheckAndDownloadGeoFiles() {
 	if shouldDownload(cfg.GeoData.GeoIPDat) {
 		if cfg.GeoData.GeoIPDownloadURL != "" {
 			log.Printf("GeoIP 文件 %s 不存在或为空，正在从 %s 下载...", cfg.GeoData.GeoIPDat, cfg.GeoData.GeoIPDownloadURL)
-			if err := util.DownloadFile(cfg.GeoData.GeoIPDat, cfg.GeoData.GeoIPDownloadURL, router.VerifyGeoIP); err != nil {
+			if err := m.downloadGeoFile("GeoIP", cfg.GeoData.GeoIPDat, cfg.GeoData.GeoIPDownloadURL, router.VerifyGeoIP); err != nil {
 				log.Printf("错误: 下载 GeoIP 文件失败: %v", err)
 			} else {
 				log.Println("GeoIP 文件下载成功")
@@ -133,7 +250,7 @@ func (m *ServiceManager) CheckAndDownloadGeoFiles() {
 	if shouldDownload(cfg.GeoData.GeoSiteDat) {
 		if cfg.GeoData.GeoSiteDownloadURL != "" {
 			log.Printf("GeoSite 文件 %s 不存在或为空，正在从 %s 下载...", cfg.GeoData.GeoSiteDat, cfg.GeoData.GeoSiteDownloadURL)
-			if err := util.DownloadFile(cfg.GeoData.GeoSiteDat, cfg.GeoData.GeoSiteDownloadURL, router.VerifyGeoSite); err != nil {
+			if err := m.downloadGeoFile("GeoSite", cfg.GeoData.GeoSiteDat, cfg.GeoData.GeoSiteDownloadURL, router.VerifyGeoSite); err != nil {
 				log.Printf("错误: 下载 GeoSite 文件失败: %v", err)
 			} else {
 				log.Println("GeoSite 文件下载成功")
@@ -146,13 +263,13 @@ func (m *ServiceManager) ForceDownloadGeoFiles() {
 	cfg := m.Config
 	if cfg.GeoData.GeoIPDownloadURL != "" {
 		log.Printf("正在自动更新 GeoIP 数据...")
-		if err := util.DownloadFile(cfg.GeoData.GeoIPDat, cfg.GeoData.GeoIPDownloadURL, router.VerifyGeoIP); err != nil {
+		if err := m.downloadGeoFile("GeoIP", cfg.GeoData.GeoIPDat, cfg.GeoData.GeoIPDownloadURL, router.VerifyGeoIP); err != nil {
 			log.Printf("更新 GeoIP 失败: %v", err)
 		}
 	}
 	if cfg.GeoData.GeoSiteDownloadURL != "" {
 		log.Printf("正在自动更新 GeoSite 数据...")
-		if err := util.DownloadFile(cfg.GeoData.GeoSiteDat, cfg.GeoData.GeoSiteDownloadURL, router.VerifyGeoSite); err != nil {
+		if err := m.downloadGeoFile("GeoSite", cfg.GeoData.GeoSiteDat, cfg.GeoData.GeoSiteDownloadURL, router.VerifyGeoSite); err != nil {
 			log.Printf("更新 GeoSite 失败: %v", err)
 		}
 	}
@@ -164,11 +281,20 @@ func (m *ServiceManager) runAutoUpdate() {
 
 	lastAttempt := time.Time{}
 
+	m.RefreshBlocklists(false)
+	lastBlocklistCheck := time.Now()
+
 	for {
 		select {
 		case <-m.stopAutoUpdate:
 			return
 		case <-ticker.C:
+			// 屏蔽列表按 blocklist_refresh 独立刷新，每小时检查一次，下载失败时也据此限制重试频率
+			if time.Since(lastBlocklistCheck) >= time.Hour {
+				lastBlocklistCheck = time.Now()
+				m.RefreshBlocklists(false)
+			}
+
 			m.mu.Lock()
 			autoUpdate := m.Config.GeoData.AutoUpdate
 			geoIPFile := m.Config.GeoData.GeoIPDat
@@ -216,47 +342,125 @@ func (m *ServiceManager) runAutoUpdate() {
 
 				m.ForceDownloadGeoFiles()
 
-				m.mu.Lock()
-				m.GeoManager = nil
-				debug.FreeOSMemory()
-				m.mu.Unlock()
-
-				if err := m.Reload(m.Config); err != nil {
-					log.Printf("Geo 更新后重载失败: %v", err)
+				if err := m.swapGeoData(); err != nil {
+					log.Printf("Geo 更新后加载新数据失败，继续使用旧数据: %v", err)
 				}
 			}
 		}
 	}
 }
 
-func (m *ServiceManager) startInternal() error {
+// swapGeoData 从磁盘加载 Geo 数据并原子替换到当前路由器中，不重建路由器与监听器。
+// 加载期间旧数据仍在服务查询，加载失败时保持不变。
+func (m *ServiceManager) swapGeoData() error {
+	m.mu.Lock()
 	cfg := m.Config
+	m.mu.Unlock()
 
-	if m.GeoManager == nil {
+	geoManager, err := router.NewGeoDataManager(cfg.GeoData.GeoIPDat, cfg.GeoData.GeoSiteDat)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.GeoManager = geoManager
+	m.geoErr = nil
+	if m.Router != nil {
+		m.Router.SetGeo(geoManager)
+	}
+	m.mu.Unlock()
+
+	debug.FreeOSMemory()
+	log.Println("Geo 数据已热更新")
+	return nil
+}
+
+// startInternal 重建路由器等核心组件，并启动 changes 中标记的监听器；
+// 未标记且仍在运行的监听器切换到新的路由器。
+func (m *ServiceManager) startInternal(changes listenerChanges) error {
+	cfg := m.Config
+	util.SetUserAgent(cfg.HTTPUserAgent)
+	util.SetDownloadPolicy(cfg.Download.Retries, time.Duration(cfg.Download.Timeout)*time.Second)
+	util.SetEDNSBufferSize(cfg.EDNSBufferSize)
+
+	if m.GeoManager == nil || m.GeoManager.Empty() {
 		geoManager, err := router.NewGeoDataManager(cfg.GeoData.GeoIPDat, cfg.GeoData.GeoSiteDat)
 		if err != nil {
-			return fmt.Errorf("GeoManager init failed: %w", err)
+			if cfg.GeoData.IsRequired() {
+				m.geoErr = err
+				return fmt.Errorf("GeoManager init failed: %w", err)
+			}
+			log.Printf("警告: Geo 数据加载失败，将在没有 Geo 数据的情况下运行 (GeoIP/GeoSite 均视为未命中，默认走 default_group 分组): %v", err)
+			geoManager = &router.GeoDataManager{}
 		}
 		m.GeoManager = geoManager
+		m.geoErr = nil
 	}
 
-	logFile := cfg.QueryLog.File
-	if cfg.QueryLog.SaveToFile && logFile == "" {
-		logFile = "query.log"
+	logStore := fmt.Sprintf("%t|%s|%s|%d", cfg.QueryLog.SaveToFile, cfg.QueryLog.Backend, cfg.QueryLog.LogFile(), cfg.QueryLog.MaxSizeMB)
+	if m.QueryLog == nil || logStore != m.logStore {
+		if m.QueryLog != nil {
+			m.QueryLog.Close()
+		}
+		m.QueryLog = querylog.NewQueryLogger(cfg.QueryLog.MaxSizeMB, cfg.QueryLog.LogFile(), cfg.QueryLog.SaveToFile, cfg.QueryLog.Backend)
+		m.logStore = logStore
+	}
+	m.QueryLog.SetAnonymizeIP(cfg.QueryLog.AnonymizeIP)
+	m.QueryLog.SetRemote(cfg.QueryLog.Remote)
+	log.SetOutput(os.Stderr)
+	if err := m.QueryLog.SetSyslog(cfg.QueryLog.Syslog); err != nil {
+		log.Printf("syslog 配置无效，查询日志将不会发送到 syslog: %v", err)
+	} else if w := m.QueryLog.SyslogWriter(); w != nil && cfg.QueryLog.Syslog.ServiceLog {
+		log.SetOutput(io.MultiWriter(os.Stderr, w))
 	}
-	m.QueryLog = querylog.NewQueryLogger(cfg.QueryLog.MaxSizeMB, logFile, cfg.QueryLog.SaveToFile)
+	watchURL := cfg.Watch.WebhookURL
+	if watchURL == "" {
+		watchURL = cfg.Notifications.WebhookURL
+	}
+	m.QueryLog.SetWatch(cfg.Watch.Domains, watchURL, time.Duration(cfg.Watch.Cooldown)*time.Second)
+
+	m.shutdownTracing()
+	stopTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Printf("无法开启 OpenTelemetry 追踪: %v", err)
+	}
+	m.stopTracing = stopTracing
 
 	m.Router = router.NewRouter(cfg, m.GeoManager, m.QueryLog)
+	if len(cfg.BlocklistURLs) > 0 {
+		m.blocklist = router.LoadBlocklist(cfg.BlocklistURLs, cfg.BlocklistCacheDir, m.blocklist)
+		m.Router.SetBlocklist(m.blocklist)
+	}
 
-	cm, err := util.NewCertManager(cfg)
-	if err != nil {
-		log.Printf("无法初始化自动证书管理器: %v (将回退到本地证书)", err)
-		m.CertManager = nil
-	} else {
-		m.CertManager = cm
+	tasksCtx, stopTasks := context.WithCancel(context.Background())
+	m.stopTasks = stopTasks
+	go m.Router.RunCanary(tasksCtx)
+	go m.Router.RunBootstrapProbe(tasksCtx)
+
+	if m.DNSServer != nil {
+		m.DNSServer.SetRouter(m.Router)
+	}
+	if m.DoTServer != nil {
+		m.DoTServer.SetRouter(m.Router)
+	}
+	if m.DoQServer != nil {
+		m.DoQServer.SetRouter(m.Router)
+	}
+	if m.DoHServer != nil {
+		m.DoHServer.SetRouter(m.Router)
+	}
+
+	if changes.acme {
+		cm, err := util.NewCertManager(cfg)
+		if err != nil {
+			log.Printf("无法初始化自动证书管理器: %v (将回退到本地证书)", err)
+			m.CertManager = nil
+		} else {
+			m.CertManager = cm
+		}
 	}
 
-	if cfg.AutoCert.Enabled && m.CertManager != nil {
+	if changes.acme && cfg.AutoCert.Enabled && m.CertManager != nil {
 		m.ACMEServer = &http.Server{
 			Addr: ":80",
 			Handler: m.CertManager.HTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -275,26 +479,30 @@ func (m *ServiceManager) startInternal() error {
 		}()
 	}
 
-	if cfg.Listen.DNSUDP != "" || cfg.Listen.DNSTCP != "" {
+	if changes.dot || changes.doq || changes.doh {
+		m.certStamp = certFilesStamp(cfg)
+	}
+
+	if changes.dns && (cfg.Listen.DNSUDP != "" || cfg.Listen.DNSTCP != "") {
 		m.DNSServer = server.NewDNSServer(cfg, m.Router)
 		m.DNSServer.Start()
 	}
 
-	if cfg.Listen.DOT != "" {
+	if changes.dot && cfg.Listen.DOT != "" {
 		m.DoTServer = server.NewDoTServer(cfg, m.Router, m.CertManager)
 		if m.DoTServer != nil {
 			m.DoTServer.Start()
 		}
 	}
 
-	if cfg.Listen.DOQ != "" {
+	if changes.doq && cfg.Listen.DOQ != "" {
 		m.DoQServer = server.NewDoQServer(cfg, m.Router, m.CertManager)
 		if m.DoQServer != nil {
 			m.DoQServer.Start()
 		}
 	}
 
-	if cfg.Listen.DOH != "" {
+	if changes.doh && cfg.Listen.DOH != "" {
 		m.DoHServer = server.NewDoHServer(cfg, m.Router, m.CertManager)
 		if m.DoHServer != nil {
 			m.DoHServer.Start()
@@ -304,38 +512,93 @@ func (m *ServiceManager) startInternal() error {
 	return nil
 }
 
-func (m *ServiceManager) stopInternal() error {
+// stopInternal 停止后台任务以及 changes 中标记的监听器。
+func (m *ServiceManager) stopInternal(changes listenerChanges) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	if m.ACMEServer != nil {
+	if m.stopTasks != nil {
+		m.stopTasks()
+		m.stopTasks = nil
+	}
+
+	if changes.acme && m.ACMEServer != nil {
 		m.ACMEServer.Shutdown(ctx)
 		m.ACMEServer = nil
 	}
 
-	if m.DNSServer != nil {
-		m.DNSServer.Stop()
+	// 所有监听器同时停止接收新查询，再在共同的截止时间内等待进行中的查询完成
+	var stopping []interface{ Stop(context.Context) error }
+	if changes.dns && m.DNSServer != nil {
+		stopping = append(stopping, m.DNSServer)
 		m.DNSServer = nil
 	}
-
-	if m.DoTServer != nil {
-		m.DoTServer.Stop()
+	if changes.dot && m.DoTServer != nil {
+		stopping = append(stopping, m.DoTServer)
 		m.DoTServer = nil
 	}
-
-	if m.DoQServer != nil {
-		m.DoQServer.Stop()
+	if changes.doq && m.DoQServer != nil {
+		stopping = append(stopping, m.DoQServer)
 		m.DoQServer = nil
 	}
-
-	if m.DoHServer != nil {
-		m.DoHServer.Stop()
+	if changes.doh && m.DoHServer != nil {
+		stopping = append(stopping, m.DoHServer)
 		m.DoHServer = nil
 	}
 
+	var wg sync.WaitGroup
+	for _, srv := range stopping {
+		wg.Add(1)
+		go func(srv interface{ Stop(context.Context) error }) {
+			defer wg.Done()
+			if err := srv.Stop(ctx); err == context.DeadlineExceeded {
+				log.Printf("停止服务时仍有查询未完成，已超时放弃等待")
+			}
+		}(srv)
+	}
+	wg.Wait()
+
 	return nil
 }
 
+func (m *ServiceManager) Healthy() (bool, string) {
+	if m.reloading.Load() {
+		return false, "reloading"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.geoErr != nil {
+		return false, "geo data load failed: " + m.geoErr.Error()
+	}
+	if m.GeoManager == nil {
+		return false, "geo data not loaded"
+	}
+	if m.Router == nil {
+		return false, "router not initialized"
+	}
+	return true, ""
+}
+
+func (m *ServiceManager) Ready(ctx context.Context) (bool, string) {
+	if ok, reason := m.Healthy(); !ok {
+		return false, reason
+	}
+
+	m.mu.Lock()
+	r := m.Router
+	m.mu.Unlock()
+
+	if ok, reason := r.HasHealthyUpstreams(); !ok {
+		return false, reason
+	}
+	if err := r.ProbeUpstreams(ctx); err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
 func (m *ServiceManager) GetCertManager() *util.CertManager {
 	return m.CertManager
 }
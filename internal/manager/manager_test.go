@@ -0,0 +1,111 @@
+package manager
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"doh-autoproxy/internal/config"
+
+	"github.com/miekg/dns"
+)
+
+// pbBytes 与 pbVarint 按 protobuf 线格式编码一个字段，用于生成最小的 V2Ray geoip.dat / geosite.dat。
+func pbBytes(field int, b []byte) []byte {
+	out := binary.AppendUvarint(nil, uint64(field<<3|2))
+	out = binary.AppendUvarint(out, uint64(len(b)))
+	return append(out, b...)
+}
+
+func pbVarint(field int, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, uint64(field<<3)), v)
+}
+
+// writeGeoData 生成只含 CN 分类的 Geo 数据：GeoIP 为 1.2.3.0/24，GeoSite 为 cn.test 及其子域名。
+func writeGeoData(t *testing.T, dir string) (geoip, geosite string) {
+	t.Helper()
+	cidr := append(pbBytes(1, []byte{1, 2, 3, 0}), pbVarint(2, 24)...)
+	ipList := pbBytes(1, append(pbBytes(1, []byte("CN")), pbBytes(2, cidr)...))
+
+	domain := append(pbVarint(1, 2), pbBytes(2, []byte("cn.test"))...)
+	siteList := pbBytes(1, append(pbBytes(1, []byte("CN")), pbBytes(2, domain)...))
+
+	geoip, geosite = filepath.Join(dir, "geoip.dat"), filepath.Join(dir, "geosite.dat")
+	if err := os.WriteFile(geoip, ipList, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(geosite, siteList, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return geoip, geosite
+}
+
+func testConfig(geoip, geosite string) *config.Config {
+	return &config.Config{
+		Hosts:   map[string]string{"race.test": "10.0.0.1"},
+		GeoData: config.GeoDataConfig{GeoIPDat: geoip, GeoSiteDat: geosite},
+	}
+}
+
+// TestRouteDuringReloadAndGeoSwap 在查询进行的同时反复重载配置与热替换 Geo 数据，配合 -race 检查路由器的替换过程。
+func TestRouteDuringReloadAndGeoSwap(t *testing.T) {
+	geoip, geosite := writeGeoData(t, t.TempDir())
+	m := NewServiceManager(testConfig(geoip, geosite))
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Stop() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("race.test.", dns.TypeA)
+			for ctx.Err() == nil {
+				m.mu.Lock()
+				r := m.Router
+				m.mu.Unlock()
+
+				resp, err := r.Route(ctx, req.Copy(), "127.0.0.1", "", "UDP")
+				if err != nil || len(resp.Answer) != 1 {
+					t.Errorf("Route(race.test) = %v, %v", resp, err)
+					return
+				}
+				if p := r.PreviewRoute("www.cn.test", dns.TypeA, "127.0.0.1"); p.Branch != "GeoSite" {
+					t.Errorf("PreviewRoute(www.cn.test) branch = %s, want GeoSite", p.Branch)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			if err := m.Reload(testConfig(geoip, geosite)); err != nil {
+				t.Errorf("Reload: %v", err)
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			if err := m.swapGeoData(); err != nil {
+				t.Errorf("swapGeoData: %v", err)
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,276 @@
+package querylog
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"doh-autoproxy/internal/util"
+)
+
+// fileStore 以每行一条 JSON 的格式追加写入日志文件，超过大小上限时裁剪掉最旧的 20%。
+// 查询时从文件末尾倒序扫描，无需把整个文件读入内存。
+type fileStore struct {
+	mu        sync.Mutex
+	path      string
+	maxSizeMB int
+}
+
+func newFileStore(path string, maxSizeMB int) *fileStore {
+	return &fileStore{path: path, maxSizeMB: maxSizeMB}
+}
+
+func (s *fileStore) Replay(fn func(*LogEntry)) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry LogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			fn(&entry)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *fileStore) Append(entry LogEntry) {
+	go s.write(entry)
+}
+
+func (s *fileStore) write(entry LogEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	limitBytes := int64(s.maxSizeMB) * 1024 * 1024
+
+	fi, err := os.Stat(s.path)
+	if err == nil {
+		if fi.Size()+int64(len(data)) > limitBytes {
+			if err := s.prune(limitBytes); err != nil {
+				log.Printf("Error pruning log file: %v", err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		log.Printf("Error checking log file size: %v", err)
+		return
+	}
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Error writing to log file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		log.Printf("Error writing data to log file: %v", err)
+	}
+}
+
+func (s *fileStore) prune(limitBytes int64) (err error) {
+	targetSize := int64(float64(limitBytes) * 0.8)
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := fi.Size()
+
+	if fileSize <= targetSize {
+		return nil
+	}
+
+	startPos := fileSize - targetSize
+	dir := filepath.Dir(s.path)
+	tmpFile, err := os.CreateTemp(dir, "querylog_*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	defer func() {
+		if tmpFile != nil {
+			tmpFile.Close()
+		}
+		if err != nil {
+			os.Remove(tmpName)
+		}
+	}()
+
+	if _, err = f.Seek(startPos, 0); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1024)
+	n, err := f.Read(buf)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	copyStart := startPos
+	newlineIdx := bytes.IndexByte(buf[:n], '\n')
+	if newlineIdx != -1 {
+		copyStart = startPos + int64(newlineIdx) + 1
+	}
+
+	if _, err = f.Seek(copyStart, 0); err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(tmpFile, f); err != nil {
+		return err
+	}
+
+	f.Close()
+	tmpFile.Close()
+	tmpFile = nil
+
+	return os.Rename(tmpName, s.path)
+}
+
+func (s *fileStore) Query(offset, limit int, filter Filter) ([]*LogEntry, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fileSize := stat.Size()
+	var result []*LogEntry
+	var matchCount int64 = 0
+
+	pooled := util.GetBuffer()
+	defer util.PutBuffer(pooled)
+	buf := (*pooled)[:4096]
+	pos := fileSize
+	var line []byte
+
+scan:
+	for pos > 0 {
+		readSize := int64(len(buf))
+		if pos < readSize {
+			readSize = pos
+		}
+		pos -= readSize
+		_, err := file.Seek(pos, 0)
+		if err != nil {
+			break
+		}
+
+		n, err := file.Read(buf[:readSize])
+		if err != nil {
+			break
+		}
+
+		for i := n - 1; i >= 0; i-- {
+			b := buf[i]
+			if b == '\n' {
+				if len(line) > 0 {
+					entry := parseReverseLine(line)
+					line = line[:0]
+					if entry != nil && filter.tooOld(entry) {
+						break scan
+					}
+					if entry != nil && filter.match(entry) {
+						if matchCount >= int64(offset) && len(result) < limit {
+							result = append(result, entry)
+						}
+						matchCount++
+					}
+				}
+			} else {
+				line = append(line, b)
+			}
+		}
+	}
+
+	if len(line) > 0 {
+		entry := parseReverseLine(line)
+		if entry != nil && filter.match(entry) {
+			if matchCount >= int64(offset) && len(result) < limit {
+				result = append(result, entry)
+			}
+			matchCount++
+		}
+	}
+
+	return result, matchCount, nil
+}
+
+func parseReverseLine(reversed []byte) *LogEntry {
+	n := len(reversed)
+	normal := make([]byte, n)
+	for i := 0; i < n; i++ {
+		normal[i] = reversed[n-1-i]
+	}
+
+	var entry LogEntry
+	if err := json.Unmarshal(normal, &entry); err != nil {
+		return nil
+	}
+	return &entry
+}
+
+// Clear 统计行数后截断日志文件。仍在异步写入的记录可能在截断后追加。
+func (s *fileStore) Clear() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	var n int64
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return n, f.Truncate(0)
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
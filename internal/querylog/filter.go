@@ -0,0 +1,71 @@
+package querylog
+
+import (
+	"strings"
+	"time"
+)
+
+// Filter 描述日志查询条件，各字段之间为“与”关系，空字段不参与过滤。
+// Query 为旧版的任意字段子串匹配；Status、Type、Protocol 为精确匹配，其余字段为子串匹配，均不区分大小写。
+type Filter struct {
+	Query    string
+	Domain   string
+	Client   string
+	Status   string
+	Upstream string
+	Type     string
+	Protocol string
+	Since    time.Time
+	Until    time.Time
+}
+
+func (f Filter) normalize() Filter {
+	f.Query = strings.ToLower(strings.TrimSpace(f.Query))
+	f.Domain = strings.ToLower(strings.TrimSpace(f.Domain))
+	f.Client = strings.ToLower(strings.TrimSpace(f.Client))
+	f.Status = strings.ToLower(strings.TrimSpace(f.Status))
+	f.Upstream = strings.ToLower(strings.TrimSpace(f.Upstream))
+	f.Type = strings.ToLower(strings.TrimSpace(f.Type))
+	f.Protocol = strings.ToLower(strings.TrimSpace(f.Protocol))
+	return f
+}
+
+// tooOld 表示条目早于 Since；日志按时间顺序写入，倒序扫描时遇到即可停止。
+func (f Filter) tooOld(entry *LogEntry) bool {
+	return !f.Since.IsZero() && entry.Time.Before(f.Since)
+}
+
+// match 要求 f 已经过 normalize。
+func (f Filter) match(entry *LogEntry) bool {
+	if f.tooOld(entry) || (!f.Until.IsZero() && entry.Time.After(f.Until)) {
+		return false
+	}
+	if f.Domain != "" && !strings.Contains(strings.ToLower(entry.Domain), f.Domain) {
+		return false
+	}
+	if f.Client != "" && !strings.Contains(strings.ToLower(entry.ClientIP), f.Client) {
+		return false
+	}
+	if f.Upstream != "" && !strings.Contains(strings.ToLower(entry.Upstream), f.Upstream) {
+		return false
+	}
+	if f.Status != "" && strings.ToLower(entry.Status) != f.Status {
+		return false
+	}
+	if f.Type != "" && strings.ToLower(entry.Type) != f.Type {
+		return false
+	}
+	if f.Protocol != "" && strings.ToLower(entry.Protocol) != f.Protocol {
+		return false
+	}
+	if f.Query == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(entry.ClientIP), f.Query) ||
+		strings.Contains(strings.ToLower(entry.Domain), f.Query) ||
+		strings.Contains(strings.ToLower(entry.Type), f.Query) ||
+		strings.Contains(strings.ToLower(entry.Upstream), f.Query) ||
+		strings.Contains(strings.ToLower(entry.Answer), f.Query) ||
+		strings.Contains(strings.ToLower(entry.Protocol), f.Query) ||
+		strings.Contains(strings.ToLower(entry.Status), f.Query)
+}
@@ -1,22 +1,22 @@
 package querylog
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
 	"io"
 	"log"
-	"os"
-	"path/filepath"
+	"net"
 	"strings"
 	"sync"
 	"time"
+
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/util"
 )
 
 type LogEntry struct {
 	ID            int64          `json:"id"`
 	Time          time.Time      `json:"time"`
 	ClientIP      string         `json:"client_ip"`
+	Protocol      string         `json:"protocol"`
 	Domain        string         `json:"domain"`
 	Type          string         `json:"type"`
 	Upstream      string         `json:"upstream"`
@@ -24,6 +24,8 @@ type LogEntry struct {
 	AnswerRecords []AnswerRecord `json:"answer_records"`
 	DurationMs    int64          `json:"duration_ms"`
 	Status        string         `json:"status"`
+	ResponseSize  int            `json:"response_size"`
+	CacheHit      bool           `json:"cache_hit"`
 }
 
 type AnswerRecord struct {
@@ -38,73 +40,168 @@ type Stats struct {
 	TotalQueries  int64            `json:"total_queries"`
 	TotalCN       int64            `json:"total_cn"`
 	TotalOverseas int64            `json:"total_overseas"`
+	CacheHits     int64            `json:"cache_hits"`
+	ResponseBytes int64            `json:"response_bytes"`
 	TopClients    map[string]int64 `json:"top_clients"`
 	TopDomains    map[string]int64 `json:"top_domains"`
+	TopTypes      map[string]int64 `json:"top_types"`
+
+	LatencyP50     int64            `json:"latency_p50_ms"`
+	LatencyP95     int64            `json:"latency_p95_ms"`
+	LatencyP99     int64            `json:"latency_p99_ms"`
+	LatencyBuckets map[string]int64 `json:"latency_buckets"`
 }
 
 type QueryLogger struct {
-	mu         sync.RWMutex
-	fileMu     sync.Mutex
-	logs       []*LogEntry
-	maxSizeMB  int
-	nextID     int64
-	filePath   string
-	saveToFile bool
-	stats      Stats
+	mu        sync.RWMutex
+	logs      []*LogEntry
+	nextID    int64
+	store     Store
+	anonymize bool
+	watcher   *domainWatcher
+	remote    *remoteShipper
+	syslog    *syslogSink
+	stats     Stats
+
+	perMinute *timeSeries
+	perHour   *timeSeries
+	latency   *util.LatencyHistogram
 }
 
 const maxMemoryLogs = 5000
 
-func NewQueryLogger(maxSizeMB int, filePath string, saveToFile bool) *QueryLogger {
+// NewQueryLogger 创建查询日志记录器。saveToFile 为 true 时按 backend ("file" 或 "sqlite")
+// 将日志持久化到 filePath，并从中恢复统计数据。
+func NewQueryLogger(maxSizeMB int, filePath string, saveToFile bool, backend string) *QueryLogger {
 	if maxSizeMB <= 0 {
 		maxSizeMB = 1
 	}
 	l := &QueryLogger{
-		logs:       make([]*LogEntry, 0, maxMemoryLogs),
-		maxSizeMB:  maxSizeMB,
-		nextID:     1,
-		filePath:   filePath,
-		saveToFile: saveToFile,
+		logs:   make([]*LogEntry, 0, maxMemoryLogs),
+		nextID: 1,
 		stats: Stats{
 			StartTime:  time.Now(),
 			TopClients: make(map[string]int64),
 			TopDomains: make(map[string]int64),
+			TopTypes:   make(map[string]int64),
 		},
+		perMinute: newTimeSeries(time.Minute, 24*60),
+		perHour:   newTimeSeries(time.Hour, 7*24),
+		latency:   util.NewLatencyHistogram(),
 	}
 
 	if saveToFile && filePath != "" {
-		l.restoreStatsFromFile()
+		l.store = openStore(backend, filePath, maxSizeMB)
+		err := l.store.Replay(func(entry *LogEntry) {
+			l.updateStats(entry)
+			if entry.ID >= l.nextID {
+				l.nextID = entry.ID + 1
+			}
+		})
+		if err != nil {
+			log.Printf("Error restoring stats from query log: %v", err)
+		}
 	}
 
 	return l
 }
 
-func (l *QueryLogger) restoreStatsFromFile() {
-	f, err := os.Open(l.filePath)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Printf("Error opening log file for stats restoration: %v", err)
-		}
-		return
+// Close 关闭持久化后端，重载配置替换记录器前调用。
+func (l *QueryLogger) Close() error {
+	l.mu.Lock()
+	remote, sink := l.remote, l.syslog
+	l.remote, l.syslog = nil, nil
+	l.mu.Unlock()
+	if remote != nil {
+		remote.close()
+	}
+	if sink != nil {
+		sink.close()
 	}
-	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		var entry LogEntry
-		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
-			l.updateStats(&entry)
-			if entry.ID >= l.nextID {
-				l.nextID = entry.ID + 1
-			}
+	if l.store == nil {
+		return nil
+	}
+	return l.store.Close()
+}
+
+// SetRemote 开启远程日志：在后台把之后记录的日志批量发送到 cfg.URL，cfg 为 nil 或 URL 为空时关闭。
+func (l *QueryLogger) SetRemote(cfg *config.RemoteLogConfig) {
+	shipper := newRemoteShipper(cfg)
+	l.mu.Lock()
+	old := l.remote
+	l.remote = shipper
+	l.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// SetSyslog 开启 syslog 输出：之后记录的日志以 key=value 格式同时发送到 syslog。cfg 为 nil 或未启用时关闭。
+func (l *QueryLogger) SetSyslog(cfg *config.SyslogConfig) error {
+	var sink *syslogSink
+	if cfg != nil && cfg.Enabled {
+		var err error
+		if sink, err = newSyslogSink(cfg); err != nil {
+			return err
 		}
 	}
+	l.mu.Lock()
+	old := l.syslog
+	l.syslog = sink
+	l.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// SyslogWriter 返回用于转发程序运行日志的 syslog 写入器，未开启 syslog 时返回 nil。
+func (l *QueryLogger) SyslogWriter() io.Writer {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.syslog == nil {
+		return nil
+	}
+	return l.syslog
+}
+
+// SetAnonymizeIP 开启后，写入内存、文件及统计前抹去客户端 IP 的主机部分。
+func (l *QueryLogger) SetAnonymizeIP(enabled bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.anonymize = enabled
+}
+
+// SetWatch 设置关注域名：记录到匹配 domains 的查询时向 url POST 一条 WatchAlert。
+// domains 中的条目匹配该域名及其所有子域名，以 full: 开头时只匹配域名本身。
+// 同一域名与客户端在 cooldown 内只告警一次，domains 或 url 为空时关闭告警。
+func (l *QueryLogger) SetWatch(domains []string, url string, cooldown time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.watcher = newDomainWatcher(domains, url, cooldown)
+}
+
+// AnonymizeIP 将 IPv4 的最后一个八位组及 IPv6 的后 80 位置零。
+func AnonymizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
 }
 
 func (l *QueryLogger) AddLog(entry *LogEntry) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	if l.anonymize {
+		entry.ClientIP = AnonymizeIP(entry.ClientIP)
+	}
+
 	entry.ID = l.nextID
 	l.nextID++
 	if entry.Time.IsZero() {
@@ -113,9 +210,18 @@ func (l *QueryLogger) AddLog(entry *LogEntry) {
 
 	l.updateStats(entry)
 	l.addToMemory(entry)
+	if l.watcher != nil {
+		l.watcher.check(entry)
+	}
+	if l.remote != nil {
+		l.remote.enqueue(*entry)
+	}
+	if l.syslog != nil {
+		l.syslog.writeEntry(entry)
+	}
 
-	if l.saveToFile && l.filePath != "" {
-		go l.appendToFile(*entry)
+	if l.store != nil {
+		l.store.Append(*entry)
 	}
 }
 
@@ -126,8 +232,19 @@ func (l *QueryLogger) updateStats(entry *LogEntry) {
 	} else if strings.Contains(entry.Upstream, "Overseas") {
 		l.stats.TotalOverseas++
 	}
+	if entry.CacheHit {
+		l.stats.CacheHits++
+	}
+	l.stats.ResponseBytes += int64(entry.ResponseSize)
 	l.stats.TopClients[entry.ClientIP]++
 	l.stats.TopDomains[entry.Domain]++
+	l.stats.TopTypes[entry.Type]++
+
+	cn := strings.Contains(entry.Upstream, "CN")
+	overseas := !cn && strings.Contains(entry.Upstream, "Overseas")
+	l.perMinute.add(entry.Time, cn, overseas)
+	l.perHour.add(entry.Time, cn, overseas)
+	l.latency.Observe(entry.DurationMs)
 }
 
 func (l *QueryLogger) addToMemory(entry *LogEntry) {
@@ -137,136 +254,29 @@ func (l *QueryLogger) addToMemory(entry *LogEntry) {
 	}
 }
 
-func (l *QueryLogger) appendToFile(entry LogEntry) {
-	l.fileMu.Lock()
-	defer l.fileMu.Unlock()
-
-	data, err := json.Marshal(entry)
-	if err != nil {
-		return
-	}
-	data = append(data, '\n')
-
-	limitBytes := int64(l.maxSizeMB) * 1024 * 1024
-
-	fi, err := os.Stat(l.filePath)
-	if err == nil {
-		if fi.Size()+int64(len(data)) > limitBytes {
-			if err := l.pruneLogFile(limitBytes); err != nil {
-				log.Printf("Error pruning log file: %v", err)
-			}
-		}
-	} else if !os.IsNotExist(err) {
-		log.Printf("Error checking log file size: %v", err)
-		return
-	}
-
-	f, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("Error writing to log file: %v", err)
-		return
-	}
-	defer f.Close()
-
-	if _, err := f.Write(data); err != nil {
-		log.Printf("Error writing data to log file: %v", err)
-	}
-}
-
-func (l *QueryLogger) pruneLogFile(limitBytes int64) (err error) {
-	targetSize := int64(float64(limitBytes) * 0.8)
-
-	f, err := os.Open(l.filePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	fi, err := f.Stat()
-	if err != nil {
-		return err
-	}
-	fileSize := fi.Size()
-
-	if fileSize <= targetSize {
-		return nil
-	}
-
-	startPos := fileSize - targetSize
-	dir := filepath.Dir(l.filePath)
-	tmpFile, err := os.CreateTemp(dir, "querylog_*.tmp")
-	if err != nil {
-		return err
-	}
-	tmpName := tmpFile.Name()
-
-	defer func() {
-		if tmpFile != nil {
-			tmpFile.Close()
-		}
-		if err != nil {
-			os.Remove(tmpName)
-		}
-	}()
+func (l *QueryLogger) GetLogs(offset, limit int, filter Filter) ([]*LogEntry, int64) {
+	filter = filter.normalize()
 
-	if _, err = f.Seek(startPos, 0); err != nil {
-		return err
-	}
-
-	buf := make([]byte, 1024)
-	n, err := f.Read(buf)
-	if err != nil && err != io.EOF {
-		return err
-	}
-
-	copyStart := startPos
-	newlineIdx := bytes.IndexByte(buf[:n], '\n')
-	if newlineIdx != -1 {
-		copyStart = startPos + int64(newlineIdx) + 1
-	}
-
-	if _, err = f.Seek(copyStart, 0); err != nil {
-		return err
-	}
-
-	if _, err = io.Copy(tmpFile, f); err != nil {
-		return err
-	}
-
-	f.Close()
-	tmpFile.Close()
-	tmpFile = nil
-
-	return os.Rename(tmpName, l.filePath)
-}
-
-func (l *QueryLogger) GetLogs(offset, limit int, search string) ([]*LogEntry, int64) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	if l.saveToFile && l.filePath != "" {
-		fileLogs, total, err := l.readLogsFromFileBackwards(offset, limit, search)
+	if l.store != nil {
+		storedLogs, total, err := l.store.Query(offset, limit, filter)
 		if err == nil {
-			return fileLogs, total
+			return storedLogs, total
 		}
+		log.Printf("Error querying stored logs: %v", err)
 	}
 
 	var result []*LogEntry
 	var count int64 = 0
-	searchLower := strings.ToLower(search)
 
 	for i := len(l.logs) - 1; i >= 0; i-- {
 		entry := l.logs[i]
-
-		if searchLower != "" {
-			match := strings.Contains(strings.ToLower(entry.ClientIP), searchLower) ||
-				strings.Contains(strings.ToLower(entry.Domain), searchLower) ||
-				strings.Contains(strings.ToLower(entry.Type), searchLower) ||
-				strings.Contains(strings.ToLower(entry.Upstream), searchLower) ||
-				strings.Contains(strings.ToLower(entry.Answer), searchLower) ||
-				strings.Contains(strings.ToLower(entry.Status), searchLower)
-			if !match {
-				continue
-			}
+		if filter.tooOld(entry) {
+			break
+		}
+		if !filter.match(entry) {
+			continue
 		}
 
 		if count >= int64(offset) && len(result) < limit {
@@ -278,124 +288,92 @@ func (l *QueryLogger) GetLogs(offset, limit int, search string) ([]*LogEntry, in
 	return result, count
 }
 
-func (l *QueryLogger) readLogsFromFileBackwards(offset, limit int, search string) ([]*LogEntry, int64, error) {
-	l.fileMu.Lock()
-	defer l.fileMu.Unlock()
-
-	file, err := os.Open(l.filePath)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer file.Close()
+func (l *QueryLogger) GetStats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
 
-	stat, err := file.Stat()
-	if err != nil {
-		return nil, 0, err
+	s := l.stats
+	s.TopClients = make(map[string]int64, len(l.stats.TopClients))
+	for k, v := range l.stats.TopClients {
+		s.TopClients[k] = v
 	}
-
-	fileSize := stat.Size()
-	var result []*LogEntry
-	var matchCount int64 = 0
-
-	buf := make([]byte, 4096)
-	pos := fileSize
-	var line []byte
-
-	searchLower := strings.ToLower(search)
-
-	for pos > 0 {
-		readSize := int64(len(buf))
-		if pos < readSize {
-			readSize = pos
-		}
-		pos -= readSize
-		_, err := file.Seek(pos, 0)
-		if err != nil {
-			break
-		}
-
-		n, err := file.Read(buf[:readSize])
-		if err != nil {
-			break
-		}
-
-		for i := n - 1; i >= 0; i-- {
-			b := buf[i]
-			if b == '\n' {
-				if len(line) > 0 {
-					entry := parseReverseLine(line)
-					if entry != nil && matches(entry, searchLower) {
-						if matchCount >= int64(offset) && len(result) < limit {
-							result = append(result, entry)
-						}
-						matchCount++
-					}
-					line = line[:0]
-				}
-			} else {
-				line = append(line, b)
-			}
-		}
+	s.TopDomains = make(map[string]int64, len(l.stats.TopDomains))
+	for k, v := range l.stats.TopDomains {
+		s.TopDomains[k] = v
 	}
-
-	if len(line) > 0 {
-		entry := parseReverseLine(line)
-		if entry != nil && matches(entry, searchLower) {
-			if matchCount >= int64(offset) && len(result) < limit {
-				result = append(result, entry)
-			}
-			matchCount++
-		}
+	s.TopTypes = make(map[string]int64, len(l.stats.TopTypes))
+	for k, v := range l.stats.TopTypes {
+		s.TopTypes[k] = v
 	}
+	s.LatencyP50 = l.latency.Percentile(0.50)
+	s.LatencyP95 = l.latency.Percentile(0.95)
+	s.LatencyP99 = l.latency.Percentile(0.99)
+	s.LatencyBuckets = l.latency.Buckets()
 
-	return result, matchCount, nil
+	return s
 }
 
-func parseReverseLine(reversed []byte) *LogEntry {
-	n := len(reversed)
-	normal := make([]byte, n)
-	for i := 0; i < n; i++ {
-		normal[i] = reversed[n-1-i]
-	}
+// Latency 返回全部查询的耗时直方图。
+func (l *QueryLogger) Latency() *util.LatencyHistogram {
+	return l.latency
+}
 
-	var entry LogEntry
-	if err := json.Unmarshal(normal, &entry); err != nil {
-		return nil
+// GetTimeSeries 返回最近 window 时长内的查询量曲线，每个点覆盖 interval 时长。
+// 24 小时以内的窗口基于分钟桶，更长的窗口基于小时桶 (最多 7 天)；
+// interval 会向上取整为基础桶长度的整数倍，为 0 时直接返回基础桶。
+func (l *QueryLogger) GetTimeSeries(window, interval time.Duration) []TimePoint {
+	l.mu.RLock()
+	ts := l.perHour
+	if window <= 24*time.Hour {
+		ts = l.perMinute
 	}
-	return &entry
-}
+	points := ts.since(time.Now(), window)
+	l.mu.RUnlock()
 
-func matches(entry *LogEntry, searchLower string) bool {
-	if searchLower == "" {
-		return true
+	if interval <= ts.step {
+		return points
 	}
-	return strings.Contains(strings.ToLower(entry.ClientIP), searchLower) ||
-		strings.Contains(strings.ToLower(entry.Domain), searchLower) ||
-		strings.Contains(strings.ToLower(entry.Type), searchLower) ||
-		strings.Contains(strings.ToLower(entry.Upstream), searchLower) ||
-		strings.Contains(strings.ToLower(entry.Answer), searchLower) ||
-		strings.Contains(strings.ToLower(entry.Status), searchLower)
+	return aggregate(points, (interval+ts.step-1)/ts.step*ts.step)
 }
 
-func (l *QueryLogger) GetStats() Stats {
+func (l *QueryLogger) DomainCount(domain string) int64 {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
+	return l.stats.TopDomains[domain]
+}
 
-	s := l.stats
-	s.TopClients = make(map[string]int64, len(l.stats.TopClients))
-	for k, v := range l.stats.TopClients {
-		s.TopClients[k] = v
-	}
-	s.TopDomains = make(map[string]int64, len(l.stats.TopDomains))
-	for k, v := range l.stats.TopDomains {
-		s.TopDomains[k] = v
-	}
+// Clear 清空内存中的最近日志，返回清除的条数。
+func (l *QueryLogger) Clear() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := len(l.logs)
+	l.logs = make([]*LogEntry, 0, maxMemoryLogs)
+	return n
+}
 
-	return s
+// ClearStore 删除持久化后端中的所有记录，未开启持久化时返回 0。
+// 清空大文件可能较慢，只在锁内取出 store，清空时不阻塞查询路径上的 AddLog。
+func (l *QueryLogger) ClearStore() (int64, error) {
+	l.mu.RLock()
+	store := l.store
+	l.mu.RUnlock()
+	if store == nil {
+		return 0, nil
+	}
+	return store.Clear()
 }
 
-func (l *QueryLogger) Clear() {
+// ResetStats 清零查询计数、排行、延迟分布与查询量曲线，运行时长不受影响。
+func (l *QueryLogger) ResetStats() {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	l.logs = make([]*LogEntry, 0, maxMemoryLogs)
+	l.stats = Stats{
+		StartTime:  l.stats.StartTime,
+		TopClients: make(map[string]int64),
+		TopDomains: make(map[string]int64),
+		TopTypes:   make(map[string]int64),
+	}
+	l.perMinute = newTimeSeries(time.Minute, 24*60)
+	l.perHour = newTimeSeries(time.Hour, 7*24)
+	l.latency = util.NewLatencyHistogram()
 }
@@ -0,0 +1,224 @@
+package querylog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"doh-autoproxy/internal/config"
+)
+
+const (
+	defaultRemoteBatchSize     = 100
+	defaultRemoteFlushInterval = 5 * time.Second
+	defaultRemoteBufferSize    = 10000
+	remoteMaxAttempts          = 3
+	remoteDrainTimeout         = 3 * time.Second
+)
+
+// remoteShipper 在后台把查询日志批量发送到远程端点 (通用 HTTP 收集器或 Loki)，与本地内存/文件日志互不影响。
+// 待发送的日志超过 buffer_size 时丢弃新日志，远程端点故障不会拖慢查询处理或占满内存。
+type remoteShipper struct {
+	url       string
+	loki      bool
+	labels    map[string]string
+	headers   map[string]string
+	batchSize int
+	interval  time.Duration
+	client    *http.Client
+
+	queue   chan LogEntry
+	dropped atomic.Int64
+	stop    chan struct{}
+	done    chan struct{}
+	ctx     context.Context // 所有请求共用，close 超过 remoteDrainTimeout 时取消
+	cancel  context.CancelFunc
+}
+
+func newRemoteShipper(cfg *config.RemoteLogConfig) *remoteShipper {
+	if cfg == nil || cfg.URL == "" {
+		return nil
+	}
+	s := &remoteShipper{
+		url:       cfg.URL,
+		loki:      cfg.Format == "loki",
+		labels:    map[string]string{"job": "doh-autoproxy"},
+		headers:   cfg.Headers,
+		batchSize: cfg.BatchSize,
+		interval:  time.Duration(cfg.FlushInterval) * time.Second,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for k, v := range cfg.Labels {
+		s.labels[k] = v
+	}
+	if s.batchSize <= 0 {
+		s.batchSize = defaultRemoteBatchSize
+	}
+	if s.interval <= 0 {
+		s.interval = defaultRemoteFlushInterval
+	}
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultRemoteBufferSize
+	}
+	s.queue = make(chan LogEntry, bufferSize)
+	go s.run()
+	return s
+}
+
+func (s *remoteShipper) enqueue(entry LogEntry) {
+	select {
+	case s.queue <- entry:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+// close 停止后台协程，退出前在 remoteDrainTimeout 内尽量发送完队列中剩余的日志 (不重试)。
+// 超时后中止进行中的请求并丢弃其余日志，重载配置时不会因远程端点故障而长时间阻塞。
+func (s *remoteShipper) close() {
+	close(s.stop)
+	timer := time.AfterFunc(remoteDrainTimeout, s.cancel)
+	<-s.done
+	timer.Stop()
+	s.cancel()
+}
+
+func (s *remoteShipper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	batch := make([]LogEntry, 0, s.batchSize)
+	flush := func(retry bool) {
+		if len(batch) > 0 {
+			s.send(batch, retry)
+			batch = batch[:0]
+		}
+		if n := s.dropped.Swap(0); n > 0 {
+			log.Printf("远程查询日志队列已满，丢弃了 %d 条日志", n)
+		}
+	}
+
+	for {
+		select {
+		case entry := <-s.queue:
+			batch = append(batch, entry)
+			if len(batch) >= s.batchSize {
+				flush(true)
+			}
+		case <-ticker.C:
+			flush(true)
+		case <-s.stop:
+			for len(s.queue) > 0 && s.ctx.Err() == nil {
+				batch = append(batch, <-s.queue)
+				if len(batch) >= s.batchSize {
+					flush(false)
+				}
+			}
+			flush(false)
+			if n := len(s.queue); n > 0 {
+				log.Printf("退出时发送远程查询日志超时，丢弃了 %d 条日志", n)
+			}
+			return
+		}
+	}
+}
+
+// send 发送一批日志。网络错误、429 与 5xx 视为暂时性故障，retry 为 true 时最多尝试 remoteMaxAttempts 次。
+func (s *remoteShipper) send(batch []LogEntry, retry bool) {
+	body, contentType, err := s.encode(batch)
+	if err != nil {
+		log.Printf("远程查询日志序列化失败: %v", err)
+		return
+	}
+
+	attempts := 1
+	if retry {
+		attempts = remoteMaxAttempts
+	}
+	for i := 1; ; i++ {
+		err := s.post(body, contentType)
+		if err == nil {
+			return
+		}
+		var perm permanentError
+		if i >= attempts || errors.As(err, &perm) {
+			log.Printf("发送 %d 条远程查询日志失败，已丢弃: %v", len(batch), err)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(i) * time.Second):
+		case <-s.stop:
+			attempts = i + 1 // 正在退出，最后再试一次
+		}
+	}
+}
+
+type permanentError struct{ status string }
+
+func (e permanentError) Error() string { return "远程端点返回 " + e.status }
+
+func (s *remoteShipper) post(body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{status: err.Error()}
+	}
+	req.Header.Set("Content-Type", contentType)
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("远程端点返回 %s", resp.Status)
+	default:
+		return permanentError{status: resp.Status}
+	}
+}
+
+// encode 按 format 编码一批日志：ndjson 为每行一条 LogEntry 的 JSON；
+// loki 为 Loki push API (/loki/api/v1/push) 的 JSON 格式，每条日志行同样是 LogEntry 的 JSON。
+func (s *remoteShipper) encode(batch []LogEntry) ([]byte, string, error) {
+	if !s.loki {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for i := range batch {
+			if err := enc.Encode(&batch[i]); err != nil {
+				return nil, "", err
+			}
+		}
+		return buf.Bytes(), "application/x-ndjson", nil
+	}
+
+	values := make([][2]string, 0, len(batch))
+	for i := range batch {
+		line, err := json.Marshal(&batch[i])
+		if err != nil {
+			return nil, "", err
+		}
+		values = append(values, [2]string{strconv.FormatInt(batch[i].Time.UnixNano(), 10), string(line)})
+	}
+	payload := map[string]any{
+		"streams": []map[string]any{{"stream": s.labels, "values": values}},
+	}
+	body, err := json.Marshal(payload)
+	return body, "application/json", err
+}
@@ -0,0 +1,14 @@
+//go:build sqlite
+
+package querylog
+
+// SQLite 后端依赖 cgo，仅在使用 -tags sqlite 且 CGO_ENABLED=1 编译时注册驱动。
+import (
+	"doh-autoproxy/internal/config"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	config.SQLiteSupported = true
+}
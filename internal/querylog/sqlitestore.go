@@ -0,0 +1,302 @@
+package querylog
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS query_log (
+	id            INTEGER PRIMARY KEY,
+	time          INTEGER NOT NULL,
+	client_ip     TEXT NOT NULL,
+	protocol      TEXT NOT NULL,
+	domain        TEXT NOT NULL,
+	type          TEXT NOT NULL,
+	upstream      TEXT NOT NULL,
+	answer        TEXT NOT NULL,
+	status        TEXT NOT NULL,
+	data          TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_query_log_time ON query_log(time);
+CREATE INDEX IF NOT EXISTS idx_query_log_client ON query_log(client_ip);
+CREATE INDEX IF NOT EXISTS idx_query_log_domain ON query_log(domain);
+CREATE INDEX IF NOT EXISTS idx_query_log_status ON query_log(status);
+`
+
+const (
+	sqliteBatchSize    = 256
+	sqliteFlushEvery   = time.Second
+	sqlitePruneEvery   = 5000
+	sqliteQueueLength  = 4096
+	sqlitePrunePercent = 20
+)
+
+// sqliteStore 将日志写入带索引的 SQLite 表，分页与字段过滤由数据库完成。
+// 写入经由队列批量提交，队列满 (或已关闭) 时丢弃记录而不阻塞查询路径。
+type sqliteStore struct {
+	db        *sql.DB
+	maxBytes  int64
+	queue     chan LogEntry
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSQLiteStore(path string, maxSizeMB int) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &sqliteStore{
+		db:       db,
+		maxBytes: int64(maxSizeMB) * 1024 * 1024,
+		queue:    make(chan LogEntry, sqliteQueueLength),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.writer()
+	return s, nil
+}
+
+func (s *sqliteStore) Append(entry LogEntry) {
+	select {
+	case s.queue <- entry:
+	default:
+	}
+}
+
+func (s *sqliteStore) writer() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(sqliteFlushEvery)
+	defer ticker.Stop()
+
+	batch := make([]LogEntry, 0, sqliteBatchSize)
+	written := 0
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := s.insert(batch); err != nil {
+			log.Printf("Error writing query log to SQLite: %v", err)
+		}
+		written += len(batch)
+		batch = batch[:0]
+		if written >= sqlitePruneEvery {
+			written = 0
+			if err := s.prune(); err != nil {
+				log.Printf("Error pruning SQLite query log: %v", err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case entry := <-s.queue:
+			batch = append(batch, entry)
+			if len(batch) >= sqliteBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.stop:
+			for {
+				select {
+				case entry := <-s.queue:
+					batch = append(batch, entry)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *sqliteStore) insert(batch []LogEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`INSERT OR REPLACE INTO query_log
+		(id, time, client_ip, protocol, domain, type, upstream, answer, status, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range batch {
+		data, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		if _, err := stmt.Exec(e.ID, e.Time.UnixNano(), e.ClientIP, e.Protocol, e.Domain, e.Type,
+			e.Upstream, e.Answer, e.Status, string(data)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// prune 在数据库超过 max_size_mb 时删除最旧的一部分记录。
+func (s *sqliteStore) prune() error {
+	var pages, pageSize int64
+	if err := s.db.QueryRow(`PRAGMA page_count`).Scan(&pages); err != nil {
+		return err
+	}
+	if err := s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return err
+	}
+	if pages*pageSize <= s.maxBytes {
+		return nil
+	}
+	_, err := s.db.Exec(`DELETE FROM query_log WHERE id <= (
+		SELECT id FROM query_log ORDER BY id LIMIT 1 OFFSET (SELECT COUNT(*) * ? / 100 FROM query_log))`,
+		sqlitePrunePercent)
+	return err
+}
+
+func (s *sqliteStore) Query(offset, limit int, filter Filter) ([]*LogEntry, int64, error) {
+	where, args := sqliteWhere(filter)
+
+	var total int64
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM query_log`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := s.db.Query(`SELECT data FROM query_log`+where+` ORDER BY id DESC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var result []*LogEntry
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, 0, err
+		}
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(data), &entry); err == nil {
+			result = append(result, &entry)
+		}
+	}
+	return result, total, rows.Err()
+}
+
+// sqliteWhere 把 Filter 翻译为 SQL 条件，语义与内存/文件后端的 Filter.match 一致
+// (LIKE 对 ASCII 不区分大小写)。
+func sqliteWhere(f Filter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	contains := func(col, v string) {
+		conds = append(conds, col+` LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(v)+"%")
+	}
+	equals := func(col, v string) {
+		conds = append(conds, col+` = ? COLLATE NOCASE`)
+		args = append(args, v)
+	}
+
+	if !f.Since.IsZero() {
+		conds = append(conds, `time >= ?`)
+		args = append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, `time <= ?`)
+		args = append(args, f.Until.UnixNano())
+	}
+	if f.Domain != "" {
+		contains("domain", f.Domain)
+	}
+	if f.Client != "" {
+		contains("client_ip", f.Client)
+	}
+	if f.Upstream != "" {
+		contains("upstream", f.Upstream)
+	}
+	if f.Status != "" {
+		equals("status", f.Status)
+	}
+	if f.Type != "" {
+		equals("type", f.Type)
+	}
+	if f.Protocol != "" {
+		equals("protocol", f.Protocol)
+	}
+	if f.Query != "" {
+		pattern := "%" + escapeLike(f.Query) + "%"
+		var any []string
+		for _, col := range []string{"client_ip", "domain", "type", "upstream", "answer", "protocol", "status"} {
+			any = append(any, col+` LIKE ? ESCAPE '\'`)
+			args = append(args, pattern)
+		}
+		conds = append(conds, "("+strings.Join(any, " OR ")+")")
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func (s *sqliteStore) Replay(fn func(*LogEntry)) error {
+	rows, err := s.db.Query(`SELECT data FROM query_log ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return err
+		}
+		var entry LogEntry
+		if err := json.Unmarshal([]byte(data), &entry); err == nil {
+			fn(&entry)
+		}
+	}
+	return rows.Err()
+}
+
+// Clear 删除表中所有记录。队列中尚未提交的记录仍会在之后写入。
+func (s *sqliteStore) Clear() (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM query_log`)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqliteStore) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+		err = s.db.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("关闭 SQLite 查询日志失败: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package querylog
+
+import (
+	"log"
+)
+
+// Store 是查询日志的持久化后端。内存中的最近日志与统计由 QueryLogger 维护，
+// 开启持久化后分页查询与启动时的统计恢复都交给 Store。
+type Store interface {
+	// Append 在查询路径上调用，实现需自行异步化写入，不能阻塞查询。
+	Append(entry LogEntry)
+	// Query 按时间倒序返回第 offset 条起最多 limit 条匹配记录及匹配总数，filter 已归一化。
+	Query(offset, limit int, filter Filter) ([]*LogEntry, int64, error)
+	// Replay 按写入顺序遍历所有已持久化的记录，用于重启后恢复统计。
+	Replay(fn func(*LogEntry)) error
+	// Clear 删除所有已持久化的记录并返回删除的条数。
+	Clear() (int64, error)
+	Close() error
+}
+
+// openStore 按 backend 打开持久化后端，SQLite 数据库无法打开时回退到文件后端。
+// 未编译 SQLite 支持的情况已由 config.Validate 在加载配置时拒绝。
+func openStore(backend, path string, maxSizeMB int) Store {
+	if backend == "sqlite" {
+		store, err := newSQLiteStore(path, maxSizeMB)
+		if err == nil {
+			return store
+		}
+		log.Printf("无法打开 SQLite 查询日志 %s: %v，回退到文件后端", path, err)
+		path += ".jsonl"
+	}
+	return newFileStore(path, maxSizeMB)
+}
@@ -0,0 +1,188 @@
+package querylog
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/config"
+)
+
+const (
+	syslogQueueSize  = 1000
+	syslogMinBackoff = time.Second
+	syslogMaxBackoff = time.Minute
+
+	syslogCloseTimeout = 3 * time.Second
+)
+
+// syslogSink 把查询日志 (以及开启 service_log 时的程序运行日志) 发送到本机或远程 syslog。
+// 写入在后台协程中进行，syslog 服务器缓慢或不可达时丢弃超出队列的日志，不会阻塞查询处理。
+// 具体的连接由各平台的 syslogDialer 实现，Windows 等不支持 syslog 的平台上返回错误。
+type syslogSink struct {
+	dial  func() (syslogWriter, error)
+	queue chan syslogLine
+
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{} // close 超时后关闭，run 不再处理剩余日志
+	done   chan struct{}
+}
+
+type syslogLine struct {
+	warning bool
+	text    string
+}
+
+type syslogWriter interface {
+	Info(m string) error
+	Warning(m string) error
+	Close() error
+}
+
+// newSyslogSink 只在配置无效时返回错误。连接在后台协程中建立，syslog 不可达不影响开启，也不会阻塞重载，由后台协程稍后重连。
+func newSyslogSink(cfg *config.SyslogConfig) (*syslogSink, error) {
+	dial, err := syslogDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s := &syslogSink{
+		dial:  dial,
+		queue: make(chan syslogLine, syslogQueueSize),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// run 逐条写出队列中的日志。连接断开 (log/syslog 自带的一次重连也失败) 后，断开期间的日志被丢弃，
+// 并按指数退避 (1 秒至 1 分钟) 重连，避免 syslog 不可达时每条日志都发起一次连接。
+func (s *syslogSink) run() {
+	defer close(s.done)
+	backoff := syslogMinBackoff
+	var retryAt time.Time
+	dropped := 0
+	w, err := s.dial()
+	if err != nil {
+		log.Printf("无法连接 syslog，稍后重试: %v", err)
+		retryAt = time.Now().Add(backoff)
+	}
+	for line := range s.queue {
+		select {
+		case <-s.stop:
+			if w != nil {
+				w.Close()
+			}
+			return
+		default:
+		}
+		if w == nil {
+			if time.Now().Before(retryAt) {
+				dropped++
+				continue
+			}
+			var err error
+			if w, err = s.dial(); err != nil {
+				retryAt = time.Now().Add(backoff)
+				backoff = min(backoff*2, syslogMaxBackoff)
+				dropped++
+				continue
+			}
+			log.Printf("syslog 已重新连接，断开期间丢弃 %d 条日志", dropped)
+			backoff, dropped = syslogMinBackoff, 0
+		}
+
+		var err error
+		if line.warning {
+			err = w.Warning(line.text)
+		} else {
+			err = w.Info(line.text)
+		}
+		if err != nil {
+			log.Printf("syslog 写入失败，稍后重连: %v", err)
+			w.Close()
+			w = nil
+			retryAt = time.Now().Add(backoff)
+			dropped++
+		}
+	}
+	if w != nil {
+		w.Close()
+	}
+}
+
+func (s *syslogSink) send(line syslogLine) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- line:
+	default:
+	}
+}
+
+// Write 实现 io.Writer，供 log.SetOutput 转发程序运行日志。关闭后的写入被静默丢弃。
+func (s *syslogSink) Write(p []byte) (int, error) {
+	s.send(syslogLine{text: strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+// writeEntry 以 key=value 格式发送一条查询日志，解析失败的查询使用 warning 级别。
+func (s *syslogSink) writeEntry(e *LogEntry) {
+	warning := e.Status == "SERVFAIL" || e.Status == "REFUSED" || e.Status == "ERROR"
+	s.send(syslogLine{warning: warning, text: formatKV(e)})
+}
+
+// close 在 syslogCloseTimeout 内发送完队列中剩余的日志后断开连接。连接或写入因 syslog 不可达而阻塞时，
+// 超时后放弃剩余日志直接返回，后台协程在阻塞的操作结束后退出。
+func (s *syslogSink) close() {
+	s.mu.Lock()
+	first := !s.closed
+	if first {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-time.After(syslogCloseTimeout):
+		if first {
+			close(s.stop)
+			log.Printf("关闭 syslog 超时，放弃发送剩余的日志")
+		}
+	}
+}
+
+// formatKV 把查询日志格式化为 key=value 形式，空值及含空格、引号的值加双引号。
+func formatKV(e *LogEntry) string {
+	var b strings.Builder
+	kv := func(k, v string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		if v == "" || strings.ContainsAny(v, " \"=") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	kv("time", e.Time.Format(time.RFC3339Nano))
+	kv("client", e.ClientIP)
+	kv("proto", e.Protocol)
+	kv("domain", e.Domain)
+	kv("type", e.Type)
+	kv("upstream", e.Upstream)
+	kv("status", e.Status)
+	kv("duration_ms", strconv.FormatInt(e.DurationMs, 10))
+	kv("size", strconv.Itoa(e.ResponseSize))
+	kv("cache_hit", strconv.FormatBool(e.CacheHit))
+	kv("answer", e.Answer)
+	return b.String()
+}
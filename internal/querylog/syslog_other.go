@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package querylog
+
+import (
+	"errors"
+
+	"doh-autoproxy/internal/config"
+)
+
+func syslogDialer(cfg *config.SyslogConfig) (func() (syslogWriter, error), error) {
+	return nil, errors.New("当前平台不支持 syslog")
+}
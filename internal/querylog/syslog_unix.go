@@ -0,0 +1,45 @@
+//go:build !windows && !plan9
+
+package querylog
+
+import (
+	"fmt"
+	"log/syslog"
+	"strings"
+
+	"doh-autoproxy/internal/config"
+)
+
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL,
+	"daemon": syslog.LOG_DAEMON, "auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG,
+	"lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS, "uucp": syslog.LOG_UUCP,
+	"cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2,
+	"local3": syslog.LOG_LOCAL3, "local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5,
+	"local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// syslogDialer 校验配置并返回连接 syslog 的函数。network 与 address 为空时连接本机 syslog 守护进程 (/dev/log 等)。
+func syslogDialer(cfg *config.SyslogConfig) (func() (syslogWriter, error), error) {
+	facility := strings.ToLower(cfg.Facility)
+	if facility == "" {
+		facility = "daemon"
+	}
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("未知的 syslog facility: %s", cfg.Facility)
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "doh-autoproxy"
+	}
+	network, address := cfg.Network, cfg.Address
+	return func() (syslogWriter, error) {
+		w, err := syslog.Dial(network, address, priority|syslog.LOG_INFO, tag)
+		if err != nil {
+			return nil, err
+		}
+		return w, nil
+	}, nil
+}
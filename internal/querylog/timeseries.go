@@ -0,0 +1,85 @@
+package querylog
+
+import (
+	"time"
+)
+
+type TimePoint struct {
+	Time     time.Time `json:"time"`
+	Count    int64     `json:"count"`
+	CN       int64     `json:"cn"`
+	Overseas int64     `json:"overseas"`
+}
+
+// timeSeries 是固定长度的环形缓冲区，每个槽位对应一个 step 长度的时间桶。
+type timeSeries struct {
+	step    time.Duration
+	buckets []TimePoint
+}
+
+func newTimeSeries(step time.Duration, size int) *timeSeries {
+	return &timeSeries{step: step, buckets: make([]TimePoint, size)}
+}
+
+func (ts *timeSeries) slot(t time.Time) (*TimePoint, time.Time) {
+	start := t.Truncate(ts.step)
+	idx := int(start.Unix()/int64(ts.step/time.Second)) % len(ts.buckets)
+	return &ts.buckets[idx], start
+}
+
+func (ts *timeSeries) add(t time.Time, cn, overseas bool) {
+	b, start := ts.slot(t)
+	if !b.Time.Equal(start) {
+		if b.Time.After(start) {
+			return
+		}
+		*b = TimePoint{Time: start}
+	}
+	b.Count++
+	if cn {
+		b.CN++
+	}
+	if overseas {
+		b.Overseas++
+	}
+}
+
+// since 返回 [now-window, now] 内按时间升序排列的桶，缺失的桶以 0 填充。
+func (ts *timeSeries) since(now time.Time, window time.Duration) []TimePoint {
+	n := int(window / ts.step)
+	if n < 1 {
+		n = 1
+	}
+	if n > len(ts.buckets) {
+		n = len(ts.buckets)
+	}
+
+	end := now.Truncate(ts.step)
+	points := make([]TimePoint, 0, n)
+	for i := n - 1; i >= 0; i-- {
+		t := end.Add(-time.Duration(i) * ts.step)
+		b, start := ts.slot(t)
+		if b.Time.Equal(start) {
+			points = append(points, *b)
+		} else {
+			points = append(points, TimePoint{Time: start})
+		}
+	}
+	return points
+}
+
+// aggregate 将升序排列的桶按 interval 对齐合并。
+func aggregate(points []TimePoint, interval time.Duration) []TimePoint {
+	var out []TimePoint
+	for _, p := range points {
+		start := p.Time.Truncate(interval)
+		if len(out) == 0 || !out[len(out)-1].Time.Equal(start) {
+			out = append(out, TimePoint{Time: start})
+		}
+		last := &out[len(out)-1]
+		last.Count += p.Count
+		last.CN += p.CN
+		last.Overseas += p.Overseas
+	}
+	return out
+}
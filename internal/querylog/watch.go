@@ -0,0 +1,108 @@
+package querylog
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/util"
+)
+
+const (
+	defaultWatchCooldown = 5 * time.Minute
+	maxWatchAlerts       = 10000
+)
+
+// WatchAlert 是查询到关注域名时 POST 到 webhook 的 JSON 内容。
+type WatchAlert struct {
+	Event     string    `json:"event"` // 固定为 watch_domain
+	Timestamp time.Time `json:"timestamp"`
+	Domain    string    `json:"domain"`
+	Type      string    `json:"type"`
+	ClientIP  string    `json:"client_ip"`
+	Upstream  string    `json:"upstream"`
+	Status    string    `json:"status"`
+}
+
+// domainWatcher 在查询日志记录到关注域名时发送告警。
+// 同一域名与客户端的告警在 cooldown 内只发送一次，避免客户端反复查询时刷屏。
+type domainWatcher struct {
+	exact    map[string]bool
+	suffixes []string
+	url      string
+	cooldown time.Duration
+
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newDomainWatcher(domains []string, url string, cooldown time.Duration) *domainWatcher {
+	if len(domains) == 0 || url == "" {
+		return nil
+	}
+	if cooldown <= 0 {
+		cooldown = defaultWatchCooldown
+	}
+	w := &domainWatcher{
+		exact:    make(map[string]bool),
+		url:      url,
+		cooldown: cooldown,
+		last:     make(map[string]time.Time),
+	}
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if full, ok := strings.CutPrefix(d, "full:"); ok {
+			w.exact[strings.Trim(full, ".")] = true
+		} else if d = strings.Trim(d, "."); d != "" {
+			w.suffixes = append(w.suffixes, d)
+		}
+	}
+	return w
+}
+
+func (w *domainWatcher) match(domain string) bool {
+	if w.exact[domain] {
+		return true
+	}
+	for _, s := range w.suffixes {
+		if domain == s || strings.HasSuffix(domain, "."+s) {
+			return true
+		}
+	}
+	return false
+}
+
+// check 在 entry 命中关注域名且不在冷却期内时异步发送告警，不会阻塞查询处理。
+func (w *domainWatcher) check(entry *LogEntry) {
+	domain := strings.ToLower(strings.TrimSuffix(entry.Domain, "."))
+	if !w.match(domain) {
+		return
+	}
+
+	key := domain + "|" + entry.ClientIP
+	now := time.Now()
+	w.mu.Lock()
+	if t, ok := w.last[key]; ok && now.Sub(t) < w.cooldown {
+		w.mu.Unlock()
+		return
+	}
+	if len(w.last) >= maxWatchAlerts {
+		for k, t := range w.last {
+			if now.Sub(t) >= w.cooldown {
+				delete(w.last, k)
+			}
+		}
+	}
+	w.last[key] = now
+	w.mu.Unlock()
+
+	util.PostWebhook(w.url, WatchAlert{
+		Event:     "watch_domain",
+		Timestamp: entry.Time,
+		Domain:    domain,
+		Type:      entry.Type,
+		ClientIP:  entry.ClientIP,
+		Upstream:  entry.Upstream,
+		Status:    entry.Status,
+	})
+}
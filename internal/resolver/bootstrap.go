@@ -3,28 +3,101 @@ package resolver
 import (
 	"context"
 	"fmt"
+	"log"
 	"net"
+	"net/url"
+	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
+type bootstrapServer struct {
+	protocol string
+	addr     string
+	host     string
+}
+
+func (s bootstrapServer) String() string {
+	if s.protocol == "udp" {
+		return s.addr
+	}
+	return s.protocol + "://" + s.addr
+}
+
 type Bootstrapper struct {
-	servers []string
+	servers []bootstrapServer
 	counter uint64
+
+	// ranked 为启用 bootstrap_probe 后按响应时间排序、剔除不可用服务器的列表，未探测时为 nil (轮询全部服务器)
+	ranked atomic.Pointer[[]bootstrapServer]
 }
 
 func NewBootstrapper(servers []string) *Bootstrapper {
-	normalized := make([]string, len(servers))
-	for i, s := range servers {
-		if _, _, err := net.SplitHostPort(s); err != nil {
-			normalized[i] = net.JoinHostPort(s, "53")
-		} else {
-			normalized[i] = s
+	normalized := make([]bootstrapServer, 0, len(servers))
+	for _, s := range servers {
+		srv, err := parseBootstrapServer(s)
+		if err != nil {
+			log.Printf("忽略无效的 Bootstrap DNS: %s -> %v", s, err)
+			continue
 		}
+		normalized = append(normalized, srv)
 	}
 	return &Bootstrapper{servers: normalized}
 }
 
+func parseBootstrapServer(s string) (bootstrapServer, error) {
+	withPort := func(hostport, port string) string {
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			return net.JoinHostPort(strings.Trim(hostport, "[]"), port)
+		}
+		return hostport
+	}
+	requireIP := func(hostport string) (string, error) {
+		host, _, err := net.SplitHostPort(hostport)
+		if err != nil {
+			return "", err
+		}
+		if net.ParseIP(host) == nil {
+			return "", fmt.Errorf("加密 Bootstrap 服务器必须使用 IP 地址: %s", host)
+		}
+		return host, nil
+	}
+
+	switch {
+	case strings.HasPrefix(s, "tls://"):
+		addr := withPort(strings.TrimPrefix(s, "tls://"), "853")
+		host, err := requireIP(addr)
+		if err != nil {
+			return bootstrapServer{}, err
+		}
+		return bootstrapServer{protocol: "tls", addr: addr, host: host}, nil
+	case strings.HasPrefix(s, "quic://"):
+		addr := withPort(strings.TrimPrefix(s, "quic://"), "853")
+		host, err := requireIP(addr)
+		if err != nil {
+			return bootstrapServer{}, err
+		}
+		return bootstrapServer{protocol: "quic", addr: addr, host: host}, nil
+	case strings.HasPrefix(s, "https://"):
+		u, err := url.Parse(s)
+		if err != nil {
+			return bootstrapServer{}, err
+		}
+		if net.ParseIP(u.Hostname()) == nil {
+			return bootstrapServer{}, fmt.Errorf("加密 Bootstrap 服务器必须使用 IP 地址: %s", u.Hostname())
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/dns-query"
+		}
+		return bootstrapServer{protocol: "https", addr: strings.TrimPrefix(u.String(), "https://"), host: u.Hostname()}, nil
+	default:
+		addr := withPort(strings.TrimPrefix(s, "udp://"), "53")
+		return bootstrapServer{protocol: "udp", addr: addr}, nil
+	}
+}
+
 func (b *Bootstrapper) LookupIP(ctx context.Context, host string) (string, error) {
 	if ip := net.ParseIP(host); ip != nil {
 		return host, nil
@@ -41,8 +114,29 @@ func (b *Bootstrapper) LookupIP(ctx context.Context, host string) (string, error
 		return ips[0].String(), nil
 	}
 
+	if ranked := b.ranked.Load(); ranked != nil {
+		var lastErr error
+		for _, server := range *ranked {
+			ip, err := b.lookupVia(ctx, server, host)
+			if err == nil {
+				return ip, nil
+			}
+			lastErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return "", lastErr
+	}
+
 	idx := atomic.AddUint64(&b.counter, 1)
-	server := b.servers[idx%uint64(len(b.servers))]
+	return b.lookupVia(ctx, b.servers[idx%uint64(len(b.servers))], host)
+}
+
+func (b *Bootstrapper) lookupVia(ctx context.Context, server bootstrapServer, host string) (string, error) {
+	if server.protocol != "udp" {
+		return b.lookupSecure(ctx, server, host)
+	}
 
 	r := &net.Resolver{
 		PreferGo: true,
@@ -50,7 +144,7 @@ func (b *Bootstrapper) LookupIP(ctx context.Context, host string) (string, error
 			d := net.Dialer{
 				Timeout: 5 * time.Second,
 			}
-			return d.DialContext(ctx, "udp", server)
+			return d.DialContext(ctx, "udp", server.addr)
 		},
 	}
 
@@ -64,3 +158,31 @@ func (b *Bootstrapper) LookupIP(ctx context.Context, host string) (string, error
 
 	return ips[0].String(), nil
 }
+
+func (b *Bootstrapper) lookupSecure(ctx context.Context, server bootstrapServer, host string) (string, error) {
+	var lastErr error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(host), qtype)
+		req.RecursionDesired = true
+
+		resp, err := exchangeSecure(ctx, server, req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, ans := range resp.Answer {
+			switch rr := ans.(type) {
+			case *dns.A:
+				return rr.A.String(), nil
+			case *dns.AAAA:
+				return rr.AAAA.String(), nil
+			}
+		}
+	}
+
+	if lastErr != nil {
+		return "", fmt.Errorf("bootstrap %s failed for %s: %w", server, host, lastErr)
+	}
+	return "", fmt.Errorf("no IP found for %s via bootstrap %s", host, server)
+}
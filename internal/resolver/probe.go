@@ -0,0 +1,112 @@
+package resolver
+
+import (
+	"cmp"
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const probeTimeout = 3 * time.Second
+
+type probeResult struct {
+	server bootstrapServer
+	rtt    time.Duration
+	err    error
+}
+
+// RunProbe 立即并每隔 interval 测量一次各 Bootstrap 服务器的响应时间，直到 ctx 被取消。
+// 探测后 LookupIP 按响应时间从快到慢依次尝试，跳过探测失败的服务器；全部失败时恢复轮询全部服务器。
+func (b *Bootstrapper) RunProbe(ctx context.Context, interval time.Duration) {
+	if len(b.servers) < 2 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		b.probe(ctx, first)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe 探测全部服务器并更新排序，结果有变化 (或 verbose 为 true) 时记录日志。
+func (b *Bootstrapper) probe(ctx context.Context, verbose bool) {
+	results := make([]probeResult, len(b.servers))
+	var wg sync.WaitGroup
+	for i, server := range b.servers {
+		wg.Add(1)
+		go func(i int, server bootstrapServer) {
+			defer wg.Done()
+			results[i] = probeServer(ctx, server)
+		}(i, server)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	slices.SortStableFunc(results, func(a, b probeResult) int {
+		if (a.err == nil) != (b.err == nil) {
+			if a.err == nil {
+				return -1
+			}
+			return 1
+		}
+		return cmp.Compare(a.rtt, b.rtt)
+	})
+
+	var ranked []bootstrapServer
+	var summary []string
+	for _, res := range results {
+		if res.err != nil {
+			summary = append(summary, res.server.String()+" 不可用")
+			continue
+		}
+		ranked = append(ranked, res.server)
+		summary = append(summary, res.server.String()+" "+res.rtt.Round(time.Millisecond).String())
+	}
+
+	var old []bootstrapServer
+	if p := b.ranked.Load(); p != nil {
+		old = *p
+	}
+	if len(ranked) == 0 {
+		b.ranked.Store(nil)
+	} else {
+		b.ranked.Store(&ranked)
+	}
+	if verbose || !slices.Equal(old, ranked) {
+		log.Printf("Bootstrap DNS 探测结果: %s", strings.Join(summary, ", "))
+	}
+}
+
+// probeServer 向服务器查询根区 NS 记录，返回往返时间。
+func probeServer(ctx context.Context, server bootstrapServer) probeResult {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	req.RecursionDesired = true
+
+	start := time.Now()
+	var err error
+	if server.protocol == "udp" {
+		cli := &dns.Client{Net: "udp", Timeout: probeTimeout}
+		_, _, err = cli.ExchangeContext(ctx, req, server.addr)
+	} else {
+		_, err = exchangeSecure(ctx, server, req)
+	}
+	return probeResult{server: server, rtt: time.Since(start), err: err}
+}
@@ -0,0 +1,127 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+var bootstrapHTTPClient = &http.Client{
+	Transport: &http.Transport{
+		ForceAttemptHTTP2:   true,
+		TLSHandshakeTimeout: 5 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	},
+	Timeout: 5 * time.Second,
+}
+
+func exchangeSecure(ctx context.Context, server bootstrapServer, req *dns.Msg) (*dns.Msg, error) {
+	switch server.protocol {
+	case "tls":
+		cli := &dns.Client{
+			Net:       "tcp-tls",
+			Timeout:   5 * time.Second,
+			TLSConfig: &tls.Config{ServerName: server.host},
+		}
+		resp, _, err := cli.ExchangeContext(ctx, req, server.addr)
+		return resp, err
+	case "https":
+		return exchangeHTTPS(ctx, server, req)
+	case "quic":
+		return exchangeQUIC(ctx, server, req)
+	default:
+		return nil, fmt.Errorf("不支持的 Bootstrap 协议: %s", server.protocol)
+	}
+}
+
+func exchangeHTTPS(ctx context.Context, server bootstrapServer, req *dns.Msg) (*dns.Msg, error) {
+	msgBuf, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+server.addr, bytes.NewReader(msgBuf))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+
+	resp, err := bootstrapHTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH bootstrap 返回非OK状态码: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(body); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func exchangeQUIC(ctx context.Context, server bootstrapServer, req *dns.Msg) (*dns.Msg, error) {
+	id := req.Id
+	req.Id = 0
+	msgBuf, err := req.Pack()
+	req.Id = id
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName: server.host,
+		NextProtos: []string{"doq"},
+	}
+	conn, err := quic.DialAddr(ctx, server.addr, tlsConfig, &quic.Config{MaxIdleTimeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 2+len(msgBuf))
+	binary.BigEndian.PutUint16(frame, uint16(len(msgBuf)))
+	copy(frame[2:], msgBuf)
+	if _, err := stream.Write(frame); err != nil {
+		return nil, err
+	}
+	stream.Close()
+
+	lengthBytes := make([]byte, 2)
+	if _, err := io.ReadFull(stream, lengthBytes); err != nil {
+		return nil, err
+	}
+	respBuf := make([]byte, binary.BigEndian.Uint16(lengthBytes))
+	if _, err := io.ReadFull(stream, respBuf); err != nil {
+		return nil, err
+	}
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(respBuf); err != nil {
+		return nil, err
+	}
+	msg.Id = id
+	return msg, nil
+}
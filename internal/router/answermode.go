@@ -0,0 +1,94 @@
+package router
+
+import (
+	"github.com/miekg/dns"
+)
+
+// blockedFamily 根据 answer_mode 返回需要屏蔽的地址记录类型，dual (默认) 时返回 0。
+func (r *Router) blockedFamily() uint16 {
+	switch r.config.AnswerMode {
+	case "ipv4_only":
+		return dns.TypeAAAA
+	case "ipv6_only":
+		return dns.TypeA
+	}
+	return 0
+}
+
+// answerModeNoData 对被屏蔽地址族的查询直接返回 NODATA，不再请求上游。
+func (r *Router) answerModeNoData(req *dns.Msg) *dns.Msg {
+	blocked := r.blockedFamily()
+	if blocked == 0 || req.Question[0].Qtype != blocked {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Ns = []dns.RR{noDataSOA(req.Question[0].Name)}
+	return m
+}
+
+// noDataSOA 返回本地合成 NODATA 应答的权威段 SOA，使客户端可按 RFC 2308 缓存该否定应答 (60 秒)。
+func noDataSOA(name string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster.localhost.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  60,
+	}
+}
+
+// filterAnswerMode 从应答中剔除被屏蔽地址族的记录 (例如 ANY 查询或 CNAME 链中夹带的记录)。
+func (r *Router) filterAnswerMode(resp *dns.Msg) {
+	blocked := r.blockedFamily()
+	if blocked == 0 || resp == nil {
+		return
+	}
+	resp.Answer = dropType(resp.Answer, blocked)
+	resp.Extra = dropType(resp.Extra, blocked)
+	dropSVCBHints(resp.Answer, blocked)
+	dropSVCBHints(resp.Extra, blocked)
+}
+
+// dropSVCBHints 删除 HTTPS/SVCB 记录中被屏蔽地址族的地址提示 (ipv4hint / ipv6hint)，
+// 否则浏览器可能直接使用提示中的地址连接。ECH 等其他参数保持不变。
+func dropSVCBHints(rrs []dns.RR, blocked uint16) {
+	for _, rr := range rrs {
+		var svcb *dns.SVCB
+		switch v := rr.(type) {
+		case *dns.HTTPS:
+			svcb = &v.SVCB
+		case *dns.SVCB:
+			svcb = v
+		default:
+			continue
+		}
+		values := svcb.Value[:0]
+		for _, kv := range svcb.Value {
+			if blocked == dns.TypeA && kv.Key() == dns.SVCB_IPV4HINT ||
+				blocked == dns.TypeAAAA && kv.Key() == dns.SVCB_IPV6HINT {
+				continue
+			}
+			values = append(values, kv)
+		}
+		svcb.Value = values
+	}
+}
+
+func dropType(rrs []dns.RR, t uint16) []dns.RR {
+	out := rrs[:0]
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == t {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == t {
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
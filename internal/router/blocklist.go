@@ -0,0 +1,224 @@
+package router
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Blocklist 是从 blocklist_urls 订阅并合并去重后的屏蔽域名集合，按完整域名匹配。
+type Blocklist struct {
+	domains map[string]struct{}
+	sources []BlocklistSource
+}
+
+// BlocklistSource 记录单个订阅列表的加载情况。
+// Domains 为该列表解析出的域名数 (未跨列表去重)，Updated 为本地缓存文件的更新时间。
+type BlocklistSource struct {
+	URL     string     `json:"url"`
+	Domains int        `json:"domains"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Error   string     `json:"error,omitempty"`
+
+	path    string // 本地缓存文件，与 size、Updated 一起判断缓存是否变化
+	size    int64
+	domains []string // 该列表解析出的域名，缓存未变化时重新加载直接复用
+}
+
+// BlocklistStats 汇总屏蔽列表的加载情况，Total 为去重后的域名数。
+type BlocklistStats struct {
+	Total   int               `json:"total"`
+	Sources []BlocklistSource `json:"sources"`
+}
+
+// hostsLocalNames 是 hosts 格式列表中常见的本机条目，不应被屏蔽。
+var hostsLocalNames = map[string]bool{
+	"localhost": true, "localhost.localdomain": true, "local": true,
+	"broadcasthost": true, "ip6-localhost": true, "ip6-loopback": true,
+	"ip6-localnet": true, "ip6-mcastprefix": true, "ip6-allnodes": true,
+	"ip6-allrouters": true, "ip6-allhosts": true, "0.0.0.0": true,
+}
+
+// BlocklistCachePath 返回订阅 url 在 cacheDir 中的本地缓存文件路径。
+func BlocklistCachePath(cacheDir, url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:8])+".txt")
+}
+
+// errNotDownloaded 是缓存文件尚不存在的列表的错误说明。
+const errNotDownloaded = "尚未下载成功"
+
+// LoadBlocklist 从本地缓存加载所有订阅列表并去重合并。
+// 缓存不存在或解析失败的列表记录错误后跳过，不影响其他列表。
+// prev 为上一次加载的结果 (可为 nil)：缓存文件未变化的列表直接复用其解析结果，全部未变化时返回 prev 本身。
+func LoadBlocklist(urls []string, cacheDir string, prev *Blocklist) *Blocklist {
+	parsed := make(map[string]BlocklistSource)
+	if prev != nil {
+		for _, src := range prev.sources {
+			parsed[src.path] = src
+		}
+	}
+
+	b := &Blocklist{}
+	unchanged := prev != nil && len(prev.sources) == len(urls)
+	total := 0
+	for i, url := range urls {
+		path := BlocklistCachePath(cacheDir, url)
+		src := BlocklistSource{URL: url, path: path}
+		old, seen := parsed[path]
+		fi, err := os.Stat(path)
+		switch {
+		case seen && err == nil && old.Error == "" && old.size == fi.Size() && old.Updated.Equal(fi.ModTime()):
+			src = old
+		case seen && os.IsNotExist(err) && old.Error == errNotDownloaded:
+			src = old
+		default:
+			unchanged = false
+			if err == nil {
+				src.domains, err = readBlocklistFile(path)
+			}
+			switch {
+			case os.IsNotExist(err):
+				src.Error = errNotDownloaded
+			case err != nil:
+				src.Error = err.Error()
+			default:
+				src.Domains = len(src.domains)
+				updated := fi.ModTime()
+				src.Updated, src.size = &updated, fi.Size()
+			}
+		}
+		if unchanged && prev.sources[i].path != path {
+			unchanged = false
+		}
+		total += len(src.domains)
+		b.sources = append(b.sources, src)
+	}
+	if unchanged {
+		return prev
+	}
+
+	b.domains = make(map[string]struct{}, total)
+	for _, src := range b.sources {
+		for _, domain := range src.domains {
+			b.domains[domain] = struct{}{}
+		}
+	}
+	log.Printf("已加载屏蔽列表: %d 个订阅，去重后共 %d 个域名", len(urls), len(b.domains))
+	return b
+}
+
+func readBlocklistFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var domains []string
+	_, err = ParseBlocklist(f, func(domain string) {
+		domains = append(domains, domain)
+	})
+	return domains, err
+}
+
+// ParseBlocklist 解析 hosts 格式 (IP 域名 [域名...]) 或每行一个域名的列表，
+// 对每个域名调用 add 并返回解析出的域名数。# 与 ! 开头的行视为注释。
+func ParseBlocklist(r io.Reader, add func(domain string)) (int, error) {
+	n := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line == "" || strings.HasPrefix(line, "!") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		} else if len(fields) > 1 {
+			continue
+		}
+		for _, domain := range fields {
+			domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+			if hostsLocalNames[domain] || net.ParseIP(domain) != nil {
+				continue
+			}
+			if _, ok := dns.IsDomainName(domain); !ok || !strings.Contains(domain, ".") {
+				continue
+			}
+			add(domain)
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+// VerifyBlocklist 用于下载校验：文件中至少要能解析出一个域名，
+// 避免把错误页面等内容当作空列表覆盖本地缓存。
+func VerifyBlocklist(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := ParseBlocklist(f, func(string) {})
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("未解析到任何域名")
+	}
+	return nil
+}
+
+// Contains 报告 name 是否在屏蔽列表中，b 为 nil 时返回 false。
+func (b *Blocklist) Contains(name string) bool {
+	if b == nil {
+		return false
+	}
+	_, ok := b.domains[name]
+	return ok
+}
+
+func (b *Blocklist) Stats() BlocklistStats {
+	if b == nil {
+		return BlocklistStats{Sources: []BlocklistSource{}}
+	}
+	return BlocklistStats{Total: len(b.domains), Sources: b.sources}
+}
+
+// SetBlocklist 原子替换屏蔽列表并清空缓存，使已缓存的应答不再绕过新列表。
+func (r *Router) SetBlocklist(b *Blocklist) {
+	r.blocklist.Store(b)
+	if r.cache != nil {
+		r.cache.Flush()
+	}
+}
+
+func (r *Router) BlocklistStats() BlocklistStats {
+	return r.blocklist.Load().Stats()
+}
+
+// blocked 对命中屏蔽列表的查询返回 NXDOMAIN。
+func (r *Router) blocked(req *dns.Msg, qName string) *dns.Msg {
+	if !r.blocklist.Load().Contains(qName) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNameError)
+	m.RecursionAvailable = true
+	return m
+}
@@ -0,0 +1,107 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/client"
+	"doh-autoproxy/internal/util"
+)
+
+// RunCanary 周期性地向每个上游查询已知存在的金丝雀域名，直到 ctx 被取消。
+func (r *Router) RunCanary(ctx context.Context) {
+	cfg := r.config.Canary
+	if !cfg.Enabled {
+		return
+	}
+
+	interval := time.Duration(cfg.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	cnDomain := cfg.CNDomain
+	if cnDomain == "" {
+		cnDomain = "www.baidu.com"
+	}
+	overseasDomain := cfg.OverseasDomain
+	if overseasDomain == "" {
+		overseasDomain = "www.google.com"
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, sc := range r.cnStats {
+			wg.Add(1)
+			go func(sc *client.StatsClient) {
+				defer wg.Done()
+				r.checkCanary(ctx, sc, cnDomain)
+			}(sc)
+		}
+		for _, sc := range r.overseasStats {
+			wg.Add(1)
+			go func(sc *client.StatsClient) {
+				defer wg.Done()
+				r.checkCanary(ctx, sc, overseasDomain)
+			}(sc)
+		}
+		wg.Wait()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Router) checkCanary(ctx context.Context, sc *client.StatsClient, domain string) {
+	checkCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	ok, changed, err := sc.Canary(checkCtx, domain)
+	if ctx.Err() != nil || !changed {
+		return
+	}
+
+	state := "up"
+	detail := ""
+	if !ok {
+		state = "down"
+		detail = err.Error()
+		log.Printf("金丝雀检测失败，上游 %s (%s) 已标记为异常: %v", sc.Address, sc.Group, err)
+	} else {
+		log.Printf("金丝雀检测恢复，上游 %s (%s) 已恢复正常", sc.Address, sc.Group)
+	}
+
+	r.notify("upstream_"+state, fmt.Sprintf("%s (%s) canary %s: %s", sc.Address, sc.Group, domain, detail))
+	util.PostWebhook(r.config.Canary.WebhookURL, map[string]interface{}{
+		"event":     "upstream_" + state,
+		"timestamp": time.Now(),
+		"upstream":  sc.Address,
+		"group":     sc.Group,
+		"domain":    domain,
+		"detail":    detail,
+	})
+}
+
+func (r *Router) notify(event, detail string) {
+	util.Notify(r.config.Notifications.WebhookURL, event, detail)
+}
+
+func (r *Router) watchHealth(sc *client.StatsClient) {
+	sc.SetHealthHook(func(healthy bool) {
+		if healthy {
+			log.Printf("上游 %s (%s) 已恢复正常", sc.Address, sc.Group)
+			r.notify("upstream_up", fmt.Sprintf("%s (%s) recovered", sc.Address, sc.Group))
+			return
+		}
+		log.Printf("上游 %s (%s) 连续失败，已标记为异常", sc.Address, sc.Group)
+		r.notify("upstream_down", fmt.Sprintf("%s (%s) failed %d consecutive queries", sc.Address, sc.Group, client.UnhealthyThreshold))
+	})
+}
@@ -0,0 +1,35 @@
+package router
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// answerChaos 在本地应答 CHAOS 类查询 (version.bind、hostname.bind 等)，不转发到上游。
+// 未配置对应字符串或查询其他名称时返回 REFUSED。
+func (r *Router) answerChaos(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	q := req.Question[0]
+	var value string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		value = r.config.Chaos.Version
+	case "hostname.bind.", "id.server.":
+		value = r.config.Chaos.Hostname
+	}
+
+	if value == "" || (q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY) {
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+
+	m.Authoritative = true
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+		Txt: []string{value},
+	})
+	return m
+}
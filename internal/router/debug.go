@@ -0,0 +1,54 @@
+package router
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"doh-autoproxy/internal/client"
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/resolver"
+
+	"github.com/miekg/dns"
+)
+
+// newDebugClient 按 debug_upstream 创建临时上游，未配置时返回 nil。
+func newDebugClient(cfg *config.DebugUpstreamConfig, bootstrapper *resolver.Bootstrapper) *client.StatsClient {
+	if cfg == nil || cfg.Address == "" {
+		return nil
+	}
+	c, err := client.NewDNSClient(cfg.UpstreamServer, bootstrapper)
+	if err != nil {
+		log.Printf("Failed to initialize debug upstream %s: %v", cfg.Address, err)
+		return nil
+	}
+	scope := "所有查询"
+	if len(cfg.Domains) > 0 {
+		scope = "匹配 " + strings.Join(cfg.Domains, ", ") + " 的查询"
+	}
+	log.Printf("警告: 已启用调试上游 %s (%s)，%s将绕过分流规则与缓存直接发往该上游，仅用于临时测试", cfg.Address, cfg.Protocol, scope)
+	return client.NewStatsClient(c, cfg.Address, cfg.Protocol, "Debug")
+}
+
+// debugMatch 判断查询是否应发往调试上游：未配置 domains 时匹配全部，否则按域名后缀匹配。
+func (r *Router) debugMatch(qName string) bool {
+	if r.debugClient == nil {
+		return false
+	}
+	domains := r.config.DebugUpstream.Domains
+	if len(domains) == 0 {
+		return true
+	}
+	name := strings.ToLower(strings.TrimSuffix(qName, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Router) resolveDebug(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return r.debugClient.Resolve(ctx, req.Copy())
+}
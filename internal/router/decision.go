@@ -0,0 +1,252 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// 分流决定的目标分组。groupGeoIP 表示需要先经 default_group 分组解析、再按应答 IP 判断。
+const (
+	groupCN       = "cn"
+	groupOverseas = "overseas"
+	groupBoth     = "both"
+	groupDirect   = "direct"
+	groupLocal    = "local"
+	groupBlock    = "block"
+	groupGeoIP    = "geoip"
+)
+
+// decision 是 routeInternal 在发出任何上游查询前作出的分流决定。
+// 本地即可应答的分支 (Hosts、Zone、屏蔽等) 直接携带 answer 或 err。
+type decision struct {
+	branch string // Identity, Policy, Hosts, Zone, Local, Blocklist, Rule, Regex, DGA, PTR, GeoSite, GeoIP
+	group  string
+	label  string // 写入查询日志与分流统计的名称，如 Rule(CN)
+	answer *dns.Msg
+	err    error
+
+	dgaEntropy float64 // 命中 DGA 检测时的熵值，action 为 log 时决定本身不受影响
+}
+
+var groupLabels = map[string]string{groupCN: "CN", groupOverseas: "Overseas", groupBoth: "Both", groupDirect: "Direct"}
+
+// decide 按本服务器自身名称、Hosts、Zone、本地域名、屏蔽列表、Policy、规则、正则、DGA、PTR、GeoSite 的顺序决定查询的去向，
+// 均未命中时返回 GeoIP 分支。不访问任何上游，因此也用于路由预览。
+func (r *Router) decide(req *dns.Msg, qName string, policy *clientPolicy) decision {
+	if r.identity != nil {
+		if resp, ok := r.identity.Answer(req); ok {
+			return decision{branch: "Identity", group: groupLocal, label: "Identity", answer: resp}
+		}
+	}
+
+	if ipStr, ok := lookupHosts(r.config.Hosts, qName); ok {
+		d := decision{branch: "Hosts", group: groupLocal, label: "Hosts"}
+		d.answer, d.err = hostsAnswer(req, qName, ipStr)
+		return d
+	}
+
+	for _, z := range r.zones {
+		if resp, ok := z.Answer(req); ok {
+			return decision{branch: "Zone", group: groupLocal, label: "Zone", answer: resp}
+		}
+	}
+
+	if r.isLocalDomain(qName) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeNameError)
+		m.RecursionAvailable = true
+		return decision{branch: "Local", group: groupLocal, label: "Local", answer: m}
+	}
+
+	if m := r.blocked(req, qName); m != nil {
+		return decision{branch: "Blocklist", group: groupBlock, label: "Blocklist", answer: m}
+	}
+
+	// 策略在规则这一层生效：force_group 与策略规则都不绕过 Hosts、区域文件、本地域名与屏蔽列表
+	rules, regexRules := r.config.Rules, r.regexRules
+	if policy != nil {
+		switch policy.forceGroup {
+		case "cn", "overseas":
+			group := policy.forceGroup
+			return decision{branch: "Policy", group: group, label: "Policy(" + policy.name + ")/" + groupLabels[group]}
+		}
+		if policy.rules != nil {
+			rules, regexRules = policy.rules, policy.regexRules
+		}
+	}
+
+	if rule, ok := rules[qName]; ok {
+		group := strings.ToLower(rule)
+		if isBlockTarget(group) {
+			return decision{branch: "Rule", group: groupBlock, label: "Rule(Block)", answer: r.ruleBlocked(req)}
+		}
+		if groupLabels[group] != "" {
+			return decision{branch: "Rule", group: group, label: "Rule(" + groupLabels[group] + ")"}
+		}
+	}
+
+	for _, rr := range regexRules {
+		if rr.Pattern.MatchString(qName) {
+			group := strings.ToLower(rr.Target)
+			if isBlockTarget(group) {
+				return decision{branch: "Regex", group: groupBlock, label: "Rule(Block)", answer: r.ruleBlocked(req)}
+			}
+			if groupLabels[group] != "" {
+				return decision{branch: "Regex", group: group, label: "Rule(Regex/" + groupLabels[group] + ")"}
+			}
+		}
+	}
+
+	var dgaEntropy float64
+	if h, ok := r.matchDGA(qName); ok {
+		dgaEntropy = h
+		switch strings.ToLower(r.config.DGADetection.Action) {
+		case "block":
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeNameError)
+			m.RecursionAvailable = true
+			return decision{branch: "DGA", group: groupBlock, label: "DGA(Block)", answer: m, dgaEntropy: h}
+		case "cn":
+			return decision{branch: "DGA", group: groupCN, label: "DGA(CN)", dgaEntropy: h}
+		case "overseas":
+			return decision{branch: "DGA", group: groupOverseas, label: "DGA(Overseas)", dgaEntropy: h}
+		}
+	}
+
+	geo := r.geo.Load()
+	if ip := reverseIP(qName); ip != nil {
+		if geo.IsCNIP(ip) {
+			return decision{branch: "PTR", group: groupCN, label: "PTR(CN)", dgaEntropy: dgaEntropy}
+		}
+		return decision{branch: "PTR", group: groupOverseas, label: "PTR(Overseas)", dgaEntropy: dgaEntropy}
+	}
+
+	if geoSiteRule := geo.LookupGeoSite(qName); geoSiteRule != "" {
+		if strings.ToLower(geoSiteRule) == "cn" {
+			return decision{branch: "GeoSite", group: groupCN, label: "GeoSite(CN)", dgaEntropy: dgaEntropy}
+		}
+		return decision{branch: "GeoSite", group: groupOverseas, label: "GeoSite(Overseas)", dgaEntropy: dgaEntropy}
+	}
+
+	return decision{branch: "GeoIP", group: groupGeoIP, label: "GeoIP", dgaEntropy: dgaEntropy}
+}
+
+// isBlockTarget 报告规则目标是否为 block (或同义的 reject)。
+func isBlockTarget(target string) bool {
+	return target == "block" || target == "reject"
+}
+
+// ruleBlocked 构造 block 规则的应答：默认 NXDOMAIN，rule_block_response 为 empty 时返回不含记录的 NOERROR。
+func (r *Router) ruleBlocked(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	if strings.ToLower(r.config.RuleBlockResponse) == "empty" {
+		m.SetReply(req)
+	} else {
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+	m.RecursionAvailable = true
+	return m
+}
+
+// isLocalDomain 报告 qName 是否属于 local_domains。这些域名只由 hosts 与区域文件应答，
+// 本地没有数据时返回 NXDOMAIN，不会转发到上游而泄露内部名称。
+func (r *Router) isLocalDomain(qName string) bool {
+	for _, d := range r.localDomains {
+		if qName == d || strings.HasSuffix(qName, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupHosts 先按完整域名查找 hosts，再查找以 "." 开头的后缀条目 (如 .example.com 匹配该域名及其所有子域名)，
+// 越具体的后缀越优先。
+func lookupHosts(hosts map[string]string, qName string) (string, bool) {
+	if ip, ok := hosts[qName]; ok {
+		return ip, true
+	}
+	for name := qName; name != ""; {
+		if ip, ok := hosts["."+name]; ok {
+			return ip, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return "", false
+}
+
+func hostsAnswer(req *dns.Msg, qName, ipStr string) (*dns.Msg, error) {
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return nil, fmt.Errorf("自定义Hosts中存在无效IP地址: %s for %s", ipStr, qName)
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	rrHeader := dns.RR_Header{
+		Name:   req.Question[0].Name,
+		Rrtype: dns.TypeA,
+		Class:  dns.ClassINET,
+		Ttl:    60,
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		m.Answer = append(m.Answer, &dns.A{Hdr: rrHeader, A: ipv4})
+	} else {
+		rrHeader.Rrtype = dns.TypeAAAA
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: ip})
+	}
+	return m, nil
+}
+
+// RoutePreview 是单个域名的路由预览结果。
+// Group 为 geoip 时表示需要先经 default_group 分组解析，再按应答 IP 是否属于中国决定最终分组；
+// 该域名已有缓存的 GeoIP 判定时直接给出分组，并将 Cached 置为 true。
+type RoutePreview struct {
+	Domain string   `json:"domain"`
+	Branch string   `json:"branch"`
+	Group  string   `json:"group"`
+	Label  string   `json:"label"`
+	Cached bool     `json:"cached,omitempty"`
+	Answer []string `json:"answer,omitempty"` // Hosts / Zone 的本地应答
+	Error  string   `json:"error,omitempty"`
+}
+
+// PreviewRoute 返回 routeInternal 对 domain 的 qtype 查询将会选择的分支与分组，不访问任何上游。
+// clientIP 不为空时按客户端策略匹配，与实际查询一样生效策略中的强制分组与独立规则。
+func (r *Router) PreviewRoute(domain string, qtype uint16, clientIP string) RoutePreview {
+	qName := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	p := RoutePreview{Domain: qName}
+	if _, ok := dns.IsDomainName(qName); !ok || qName == "" {
+		p.Error = "无效的域名"
+		return p
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(qName), qtype)
+	d := r.decide(req, qName, r.matchPolicy(clientIP, ""))
+	p.Branch, p.Group, p.Label = d.branch, d.group, d.label
+	if d.group == groupGeoIP {
+		if cn, ok := r.geoDecisions.get(probeName(qName)); ok {
+			p.Group, p.Label, p.Cached = groupOverseas, "GeoIP(Overseas)", true
+			if cn {
+				p.Group, p.Label = groupCN, "GeoIP(CN)"
+			}
+		}
+	}
+	if d.err != nil {
+		p.Error = d.err.Error()
+	}
+	if d.answer != nil {
+		for _, rr := range d.answer.Answer {
+			parts := strings.Fields(rr.String())
+			p.Answer = append(p.Answer, strings.Join(parts[min(len(parts), 3):], " "))
+		}
+	}
+	return p
+}
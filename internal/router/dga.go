@@ -0,0 +1,56 @@
+package router
+
+import (
+	"math"
+	"strings"
+)
+
+// dgaLabel 返回用于 DGA 检测的二级域名标签 (如 x1b9k3q7.com 中的 x1b9k3q7)。
+// 未处理 co.uk 等多级公共后缀，此时取到的是公共后缀的一部分，通常熵较低不会误判。
+func dgaLabel(qName string) string {
+	labels := strings.Split(qName, ".")
+	if len(labels) < 2 {
+		return ""
+	}
+	return labels[len(labels)-2]
+}
+
+func shannonEntropy(s string) float64 {
+	if s == "" {
+		return 0
+	}
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+	var h float64
+	n := float64(len(s))
+	for _, c := range counts {
+		p := float64(c) / n
+		h -= p * math.Log2(p)
+	}
+	return h
+}
+
+// matchDGA 判断域名的二级标签是否像 DGA 生成的随机字符串，返回标签的熵。
+func (r *Router) matchDGA(qName string) (float64, bool) {
+	cfg := r.config.DGADetection
+	if !cfg.Enabled {
+		return 0, false
+	}
+	minEntropy := cfg.MinEntropy
+	if minEntropy <= 0 {
+		minEntropy = 3.8
+	}
+	minLength := cfg.MinLength
+	if minLength <= 0 {
+		minLength = 12
+	}
+
+	label := dgaLabel(qName)
+	if len(label) < minLength {
+		return 0, false
+	}
+	h := shannonEntropy(label)
+	return h, h >= minEntropy
+}
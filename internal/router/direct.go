@@ -0,0 +1,173 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/client"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	resolvConfPath    = "/etc/resolv.conf"
+	resolvConfRefresh = 30 * time.Second
+)
+
+var (
+	resolvConfMu      sync.Mutex
+	resolvConfServers []string
+	resolvConfErr     error
+	resolvConfLoaded  time.Time
+
+	localAddrsMu     sync.Mutex
+	localAddrs       []net.IP
+	localAddrsLoaded time.Time
+)
+
+// systemNameservers 返回 /etc/resolv.conf 中的 nameserver (host:port)，结果缓存 30 秒，
+// 以便跟随 DHCP / VPN 对系统 DNS 的修改。文件无法读取时返回错误。
+func systemNameservers() ([]string, error) {
+	resolvConfMu.Lock()
+	defer resolvConfMu.Unlock()
+	if time.Since(resolvConfLoaded) < resolvConfRefresh {
+		return resolvConfServers, resolvConfErr
+	}
+	resolvConfLoaded = time.Now()
+	resolvConfServers = nil
+	cc, err := dns.ClientConfigFromFile(resolvConfPath)
+	resolvConfErr = err
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range cc.Servers {
+		resolvConfServers = append(resolvConfServers, net.JoinHostPort(s, cc.Port))
+	}
+	return resolvConfServers, nil
+}
+
+// isLocalAddr 报告 ip 是否为本机网卡上的地址。网卡地址列表与 resolv.conf 一样缓存 30 秒。
+func isLocalAddr(ip net.IP) bool {
+	localAddrsMu.Lock()
+	defer localAddrsMu.Unlock()
+	if time.Since(localAddrsLoaded) >= resolvConfRefresh {
+		localAddrsLoaded = time.Now()
+		localAddrs = nil
+		addrs, _ := net.InterfaceAddrs()
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				localAddrs = append(localAddrs, n.IP)
+			}
+		}
+	}
+	for _, local := range localAddrs {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isOwnListener 报告 addr 是否指向本程序的 DNS 监听地址。系统 DNS 指向本程序时转发会形成环路。
+func (r *Router) isOwnListener(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	for _, listen := range []string{r.config.Listen.DNSUDP, r.config.Listen.DNSTCP} {
+		lhost, lport, err := net.SplitHostPort(listen)
+		if err != nil || lport != port {
+			continue
+		}
+		lip := net.ParseIP(lhost)
+		if lip == nil || lip.IsUnspecified() {
+			// 监听通配地址时，本机任一网卡地址 (如路由器 resolv.conf 中常见的 LAN 地址) 都会回到本程序
+			if ip != nil && (ip.IsLoopback() || isLocalAddr(ip)) {
+				return true
+			}
+			continue
+		}
+		if lip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveDirect 处理 direct 规则：绕过 CN/海外分组，把查询原样转发给系统 DNS (/etc/resolv.conf)，
+// 适用于强制门户检测、公司内网域名等需要使用本地网络 DNS 的场景。
+// 无法读取系统 DNS 配置 (如 Windows) 时改用 net.DefaultResolver，此时只支持 A/AAAA 查询。
+// 系统 DNS 全部指向本程序自身 (或没有配置 nameserver) 时返回错误，不能再交给 net.DefaultResolver，否则查询会回到本程序形成环路。
+func (r *Router) resolveDirect(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	nameservers, err := systemNameservers()
+	if err != nil {
+		return resolveDirectFallback(ctx, req)
+	}
+	var servers []string
+	for _, s := range nameservers {
+		if !r.isOwnListener(s) {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("%s 中没有除本程序以外的 DNS 服务器，无法处理 direct 规则", resolvConfPath)
+	}
+
+	var lastErr error
+	for _, server := range servers {
+		cli := &dns.Client{Net: "udp", Timeout: 3 * time.Second}
+		resp, _, err := cli.ExchangeContext(ctx, req, server)
+		if err == nil && resp.Truncated {
+			cli.Net = "tcp"
+			resp, _, err = cli.ExchangeContext(ctx, req, server)
+		}
+		if err == nil {
+			err = client.CheckQuestion(req, resp)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("系统 DNS 查询失败: %w", lastErr)
+}
+
+func resolveDirectFallback(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	network := "ip4"
+	switch q.Qtype {
+	case dns.TypeA:
+	case dns.TypeAAAA:
+		network = "ip6"
+	default:
+		return nil, fmt.Errorf("无法读取系统 DNS 配置，direct 规则仅支持 A/AAAA 查询")
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, q.Name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			m.Rcode = dns.RcodeNameError
+			return m, nil
+		}
+		return nil, fmt.Errorf("系统 DNS 查询失败: %w", err)
+	}
+	for _, ip := range ips {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		if q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip})
+		} else {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m, nil
+}
@@ -38,6 +38,25 @@ func NewGeoDataManager(geoipPath, geositePath string) (*GeoDataManager, error) {
 	}, nil
 }
 
+// Empty 报告是否未加载任何 Geo 数据 (geo_data.required 为 false 且加载失败时使用的空管理器)。
+// 空管理器 (以及 nil) 的查询均视为未命中。
+func (g *GeoDataManager) Empty() bool {
+	return g == nil || (g.geoip == nil && g.geosite == nil)
+}
+
+// SetGeo 原子替换路由器使用的 Geo 数据，进行中的查询继续使用旧数据。
+// 替换后清空响应缓存，使按旧数据分流的结果不再被复用。
+func (r *Router) SetGeo(g *GeoDataManager) {
+	if g == nil {
+		g = &GeoDataManager{}
+	}
+	r.geo.Store(g)
+	r.geoDecisions.flush()
+	if r.cache != nil {
+		r.cache.Flush()
+	}
+}
+
 func VerifyGeoIP(path string) error {
 	_, err := geoip.FromFile(path)
 	return err
@@ -49,7 +68,7 @@ func VerifyGeoSite(path string) error {
 }
 
 func (g *GeoDataManager) IsCNIP(ip net.IP) bool {
-	if g.geoip == nil {
+	if g == nil || g.geoip == nil {
 		return false
 	}
 	codes := g.geoip.LookupCode(ip)
@@ -62,7 +81,7 @@ func (g *GeoDataManager) IsCNIP(ip net.IP) bool {
 }
 
 func (g *GeoDataManager) LookupGeoSite(domain string) string {
-	if g.geosite == nil {
+	if g == nil || g.geosite == nil {
 		return ""
 	}
 
@@ -0,0 +1,181 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"doh-autoproxy/internal/client"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	geoDecisionMaxEntries = 8192
+	geoDecisionMinTTL     = 60 * time.Second
+	geoDecisionMaxTTL     = time.Hour
+)
+
+// geoDecisionCache 记录 GeoIP 分支对每个域名的判定结果 (应答 IP 是否属于中国)，有效期取应答 TTL。
+// 命中时直接查询对应分组，省去先经 default_group 分组解析再判断的过程；MX/TXT 等非地址查询也借此免去探测查询。
+// 重载配置时随路由器重建，热更新 Geo 数据时清空。
+type geoDecisionCache struct {
+	mu      sync.Mutex
+	entries map[string]geoDecision
+}
+
+type geoDecision struct {
+	cn      bool
+	expires time.Time
+}
+
+func newGeoDecisionCache() *geoDecisionCache {
+	return &geoDecisionCache{entries: make(map[string]geoDecision)}
+}
+
+func (c *geoDecisionCache) get(domain string) (cn, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d, ok := c.entries[domain]
+	if !ok || time.Now().After(d.expires) {
+		return false, false
+	}
+	return d.cn, true
+}
+
+func (c *geoDecisionCache) set(domain string, cn bool, ttl time.Duration) {
+	ttl = min(max(ttl, geoDecisionMinTTL), geoDecisionMaxTTL)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= geoDecisionMaxEntries {
+		now := time.Now()
+		for k, d := range c.entries {
+			if now.After(d.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 仍然已满时随机淘汰一部分
+		for k := range c.entries {
+			if len(c.entries) < geoDecisionMaxEntries*3/4 {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[domain] = geoDecision{cn: cn, expires: time.Now().Add(ttl)}
+}
+
+func (c *geoDecisionCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]geoDecision)
+}
+
+// defaultCN 报告 default_group 是否为 cn。default_group 是 GeoIP 分支首先查询的分组，
+// 也是应答中没有可判断地址 (或没有 Geo 数据) 时的最终去向，默认为 overseas。
+func (r *Router) defaultCN() bool {
+	return strings.ToLower(r.config.DefaultGroup) == groupCN
+}
+
+// isCNAddress 报告 ip 是否应走国内分组。Geo 数据为空时无从判断，沿用 default_group。
+func (r *Router) isCNAddress(ip net.IP) bool {
+	geo := r.geo.Load()
+	if geo.Empty() {
+		return r.defaultCN()
+	}
+	return geo.IsCNIP(ip)
+}
+
+func (r *Router) geoClients(cn bool) []client.DNSClient {
+	if cn {
+		return r.cnClients
+	}
+	return r.overseasClients
+}
+
+func geoLabel(cn bool) string {
+	if cn {
+		return "GeoIP(CN)"
+	}
+	return "GeoIP(Overseas)"
+}
+
+// resolveGeoIP 是 routeInternal 的最后一步：域名未命中任何规则时，先经 default_group 分组解析，
+// 应答 IP 的归属与该分组不符时改用另一分组重新查询。判定结果按域名缓存，之后的查询直接使用对应分组。
+func (r *Router) resolveGeoIP(ctx context.Context, req *dns.Msg, qName string) (*dns.Msg, string, error) {
+	if qtype := req.Question[0].Qtype; qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		if probeType := r.geoProbeType(); probeType != 0 {
+			return r.resolveGeoIPProbe(ctx, req, qName, probeType)
+		}
+	}
+
+	if cn, ok := r.geoDecisions.get(qName); ok {
+		return r.resolveDecided(ctx, req, cn)
+	}
+
+	defaultCN := r.defaultCN()
+	resp, err := r.race(ctx, req, r.geoClients(defaultCN))
+	if err != nil {
+		return nil, "GeoIP(Fail)", fmt.Errorf("GeoIP分流时首次解析失败: %w", err)
+	}
+
+	if ip, ttl := firstAddress(resp); ip != nil {
+		cn := r.isCNAddress(ip)
+		r.geoDecisions.set(qName, cn, ttl)
+		if cn != defaultCN {
+			resp, err := r.race(ctx, req, r.geoClients(cn))
+			return resp, geoLabel(cn), err
+		}
+	}
+
+	return resp, geoLabel(defaultCN), nil
+}
+
+// resolveDecided 按已缓存的判定结果直接查询对应分组。
+func (r *Router) resolveDecided(ctx context.Context, req *dns.Msg, cn bool) (*dns.Msg, string, error) {
+	resp, err := r.race(ctx, req, r.geoClients(cn))
+	return resp, geoLabel(cn), err
+}
+
+// firstAddress 返回应答中第一个可用于地理判断的地址及其 TTL：A/AAAA 记录，
+// 或 HTTPS/SVCB 记录中的 ipv4hint/ipv6hint。
+func firstAddress(resp *dns.Msg) (net.IP, time.Duration) {
+	for _, ans := range resp.Answer {
+		ttl := time.Duration(ans.Header().Ttl) * time.Second
+		switch rr := ans.(type) {
+		case *dns.A:
+			return rr.A, ttl
+		case *dns.AAAA:
+			return rr.AAAA, ttl
+		case *dns.HTTPS:
+			if ip := svcbHint(&rr.SVCB); ip != nil {
+				return ip, ttl
+			}
+		case *dns.SVCB:
+			if ip := svcbHint(rr); ip != nil {
+				return ip, ttl
+			}
+		}
+	}
+	return nil, 0
+}
+
+func svcbHint(rr *dns.SVCB) net.IP {
+	for _, kv := range rr.Value {
+		switch hint := kv.(type) {
+		case *dns.SVCBIPv4Hint:
+			if len(hint.Hint) > 0 {
+				return hint.Hint[0]
+			}
+		case *dns.SVCBIPv6Hint:
+			if len(hint.Hint) > 0 {
+				return hint.Hint[0]
+			}
+		}
+	}
+	return nil
+}
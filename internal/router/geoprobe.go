@@ -0,0 +1,89 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// geoProbeType 返回非地址查询在 GeoIP 分支中使用的探测记录类型，geoip_probe 为 none 时返回 0。
+func (r *Router) geoProbeType() uint16 {
+	switch strings.ToUpper(r.config.GeoIPProbe) {
+	case "", "A":
+		return dns.TypeA
+	case "AAAA":
+		return dns.TypeAAAA
+	}
+	return 0
+}
+
+// probeName 返回探测所用的域名：去掉 SRV 等记录名前面以下划线开头的服务标签，
+// 如 _sip._tcp.example.cn 探测 example.cn。
+func probeName(qName string) string {
+	labels := strings.Split(qName, ".")
+	i := 0
+	for i < len(labels)-1 && strings.HasPrefix(labels[i], "_") {
+		i++
+	}
+	return strings.Join(labels[i:], ".")
+}
+
+// resolveGeoIPProbe 处理 GeoIP 分支中的非地址查询 (MX、TXT、SRV、HTTPS 等)。这类应答中通常没有可供判断的 IP，
+// 因此在经 default_group 分组解析原查询的同时，并行对域名发出一次 geoip_probe 类型的探测查询，
+// 按探测结果中的 IP 决定最终分组，并缓存判定结果。HTTPS/SVCB 应答带有地址提示时优先使用提示中的地址。
+func (r *Router) resolveGeoIPProbe(ctx context.Context, req *dns.Msg, qName string, probeType uint16) (*dns.Msg, string, error) {
+	target := probeName(qName)
+	if cn, ok := r.geoDecisions.get(target); ok {
+		return r.resolveDecided(ctx, req, cn)
+	}
+
+	defaultCN := r.defaultCN()
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	probeCh := make(chan result, 1)
+	go func() {
+		probe := new(dns.Msg)
+		probe.SetQuestion(dns.Fqdn(target), probeType)
+		probe.RecursionDesired = true
+		resp, err := r.race(ctx, probe, r.geoClients(defaultCN))
+		probeCh <- result{resp, err}
+	}()
+
+	resp, err := r.race(ctx, req, r.geoClients(defaultCN))
+
+	// HTTPS/SVCB 应答自带 ipv4hint/ipv6hint 时直接据此判断，无需等待探测结果
+	if err == nil {
+		if ip, ttl := firstAddress(resp); ip != nil {
+			cn := r.isCNAddress(ip)
+			r.geoDecisions.set(target, cn, ttl)
+			if cn != defaultCN {
+				resp, err := r.race(ctx, req, r.geoClients(cn))
+				return resp, geoLabel(cn), err
+			}
+			return resp, geoLabel(cn), nil
+		}
+	}
+
+	probe := <-probeCh
+	if probe.err == nil && probe.resp != nil {
+		cn := defaultCN
+		ip, ttl := firstAddress(probe.resp)
+		if ip != nil {
+			cn = r.isCNAddress(ip)
+		}
+		r.geoDecisions.set(target, cn, ttl)
+		if cn != defaultCN {
+			resp, err := r.race(ctx, req, r.geoClients(cn))
+			return resp, geoLabel(cn), err
+		}
+	}
+
+	if err != nil {
+		return nil, "GeoIP(Fail)", fmt.Errorf("GeoIP分流时首次解析失败: %w", err)
+	}
+	return resp, geoLabel(defaultCN), nil
+}
@@ -0,0 +1,35 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// newIdentityZone 为 server_identity 生成只含本服务器自身记录的权威区域：SOA、NS 指向 name，
+// A/AAAA 指向 ip。部分客户端和系统解析器会查询所配置 DNS 服务器自身的这些记录，
+// 由本地应答可避免转发到上游后得到不一致的结果。name 下不存在的子域名返回 NXDOMAIN。
+func newIdentityZone(name, ip string) (*Zone, error) {
+	name = strings.ToLower(dns.Fqdn(strings.TrimSpace(name)))
+	if _, ok := dns.IsDomainName(name); !ok || name == "." {
+		return nil, fmt.Errorf("无效的 server_identity.name: %q", name)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "@ 3600 IN SOA %s hostmaster.%s 1 3600 600 86400 60\n", name, name)
+	fmt.Fprintf(&b, "@ 3600 IN NS %s\n", name)
+	if ip != "" {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, fmt.Errorf("无效的 server_identity.ip: %q", ip)
+		}
+		if addr.To4() != nil {
+			fmt.Fprintf(&b, "@ 3600 IN A %s\n", addr)
+		} else {
+			fmt.Fprintf(&b, "@ 3600 IN AAAA %s\n", addr)
+		}
+	}
+	return parseZone(strings.NewReader(b.String()), name, "server_identity", false)
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// raceBoth 并发查询国内与海外分组，并将两者的应答合并去重。
+func (r *Router) raceBoth(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+
+	cnCh := make(chan result, 1)
+	overseasCh := make(chan result, 1)
+	go func() {
+		resp, err := r.race(ctx, req, r.cnClients)
+		cnCh <- result{resp, err}
+	}()
+	go func() {
+		resp, err := r.race(ctx, req, r.overseasClients)
+		overseasCh <- result{resp, err}
+	}()
+	cn, overseas := <-cnCh, <-overseasCh
+
+	switch {
+	case cn.err != nil && overseas.err != nil:
+		return nil, fmt.Errorf("国内与海外分组均解析失败: %v; %v", cn.err, overseas.err)
+	case cn.err != nil:
+		return overseas.resp, nil
+	case overseas.err != nil:
+		return cn.resp, nil
+	}
+
+	if cn.resp.Rcode != dns.RcodeSuccess {
+		return overseas.resp, nil
+	}
+	if overseas.resp.Rcode != dns.RcodeSuccess {
+		return cn.resp, nil
+	}
+	return mergeAnswers(cn.resp, overseas.resp), nil
+}
+
+func mergeAnswers(base, other *dns.Msg) *dns.Msg {
+	merged := base.Copy()
+
+	cnames := make(map[string]bool)
+	for _, rr := range merged.Answer {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			cnames[strings.ToLower(rr.Header().Name)] = true
+		}
+	}
+
+	for _, rr := range other.Answer {
+		dup := false
+		for _, existing := range merged.Answer {
+			if dns.IsDuplicate(rr, existing) {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		// 同一名称只能有一个 CNAME，保留国内分组的结果
+		if rr.Header().Rrtype == dns.TypeCNAME && cnames[strings.ToLower(rr.Header().Name)] {
+			continue
+		}
+		merged.Answer = append(merged.Answer, dns.Copy(rr))
+	}
+	return merged
+}
@@ -0,0 +1,120 @@
+package router
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"doh-autoproxy/internal/config"
+)
+
+type clientPolicy struct {
+	name       string
+	networks   []*net.IPNet
+	forceGroup string
+	rules      map[string]string
+	regexRules []RegexRule
+}
+
+func loadClientPolicies(cfgs []config.ClientPolicyConfig) []*clientPolicy {
+	var policies []*clientPolicy
+	for _, pc := range cfgs {
+		p := &clientPolicy{
+			name:       pc.Name,
+			forceGroup: strings.ToLower(pc.ForceGroup),
+		}
+		if p.name == "" {
+			p.name = pc.CIDR
+		}
+
+		for _, cidr := range strings.Split(pc.CIDR, ",") {
+			network, err := parseCIDR(strings.TrimSpace(cidr))
+			if err != nil {
+				log.Printf("忽略无效的客户端策略网段: %s -> %v", cidr, err)
+				continue
+			}
+			p.networks = append(p.networks, network)
+		}
+		if len(p.networks) == 0 {
+			continue
+		}
+
+		if pc.RulesFile != "" {
+			rules, err := config.LoadRulesFile(pc.RulesFile)
+			if err != nil {
+				log.Printf("加载客户端策略规则文件失败: %s -> %v", pc.RulesFile, err)
+			} else {
+				p.rules = rules
+				p.regexRules = compileRegexRules(rules)
+			}
+		}
+
+		if p.forceGroup == "" && p.rules == nil {
+			log.Printf("客户端策略 %s 未指定 force_group 或 rules_file，已忽略", p.name)
+			continue
+		}
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// loadInterfacePolicies 复用客户端策略的解析逻辑，网段匹配的对象换成查询到达的本地地址。
+func loadInterfacePolicies(cfgs []config.InterfacePolicyConfig) []*clientPolicy {
+	converted := make([]config.ClientPolicyConfig, 0, len(cfgs))
+	for _, ic := range cfgs {
+		name := ic.Name
+		if name == "" {
+			name = "iface:" + ic.LocalAddr
+		}
+		converted = append(converted, config.ClientPolicyConfig{
+			Name:       name,
+			CIDR:       ic.LocalAddr,
+			ForceGroup: ic.ForceGroup,
+			RulesFile:  ic.RulesFile,
+		})
+	}
+	return loadClientPolicies(converted)
+}
+
+// matchPolicy 优先按客户端地址匹配客户端策略，未命中时再按本地地址匹配接口策略。
+func (r *Router) matchPolicy(clientIP, localIP string) *clientPolicy {
+	if p := findPolicy(r.clientPolicies, clientIP); p != nil {
+		return p
+	}
+	return findPolicy(r.interfacePolicies, localIP)
+}
+
+func findPolicy(policies []*clientPolicy, addr string) *clientPolicy {
+	if len(policies) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	for _, p := range policies {
+		for _, network := range p.networks {
+			if network.Contains(ip) {
+				return p
+			}
+		}
+	}
+	return nil
+}
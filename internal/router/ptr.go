@@ -0,0 +1,47 @@
+package router
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// reverseIP 从 in-addr.arpa / ip6.arpa 反向查询名称中解析出被查询的 IP，名称不完整时返回 nil。
+func reverseIP(qName string) net.IP {
+	switch {
+	case strings.HasSuffix(qName, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(qName, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return nil
+		}
+		ip := make(net.IP, 4)
+		for i, label := range labels {
+			v, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[3-i] = byte(v)
+		}
+		return ip
+	case strings.HasSuffix(qName, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(qName, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return nil
+		}
+		ip := make(net.IP, 16)
+		for i, label := range labels {
+			v, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+			pos := 31 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(v) << 4
+			} else {
+				ip[pos/2] |= byte(v)
+			}
+		}
+		return ip
+	}
+	return nil
+}
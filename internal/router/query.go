@@ -0,0 +1,29 @@
+package router
+
+import (
+	"github.com/miekg/dns"
+)
+
+// formErr 拒绝包含多个问题的查询。DNS 实践中一个消息只有一个问题，
+// 若只处理第一个问题而忽略其余部分，客户端可借此绕过按名称生效的规则。
+func formErr(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcodeFormatError(req)
+	return m
+}
+
+// answerANY 按 any_query 处理 ANY 查询。minimal (默认) 时依照 RFC 8482 返回单条
+// HINFO "RFC8482" 记录，不向上游转发；forward 时返回 nil，由正常分流流程处理。
+func (r *Router) answerANY(req *dns.Msg) *dns.Msg {
+	if req.Question[0].Qtype != dns.TypeANY || r.config.AnyQuery == "forward" {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: 3600},
+		Cpu: "RFC8482",
+	})
+	return m
+}
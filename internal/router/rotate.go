@@ -0,0 +1,38 @@
+package router
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// rotateAnswers 轮转应答中每个 RRset 内记录的顺序，实现经典 DNS 轮询。
+// 仅在连续的同名同类型记录内部轮转，CNAME 链与 RRSIG 的位置保持不变，
+// 且在 DNSSEC 验证之后执行 (签名校验与记录顺序无关)。
+func (r *Router) rotateAnswers(resp *dns.Msg) {
+	if resp == nil || len(resp.Answer) < 2 {
+		return
+	}
+	shift := int(r.rotateCounter.Add(1))
+
+	answers := resp.Answer
+	for start := 0; start < len(answers); {
+		end := start + 1
+		for end < len(answers) && sameRRset(answers[start], answers[end]) {
+			end++
+		}
+		if n := end - start; n > 1 && answers[start].Header().Rrtype != dns.TypeRRSIG {
+			run := make([]dns.RR, n)
+			for i := 0; i < n; i++ {
+				run[i] = answers[start+(i+shift)%n]
+			}
+			copy(answers[start:end], run)
+		}
+		start = end
+	}
+}
+
+func sameRRset(a, b dns.RR) bool {
+	ha, hb := a.Header(), b.Header()
+	return ha.Rrtype == hb.Rrtype && ha.Class == hb.Class && strings.EqualFold(ha.Name, hb.Name)
+}
@@ -4,17 +4,25 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"net"
+	"math"
 	"regexp"
+	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"doh-autoproxy/internal/cache"
 	"doh-autoproxy/internal/client"
 	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/dnssec"
 	"doh-autoproxy/internal/querylog"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/tracing"
+	"doh-autoproxy/internal/util"
 
 	"github.com/miekg/dns"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 type RegexRule struct {
@@ -24,25 +32,38 @@ type RegexRule struct {
 
 type Router struct {
 	config          *config.Config
-	geo             *GeoDataManager
+	geo             atomic.Pointer[GeoDataManager]
+	blocklist       atomic.Pointer[Blocklist]
 	logger          *querylog.QueryLogger
 	cnClients       []client.DNSClient
 	overseasClients []client.DNSClient
 
 	cnStats       []*client.StatsClient
 	overseasStats []*client.StatsClient
-
-	regexRules []RegexRule
+	disabledStats []interface{}
+
+	regexRules        []RegexRule
+	localDomains      []string
+	zones             []*Zone
+	identity          *Zone
+	clientPolicies    []*clientPolicy
+	interfacePolicies []*clientPolicy
+
+	cache        *cache.Cache
+	injectedECS  []*dns.EDNS0_SUBNET // 各上游 ecs_ip 注入的 ECS，缓存查找时按同样的子网推导键
+	denials      *cache.DenialCache  // 积极否定缓存，仅在同时启用缓存与 DNSSEC 验证时创建
+	validator    *dnssec.Validator
+	debugClient  *client.StatsClient
+	bootstrapper *resolver.Bootstrapper
+
+	geoDecisions  *geoDecisionCache
+	rotateCounter atomic.Uint64
+	stages        stageCounters
 }
 
-func NewRouter(cfg *config.Config, geoManager *GeoDataManager, logger *querylog.QueryLogger) *Router {
-	r := &Router{
-		config: cfg,
-		geo:    geoManager,
-		logger: logger,
-	}
-
-	for domain, target := range cfg.Rules {
+func compileRegexRules(rules map[string]string) []RegexRule {
+	var regexRules []RegexRule
+	for domain, target := range rules {
 		if strings.HasPrefix(domain, "regexp:") {
 			pattern := strings.TrimPrefix(domain, "regexp:")
 			re, err := regexp.Compile(pattern)
@@ -50,58 +71,298 @@ func NewRouter(cfg *config.Config, geoManager *GeoDataManager, logger *querylog.
 				log.Printf("忽略无效的正则规则: %s -> %v", domain, err)
 				continue
 			}
-			r.regexRules = append(r.regexRules, RegexRule{
+			regexRules = append(regexRules, RegexRule{
 				Pattern: re,
 				Target:  target,
 			})
 		}
 	}
+	return regexRules
+}
+
+func NewRouter(cfg *config.Config, geoManager *GeoDataManager, logger *querylog.QueryLogger) *Router {
+	r := &Router{
+		config: cfg,
+		logger: logger,
+		stages: newStageCounters(),
+
+		geoDecisions: newGeoDecisionCache(),
+	}
+	if geoManager == nil {
+		geoManager = &GeoDataManager{}
+	}
+	r.geo.Store(geoManager)
+
+	r.regexRules = compileRegexRules(cfg.Rules)
+	for _, d := range cfg.LocalDomains {
+		if d = strings.ToLower(strings.Trim(strings.TrimSpace(d), ".")); d != "" {
+			r.localDomains = append(r.localDomains, d)
+		}
+	}
+	r.clientPolicies = loadClientPolicies(cfg.ClientPolicies)
+	r.interfacePolicies = loadInterfacePolicies(cfg.InterfacePolicies)
+
+	for _, zf := range cfg.ZoneFiles {
+		z, err := LoadZone(zf.Origin, zf.File, zf.Fallthrough)
+		if err != nil {
+			log.Printf("加载区域文件失败: %s (%s) -> %v", zf.File, zf.Origin, err)
+			continue
+		}
+		log.Printf("已加载区域文件: %s (%s)", zf.File, z.Origin())
+		r.zones = append(r.zones, z)
+	}
+	sortZones(r.zones)
+
+	if id := cfg.ServerIdentity; id != nil && id.Name != "" {
+		z, err := newIdentityZone(id.Name, id.IP)
+		if err != nil {
+			log.Printf("忽略 server_identity: %v", err)
+		} else {
+			r.identity = z
+		}
+	}
+
+	switch strings.ToLower(cfg.DefaultGroup) {
+	case "", groupCN, groupOverseas:
+	default:
+		log.Printf("无效的 default_group: %q，使用 overseas", cfg.DefaultGroup)
+	}
+
+	if cfg.Cache.Enabled {
+		staleWindow := time.Duration(cfg.Cache.StaleWindow) * time.Second
+		if staleWindow <= 0 {
+			staleWindow = time.Hour
+		}
+		r.cache = cache.New(cfg.Cache.Size, staleWindow)
+	}
 
 	bootstrapper := resolver.NewBootstrapper(cfg.BootstrapDNS)
+	r.bootstrapper = bootstrapper
 
 	for _, upstreamCfg := range cfg.Upstreams.CN {
-		c, err := client.NewDNSClient(upstreamCfg, bootstrapper)
+		if !upstreamCfg.IsEnabled() {
+			r.disabledStats = append(r.disabledStats, disabledUpstream(upstreamCfg, "CN"))
+			continue
+		}
+		clientCfg := withGroupECS(upstreamCfg, cfg.Upstreams.CNECS)
+		c, err := client.NewDNSClient(clientCfg, bootstrapper)
 		if err != nil {
 			log.Printf("Failed to initialize CN upstream %s: %v", upstreamCfg.Address, err)
 			continue
 		}
 		sc := client.NewStatsClient(c, upstreamCfg.Address, upstreamCfg.Protocol, "CN")
+		sc.SetRetryPolicy(upstreamCfg.Retries, time.Duration(upstreamCfg.RetryBackoffMs)*time.Millisecond)
+		if upstreamCfg.Weight > 0 {
+			sc.Weight = upstreamCfg.Weight
+		}
+		sc.Tier = upstreamCfg.Tier
+		if cb := cfg.CircuitBreaker; cb.Enabled {
+			sc.SetCircuitBreaker(cb.Failures, time.Duration(cb.Window)*time.Second, time.Duration(cb.Cooldown)*time.Second)
+		}
 		r.cnClients = append(r.cnClients, sc)
 		r.cnStats = append(r.cnStats, sc)
+		r.addInjectedECS(clientCfg.ECSIP)
+		r.watchHealth(sc)
 	}
 
 	for _, upstreamCfg := range cfg.Upstreams.Overseas {
-		c, err := client.NewDNSClient(upstreamCfg, bootstrapper)
+		if !upstreamCfg.IsEnabled() {
+			r.disabledStats = append(r.disabledStats, disabledUpstream(upstreamCfg, "Overseas"))
+			continue
+		}
+		clientCfg := withGroupECS(upstreamCfg, cfg.Upstreams.OverseasECS)
+		c, err := client.NewDNSClient(clientCfg, bootstrapper)
 		if err != nil {
 			log.Printf("Failed to initialize Overseas upstream %s: %v", upstreamCfg.Address, err)
 			continue
 		}
 		sc := client.NewStatsClient(c, upstreamCfg.Address, upstreamCfg.Protocol, "Overseas")
+		sc.SetRetryPolicy(upstreamCfg.Retries, time.Duration(upstreamCfg.RetryBackoffMs)*time.Millisecond)
+		if upstreamCfg.Weight > 0 {
+			sc.Weight = upstreamCfg.Weight
+		}
+		sc.Tier = upstreamCfg.Tier
+		if cb := cfg.CircuitBreaker; cb.Enabled {
+			sc.SetCircuitBreaker(cb.Failures, time.Duration(cb.Window)*time.Second, time.Duration(cb.Cooldown)*time.Second)
+		}
 		r.overseasClients = append(r.overseasClients, sc)
 		r.overseasStats = append(r.overseasStats, sc)
+		r.addInjectedECS(clientCfg.ECSIP)
+		r.watchHealth(sc)
+	}
+
+	r.debugClient = newDebugClient(cfg.DebugUpstream, bootstrapper)
+
+	if cfg.DNSSEC.Validate {
+		anchors := dnssec.DefaultRootAnchors()
+		if cfg.DNSSEC.TrustAnchorFile != "" {
+			loaded, err := dnssec.LoadAnchors(cfg.DNSSEC.TrustAnchorFile)
+			if err != nil {
+				log.Printf("加载 DNSSEC 信任锚失败，使用内置根区信任锚: %v", err)
+			} else {
+				anchors = loaded
+			}
+		}
+
+		clients := r.overseasClients
+		if strings.ToLower(cfg.DNSSEC.Group) == "cn" {
+			clients = r.cnClients
+		}
+		r.validator = dnssec.NewValidator(func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+			return r.race(ctx, req, clients)
+		}, anchors)
+		if r.cache != nil {
+			r.denials = cache.NewDenialCache(cfg.Cache.Size, uint32(cfg.Cache.NegativeTTL))
+		}
 	}
 
 	return r
 }
 
+// addInjectedECS 记录上游注入的 ECS，相同子网只记录一次。
+func (r *Router) addInjectedECS(ecsIP string) {
+	e := client.ECSOption(ecsIP)
+	if e == nil {
+		return
+	}
+	for _, o := range r.injectedECS {
+		if o.String() == e.String() {
+			return
+		}
+	}
+	r.injectedECS = append(r.injectedECS, e)
+}
+
+// withGroupECS 将分组级 ECS 默认值应用到未单独配置 ECS 的上游。
+func withGroupECS(upstream config.UpstreamServer, group config.GroupECSConfig) config.UpstreamServer {
+	if upstream.ECSIP == "" {
+		upstream.ECSIP = group.ECSIP
+	}
+	if group.StripECS {
+		upstream.StripECS = true
+	}
+	return upstream
+}
+
+// StatsClients 返回已启用的全部上游 (CN 在前)。
+func (r *Router) StatsClients() []*client.StatsClient {
+	return append(slices.Clone(r.cnStats), r.overseasStats...)
+}
+
 func (r *Router) GetUpstreamStats() []interface{} {
 	var stats []interface{}
-	for _, s := range r.cnStats {
-		stats = append(stats, s.GetStats())
+	stats = appendGroupStats(stats, r.cnStats)
+	stats = appendGroupStats(stats, r.overseasStats)
+	return append(stats, r.disabledStats...)
+}
+
+// appendGroupStats 追加一组上游的统计。weighted 策略下额外给出 selected_share：
+// 同组同层上游中被抽为首选的实际比例 (百分比)，用于核对流量分配是否符合配置的权重。
+func appendGroupStats(stats []interface{}, group []*client.StatsClient) []interface{} {
+	selected := make(map[int]int64)
+	for _, s := range group {
+		selected[s.Tier] += s.Selected()
 	}
-	for _, s := range r.overseasStats {
-		stats = append(stats, s.GetStats())
+	for _, s := range group {
+		st := s.GetStats()
+		if total := selected[s.Tier]; total > 0 {
+			st["selected_share"] = math.Round(float64(st["total_selected"].(int64))*1000/float64(total)) / 10
+		}
+		stats = append(stats, st)
 	}
 	return stats
 }
 
-func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns.Msg, error) {
+// disabledUpstream 为已停用的上游生成占位统计，使其仍显示在上游列表中。
+func disabledUpstream(u config.UpstreamServer, group string) map[string]interface{} {
+	return map[string]interface{}{
+		"address":  u.Address,
+		"protocol": u.Protocol,
+		"group":    group,
+		"disabled": true,
+	}
+}
+
+func (r *Router) HasHealthyUpstreams() (bool, string) {
+	anyHealthy := func(stats []*client.StatsClient) bool {
+		for _, s := range stats {
+			if s.Healthy() {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !anyHealthy(r.cnStats) {
+		return false, "no healthy CN upstream"
+	}
+	if !anyHealthy(r.overseasStats) {
+		return false, "no healthy Overseas upstream"
+	}
+	return true, ""
+}
+
+// ProbeUpstreams 向每组上游发送一次探测查询。探测绕过 StatsClient 直接使用底层客户端，
+// 不计入查询统计，也不影响熔断与健康状态。
+func (r *Router) ProbeUpstreams(ctx context.Context) error {
+	probe := func(domain string, stats []*client.StatsClient) error {
+		clients := make([]client.DNSClient, len(stats))
+		for i, s := range stats {
+			clients[i] = s.Client
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+		_, err := client.RaceResolve(ctx, req, clients)
+		return err
+	}
+
+	if err := probe("www.baidu.com", r.cnStats); err != nil {
+		return fmt.Errorf("CN upstream probe failed: %w", err)
+	}
+	if err := probe("www.google.com", r.overseasStats); err != nil {
+		return fmt.Errorf("Overseas upstream probe failed: %w", err)
+	}
+	return nil
+}
+
+// Route 处理一次查询。localIP 为查询到达的本地地址，用于匹配 interface_policies，未知时传空字符串。
+func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP, localIP, protocol string) (*dns.Msg, error) {
 	start := time.Now()
 	if len(req.Question) == 0 {
 		return nil, fmt.Errorf("no question")
 	}
-
-	resp, upstream, err := r.routeInternal(ctx, req)
+	ctx, span := tracing.Start(ctx, "dns.query")
+	defer span.End()
+
+	var resp *dns.Msg
+	var upstream string
+	var err error
+	if len(req.Question) > 1 {
+		resp, upstream = formErr(req), "FormErr"
+	} else if req.Question[0].Qclass == dns.ClassCHAOS {
+		resp, upstream = r.answerChaos(req), "Chaos"
+	} else if m := r.answerANY(req); m != nil {
+		resp, upstream = m, "ANY"
+	} else if r.debugMatch(req.Question[0].Name) {
+		resp, err = r.resolveDebug(ctx, req)
+		upstream = "Debug"
+	} else if m := r.answerModeNoData(req); m != nil {
+		resp, upstream = m, "AnswerMode"
+	} else {
+		policy := r.matchPolicy(clientIP, localIP)
+		resp, upstream, err = r.resolveWithCache(ctx, req, policy)
+		r.filterAnswerMode(resp)
+	}
+	r.stages.record(upstream, err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure)
+	if r.validator != nil && resp != nil && !dnssec.WantsDNSSEC(req) {
+		dnssec.StripRecords(resp, req.Question[0].Qtype)
+	}
+	if resp != nil {
+		advertiseEDNS(req, resp)
+	}
+	if r.config.RotateAnswers {
+		r.rotateAnswers(resp)
+	}
 
 	duration := time.Since(start).Milliseconds()
 
@@ -110,10 +371,12 @@ func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns
 
 	status := "ERROR"
 	answer := ""
+	responseSize := 0
 	var answerRecords []querylog.AnswerRecord
 
 	if err == nil && resp != nil {
 		status = dns.RcodeToString[resp.Rcode]
+		responseSize = resp.Len()
 		if len(resp.Answer) > 0 {
 			parts := strings.Fields(resp.Answer[0].String())
 			if len(parts) > 4 {
@@ -143,9 +406,26 @@ func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns
 		}
 	}
 
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("dns.question.name", qName),
+			attribute.String("dns.question.type", qType),
+			attribute.String("client.address", clientIP),
+			attribute.String("network.protocol.name", protocol),
+			attribute.String("dns.route", upstream),
+			attribute.String("dns.response_code", status),
+			attribute.Bool("dns.cache_hit", strings.HasPrefix(upstream, "Cache")),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+
 	if r.logger != nil {
 		r.logger.AddLog(&querylog.LogEntry{
 			ClientIP:      clientIP,
+			Protocol:      protocol,
 			Domain:        qName,
 			Type:          qType,
 			Upstream:      upstream,
@@ -153,6 +433,8 @@ func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns
 			AnswerRecords: answerRecords,
 			DurationMs:    duration,
 			Status:        status,
+			ResponseSize:  responseSize,
+			CacheHit:      strings.HasPrefix(upstream, "Cache"),
 		})
 	}
 
@@ -171,89 +453,250 @@ func (r *Router) Route(ctx context.Context, req *dns.Msg, clientIP string) (*dns
 	return resp, err
 }
 
-func (r *Router) routeInternal(ctx context.Context, req *dns.Msg) (*dns.Msg, string, error) {
-	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+func (r *Router) resolveWithCache(ctx context.Context, req *dns.Msg, policy *clientPolicy) (*dns.Msg, string, error) {
+	if r.cache == nil {
+		return r.resolve(ctx, req, policy)
+	}
 
-	if ipStr, ok := r.config.Hosts[qName]; ok {
-		ip := net.ParseIP(ipStr)
-		if ip == nil {
-			return nil, "Hosts", fmt.Errorf("自定义Hosts中存在无效IP地址: %s for %s", ipStr, qName)
+	base := cache.Key(req.Question[0])
+	if policy != nil {
+		base += "|policy=" + policy.name
+	}
+	keys := cache.LookupKeys(base, req, r.injectedECS)
+	for _, key := range keys {
+		if cached, _, ok := r.cache.Get(key); ok {
+			cached.Id = req.Id
+			r.maybePrefetch(base, key, req, policy)
+			return cached, "Cache", nil
 		}
+	}
+
+	resp, upstream, err := r.resolve(ctx, req, policy)
+	if err == nil && resp != nil && upstream != "Hosts" {
+		r.cache.Set(cache.StoreKey(base, resp), resp, upstream)
+	}
 
-		m := new(dns.Msg)
-		m.SetReply(req)
-		rrHeader := dns.RR_Header{
-			Name:   req.Question[0].Name,
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    60,
+	if r.config.Cache.ServeStale && (err != nil || resp == nil || resp.Rcode == dns.RcodeServerFailure) {
+		staleTTL := uint32(r.config.Cache.StaleTTL)
+		if staleTTL == 0 {
+			staleTTL = 30
 		}
-		if ipv4 := ip.To4(); ipv4 != nil {
-			m.Answer = append(m.Answer, &dns.A{Hdr: rrHeader, A: ipv4})
-		} else {
-			rrHeader.Rrtype = dns.TypeAAAA
-			m.Answer = append(m.Answer, &dns.AAAA{Hdr: rrHeader, AAAA: ip})
+		for _, key := range keys {
+			if stale, _, ok := r.cache.GetStale(key, staleTTL); ok {
+				log.Printf("上游解析失败，返回过期缓存: %s (%v)", req.Question[0].Name, err)
+				stale.Id = req.Id
+				return stale, "Cache(Stale)", nil
+			}
 		}
-		return m, "Hosts", nil
 	}
 
-	if rule, ok := r.config.Rules[qName]; ok {
-		switch strings.ToLower(rule) {
-		case "cn":
-			resp, err := client.RaceResolve(ctx, req, r.cnClients)
-			return resp, "Rule(CN)", err
-		case "overseas":
-			resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-			return resp, "Rule(Overseas)", err
-		default:
+	return resp, upstream, err
+}
+
+func (r *Router) resolve(ctx context.Context, req *dns.Msg, policy *clientPolicy) (*dns.Msg, string, error) {
+	if r.validator == nil {
+		resp, upstream, err := r.routeInternal(ctx, req, policy)
+		r.clampTTL(resp)
+		return resp, upstream, err
+	}
+
+	upstreamReq := req.Copy()
+	dnssec.SetDO(upstreamReq)
+	resp, upstream, err := r.routeInternal(ctx, upstreamReq, policy)
+	secure := false
+	if err == nil && resp != nil && upstream != "Hosts" && upstream != "Zone" && upstream != "Cache(NSEC)" {
+		result, verr := r.validator.Validate(ctx, req, resp)
+		if verr != nil {
+			log.Printf("DNSSEC 验证失败: %s %s -> %v", req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype], verr)
+			m := new(dns.Msg)
+			m.SetRcode(req, dns.RcodeServerFailure)
+			return m, upstream, nil
 		}
+		secure = result == dnssec.Secure
+		resp.AuthenticatedData = secure
+	}
+	r.clampTTL(resp)
+	if secure && r.denials != nil {
+		r.denials.Add(resp)
 	}
+	return resp, upstream, err
+}
 
-	for _, rr := range r.regexRules {
-		if rr.Pattern.MatchString(qName) {
-			switch strings.ToLower(rr.Target) {
-			case "cn":
-				resp, err := client.RaceResolve(ctx, req, r.cnClients)
-				return resp, "Rule(Regex/CN)", err
-			case "overseas":
-				resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-				return resp, "Rule(Regex/Overseas)", err
-			}
+// advertiseEDNS 让应答的 OPT 记录与查询一致：查询不带 EDNS 时移除 OPT，
+// 否则在应答中 (必要时补上 OPT) 通告 edns_buffer_size，而不是上游向本服务器通告的大小。
+func advertiseEDNS(req, resp *dns.Msg) {
+	if req.IsEdns0() == nil {
+		stripOPT(resp)
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		resp.SetEdns0(util.EDNSBufferSize(), false)
+		return
+	}
+	opt.SetUDPSize(util.EDNSBufferSize())
+}
+
+// stripOPT 删除响应中的 OPT 记录，避免向未使用 EDNS 的客户端返回上游附加的 EDNS 信息。
+func stripOPT(resp *dns.Msg) {
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
 		}
 	}
+	resp.Extra = extra
+}
 
-	if geoSiteRule := r.geo.LookupGeoSite(qName); geoSiteRule != "" {
-		switch strings.ToLower(geoSiteRule) {
-		case "cn":
-			resp, err := client.RaceResolve(ctx, req, r.cnClients)
-			return resp, "GeoSite(CN)", err
-		default:
-			resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-			return resp, "GeoSite(Overseas)", err
+func (r *Router) clampTTL(resp *dns.Msg) {
+	if resp == nil {
+		return
+	}
+	minTTL := uint32(r.config.Cache.MinTTL)
+	maxTTL := uint32(r.config.Cache.MaxTTL)
+	// 否定应答 (NXDOMAIN/NODATA) 另受 negative_ttl 限制，min_ttl 也不会把它抬高到该值以上
+	if negTTL := uint32(r.config.Cache.NegativeTTL); negTTL > 0 && isNegative(resp) {
+		minTTL = min(minTTL, negTTL)
+		if maxTTL == 0 || maxTTL > negTTL {
+			maxTTL = negTTL
 		}
 	}
+	if minTTL == 0 && maxTTL == 0 {
+		return
+	}
 
-	resp, err := client.RaceResolve(ctx, req, r.overseasClients)
-	if err != nil {
-		return nil, "GeoIP(Fail)", fmt.Errorf("GeoIP分流时首次海外解析失败: %w", err)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			if hdr.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if minTTL > 0 && hdr.Ttl < minTTL {
+				hdr.Ttl = minTTL
+			}
+			if maxTTL > 0 && hdr.Ttl > maxTTL {
+				hdr.Ttl = maxTTL
+			}
+		}
 	}
+}
+
+// isNegative 报告 resp 是否为否定应答：NXDOMAIN，或 NOERROR 但应答段为空 (NODATA)。
+func isNegative(resp *dns.Msg) bool {
+	return resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+}
 
-	var resolvedIP net.IP
-	for _, ans := range resp.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			resolvedIP = a.A
-			break
+// maybePrefetch 在缓存条目 key 即将过期时后台刷新。新应答与正常查询一样按 cache.StoreKey(base, resp) 存储，
+// 带 ECS scope 的应答不会写回命中的 key 而被其他子网的客户端使用。
+func (r *Router) maybePrefetch(base, key string, req *dns.Msg, policy *clientPolicy) {
+	if !r.config.Cache.Prefetch {
+		return
+	}
+
+	minHits := r.config.Cache.PrefetchMinHits
+	if minHits <= 0 {
+		minHits = 3
+	}
+	if r.logger == nil || r.logger.DomainCount(req.Question[0].Name) < minHits {
+		return
+	}
+
+	threshold := r.config.Cache.PrefetchThreshold
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.1
+	}
+	if !r.cache.ShouldPrefetch(key, threshold) {
+		return
+	}
+
+	prefetchReq := req.Copy()
+	prefetchReq.Id = dns.Id()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		defer r.cache.ClearPrefetch(key)
+
+		resp, upstream, err := r.resolve(ctx, prefetchReq, policy)
+		if err != nil || resp == nil {
+			log.Printf("缓存预取失败: %s (%v)", prefetchReq.Question[0].Name, err)
+			return
 		}
-		if aaaa, ok := ans.(*dns.AAAA); ok {
-			resolvedIP = aaaa.AAAA
-			break
+		r.cache.Set(cache.StoreKey(base, resp), resp, upstream)
+	}()
+}
+
+// selectInTier 在同一层级内按 strategy 选择上游 (race 或 weighted)。
+func (r *Router) selectInTier(ctx context.Context, req *dns.Msg, clients []client.DNSClient) (*dns.Msg, error) {
+	if r.config.Upstreams.Strategy == "weighted" {
+		return r.weighted(ctx, req, clients)
+	}
+
+	retries := r.config.Race.EmptyAnswerRetries
+	opts := client.RaceOptions{
+		EmptyAnswerWait: time.Duration(r.config.Race.EmptyAnswerWaitMs) * time.Millisecond,
+		SoftFailEmpty:   retries > 0,
+	}
+
+	resp, err := client.RaceResolveWithOptions(ctx, req, clients, opts)
+	for i := 0; i < retries && err == nil && client.IsSoftEmpty(req, resp); i++ {
+		log.Printf("上游返回无 SOA 的空应答，正在重试 (%d/%d): %s %s", i+1, retries, req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype])
+		resp, err = client.RaceResolveWithOptions(ctx, req, clients, opts)
+	}
+	return resp, err
+}
+
+func (r *Router) routeInternal(ctx context.Context, req *dns.Msg, policy *clientPolicy) (*dns.Msg, string, error) {
+	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+
+	_, span := tracing.Start(ctx, "router.decide")
+	d := r.decide(req, qName, policy)
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("route.branch", d.branch),
+			attribute.String("route.group", d.group),
+			attribute.String("route.label", d.label),
+		)
+	}
+	span.End()
+	if d.dgaEntropy > 0 {
+		log.Printf("疑似 DGA 域名: %s (熵 %.2f)，动作: %s", qName, d.dgaEntropy, strings.ToLower(r.config.DGADetection.Action))
+	}
+	if d.answer != nil || d.err != nil {
+		return d.answer, d.label, d.err
+	}
+	// 已缓存的 NSEC/NSEC3 证明覆盖该名称时直接合成 NXDOMAIN (RFC 8198)
+	if r.denials != nil {
+		if m := r.denials.Lookup(req); m != nil {
+			return m, "Cache(NSEC)", nil
 		}
 	}
 
-	if resolvedIP != nil && r.geo.IsCNIP(resolvedIP) {
-		resp, err := client.RaceResolve(ctx, req, r.cnClients)
-		return resp, "GeoIP(CN)", err
+	switch d.group {
+	case groupCN:
+		resp, err := r.race(ctx, req, r.cnClients)
+		return resp, d.label, err
+	case groupOverseas:
+		resp, err := r.race(ctx, req, r.overseasClients)
+		return resp, d.label, err
+	case groupBoth:
+		resp, err := r.raceBoth(ctx, req)
+		return resp, d.label, err
+	case groupDirect:
+		resp, err := r.resolveDirect(ctx, req)
+		return resp, d.label, err
 	}
 
-	return resp, "GeoIP(Overseas)", nil
+	return r.resolveGeoIP(ctx, req, qName)
+}
+
+// bootstrapProbeInterval 是启用 bootstrap_probe 时重新测量 Bootstrap DNS 响应时间的间隔。
+const bootstrapProbeInterval = 10 * time.Minute
+
+// RunBootstrapProbe 在启用 bootstrap_probe 时周期性测量各 Bootstrap DNS 的响应时间，直到 ctx 被取消。
+// 上游主机名随后优先交给最快的 Bootstrap 服务器解析，不可用的服务器会被跳过。
+func (r *Router) RunBootstrapProbe(ctx context.Context) {
+	if !r.config.BootstrapProbe {
+		return
+	}
+	r.bootstrapper.RunProbe(ctx, bootstrapProbeInterval)
 }
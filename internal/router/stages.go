@@ -0,0 +1,65 @@
+package router
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+var routingStages = []string{
+	"Cache", "Cache(Stale)", "Cache(NSEC)", "FormErr", "Chaos", "ANY", "Debug", "AnswerMode", "Identity", "Hosts", "Zone", "Local", "Blocklist", "Policy",
+	"Rule(CN)", "Rule(Overseas)", "Rule(Both)", "Rule(Direct)", "Rule(Block)",
+	"Rule(Regex/CN)", "Rule(Regex/Overseas)", "Rule(Regex/Both)", "Rule(Regex/Direct)",
+	"DGA",
+	"PTR(CN)", "PTR(Overseas)",
+	"GeoSite(CN)", "GeoSite(Overseas)",
+	"GeoIP(CN)", "GeoIP(Overseas)",
+	"Failure",
+}
+
+type stageCounters map[string]*atomic.Int64
+
+func newStageCounters() stageCounters {
+	c := make(stageCounters, len(routingStages))
+	for _, name := range routingStages {
+		c[name] = new(atomic.Int64)
+	}
+	return c
+}
+
+func (c stageCounters) record(upstream string, failed bool) {
+	if failed {
+		c["Failure"].Add(1)
+		return
+	}
+	if strings.HasPrefix(upstream, "Policy(") {
+		upstream = "Policy"
+	}
+	if strings.HasPrefix(upstream, "DGA(") {
+		upstream = "DGA"
+	}
+	if counter, ok := c[upstream]; ok {
+		counter.Add(1)
+	}
+}
+
+// GetStageStats 返回各分流阶段命中次数。
+func (r *Router) GetStageStats() map[string]int64 {
+	stats := make(map[string]int64, len(r.stages))
+	for name, counter := range r.stages {
+		stats[name] = counter.Load()
+	}
+	return stats
+}
+
+func (r *Router) ResetStageStats() {
+	for _, counter := range r.stages {
+		counter.Store(0)
+	}
+}
+
+func (r *Router) CacheSize() int {
+	if r.cache == nil {
+		return 0
+	}
+	return r.cache.Len()
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"doh-autoproxy/internal/client"
+
+	"github.com/miekg/dns"
+)
+
+// race 按 tier 从小到大依次查询：同层内沿用 race / weighted 策略，
+// 只有整层上游都失败时才会使用下一层的备用上游。未配置 tier 时所有上游同属第 0 层。
+func (r *Router) race(ctx context.Context, req *dns.Msg, clients []client.DNSClient) (*dns.Msg, error) {
+	tiers := splitTiers(skipOpenCircuits(clients))
+	if len(tiers) == 1 {
+		return r.selectInTier(ctx, req, tiers[0])
+	}
+	if len(tiers) == 0 {
+		return r.selectInTier(ctx, req, clients)
+	}
+
+	var resp *dns.Msg
+	var err error
+	for i, tier := range tiers {
+		resp, err = r.selectInTier(ctx, req, tier)
+		if err == nil || ctx.Err() != nil {
+			return resp, err
+		}
+		if i < len(tiers)-1 {
+			log.Printf("第 %d 层上游全部失败，切换到备用层: %v", clientTier(tier[0]), err)
+		}
+	}
+	return resp, err
+}
+
+// skipOpenCircuits 剔除熔断冷却中的上游；全部处于熔断时保留原列表，避免查询无上游可用。
+func skipOpenCircuits(clients []client.DNSClient) []client.DNSClient {
+	var available []client.DNSClient
+	for _, c := range clients {
+		if sc, ok := c.(*client.StatsClient); ok && sc.CircuitOpen() {
+			continue
+		}
+		available = append(available, c)
+	}
+	if len(available) == 0 {
+		return clients
+	}
+	return available
+}
+
+// splitTiers 按 tier 升序分组，保持组内上游的配置顺序。
+func splitTiers(clients []client.DNSClient) [][]client.DNSClient {
+	byTier := make(map[int][]client.DNSClient)
+	var levels []int
+	for _, c := range clients {
+		t := clientTier(c)
+		if _, ok := byTier[t]; !ok {
+			levels = append(levels, t)
+		}
+		byTier[t] = append(byTier[t], c)
+	}
+	sort.Ints(levels)
+
+	tiers := make([][]client.DNSClient, 0, len(levels))
+	for _, t := range levels {
+		tiers = append(tiers, byTier[t])
+	}
+	return tiers
+}
+
+func clientTier(c client.DNSClient) int {
+	if sc, ok := c.(*client.StatsClient); ok {
+		return sc.Tier
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+
+	"doh-autoproxy/internal/client"
+
+	"github.com/miekg/dns"
+)
+
+// weighted 按权重随机选择一个上游查询，而不是同时向组内所有上游发起竞速。
+// 失败时按剩余权重继续挑选下一个上游，因此低权重的上游仍承担故障转移。
+func (r *Router) weighted(ctx context.Context, req *dns.Msg, clients []client.DNSClient) (*dns.Msg, error) {
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("没有可用的上游客户端")
+	}
+
+	order := weightedOrder(clients)
+	if sc, ok := order[0].(*client.StatsClient); ok {
+		sc.MarkSelected()
+	}
+
+	var lastErr error
+	for _, c := range order {
+		resp, err := c.Resolve(ctx, req.Copy())
+		if err == nil {
+			err = client.CheckQuestion(req, resp)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+		log.Printf("加权上游查询失败，尝试下一个上游: %v", err)
+	}
+	return nil, fmt.Errorf("所有上游查询均失败: %w", lastErr)
+}
+
+// weightedOrder 按权重做不放回抽样得到尝试顺序，不健康的上游排在最后。
+func weightedOrder(clients []client.DNSClient) []client.DNSClient {
+	var healthy, unhealthy []client.DNSClient
+	for _, c := range clients {
+		if sc, ok := c.(*client.StatsClient); ok && !sc.Healthy() {
+			unhealthy = append(unhealthy, c)
+		} else {
+			healthy = append(healthy, c)
+		}
+	}
+	return append(weightedShuffle(healthy), weightedShuffle(unhealthy)...)
+}
+
+func weightedShuffle(clients []client.DNSClient) []client.DNSClient {
+	pool := append([]client.DNSClient(nil), clients...)
+	order := make([]client.DNSClient, 0, len(pool))
+	for len(pool) > 0 {
+		total := 0
+		for _, c := range pool {
+			total += clientWeight(c)
+		}
+		n := rand.Intn(total)
+		i := 0
+		for ; i < len(pool)-1; i++ {
+			n -= clientWeight(pool[i])
+			if n < 0 {
+				break
+			}
+		}
+		order = append(order, pool[i])
+		pool = append(pool[:i], pool[i+1:]...)
+	}
+	return order
+}
+
+func clientWeight(c client.DNSClient) int {
+	if sc, ok := c.(*client.StatsClient); ok && sc.Weight > 0 {
+		return sc.Weight
+	}
+	return 1
+}
@@ -0,0 +1,141 @@
+package router
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type Zone struct {
+	origin      string
+	records     map[string][]dns.RR
+	names       map[string]bool
+	soa         *dns.SOA
+	fallThrough bool
+}
+
+func LoadZone(origin, path string, fallThrough bool) (*Zone, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseZone(f, origin, path, fallThrough)
+}
+
+func parseZone(r io.Reader, origin, path string, fallThrough bool) (*Zone, error) {
+	origin = strings.ToLower(dns.Fqdn(origin))
+	z := &Zone{
+		origin:      origin,
+		records:     make(map[string][]dns.RR),
+		names:       make(map[string]bool),
+		fallThrough: fallThrough,
+	}
+
+	zp := dns.NewZoneParser(r, origin, path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(origin, name) {
+			continue
+		}
+		if soa, ok := rr.(*dns.SOA); ok && name == origin {
+			z.soa = soa
+		}
+		z.records[name] = append(z.records[name], rr)
+
+		for n := name; dns.IsSubDomain(origin, n); {
+			z.names[n] = true
+			off, end := dns.NextLabel(n, 0)
+			if end {
+				break
+			}
+			n = n[off:]
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("解析区域文件 %s 失败: %w", path, err)
+	}
+
+	if z.soa == nil {
+		z.soa = &dns.SOA{
+			Hdr:     dns.RR_Header{Name: origin, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+			Ns:      origin,
+			Mbox:    "hostmaster." + origin,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  60,
+		}
+	}
+
+	return z, nil
+}
+
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+func (z *Zone) Answer(req *dns.Msg) (*dns.Msg, bool) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return nil, false
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	if !z.names[name] {
+		if z.fallThrough {
+			return nil, false
+		}
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{dns.Copy(z.soa)}
+		return m, true
+	}
+
+	target := name
+	for i := 0; i < 8; i++ {
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range z.records[target] {
+			if q.Qtype == dns.TypeANY || rr.Header().Rrtype == q.Qtype {
+				m.Answer = append(m.Answer, withName(rr, target))
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			break
+		}
+		m.Answer = append(m.Answer, withName(cname, target))
+		target = strings.ToLower(cname.Target)
+		if !dns.IsSubDomain(z.origin, target) {
+			break
+		}
+	}
+
+	if len(m.Answer) == 0 {
+		m.Ns = []dns.RR{dns.Copy(z.soa)}
+	}
+	return m, true
+}
+
+func withName(rr dns.RR, name string) dns.RR {
+	c := dns.Copy(rr)
+	c.Header().Name = name
+	return c
+}
+
+func sortZones(zones []*Zone) {
+	sort.Slice(zones, func(i, j int) bool {
+		return dns.CountLabel(zones[i].origin) > dns.CountLabel(zones[j].origin)
+	})
+}
@@ -4,82 +4,188 @@ import (
 	"context"
 	"log"
 	"net"
+	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/router"
+	"doh-autoproxy/internal/util"
 
 	"github.com/miekg/dns"
 )
 
 type DNSServer struct {
-	udpServer *dns.Server
-	tcpServer *dns.Server
-	router    *router.Router
+	udpServers []*dns.Server
+	tcpServer  *dns.Server
+	handler    *DNSRequestHandler
+	cfg        *config.Config
+	udpState   listenerState
+	tcpState   listenerState
 }
 
 func NewDNSServer(cfg *config.Config, r *router.Router) *DNSServer {
-	handler := &DNSRequestHandler{router: r}
+	handler := &DNSRequestHandler{}
+	handler.router.Store(r)
 
-	var udpServer, tcpServer *dns.Server
+	var udpServers []*dns.Server
+	var tcpServer *dns.Server
+
+	t := cfg.Timeouts.DNS
+	readTimeout, writeTimeout := timeoutOr(t.Read, 5*time.Second), timeoutOr(t.Write, 5*time.Second)
+	idleTimeout := timeoutOr(t.Idle, 8*time.Second)
 
 	if cfg.Listen.DNSUDP != "" {
-		udpServer = &dns.Server{Addr: cfg.Listen.DNSUDP, Net: "udp", Handler: handler, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+		n := 1
+		if cfg.Listen.ReusePort {
+			n = cfg.Listen.UDPListeners
+			if n <= 0 {
+				n = runtime.NumCPU()
+			}
+		}
+		for i := 0; i < n; i++ {
+			udpServers = append(udpServers, &dns.Server{Addr: cfg.Listen.DNSUDP, Net: "udp", Handler: handler, ReadTimeout: readTimeout, WriteTimeout: writeTimeout})
+		}
 	}
 
 	if cfg.Listen.DNSTCP != "" {
-		tcpServer = &dns.Server{Addr: cfg.Listen.DNSTCP, Net: "tcp", Handler: handler, ReadTimeout: 5 * time.Second, WriteTimeout: 5 * time.Second}
+		tcpServer = &dns.Server{Addr: cfg.Listen.DNSTCP, Net: "tcp", Handler: handler, ReadTimeout: readTimeout, WriteTimeout: writeTimeout,
+			IdleTimeout: func() time.Duration { return idleTimeout }}
 	}
 
 	return &DNSServer{
-		udpServer: udpServer,
-		tcpServer: tcpServer,
-		router:    r,
+		udpServers: udpServers,
+		tcpServer:  tcpServer,
+		handler:    handler,
+		cfg:        cfg,
 	}
 }
 
 func (s *DNSServer) Start() {
-	if s.udpServer != nil {
-		go func() {
-			log.Printf("Starting UDP DNS server on %s", s.udpServer.Addr)
-			err := s.udpServer.ListenAndServe()
+	iface := s.cfg.Listen.Interface
+	reusePort := s.cfg.Listen.ReusePort
+
+	if len(s.udpServers) > 0 {
+		if pc := util.ActivatedPacketConn(s.cfg.Listen.DNSUDP); pc != nil {
+			log.Printf("UDP DNS server 使用 systemd 套接字激活传入的 %s", pc.LocalAddr())
+			// 传入的套接字只有一个，忽略 reuse_port 的多监听器设置
+			s.udpServers = s.udpServers[:1]
+			s.udpServers[0].PacketConn = pc
+			s.udpState.up()
+			go func(srv *dns.Server) {
+				err := srv.ActivateAndServe()
+				if err != nil {
+					log.Printf("UDP DNS服务器异常退出: %v", err)
+				}
+				s.udpState.down(err)
+			}(s.udpServers[0])
+		}
+	}
+
+	for i, srv := range s.udpServers {
+		if srv.PacketConn != nil {
+			continue
+		}
+		go func(i int, srv *dns.Server) {
+			log.Printf("Starting UDP DNS server #%d on %s", i, srv.Addr)
+			pc, err := util.ListenPacket(srv.Addr, iface, reusePort)
 			if err != nil {
 				log.Printf("无法启动UDP DNS服务器: %v", err)
+				s.udpState.fail(err)
+				return
 			}
-		}()
+			srv.PacketConn = pc
+			s.udpState.up()
+			err = srv.ActivateAndServe()
+			if err != nil {
+				log.Printf("UDP DNS服务器异常退出: %v", err)
+			}
+			s.udpState.down(err)
+		}(i, srv)
 	}
 
 	if s.tcpServer != nil {
 		go func() {
-			log.Printf("Starting TCP DNS server on %s", s.tcpServer.Addr)
-			err := s.tcpServer.ListenAndServe()
+			l := util.ActivatedListener(s.tcpServer.Addr)
+			if l != nil {
+				log.Printf("TCP DNS server 使用 systemd 套接字激活传入的 %s", l.Addr())
+			} else {
+				log.Printf("Starting TCP DNS server on %s", s.tcpServer.Addr)
+				var err error
+				l, err = util.Listen(s.tcpServer.Addr, iface, reusePort)
+				if err != nil {
+					log.Printf("无法启动TCP DNS服务器: %v", err)
+					s.tcpState.fail(err)
+					return
+				}
+			}
+			s.tcpServer.Listener = l
+			s.tcpState.up()
+			err := s.tcpServer.ActivateAndServe()
 			if err != nil {
-				log.Printf("无法启动TCP DNS服务器: %v", err)
+				log.Printf("TCP DNS服务器异常退出: %v", err)
 			}
+			s.tcpState.down(err)
 		}()
 	}
 }
 
-func (s *DNSServer) Stop() error {
-	if s.udpServer != nil {
-		if err := s.udpServer.Shutdown(); err != nil {
-			return err
-		}
+// Listeners 返回已配置的 UDP (dns_udp) 与 TCP (dns_tcp) 监听器的状态。
+func (s *DNSServer) Listeners() map[string]ListenerStatus {
+	m := make(map[string]ListenerStatus, 2)
+	if len(s.udpServers) > 0 {
+		m["dns_udp"] = s.udpState.status()
 	}
 	if s.tcpServer != nil {
-		if err := s.tcpServer.Shutdown(); err != nil {
-			return err
-		}
+		m["dns_tcp"] = s.tcpState.status()
+	}
+	return m
+}
+
+// Stop 停止接收新查询，并等待进行中的查询写回响应 (最长到 ctx 截止) 后关闭监听。
+func (s *DNSServer) Stop(ctx context.Context) error {
+	servers := s.udpServers
+	if s.tcpServer != nil {
+		servers = append(servers[:len(servers):len(servers)], s.tcpServer)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); err != nil {
+				errs <- err
+			}
+		}(srv)
 	}
-	return nil
+	wg.Wait()
+	close(errs)
+
+	if err := waitDrained(ctx, &s.handler.inflight); err != nil {
+		return err
+	}
+	return <-errs
+}
+
+// SetRouter 替换处理查询所用的路由器，重载时未变更的监听器借此继续运行而无需重新绑定端口。
+func (s *DNSServer) SetRouter(r *router.Router) {
+	s.handler.router.Store(r)
 }
 
 type DNSRequestHandler struct {
-	router *router.Router
+	router   atomic.Pointer[router.Router]
+	protocol string
+	inflight sync.WaitGroup
 }
 
 func (h *DNSRequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	h.inflight.Add(1)
+	defer h.inflight.Done()
+
 	if len(req.Question) == 0 {
 		dns.HandleFailed(w, req)
 		return
@@ -88,11 +194,20 @@ func (h *DNSRequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
 
 	clientIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	localIP, _, _ := net.SplitHostPort(w.LocalAddr().String())
+
+	protocol := h.protocol
+	if protocol == "" {
+		protocol = "TCP"
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			protocol = "UDP"
+		}
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	resp, err := h.router.Route(ctx, req, clientIP)
+	resp, err := h.router.Load().Route(ctx, req, clientIP, localIP, protocol)
 	if err != nil {
 		log.Printf("Error routing DNS query for %s: %v", qName, err)
 		dns.HandleFailed(w, req)
@@ -100,5 +215,18 @@ func (h *DNSRequestHandler) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	resp.SetRcode(req, resp.Rcode)
+	if protocol == "UDP" {
+		resp.Truncate(udpResponseSize(req))
+	}
 	w.WriteMsg(resp)
 }
+
+// udpResponseSize 返回 UDP 应答的大小上限：客户端通告的 EDNS 缓冲区与 edns_buffer_size 中的较小者，
+// 客户端不带 EDNS 时为 512 字节。超出的应答被截断并置 TC 位，客户端改用 TCP 重试。
+func udpResponseSize(req *dns.Msg) int {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+	return int(max(min(opt.UDPSize(), util.EDNSBufferSize()), dns.MinMsgSize))
+}
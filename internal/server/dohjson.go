@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"doh-autoproxy/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+// JSON DoH 接口 (application/dns-json)，与 Google / Cloudflare 的格式兼容：
+// GET /dns-query?name=example.com&type=AAAA[&do=1][&cd=1]
+
+type jsonQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type jsonRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type jsonResponse struct {
+	Status     int            `json:"Status"`
+	TC         bool           `json:"TC"`
+	RD         bool           `json:"RD"`
+	RA         bool           `json:"RA"`
+	AD         bool           `json:"AD"`
+	CD         bool           `json:"CD"`
+	Question   []jsonQuestion `json:"Question"`
+	Answer     []jsonRR       `json:"Answer,omitempty"`
+	Authority  []jsonRR       `json:"Authority,omitempty"`
+	Additional []jsonRR       `json:"Additional,omitempty"`
+}
+
+// isJSONQuery 判断 GET 请求是否使用 JSON 接口：带 name 参数且没有 dns 参数。
+func isJSONQuery(q url.Values) bool {
+	return q.Get("dns") == "" && q.Get("name") != ""
+}
+
+// parseJSONQuery 将 name/type/do/cd 参数转换为 DNS 请求。type 可以是类型名或数值，默认为 A。
+func parseJSONQuery(q url.Values) (*dns.Msg, error) {
+	name := q.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, fmt.Errorf("无效的域名: %q", name)
+	}
+
+	qtype := dns.TypeA
+	if t := q.Get("type"); t != "" {
+		if n, err := strconv.ParseUint(t, 10, 16); err == nil {
+			qtype = uint16(n)
+		} else if v, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+			qtype = v
+		} else {
+			return nil, fmt.Errorf("无效的查询类型: %q", t)
+		}
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.CheckingDisabled = jsonFlag(q.Get("cd"))
+	if jsonFlag(q.Get("do")) {
+		req.SetEdns0(util.EDNSBufferSize(), true)
+	}
+	return req, nil
+}
+
+func jsonFlag(v string) bool {
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+func newJSONResponse(resp *dns.Msg) *jsonResponse {
+	out := &jsonResponse{
+		Status:     resp.Rcode,
+		TC:         resp.Truncated,
+		RD:         resp.RecursionDesired,
+		RA:         resp.RecursionAvailable,
+		AD:         resp.AuthenticatedData,
+		CD:         resp.CheckingDisabled,
+		Answer:     jsonRRs(resp.Answer),
+		Authority:  jsonRRs(resp.Ns),
+		Additional: jsonRRs(resp.Extra),
+	}
+	for _, q := range resp.Question {
+		out.Question = append(out.Question, jsonQuestion{Name: q.Name, Type: q.Qtype})
+	}
+	return out
+}
+
+// jsonRRs 转换记录，data 为记录的 RDATA 文本形式；OPT 伪记录不输出。
+func jsonRRs(rrs []dns.RR) []jsonRR {
+	var out []jsonRR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, jsonRR{
+			Name: h.Name,
+			Type: h.Rrtype,
+			TTL:  h.Ttl,
+			Data: strings.TrimPrefix(rr.String(), h.String()),
+		})
+	}
+	return out
+}
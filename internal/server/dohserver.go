@@ -2,16 +2,22 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"doh-autoproxy/internal/cache"
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/router"
 	"doh-autoproxy/internal/util"
@@ -24,8 +30,11 @@ import (
 type DoHServer struct {
 	http2Server *http.Server
 	http3Server *http3.Server
-	router      *router.Router
+	h3Conn      atomic.Pointer[net.UDPConn]
+	handler     *DoHRequestHandler
 	cfg         *config.Config
+	h2State     listenerState
+	h3State     listenerState
 }
 
 func NewDoHServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *DoHServer {
@@ -34,9 +43,35 @@ func NewDoHServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *D
 		dohPath = "/dns-query"
 	}
 
-	dohHandler := &DoHRequestHandler{
-		router: r,
-		path:   dohPath,
+	t := cfg.Timeouts.DoH
+	readTimeout, writeTimeout := timeoutOr(t.Read, 10*time.Second), timeoutOr(t.Write, 10*time.Second)
+	idleTimeout := timeoutOr(t.Idle, 30*time.Second)
+
+	dohHandler := &DoHRequestHandler{path: dohPath}
+	dohHandler.router.Store(r)
+	for _, p := range cfg.Listen.DoHTrustedProxies {
+		if prefix, err := config.ParseTrustedProxy(p); err == nil {
+			dohHandler.trustedProxies = append(dohHandler.trustedProxies, prefix)
+		}
+	}
+
+	if cfg.Listen.DoHPlaintext {
+		log.Println("DoH: 明文模式 (HTTP/1.1, h2c)，请在前端反向代理终止 TLS")
+		protocols := new(http.Protocols)
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		return &DoHServer{
+			http2Server: &http.Server{
+				Addr:         cfg.Listen.DOH,
+				Handler:      dohHandler,
+				Protocols:    protocols,
+				ReadTimeout:  readTimeout,
+				WriteTimeout: writeTimeout,
+				IdleTimeout:  idleTimeout,
+			},
+			handler: dohHandler,
+			cfg:     cfg,
+		}
 	}
 
 	var tlsConfig *tls.Config
@@ -75,9 +110,23 @@ func NewDoHServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *D
 		Addr:         cfg.Listen.DOH,
 		Handler:      dohHandler,
 		TLSConfig:    tlsConfig,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  30 * time.Second,
+		ReadTimeout:  readTimeout,
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  idleTimeout,
+	}
+
+	if !cfg.Listen.DoHHTTP3Enabled() {
+		log.Println("DoH: 已关闭 HTTP/3 (doh_http3: false)")
+		return &DoHServer{
+			http2Server: http2Server,
+			handler:     dohHandler,
+			cfg:         cfg,
+		}
+	}
+
+	// HTTP/1.1 与 HTTP/2 应答通过 Alt-Svc 告知客户端同一端口上可用 HTTP/3
+	if port := util.ParsePort(cfg.Listen.DOH); port != 0 {
+		dohHandler.altSvc = fmt.Sprintf(`h3=":%d"; ma=86400`, port)
 	}
 
 	http3Server := &http3.Server{
@@ -85,84 +134,209 @@ func NewDoHServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *D
 		TLSConfig: tlsConfig,
 		Handler:   dohHandler,
 		QUICConfig: &quic.Config{
-			MaxIdleTimeout: 30 * time.Second,
+			MaxIdleTimeout: idleTimeout,
 		},
 	}
 
 	return &DoHServer{
 		http2Server: http2Server,
 		http3Server: http3Server,
-		router:      r,
+		handler:     dohHandler,
 		cfg:         cfg,
 	}
 }
 
 func (s *DoHServer) Start() {
-	if s.http2Server == nil || s.http3Server == nil {
-		log.Println("DoH 服务器未完全初始化，可能因为证书加载失败。")
+	if s.cfg.Listen.DoHPlaintext && s.http2Server != nil {
+		log.Printf("Starting DoH (plaintext HTTP/1.1, h2c) server on %s%s", s.http2Server.Addr, s.cfg.Listen.DoHPath)
+		go s.serveHTTP(false)
 		return
 	}
 
-	go func() {
-		log.Printf("Starting DoH (HTTP/1.1, HTTP/2) server on %s%s", s.http2Server.Addr, s.cfg.Listen.DoHPath)
-		err := s.http2Server.ListenAndServeTLS("", "")
-		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("无法启动DoH (HTTP/1.1, HTTP/2) 服务器: %v", err)
-		}
-	}()
-
-	go func() {
-		log.Printf("Starting DoH (HTTP/3) server on %s%s", s.http3Server.Addr, s.cfg.Listen.DoHPath)
+	if s.http2Server == nil {
+		log.Println("DoH 服务器未完全初始化，可能因为证书加载失败。")
+		return
+	}
 
+	// 先绑定 UDP 端口：HTTP/3 是可选的，绑定失败时只记录警告，并在 HTTP/2 开始服务前撤下 Alt-Svc
+	if s.http3Server != nil {
 		udpPort := util.ParsePort(s.http3Server.Addr)
-		udpAddr := &net.UDPAddr{Port: udpPort}
-		udpConn, err := net.ListenUDP("udp", udpAddr)
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: udpPort})
 		if err != nil {
-			log.Fatalf("无法监听UDP端口用于HTTP/3: %v", err)
+			log.Printf("警告: 无法监听UDP端口用于HTTP/3，DoH 仅通过 HTTP/1.1、HTTP/2 提供服务: %v", err)
+			s.h3State.fail(err)
+			s.handler.altSvc = ""
+		} else {
+			// 由 Stop 在进行中的请求处理完毕后关闭，Serve 返回时连接上可能仍有未写完的响应
+			s.h3Conn.Store(udpConn)
+			s.h3State.up()
+			go func() {
+				log.Printf("Starting DoH (HTTP/3) server on %s%s", s.http3Server.Addr, s.cfg.Listen.DoHPath)
+				err := s.http3Server.Serve(udpConn)
+				if err == http.ErrServerClosed {
+					err = nil
+				}
+				if err != nil {
+					log.Printf("DoH (HTTP/3) 服务器异常退出: %v", err)
+				}
+				s.h3State.down(err)
+			}()
 		}
-		defer udpConn.Close()
+	}
 
-		err = s.http3Server.Serve(udpConn)
-		if err != nil && err != http.ErrServerClosed {
-			log.Fatalf("无法启动DoH (HTTP/3) 服务器: %v", err)
-		}
-	}()
+	log.Printf("Starting DoH (HTTP/1.1, HTTP/2) server on %s%s", s.http2Server.Addr, s.cfg.Listen.DoHPath)
+	go s.serveHTTP(true)
 }
 
-func (s *DoHServer) Stop() error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+// serveHTTP 绑定 TCP 端口并提供 HTTP/1.1、HTTP/2 (useTLS 为 false 时为明文 h2c) 服务。
+// 绑定失败只记录错误，不影响其他协议的监听器。
+func (s *DoHServer) serveHTTP(useTLS bool) {
+	l, err := net.Listen("tcp", s.http2Server.Addr)
+	if err != nil {
+		log.Printf("无法启动DoH服务器: %v", err)
+		s.h2State.fail(err)
+		return
+	}
+	s.h2State.up()
+	if useTLS {
+		err = s.http2Server.ServeTLS(l, "", "")
+	} else {
+		err = s.http2Server.Serve(l)
+	}
+	if err == http.ErrServerClosed {
+		err = nil
+	}
+	if err != nil {
+		log.Printf("DoH服务器异常退出: %v", err)
+	}
+	s.h2State.down(err)
+}
 
+// Listeners 返回 DoH 的 HTTP/1.1、HTTP/2 监听器 (doh) 与开启时的 HTTP/3 监听器 (doh3) 的状态。
+func (s *DoHServer) Listeners() map[string]ListenerStatus {
+	m := map[string]ListenerStatus{"doh": s.h2State.status()}
+	if s.http3Server != nil {
+		m["doh3"] = s.h3State.status()
+	}
+	return m
+}
+
+// Stop 停止接受新请求，并等待进行中的查询完成 (最长到 ctx 截止) 后关闭监听。
+func (s *DoHServer) Stop(ctx context.Context) error {
+	var wg sync.WaitGroup
 	if s.http2Server != nil {
-		if err := s.http2Server.Shutdown(ctx); err != nil {
-			log.Printf("Error shutting down DoH HTTP/2 server: %v", err)
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.http2Server.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down DoH HTTP/2 server: %v", err)
+			}
+		}()
 	}
 	if s.http3Server != nil {
-		if err := s.http3Server.Close(); err != nil {
-			log.Printf("Error closing DoH HTTP/3 server: %v", err)
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.http3Server.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down DoH HTTP/3 server: %v", err)
+				s.http3Server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	err := waitDrained(ctx, &s.handler.inflight)
+	if conn := s.h3Conn.Load(); conn != nil {
+		conn.Close()
 	}
-	return nil
+	return err
+}
+
+func (s *DoHServer) SetRouter(r *router.Router) {
+	s.handler.router.Store(r)
 }
 
 type DoHRequestHandler struct {
-	router *router.Router
-	path   string
+	router         atomic.Pointer[router.Router]
+	path           string
+	altSvc         string         // 为空时不发送 Alt-Svc (明文模式没有 HTTP/3)
+	trustedProxies []netip.Prefix // 只有来自这些地址的 X-Forwarded-For 才被采信
+	inflight       sync.WaitGroup
+}
+
+// clientIP 返回查询的客户端地址，客户端策略按它匹配。默认为连接的对端地址；只有对端是受信反向代理时
+// 才采信 X-Forwarded-For，并自右向左跳过受信代理追加的地址，取第一个不属于受信代理的地址
+// (更靠左的部分可由客户端任意伪造)。
+func (h *DoHRequestHandler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !h.trusted(host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if _, err := netip.ParseAddr(hop); err != nil {
+			break
+		}
+		host = hop
+		if !h.trusted(hop) {
+			break
+		}
+	}
+	return host
+}
+
+func (h *DoHRequestHandler) trusted(host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range h.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
 }
 
 func (h *DoHRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.inflight.Add(1)
+	defer h.inflight.Done()
+
+	if h.altSvc != "" && r.ProtoMajor < 3 {
+		w.Header().Set("Alt-Svc", h.altSvc)
+	}
+
 	if r.URL.Path != h.path {
 		http.NotFound(w, r)
 		return
 	}
 
 	var dnsMsg []byte
+	var req *dns.Msg
 	var err error
+	jsonMode := false
 
 	switch r.Method {
 	case http.MethodGet:
-		dnsParam := r.URL.Query().Get("dns")
+		query := r.URL.Query()
+		if isJSONQuery(query) {
+			jsonMode = true
+			req, err = parseJSONQuery(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			break
+		}
+		dnsParam := query.Get("dns")
 		if dnsParam == "" {
 			http.Error(w, "缺少dns查询参数", http.StatusBadRequest)
 			return
@@ -177,20 +351,33 @@ func (h *DoHRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Content-Type必须是application/dns-message", http.StatusUnsupportedMediaType)
 			return
 		}
-		dnsMsg, err = ioutil.ReadAll(r.Body)
-		if err != nil {
+		buf := util.GetBuffer()
+		defer util.PutBuffer(buf)
+		n, err := io.ReadFull(r.Body, *buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
 			http.Error(w, "无法读取请求体", http.StatusBadRequest)
 			return
 		}
+		// 缓冲区已读满时再多读一个字节，请求体超过 DNS 消息的最大长度则拒绝，而不是截断后解包
+		if n == len(*buf) {
+			var extra [1]byte
+			if m, _ := io.ReadFull(r.Body, extra[:]); m > 0 {
+				http.Error(w, "请求体超过DNS消息的最大长度", http.StatusRequestEntityTooLarge)
+				return
+			}
+		}
+		dnsMsg = (*buf)[:n]
 	default:
 		http.Error(w, "不支持的HTTP方法", http.StatusMethodNotAllowed)
 		return
 	}
 
-	req := new(dns.Msg)
-	if err := req.Unpack(dnsMsg); err != nil {
-		http.Error(w, fmt.Sprintf("无法解包DNS消息: %v", err), http.StatusBadRequest)
-		return
+	if req == nil {
+		req = new(dns.Msg)
+		if err := req.Unpack(dnsMsg); err != nil {
+			http.Error(w, fmt.Sprintf("无法解包DNS消息: %v", err), http.StatusBadRequest)
+			return
+		}
 	}
 
 	if len(req.Question) == 0 {
@@ -200,31 +387,56 @@ func (h *DoHRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
 
-	clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			clientIP = strings.TrimSpace(parts[0])
-		}
+	clientIP := h.clientIP(r)
+	var localIP string
+	if la, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		localIP, _, _ = net.SplitHostPort(la.String())
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
 	defer cancel()
 
-	resp, err := h.router.Route(ctx, req, clientIP)
+	resp, err := h.router.Load().Route(ctx, req, clientIP, localIP, "DoH")
 	if err != nil {
 		log.Printf("Error routing DoH query for %s: %v", qName, err)
 		resp = new(dns.Msg)
 		resp.SetRcode(req, dns.RcodeServerFailure)
 	}
 
-	packedResp, err := resp.Pack()
+	packBuf := util.GetBuffer()
+	defer util.PutBuffer(packBuf)
+	packedResp, err := resp.PackBuffer(*packBuf)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("无法打包DNS响应: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/dns-message")
-	w.Write(packedResp)
-}
+	// ETag 不包含消息 ID，同一问题的重复查询得到相同的 ETag
+	contentType, body, etagBody := "application/dns-message", packedResp, packedResp[2:]
+	if jsonMode {
+		body, err = json.Marshal(newJSONResponse(resp))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("无法编码JSON响应: %v", err), http.StatusInternalServerError)
+			return
+		}
+		contentType, etagBody = "application/dns-json", body
+	}
 
+	// RFC 8484 §5.1: max-age 取应答记录的最小 TTL，否定应答取 SOA 的否定缓存时间；
+	// 无记录可依据或出错的应答 (SERVFAIL 等) 为 max-age=0，要求 HTTP 缓存每次重新验证。
+	w.Header().Set("Content-Type", contentType)
+	if ttl, ok := cache.MinTTL(resp); ok && ttl > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		if r.Method == http.MethodGet {
+			etag := fmt.Sprintf("\"%x\"", sha256.Sum256(etagBody))
+			w.Header().Set("ETag", etag)
+			if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	} else {
+		w.Header().Set("Cache-Control", "max-age=0")
+	}
+	w.Write(body)
+}
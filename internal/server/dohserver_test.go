@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"doh-autoproxy/internal/config"
+	"doh-autoproxy/internal/router"
+	"doh-autoproxy/internal/util"
+
+	"github.com/miekg/dns"
+)
+
+func newTestDoHHandler(tb testing.TB) *DoHRequestHandler {
+	tb.Helper()
+	cfg := &config.Config{Hosts: map[string]string{"bench.test": "10.0.0.1"}}
+	h := &DoHRequestHandler{path: "/dns-query"}
+	h.router.Store(router.NewRouter(cfg, &router.GeoDataManager{}, nil))
+	return h
+}
+
+func packQuery(tb testing.TB, name string) []byte {
+	tb.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	packed, err := req.Pack()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return packed
+}
+
+func postQuery(h http.Handler, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/dns-message")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestDoHPostOversizedBody(t *testing.T) {
+	h := newTestDoHHandler(t)
+
+	body := append(packQuery(t, "bench.test"), make([]byte, util.MaxDNSMessageSize)...)
+	if w := postQuery(h, body); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body: got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+
+	w := postQuery(h, packQuery(t, "bench.test"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("normal body: got status %d, want %d", w.Code, http.StatusOK)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(w.Body.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Answer) != 1 {
+		t.Fatalf("got %d answers, want 1", len(resp.Answer))
+	}
+}
+
+// BenchmarkDoHPost 衡量一次 DoH POST 查询 (读请求体、解包、路由、打包) 的分配次数。
+func BenchmarkDoHPost(b *testing.B) {
+	h := newTestDoHHandler(b)
+	body := packQuery(b, "bench.test")
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if w := postQuery(h, body); w.Code != http.StatusOK {
+			b.Fatalf("got status %d", w.Code)
+		}
+	}
+}
+
+// BenchmarkPack 对比每次分配新切片的 Pack 与使用缓冲池的 PackBuffer。
+func BenchmarkPack(b *testing.B) {
+	resp := new(dns.Msg)
+	resp.SetQuestion("bench.test.", dns.TypeA)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "bench.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{10, 0, 0, 1},
+	})
+
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := resp.Pack(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pool", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			buf := util.GetBuffer()
+			if _, err := resp.PackBuffer(*buf); err != nil {
+				b.Fatal(err)
+			}
+			util.PutBuffer(buf)
+		}
+	})
+}
+
+func TestDoHClientIP(t *testing.T) {
+	h := &DoHRequestHandler{}
+	for _, p := range []string{"127.0.0.1", "10.0.0.0/8"} {
+		prefix, err := config.ParseTrustedProxy(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.trustedProxies = append(h.trustedProxies, prefix)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{name: "no header", remote: "192.0.2.1:5000", want: "192.0.2.1"},
+		{name: "untrusted peer", remote: "192.0.2.1:5000", xff: []string{"198.51.100.7"}, want: "192.0.2.1"},
+		{name: "trusted proxy", remote: "127.0.0.1:5000", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "spoofed leftmost entry", remote: "127.0.0.1:5000", xff: []string{"192.168.1.50, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "proxy chain", remote: "127.0.0.1:5000", xff: []string{"198.51.100.7", "10.1.2.3"}, want: "198.51.100.7"},
+		{name: "invalid entry", remote: "127.0.0.1:5000", xff: []string{"198.51.100.7, bogus"}, want: "127.0.0.1"},
+		{name: "only proxies", remote: "127.0.0.1:5000", xff: []string{"10.1.2.3"}, want: "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := h.clientIP(r); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"doh-autoproxy/internal/config"
@@ -18,21 +20,64 @@ import (
 	"github.com/quic-go/quic-go"
 )
 
+const (
+	doqErrorNoError       = 0x0
+	doqErrorExcessiveLoad = 0x4
+)
+
 type DoQServer struct {
 	addr     string
-	router   *router.Router
+	router   atomic.Pointer[router.Router]
 	cfg      *config.Config
 	cm       *util.CertManager
 	listener *quic.Listener
+
+	// acceptCtx 在 Stop 时取消，使监听与各连接不再接受新的连接和流
+	acceptCtx  context.Context
+	stopAccept context.CancelFunc
+	inflight   sync.WaitGroup
+	state      listenerState
+
+	idleTimeout       time.Duration
+	maxConnections    int64
+	maxStreamsPerConn int64
+	activeConns       atomic.Int64
+	streamSem         chan struct{}
 }
 
 func NewDoQServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *DoQServer {
-	return &DoQServer{
-		addr:   cfg.Listen.DOQ,
-		router: r,
-		cfg:    cfg,
-		cm:     cm,
+	maxConns := cfg.DoQLimits.MaxConnections
+	if maxConns <= 0 {
+		maxConns = 1000
+	}
+	maxStreamsPerConn := cfg.DoQLimits.MaxStreamsPerConn
+	if maxStreamsPerConn <= 0 {
+		maxStreamsPerConn = 100
 	}
+	maxStreams := cfg.DoQLimits.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = 10000
+	}
+
+	acceptCtx, stopAccept := context.WithCancel(context.Background())
+
+	s := &DoQServer{
+		addr:              cfg.Listen.DOQ,
+		acceptCtx:         acceptCtx,
+		stopAccept:        stopAccept,
+		cfg:               cfg,
+		cm:                cm,
+		idleTimeout:       timeoutOr(cfg.Timeouts.DoQ.Idle, 30*time.Second),
+		maxConnections:    int64(maxConns),
+		maxStreamsPerConn: int64(maxStreamsPerConn),
+		streamSem:         make(chan struct{}, maxStreams),
+	}
+	s.router.Store(r)
+	return s
+}
+
+func (s *DoQServer) SetRouter(r *router.Router) {
+	s.router.Store(r)
 }
 
 func (s *DoQServer) Start() {
@@ -52,12 +97,14 @@ func (s *DoQServer) Start() {
 			certs, err = util.LoadServerCertificates(s.cfg.TLSCertificates)
 			if err != nil {
 				log.Printf("Warning: DoQ 服务器无法加载配置的证书: %v", err)
+				s.state.fail(err)
 				return
 			}
 		} else {
 			certs, err = util.LoadServerCertificate("server.crt", "server.key")
 			if err != nil {
 				log.Printf("Warning: DoQ 服务器无法加载默认证书: %v", err)
+				s.state.fail(err)
 				return
 			}
 		}
@@ -69,7 +116,9 @@ func (s *DoQServer) Start() {
 	}
 
 	quicConfig := &quic.Config{
-		MaxIdleTimeout: 30 * time.Second,
+		MaxIdleTimeout:        s.idleTimeout,
+		MaxIncomingStreams:    s.maxStreamsPerConn,
+		MaxIncomingUniStreams: -1,
 	}
 
 	go func() {
@@ -77,45 +126,88 @@ func (s *DoQServer) Start() {
 		listener, err := quic.ListenAddr(s.addr, tlsConfig, quicConfig)
 		if err != nil {
 			log.Printf("无法启动DoQ服务器: %v", err)
+			s.state.fail(err)
 			return
 		}
 		s.listener = listener
+		s.state.up()
 
 		for {
-			conn, err := listener.Accept(context.Background())
+			conn, err := listener.Accept(s.acceptCtx)
 			if err != nil {
-				if err != quic.ErrServerClosed {
+				if err != quic.ErrServerClosed && s.acceptCtx.Err() == nil {
 					log.Printf("接受QUIC连接失败: %v", err)
+					s.state.down(err)
+				} else {
+					s.state.down(nil)
 				}
 				return
 			}
+			if s.activeConns.Add(1) > s.maxConnections {
+				s.activeConns.Add(-1)
+				log.Printf("DoQ: 连接数已达上限 (%d)，拒绝来自 %s 的连接", s.maxConnections, conn.RemoteAddr())
+				conn.CloseWithError(quic.ApplicationErrorCode(doqErrorExcessiveLoad), "too many connections")
+				continue
+			}
+			s.inflight.Add(1)
 			go s.handleQuicConnection(conn)
 		}
 	}()
 }
 
-func (s *DoQServer) Stop() error {
+// Listeners 返回 DoQ 监听器 (doq) 的状态。
+func (s *DoQServer) Listeners() map[string]ListenerStatus {
+	return map[string]ListenerStatus{"doq": s.state.status()}
+}
+
+// Stop 停止接受新连接与新查询流，等待进行中的流写回响应 (最长到 ctx 截止)。
+// 已建立的连接在其流处理完毕后才会关闭，避免响应被截断。
+func (s *DoQServer) Stop(ctx context.Context) error {
+	s.stopAccept()
 	if s.listener != nil {
-		return s.listener.Close()
+		if err := s.listener.Close(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return waitDrained(ctx, &s.inflight)
 }
 
 func (s *DoQServer) handleQuicConnection(conn *quic.Conn) {
 	log.Printf("DoQ: New connection from %s", conn.RemoteAddr())
-	defer conn.CloseWithError(quic.ApplicationErrorCode(quic.NoError), "Connection closed")
+	var streams sync.WaitGroup
+	defer s.inflight.Done()
+	defer s.activeConns.Add(-1)
+	defer conn.CloseWithError(quic.ApplicationErrorCode(doqErrorNoError), "Connection closed")
+	defer streams.Wait()
 
 	for {
-		stream, err := conn.AcceptStream(context.Background())
+		stream, err := conn.AcceptStream(s.acceptCtx)
 		if err != nil {
-			log.Printf("DoQ: 接受流失败: %v", err)
+			if s.acceptCtx.Err() == nil {
+				log.Printf("DoQ: 接受流失败: %v", err)
+			}
 			return
 		}
-		go s.handleQuicStream(stream, conn.RemoteAddr())
+
+		select {
+		case s.streamSem <- struct{}{}:
+		default:
+			log.Printf("DoQ: 并发流已达全局上限 (%d)，拒绝来自 %s 的查询", cap(s.streamSem), conn.RemoteAddr())
+			stream.CancelRead(quic.StreamErrorCode(doqErrorExcessiveLoad))
+			stream.CancelWrite(quic.StreamErrorCode(doqErrorExcessiveLoad))
+			continue
+		}
+
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			defer func() { <-s.streamSem }()
+			s.handleQuicStream(stream, conn.RemoteAddr(), conn.LocalAddr())
+		}()
 	}
 }
 
-func (s *DoQServer) handleQuicStream(stream *quic.Stream, remoteAddr net.Addr) {
+func (s *DoQServer) handleQuicStream(stream *quic.Stream, remoteAddr, localAddr net.Addr) {
 	defer stream.Close()
 
 	lengthBytes := make([]byte, 2)
@@ -127,7 +219,10 @@ func (s *DoQServer) handleQuicStream(stream *quic.Stream, remoteAddr net.Addr) {
 	}
 	dnsMsgLen := binary.BigEndian.Uint16(lengthBytes)
 
-	msgBuf := make([]byte, dnsMsgLen)
+	buf := util.GetBuffer()
+	defer util.PutBuffer(buf)
+
+	msgBuf := (*buf)[:dnsMsgLen]
 	if _, err := io.ReadFull(stream, msgBuf); err != nil {
 		log.Printf("DoQ: 读取DNS消息失败: %v", err)
 		return
@@ -147,18 +242,19 @@ func (s *DoQServer) handleQuicStream(stream *quic.Stream, remoteAddr net.Addr) {
 	qName := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
 
 	clientIP, _, _ := net.SplitHostPort(remoteAddr.String())
+	localIP, _, _ := net.SplitHostPort(localAddr.String())
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	resp, err := s.router.Route(ctx, req, clientIP)
+	resp, err := s.router.Load().Route(ctx, req, clientIP, localIP, "DoQ")
 	if err != nil {
 		log.Printf("DoQ: Error routing DNS query for %s: %v", qName, err)
 		resp = new(dns.Msg)
 		resp.SetRcode(req, dns.RcodeServerFailure)
 	}
 
-	packedResp, err := resp.Pack()
+	packedResp, err := resp.PackBuffer(*buf)
 	if err != nil {
 		log.Printf("DoQ: 打包响应消息失败: %v", err)
 		return
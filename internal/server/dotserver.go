@@ -1,6 +1,7 @@
 package server
 
 import (
+	"context"
 	"crypto/tls"
 	"log"
 	"time"
@@ -13,13 +14,15 @@ import (
 )
 
 type DoTServer struct {
-	server *dns.Server
-	router *router.Router
-	cfg    *config.Config
+	server  *dns.Server
+	handler *DNSRequestHandler
+	cfg     *config.Config
+	state   listenerState
 }
 
 func NewDoTServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *DoTServer {
-	handler := &DNSRequestHandler{router: r}
+	handler := &DNSRequestHandler{protocol: "DoT"}
+	handler.router.Store(r)
 
 	var tlsConfig *tls.Config
 
@@ -53,19 +56,22 @@ func NewDoTServer(cfg *config.Config, r *router.Router, cm *util.CertManager) *D
 		}
 	}
 
+	t := cfg.Timeouts.DoT
+	idleTimeout := timeoutOr(t.Idle, 8*time.Second)
 	server := &dns.Server{
 		Addr:         cfg.Listen.DOT,
 		Net:          "tcp-tls",
 		TLSConfig:    tlsConfig,
 		Handler:      handler,
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		ReadTimeout:  timeoutOr(t.Read, 10*time.Second),
+		WriteTimeout: timeoutOr(t.Write, 10*time.Second),
+		IdleTimeout:  func() time.Duration { return idleTimeout },
 	}
 
 	return &DoTServer{
-		server: server,
-		router: r,
-		cfg:    cfg,
+		server:  server,
+		handler: handler,
+		cfg:     cfg,
 	}
 }
 
@@ -76,16 +82,38 @@ func (s *DoTServer) Start() {
 	}
 	go func() {
 		log.Printf("Starting DoT server on %s", s.server.Addr)
-		err := s.server.ListenAndServe()
+		l, err := tls.Listen("tcp", s.server.Addr, s.server.TLSConfig)
 		if err != nil {
 			log.Printf("无法启动DoT服务器: %v", err)
+			s.state.fail(err)
+			return
 		}
+		s.server.Listener = l
+		s.state.up()
+		err = s.server.ActivateAndServe()
+		if err != nil {
+			log.Printf("DoT服务器异常退出: %v", err)
+		}
+		s.state.down(err)
 	}()
 }
 
-func (s *DoTServer) Stop() error {
-	if s.server != nil {
-		return s.server.Shutdown()
+// Listeners 返回 DoT 监听器 (dot) 的状态。
+func (s *DoTServer) Listeners() map[string]ListenerStatus {
+	return map[string]ListenerStatus{"dot": s.state.status()}
+}
+
+func (s *DoTServer) SetRouter(r *router.Router) {
+	s.handler.router.Store(r)
+}
+
+func (s *DoTServer) Stop(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	err := s.server.ShutdownContext(ctx)
+	if drainErr := waitDrained(ctx, &s.handler.inflight); drainErr != nil {
+		return drainErr
 	}
-	return nil
+	return err
 }
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// timeoutOr 把 timeouts 配置中的秒数转换为时长，未设置 (不大于 0) 时返回 def。
+func timeoutOr(seconds int, def time.Duration) time.Duration {
+	if seconds <= 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// waitDrained 等待所有进行中的查询处理完毕，最长等到 ctx 截止。
+func waitDrained(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import "sync"
+
+// ListenerStatus 是单个监听器的运行状态。Listening 为 false 且 Error 不为空表示启动失败或异常退出。
+type ListenerStatus struct {
+	Listening bool   `json:"listening"`
+	Error     string `json:"error,omitempty"`
+}
+
+// listenerState 记录一个监听器 (或同一地址上的一组 reuse_port 监听器) 的状态。
+// 监听失败只记录日志与错误，不会结束进程，其他协议的监听器照常服务。
+type listenerState struct {
+	mu     sync.Mutex
+	active int
+	err    string
+}
+
+// up 在端口绑定成功、即将开始服务时调用。
+func (l *listenerState) up() {
+	l.mu.Lock()
+	l.active++
+	l.mu.Unlock()
+}
+
+// down 在已开始服务的监听器退出时调用，正常停止时 err 为 nil。
+func (l *listenerState) down(err error) {
+	l.mu.Lock()
+	l.active--
+	if err != nil {
+		l.err = err.Error()
+	}
+	l.mu.Unlock()
+}
+
+// fail 记录绑定端口等启动阶段的失败。
+func (l *listenerState) fail(err error) {
+	l.mu.Lock()
+	l.err = err.Error()
+	l.mu.Unlock()
+}
+
+func (l *listenerState) status() ListenerStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return ListenerStatus{Listening: l.active > 0, Error: l.err}
+}
@@ -0,0 +1,61 @@
+//go:build otel
+
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"doh-autoproxy/internal/config"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Setup 按配置创建 TracerProvider 并开始记录 span，返回的 shutdown 在停止或重载时调用，用于发送剩余的 span。
+// 未启用时关闭追踪并返回空操作的 shutdown。
+func Setup(cfg config.TracingConfig) (shutdown func(context.Context) error, err error) {
+	noop := func(context.Context) error { return nil }
+	if !cfg.Enabled || cfg.Endpoint == "" {
+		tracer.Store(nil)
+		return noop, nil
+	}
+
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		tracer.Store(nil)
+		return noop, fmt.Errorf("无效的 tracing.endpoint: %s", cfg.Endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(u.String())}
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		tracer.Store(nil)
+		return noop, fmt.Errorf("创建 OTLP 导出器失败: %w", err)
+	}
+
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "doh-autoproxy"
+	}
+	ratio := cfg.SampleRatio
+	if ratio <= 0 || ratio > 1 {
+		ratio = 1
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	t := tp.Tracer("doh-autoproxy")
+	tracer.Store(&t)
+	return tp.Shutdown, nil
+}
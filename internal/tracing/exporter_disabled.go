@@ -0,0 +1,20 @@
+//go:build !otel
+
+package tracing
+
+import (
+	"context"
+	"errors"
+
+	"doh-autoproxy/internal/config"
+)
+
+// Setup 在未编译 OTLP 导出器时关闭追踪；配置中启用了追踪则返回错误，提示使用 -tags otel 重新编译。
+func Setup(cfg config.TracingConfig) (shutdown func(context.Context) error, err error) {
+	tracer.Store(nil)
+	noop := func(context.Context) error { return nil }
+	if cfg.Enabled && cfg.Endpoint != "" {
+		return noop, errors.New("当前程序未编译 OpenTelemetry 支持，需使用 go build -tags otel 编译")
+	}
+	return noop, nil
+}
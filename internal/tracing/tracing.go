@@ -0,0 +1,26 @@
+// Package tracing 提供可选的 OpenTelemetry 追踪：为每个查询生成 span，覆盖分流决定、上游解析与缓存命中，
+// 经 OTLP/HTTP 发送到 tracing.endpoint。未启用时 Start 直接返回 no-op span，不产生额外开销。
+// SDK 与 OTLP 导出器体积较大，仅在使用 -tags otel 编译时包含 (见 exporter.go)，默认构建只依赖 trace API。
+package tracing
+
+import (
+	"context"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer   atomic.Pointer[trace.Tracer]
+	noopSpan = trace.SpanFromContext(context.Background())
+)
+
+// Start 开始一个 span。未启用追踪时直接返回原 ctx 与 no-op span。
+// 调用方只应在 span.IsRecording() 为 true 时构造属性，以免在未启用时产生开销。
+func Start(ctx context.Context, name string) (context.Context, trace.Span) {
+	t := tracer.Load()
+	if t == nil {
+		return ctx, noopSpan
+	}
+	return (*t).Start(ctx, name)
+}
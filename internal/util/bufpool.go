@@ -0,0 +1,26 @@
+package util
+
+import (
+	"sync"
+)
+
+const MaxDNSMessageSize = 65535
+
+var messageBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, MaxDNSMessageSize)
+		return &b
+	},
+}
+
+func GetBuffer() *[]byte {
+	return messageBufferPool.Get().(*[]byte)
+}
+
+func PutBuffer(b *[]byte) {
+	if b == nil || cap(*b) < MaxDNSMessageSize {
+		return
+	}
+	*b = (*b)[:MaxDNSMessageSize]
+	messageBufferPool.Put(b)
+}
@@ -1,17 +1,87 @@
 package util
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 type Validator func(string) error
 
+const (
+	defaultDownloadRetries = 3
+	defaultDownloadTimeout = 10 * time.Minute
+	downloadBackoff        = 2 * time.Second
+	downloadMaxBackoff     = time.Minute
+	downloadStallTimeout   = 30 * time.Second
+)
+
+var errDownloadStalled = errors.New("连接停滞")
+
+// downloadClient 不限制单次请求时长，整体时长由 DownloadFile 的 context 控制，
+// 停滞的连接由 stallReader 中断后断点续传。关闭透明 gzip，保证续传时的字节偏移与首次请求一致。
+var downloadClient = func() *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.ResponseHeaderTimeout = 30 * time.Second
+	t.DisableCompression = true
+	return &http.Client{Transport: t}
+}()
+
+var userAgent atomic.Value // string
+
+// SetUserAgent 设置文件下载与 DoH 请求使用的 User-Agent，为空时使用 Go 的默认值。
+func SetUserAgent(ua string) {
+	userAgent.Store(ua)
+}
+
+// UserAgent 返回 http_user_agent 配置的 User-Agent，未配置时返回空字符串。
+func UserAgent() string {
+	ua, _ := userAgent.Load().(string)
+	return ua
+}
+
+type downloadPolicy struct {
+	retries int
+	timeout time.Duration
+}
+
+var policy atomic.Pointer[downloadPolicy]
+
+// SetDownloadPolicy 设置 DownloadFile 失败后的重试次数与整体超时 (含所有重试)，不大于 0 时使用默认值 3 次与 10 分钟。
+func SetDownloadPolicy(retries int, timeout time.Duration) {
+	if retries <= 0 {
+		retries = defaultDownloadRetries
+	}
+	if timeout <= 0 {
+		timeout = defaultDownloadTimeout
+	}
+	policy.Store(&downloadPolicy{retries: retries, timeout: timeout})
+}
+
+func currentPolicy() downloadPolicy {
+	if p := policy.Load(); p != nil {
+		return *p
+	}
+	return downloadPolicy{retries: defaultDownloadRetries, timeout: defaultDownloadTimeout}
+}
+
+// DownloadFile 把 url 下载到 filepath：先写入临时文件，校验长度并通过 validator 校验后再替换原文件。
+// 网络错误、429 与 5xx 按 SetDownloadPolicy 的次数重试，等待时间每次翻倍；
+// 重试时以 Range 请求从临时文件末尾续传，服务器不支持或文件已变化时从头下载。
 func DownloadFile(filepath string, url string, validator Validator) error {
-	tempFile := filepath + ".tmp"
+	p := currentPolicy()
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
 
+	tempFile := filepath + ".tmp"
 	out, err := os.Create(tempFile)
 	if err != nil {
 		return fmt.Errorf("无法创建临时文件: %w", err)
@@ -25,23 +95,32 @@ func DownloadFile(filepath string, url string, validator Validator) error {
 		}
 	}()
 
-	resp, err := http.Get(url)
-	if err != nil {
-		return fmt.Errorf("HTTP 请求失败: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("下载失败，HTTP 状态码: %s", resp.Status)
+	d := &download{url: url, out: out}
+	for i := 0; ; i++ {
+		err := d.fetch(ctx)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("下载超时 (%v): %w", p.timeout, err)
+		}
+		var perm permanentError
+		if i >= p.retries || errors.As(err, &perm) {
+			return err
+		}
+		wait := min(downloadBackoff<<i, downloadMaxBackoff)
+		log.Printf("下载 %s 失败 (第 %d 次，已接收 %d 字节)，%v 后重试: %v", url, i+1, d.written, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("下载超时 (%v): %w", p.timeout, err)
+		}
 	}
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
+	if err := out.Close(); err != nil {
 		return fmt.Errorf("写入文件失败: %w", err)
 	}
 
-	out.Close()
-
 	if validator != nil {
 		if err := validator(tempFile); err != nil {
 			return fmt.Errorf("文件校验失败: %w", err)
@@ -56,3 +135,149 @@ func DownloadFile(filepath string, url string, validator Validator) error {
 
 	return nil
 }
+
+// permanentError 表示重试也无法成功的下载错误 (如 404)。
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+
+func (e permanentError) Unwrap() error { return e.err }
+
+// download 记录一次下载在多次尝试之间的进度。
+type download struct {
+	url     string
+	out     *os.File
+	written int64  // 临时文件中已写入的字节数
+	total   int64  // 文件总长度，未知时为 -1
+	ifRange string // 首次应答的 ETag 或 Last-Modified，续传时确保文件未变化
+}
+
+// reset 清空临时文件，下一次尝试从头下载。
+func (d *download) reset() error {
+	d.written, d.ifRange = 0, ""
+	if err := d.out.Truncate(0); err != nil {
+		return permanentError{fmt.Errorf("写入文件失败: %w", err)}
+	}
+	if _, err := d.out.Seek(0, io.SeekStart); err != nil {
+		return permanentError{fmt.Errorf("写入文件失败: %w", err)}
+	}
+	return nil
+}
+
+func (d *download) fetch(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return permanentError{fmt.Errorf("无效的下载地址: %w", err)}
+	}
+	if ua := UserAgent(); ua != "" {
+		req.Header.Set("User-Agent", ua)
+	}
+	if d.written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+		if d.ifRange != "" {
+			req.Header.Set("If-Range", d.ifRange)
+		}
+	}
+
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("HTTP 请求失败: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if d.written > 0 {
+			log.Printf("%s 不支持断点续传或文件已变化，从头下载", d.url)
+			if err := d.reset(); err != nil {
+				return err
+			}
+		}
+		d.total = resp.ContentLength
+		if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			d.ifRange = etag
+		} else {
+			d.ifRange = resp.Header.Get("Last-Modified")
+		}
+	case http.StatusPartialContent:
+		start, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.written {
+			if err := d.reset(); err != nil {
+				return err
+			}
+			return fmt.Errorf("续传应答的 Content-Range 无效: %q", resp.Header.Get("Content-Range"))
+		}
+		d.total = total
+	case http.StatusRequestedRangeNotSatisfiable:
+		if err := d.reset(); err != nil {
+			return err
+		}
+		return fmt.Errorf("续传失败，HTTP 状态码: %s", resp.Status)
+	default:
+		err := fmt.Errorf("下载失败，HTTP 状态码: %s", resp.Status)
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return err
+		}
+		return permanentError{err}
+	}
+
+	stall := time.AfterFunc(downloadStallTimeout, func() { cancel(errDownloadStalled) })
+	defer stall.Stop()
+	n, err := io.Copy(d.out, &stallReader{r: resp.Body, timer: stall})
+	d.written += n
+	if err != nil {
+		if context.Cause(ctx) == errDownloadStalled {
+			return fmt.Errorf("下载中断: %v 内未收到数据", downloadStallTimeout)
+		}
+		return fmt.Errorf("下载中断: %w", err)
+	}
+	if d.total >= 0 && d.written != d.total {
+		return fmt.Errorf("文件不完整: 已接收 %d 字节，Content-Length 为 %d", d.written, d.total)
+	}
+	return nil
+}
+
+// parseContentRange 解析 "bytes start-end/total"，total 未知 (*) 时返回 -1。
+func parseContentRange(v string) (start, total int64, ok bool) {
+	v, found := strings.CutPrefix(v, "bytes ")
+	if !found {
+		return 0, 0, false
+	}
+	rng, size, found := strings.Cut(v, "/")
+	if !found {
+		return 0, 0, false
+	}
+	first, _, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if size == "*" {
+		return start, -1, true
+	}
+	total, err = strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// stallReader 每次读到数据时重置计时器，计时器触发说明连接已停滞。
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(downloadStallTimeout)
+	}
+	return n, err
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// DefaultEDNSBufferSize 是 DNS Flag Day 2020 推荐的 EDNS UDP 缓冲区大小，可避免 IP 分片。
+const DefaultEDNSBufferSize = 1232
+
+var ednsBufferSize atomic.Int32
+
+// SetEDNSBufferSize 设置向上游与客户端通告的 EDNS UDP 缓冲区大小，不大于 0 时使用默认值 1232，
+// 取值限制在 512 到 65535 之间。
+func SetEDNSBufferSize(size int) {
+	if size <= 0 {
+		size = DefaultEDNSBufferSize
+	}
+	ednsBufferSize.Store(int32(min(max(size, dns.MinMsgSize), dns.MaxMsgSize)))
+}
+
+// EDNSBufferSize 返回 edns_buffer_size 配置的 EDNS UDP 缓冲区大小。
+func EDNSBufferSize() uint16 {
+	if size := ednsBufferSize.Load(); size > 0 {
+		return uint16(size)
+	}
+	return DefaultEDNSBufferSize
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"strconv"
+	"sync"
+)
+
+var latencyBucketsMs = []int64{1, 2, 5, 10, 20, 30, 50, 75, 100, 150, 200, 300, 500, 750, 1000, 2000, 3000, 5000, 10000}
+
+type LatencyHistogram struct {
+	mu     sync.Mutex
+	counts []int64
+	total  int64
+	sum    int64
+}
+
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		counts: make([]int64, len(latencyBucketsMs)+1),
+	}
+}
+
+func (h *LatencyHistogram) Observe(ms int64) {
+	idx := len(latencyBucketsMs)
+	for i, bound := range latencyBucketsMs {
+		if ms <= bound {
+			idx = i
+			break
+		}
+	}
+
+	h.mu.Lock()
+	h.counts[idx]++
+	h.total++
+	h.sum += ms
+	h.mu.Unlock()
+}
+
+func (h *LatencyHistogram) Percentile(p float64) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.total == 0 {
+		return 0
+	}
+
+	rank := int64(float64(h.total)*p + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+
+	var cumulative int64
+	for i, c := range h.counts {
+		if c == 0 {
+			continue
+		}
+		if cumulative+c < rank {
+			cumulative += c
+			continue
+		}
+		if i == len(latencyBucketsMs) {
+			return latencyBucketsMs[len(latencyBucketsMs)-1]
+		}
+		lower := int64(0)
+		if i > 0 {
+			lower = latencyBucketsMs[i-1]
+		}
+		upper := latencyBucketsMs[i]
+		return lower + (upper-lower)*(rank-cumulative)/c
+	}
+
+	return latencyBucketsMs[len(latencyBucketsMs)-1]
+}
+
+func (h *LatencyHistogram) Buckets() map[string]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	result := make(map[string]int64, len(h.counts))
+	for i, c := range h.counts {
+		if i == len(latencyBucketsMs) {
+			result["+Inf"] = c
+			continue
+		}
+		result[strconv.FormatInt(latencyBucketsMs[i], 10)] = c
+	}
+	return result
+}
+
+// Snapshot 返回各桶的上界 (毫秒)、按上界累计的计数 (最后一项为 +Inf)、总数与耗时总和，
+// 即 Prometheus histogram 的 le 桶、_count 与 _sum。
+func (h *LatencyHistogram) Snapshot() (bounds, cumulative []int64, count, sum int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	cumulative = make([]int64, len(h.counts))
+	var acc int64
+	for i, c := range h.counts {
+		acc += c
+		cumulative[i] = acc
+	}
+	return latencyBucketsMs, cumulative, h.total, h.sum
+}
@@ -1,9 +1,11 @@
 package util
 
 import (
+	"context"
 	"net"
 	"strconv"
 	"strings"
+	"syscall"
 )
 
 func ParsePort(addr string) int {
@@ -21,3 +23,19 @@ func ParsePort(addr string) int {
 	}
 	return port
 }
+
+func NewListenConfig(iface string, reusePort bool) *net.ListenConfig {
+	return &net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setSockOpts(c, iface, reusePort)
+		},
+	}
+}
+
+func ListenPacket(addr, iface string, reusePort bool) (net.PacketConn, error) {
+	return NewListenConfig(iface, reusePort).ListenPacket(context.Background(), "udp", addr)
+}
+
+func Listen(addr, iface string, reusePort bool) (net.Listener, error) {
+	return NewListenConfig(iface, reusePort).Listen(context.Background(), "tcp", addr)
+}
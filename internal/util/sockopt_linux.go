@@ -0,0 +1,27 @@
+//go:build linux
+
+package util
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func setSockOpts(c syscall.RawConn, iface string, reusePort bool) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		if reusePort {
+			if opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); opErr != nil {
+				return
+			}
+		}
+		if iface != "" {
+			opErr = unix.BindToDevice(int(fd), iface)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package util
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func setSockOpts(c syscall.RawConn, iface string, reusePort bool) error {
+	if iface != "" || reusePort {
+		return fmt.Errorf("当前平台不支持绑定网卡或 SO_REUSEPORT")
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package util
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFdsStart 是 systemd 传入的第一个文件描述符 (SD_LISTEN_FDS_START)。
+const listenFdsStart = 3
+
+var (
+	activatedOnce  sync.Once
+	activatedFiles []*os.File
+)
+
+// systemdFiles 返回 systemd 套接字激活 (LISTEN_PID / LISTEN_FDS) 传入的套接字。
+// 文件在整个进程生命周期内保持打开，每次取用时复制一份描述符，
+// 因此监听器在重载时关闭后仍可再次从中取得同一个套接字，无需重新绑定端口。
+func systemdFiles() []*os.File {
+	activatedOnce.Do(func() {
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		names := make([]string, n)
+		copy(names, strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"))
+		for i := 0; i < n; i++ {
+			name := names[i]
+			if name == "" {
+				name = "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+			}
+			activatedFiles = append(activatedFiles, os.NewFile(uintptr(listenFdsStart+i), name))
+		}
+		// 避免子进程误认为这些套接字是传给自己的
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+	return activatedFiles
+}
+
+// ActivatedPacketConn 返回 systemd 传入的、端口与 addr 相同的 UDP 套接字，没有时返回 nil。
+func ActivatedPacketConn(addr string) net.PacketConn {
+	port := ParsePort(addr)
+	for _, f := range systemdFiles() {
+		pc, err := net.FilePacketConn(f)
+		if err != nil {
+			continue
+		}
+		if udp, ok := pc.LocalAddr().(*net.UDPAddr); ok && udp.Port == port {
+			return pc
+		}
+		pc.Close()
+	}
+	return nil
+}
+
+// ActivatedListener 返回 systemd 传入的、端口与 addr 相同的 TCP 监听套接字，没有时返回 nil。
+func ActivatedListener(addr string) net.Listener {
+	port := ParsePort(addr)
+	for _, f := range systemdFiles() {
+		l, err := net.FileListener(f)
+		if err != nil {
+			continue
+		}
+		if tcp, ok := l.Addr().(*net.TCPAddr); ok && tcp.Port == port {
+			return l
+		}
+		l.Close()
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+type Event struct {
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Detail    string    `json:"detail"`
+}
+
+// Notify 向 url 发送一条事件通知，url 为空时不做任何事。
+func Notify(url, event, detail string) {
+	PostWebhook(url, Event{Event: event, Timestamp: time.Now(), Detail: detail})
+}
+
+// PostWebhook 在后台将 payload 以 JSON 形式 POST 到 url，失败仅记录日志，不阻塞调用方。
+func PostWebhook(url string, payload interface{}) {
+	if url == "" {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Webhook 序列化失败: %v", err)
+		return
+	}
+
+	go func() {
+		resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Webhook 发送失败: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Webhook 返回非成功状态码: %s", resp.Status)
+		}
+	}()
+}
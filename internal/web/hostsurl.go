@@ -0,0 +1,64 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var hostsClient = &http.Client{Timeout: 30 * time.Second}
+
+// maxHostsDownload 限制远程 hosts 文件的大小。
+const maxHostsDownload = 20 << 20
+
+// errHostsTooLarge 表示远程 hosts 文件超过 maxHostsDownload。直接报错而不是截断，
+// 以免替换模式把被截断的列表当作完整内容导入。
+var errHostsTooLarge = errors.New("远程 hosts 文件超过 20 MB")
+
+// limitedBody 在读取超过 remaining 字节时返回 errHostsTooLarge。
+type limitedBody struct {
+	io.Reader
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	n, err := l.Reader.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return 0, errHostsTooLarge
+	}
+	return n, err
+}
+
+// openHostsURL 下载远程 hosts 文件，仅支持 http / https。
+func openHostsURL(ctx context.Context, rawURL string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("无效的 hosts 地址: %s", rawURL)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hostsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("下载 hosts 失败: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("下载 hosts 失败，HTTP 状态码: %s", resp.Status)
+	}
+	if resp.ContentLength > maxHostsDownload {
+		resp.Body.Close()
+		return nil, errHostsTooLarge
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&limitedBody{Reader: resp.Body, remaining: maxHostsDownload}, resp.Body}, nil
+}
@@ -0,0 +1,134 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"doh-autoproxy/internal/manager"
+	"doh-autoproxy/internal/util"
+)
+
+// writeMetrics 以 Prometheus 文本格式 (0.0.4) 输出 /api/stats 中的主要指标：
+// 查询总量与缓存命中、整体与各上游的耗时直方图、各上游的查询/错误计数与健康状态、各分流阶段命中次数。
+func writeMetrics(w io.Writer, mgr *manager.ServiceManager) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	stats := mgr.QueryLog.GetStats()
+	gauge(w, "doh_autoproxy_uptime_seconds", "Seconds since the query logger started.", time.Since(stats.StartTime).Seconds())
+	gauge(w, "doh_autoproxy_memory_alloc_bytes", "Bytes of allocated heap objects.", float64(m.Alloc))
+	gauge(w, "doh_autoproxy_goroutines", "Number of goroutines.", float64(runtime.NumGoroutine()))
+
+	header(w, "doh_autoproxy_queries_total", "Queries answered, by upstream group.", "counter")
+	sample(w, "doh_autoproxy_queries_total", `group="cn"`, float64(stats.TotalCN))
+	sample(w, "doh_autoproxy_queries_total", `group="overseas"`, float64(stats.TotalOverseas))
+	sample(w, "doh_autoproxy_queries_total", `group="other"`, float64(stats.TotalQueries-stats.TotalCN-stats.TotalOverseas))
+	counter(w, "doh_autoproxy_cache_hits_total", "Queries answered from the response cache.", float64(stats.CacheHits))
+
+	header(w, "doh_autoproxy_query_duration_milliseconds", "Query latency as seen by clients.", "histogram")
+	histogram(w, "doh_autoproxy_query_duration_milliseconds", "", mgr.QueryLog.Latency())
+
+	r := mgr.Router
+	if r == nil {
+		return
+	}
+	gauge(w, "doh_autoproxy_cache_entries", "Entries in the response cache.", float64(r.CacheSize()))
+
+	upstreams := r.StatsClients()
+	metrics := []struct{ name, help, key string }{
+		{"doh_autoproxy_upstream_queries_total", "Queries sent to the upstream.", "total_queries"},
+		{"doh_autoproxy_upstream_errors_total", "Failed upstream queries, excluding cancellations.", "total_errors"},
+		{"doh_autoproxy_upstream_canceled_total", "Upstream queries canceled after another upstream answered.", "total_canceled"},
+		{"doh_autoproxy_upstream_retries_total", "Retries sent to the upstream.", "total_retries"},
+	}
+	snapshots := make([]map[string]interface{}, len(upstreams))
+	for i, s := range upstreams {
+		snapshots[i] = s.GetStats()
+	}
+	for _, mt := range metrics {
+		header(w, mt.name, mt.help, "counter")
+		for i, s := range upstreams {
+			v, _ := snapshots[i][mt.key].(int64)
+			sample(w, mt.name, upstreamLabels(s.Address, s.Protocol, s.Group), float64(v))
+		}
+	}
+	header(w, "doh_autoproxy_upstream_healthy", "1 if the upstream is considered healthy.", "gauge")
+	for _, s := range upstreams {
+		sample(w, "doh_autoproxy_upstream_healthy", upstreamLabels(s.Address, s.Protocol, s.Group), boolValue(s.Healthy()))
+	}
+	header(w, "doh_autoproxy_upstream_duration_milliseconds", "Upstream query latency.", "histogram")
+	for _, s := range upstreams {
+		histogram(w, "doh_autoproxy_upstream_duration_milliseconds", upstreamLabels(s.Address, s.Protocol, s.Group), s.Latency())
+	}
+
+	stages := r.GetStageStats()
+	names := make([]string, 0, len(stages))
+	for name := range stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	header(w, "doh_autoproxy_routing_stage_total", "Queries decided by each routing stage.", "counter")
+	for _, name := range names {
+		sample(w, "doh_autoproxy_routing_stage_total", `stage="`+escapeLabel(name)+`"`, float64(stages[name]))
+	}
+}
+
+func header(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func gauge(w io.Writer, name, help string, v float64) {
+	header(w, name, help, "gauge")
+	sample(w, name, "", v)
+}
+
+func counter(w io.Writer, name, help string, v float64) {
+	header(w, name, help, "counter")
+	sample(w, name, "", v)
+}
+
+func histogram(w io.Writer, name, labels string, h *util.LatencyHistogram) {
+	bounds, cumulative, count, sum := h.Snapshot()
+	prefix := ""
+	if labels != "" {
+		prefix = labels + ","
+	}
+	for i, c := range cumulative {
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatInt(bounds[i], 10)
+		}
+		sample(w, name+"_bucket", prefix+`le="`+le+`"`, float64(c))
+	}
+	sample(w, name+"_sum", labels, float64(sum))
+	sample(w, name+"_count", labels, float64(count))
+}
+
+func upstreamLabels(address, protocol, group string) string {
+	return `address="` + escapeLabel(address) + `",protocol="` + escapeLabel(protocol) + `",group="` + escapeLabel(strings.ToLower(group)) + `"`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
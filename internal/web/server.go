@@ -5,15 +5,23 @@ import (
 	"doh-autoproxy/internal/client"
 	"doh-autoproxy/internal/config"
 	"doh-autoproxy/internal/manager"
+	"doh-autoproxy/internal/querylog"
 	"doh-autoproxy/internal/resolver"
+	"doh-autoproxy/internal/router"
+	"doh-autoproxy/internal/server"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -30,22 +38,33 @@ var (
 )
 
 type DashboardStats struct {
-	UptimeSeconds    int64            `json:"uptime_seconds"`
-	MemoryUsageMB    float64          `json:"memory_usage_mb"`
-	NumGoroutines    int              `json:"num_goroutines"`
-	TotalQueries     int64            `json:"total_queries"`
-	TotalCN          int64            `json:"total_cn"`
-	TotalOverseas    int64            `json:"total_overseas"`
-	ListenDNSUDP     string           `json:"listen_dns_udp"`
-	ListenDNSTCP     string           `json:"listen_dns_tcp"`
-	ListenDOH        string           `json:"listen_doh"`
-	ListenDOT        string           `json:"listen_dot"`
-	ListenDOQ        string           `json:"listen_doq"`
-	UpstreamCN       int              `json:"upstream_cn_count"`
-	UpstreamOverseas int              `json:"upstream_overseas_count"`
-	UpstreamStats    []interface{}    `json:"upstream_stats,omitempty"`
-	TopClients       map[string]int64 `json:"top_clients"`
-	TopDomains       map[string]int64 `json:"top_domains"`
+	UptimeSeconds    int64                            `json:"uptime_seconds"`
+	MemoryUsageMB    float64                          `json:"memory_usage_mb"`
+	NumGoroutines    int                              `json:"num_goroutines"`
+	TotalQueries     int64                            `json:"total_queries"`
+	TotalCN          int64                            `json:"total_cn"`
+	TotalOverseas    int64                            `json:"total_overseas"`
+	CacheHits        int64                            `json:"cache_hits"`
+	AvgResponseSize  int64                            `json:"avg_response_size"`
+	LatencyP50       int64                            `json:"latency_p50_ms"`
+	LatencyP95       int64                            `json:"latency_p95_ms"`
+	LatencyP99       int64                            `json:"latency_p99_ms"`
+	LatencyBuckets   map[string]int64                 `json:"latency_buckets"`
+	ListenDNSUDP     string                           `json:"listen_dns_udp"`
+	ListenDNSTCP     string                           `json:"listen_dns_tcp"`
+	ListenDOH        string                           `json:"listen_doh"`
+	ListenDOT        string                           `json:"listen_dot"`
+	ListenDOQ        string                           `json:"listen_doq"`
+	Listeners        map[string]server.ListenerStatus `json:"listeners"`
+	UpstreamCN       int                              `json:"upstream_cn_count"`
+	UpstreamOverseas int                              `json:"upstream_overseas_count"`
+	UpstreamStats    []interface{}                    `json:"upstream_stats,omitempty"`
+	RoutingStages    map[string]int64                 `json:"routing_stages,omitempty"`
+	CacheEntries     int                              `json:"cache_entries"`
+	TopClients       map[string]int64                 `json:"top_clients"`
+	TopDomains       map[string]int64                 `json:"top_domains"`
+	TopTypes         map[string]int64                 `json:"top_types"`
+	Reload           manager.ReloadInfo               `json:"reload"`
 }
 
 type TestResult struct {
@@ -75,6 +94,9 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		if mgr.Config.WebUI.Username == "" || mgr.Config.WebUI.Password == "" {
 			return true
 		}
+		if isTrustedClient(r.RemoteAddr, mgr.Config.WebUI.TrustedCIDRs) {
+			return true
+		}
 		cookie, err := r.Cookie("session_token")
 		if err != nil {
 			return false
@@ -85,6 +107,30 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		return ok && time.Now().Before(expiry)
 	}
 
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		healthy, reason := mgr.Healthy()
+		if !healthy {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		ready, reason := mgr.Ready(ctx)
+		if !ready {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ready"))
+	})
+
 	mux.HandleFunc("/api/auth/status", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate, max-age=0")
 		w.Header().Set("Pragma", "no-cache")
@@ -196,6 +242,11 @@ func StartWebServer(mgr *manager.ServiceManager) {
 				newCfg.Hosts[k] = v
 			}
 
+			if err := newCfg.Validate(); err != nil {
+				http.Error(w, "Invalid config: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
 			configPath := config.GetDefaultConfigPath()
 			if err := newCfg.Save(configPath); err != nil {
 				http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
@@ -215,6 +266,115 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	})
 
+	mux.HandleFunc("/api/config/restore", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		configPath := config.GetDefaultConfigPath()
+		backup, err := config.RestoreConfigBackup(configPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				http.Error(w, "No config backup found", http.StatusNotFound)
+				return
+			}
+			http.Error(w, "Failed to restore config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		newCfg, err := config.LoadConfig(configPath)
+		if err != nil {
+			http.Error(w, "Config restored but failed to load: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := mgr.Reload(newCfg); err != nil {
+			http.Error(w, "Config restored but reload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"restored": filepath.Base(backup)})
+	})
+
+	mux.HandleFunc("/api/upstreams/toggle", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Group   string `json:"group"`
+			Address string `json:"address"`
+			Enabled *bool  `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		newCfg := *mgr.Config
+		var list *[]config.UpstreamServer
+		switch strings.ToLower(req.Group) {
+		case "cn":
+			list = &newCfg.Upstreams.CN
+		case "overseas":
+			list = &newCfg.Upstreams.Overseas
+		default:
+			http.Error(w, "Invalid group", http.StatusBadRequest)
+			return
+		}
+		*list = append([]config.UpstreamServer(nil), *list...)
+
+		found := false
+		var enabled bool
+		for i := range *list {
+			u := &(*list)[i]
+			if u.Address != req.Address {
+				continue
+			}
+			enabled = !u.IsEnabled()
+			if req.Enabled != nil {
+				enabled = *req.Enabled
+			}
+			if enabled {
+				u.Enabled = nil
+			} else {
+				u.Enabled = &enabled
+			}
+			found = true
+			break
+		}
+		if !found {
+			http.Error(w, "Upstream not found", http.StatusNotFound)
+			return
+		}
+
+		if err := newCfg.Save(config.GetDefaultConfigPath()); err != nil {
+			http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := mgr.Reload(&newCfg); err != nil {
+			http.Error(w, "Config saved but reload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"group":   req.Group,
+			"address": req.Address,
+			"enabled": enabled,
+		})
+	})
+
 	mux.HandleFunc("/api/hosts", func(w http.ResponseWriter, r *http.Request) {
 		if !checkAuth(r) && (!mgr.Config.WebUI.GuestMode || r.Method != http.MethodGet) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
@@ -345,6 +505,147 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	})
 
+	mux.HandleFunc("/api/hosts/import", func(w http.ResponseWriter, r *http.Request) {
+		if !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// 请求体为原始文本，或 JSON {"url": "...", "replace": false, "format": "hosts"} 从远程地址下载
+		format := r.URL.Query().Get("format")
+		replace := r.URL.Query().Get("replace") == "true"
+		var body io.Reader = http.MaxBytesReader(w, r.Body, 10<<20)
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			var payload struct {
+				URL     string `json:"url"`
+				Replace bool   `json:"replace"`
+				Format  string `json:"format"`
+			}
+			if err := json.NewDecoder(body).Decode(&payload); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			rc, err := openHostsURL(r.Context(), payload.URL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer rc.Close()
+			body, replace = rc, payload.Replace
+			if payload.Format != "" {
+				format = payload.Format
+			}
+		}
+
+		parsed := make(map[string]string)
+		res, err := config.ParseHosts(body, format, parsed)
+		var tooLarge *http.MaxBytesError
+		switch {
+		case errors.Is(err, errHostsTooLarge) || errors.As(err, &tooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// 替换模式会删除现有全部条目，格式选错或内容损坏时拒绝导入
+		if replace && (len(parsed) == 0 || res.Invalid > (res.Invalid+res.Added)/10) {
+			http.Error(w, fmt.Sprintf("Refusing to replace hosts: %d valid entries, %d invalid lines", res.Added, res.Invalid), http.StatusUnprocessableEntity)
+			return
+		}
+
+		newCfg := *mgr.Config
+		newCfg.Hosts = make(map[string]string)
+		if !replace {
+			for k, v := range mgr.Config.Hosts {
+				newCfg.Hosts[k] = v
+			}
+		}
+
+		res.Added = 0
+		for domain, ip := range parsed {
+			if mgr.Config.Hosts[domain] == ip {
+				res.Skipped++
+			} else {
+				res.Added++
+			}
+			newCfg.Hosts[domain] = ip
+		}
+		if replace {
+			for domain := range mgr.Config.Hosts {
+				if _, ok := parsed[domain]; !ok {
+					res.Removed++
+				}
+			}
+		}
+
+		if res.Added > 0 || res.Removed > 0 {
+			configPath := config.GetDefaultConfigPath()
+			if err := newCfg.Save(configPath); err != nil {
+				http.Error(w, "Failed to save config: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := mgr.Reload(&newCfg); err != nil {
+				http.Error(w, "Failed to reload: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// route-preview 返回每个域名在当前规则下的分流分支与目标分组，不发出任何上游查询
+	mux.HandleFunc("/api/route-preview", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req struct {
+			Domains  []string `json:"domains"`
+			Type     string   `json:"type"`
+			ClientIP string   `json:"client_ip"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Domains) == 0 || len(req.Domains) > 1000 {
+			http.Error(w, "domains must contain 1-1000 entries", http.StatusBadRequest)
+			return
+		}
+		qtype := dns.TypeA
+		if req.Type != "" {
+			t, ok := dns.StringToType[strings.ToUpper(req.Type)]
+			if !ok {
+				http.Error(w, "Invalid type", http.StatusBadRequest)
+				return
+			}
+			qtype = t
+		}
+		if mgr.Router == nil {
+			http.Error(w, "Router not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		results := make([]router.RoutePreview, 0, len(req.Domains))
+		for _, domain := range req.Domains {
+			results = append(results, mgr.Router.PreviewRoute(domain, qtype, req.ClientIP))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(results)
+	})
+
 	mux.HandleFunc("/api/test-upstreams", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -420,6 +721,31 @@ func StartWebServer(mgr *manager.ServiceManager) {
 	})
 
 	mux.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			// DELETE 清空内存中的日志；file=true 时同时清空持久化的日志文件 (或 SQLite 表)，
+			// stats=true 时同时清零仪表盘统计 (查询总数、排行、延迟与查询量曲线)
+			if !checkAuth(r) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			q := r.URL.Query()
+			resp := map[string]interface{}{"cleared": mgr.QueryLog.Clear()}
+			if q.Get("file") == "true" {
+				n, err := mgr.QueryLog.ClearStore()
+				if err != nil {
+					http.Error(w, "Failed to clear log file: "+err.Error(), http.StatusInternalServerError)
+					return
+				}
+				resp["file_cleared"] = n
+			}
+			if q.Get("stats") == "true" {
+				mgr.QueryLog.ResetStats()
+				resp["stats_reset"] = true
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+			return
+		}
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -441,12 +767,30 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		}
 
 		offset := (page - 1) * limit
-		query := r.URL.Query().Get("q")
-		if query == "" {
-			query = r.URL.Query().Get("ip")
+		q := r.URL.Query()
+		filter := querylog.Filter{
+			Query:    q.Get("q"),
+			Domain:   q.Get("domain"),
+			Client:   q.Get("client"),
+			Status:   q.Get("status"),
+			Upstream: q.Get("upstream"),
+			Type:     q.Get("type"),
+			Protocol: q.Get("protocol"),
+		}
+		if filter.Query == "" {
+			filter.Query = q.Get("ip")
+		}
+		var err error
+		if filter.Since, err = parseTimeParam(q.Get("since")); err != nil {
+			http.Error(w, "Invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.Until, err = parseTimeParam(q.Get("until")); err != nil {
+			http.Error(w, "Invalid until: "+err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		logs, total := mgr.QueryLog.GetLogs(offset, limit, query)
+		logs, total := mgr.QueryLog.GetLogs(offset, limit, filter)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -481,25 +825,154 @@ func StartWebServer(mgr *manager.ServiceManager) {
 			TotalQueries:     stats.TotalQueries,
 			TotalCN:          stats.TotalCN,
 			TotalOverseas:    stats.TotalOverseas,
+			CacheHits:        stats.CacheHits,
+			LatencyP50:       stats.LatencyP50,
+			LatencyP95:       stats.LatencyP95,
+			LatencyP99:       stats.LatencyP99,
+			LatencyBuckets:   stats.LatencyBuckets,
 			ListenDNSUDP:     currentCfg.Listen.DNSUDP,
 			ListenDNSTCP:     currentCfg.Listen.DNSTCP,
 			ListenDOH:        currentCfg.Listen.DOH,
 			ListenDOT:        currentCfg.Listen.DOT,
 			ListenDOQ:        currentCfg.Listen.DOQ,
+			Listeners:        mgr.Listeners(),
 			UpstreamCN:       len(currentCfg.Upstreams.CN),
 			UpstreamOverseas: len(currentCfg.Upstreams.Overseas),
 			TopClients:       stats.TopClients,
 			TopDomains:       stats.TopDomains,
+			TopTypes:         stats.TopTypes,
+			Reload:           mgr.ReloadStatus(),
+		}
+
+		if stats.TotalQueries > 0 {
+			resp.AvgResponseSize = stats.ResponseBytes / stats.TotalQueries
 		}
 
 		if mgr.Router != nil {
 			resp.UpstreamStats = mgr.Router.GetUpstreamStats()
+			resp.RoutingStages = mgr.Router.GetStageStats()
+			resp.CacheEntries = mgr.Router.CacheSize()
 		}
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(resp)
 	})
 
+	// Prometheus 抓取不带登录会话，需开启 guest_mode 或将抓取端地址加入 trusted_cidrs
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !mgr.Config.WebUI.GuestMode && !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w, mgr)
+	})
+
+	mux.HandleFunc("/api/stats/routing", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if !mgr.Config.WebUI.GuestMode && !checkAuth(r) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		case http.MethodDelete:
+			if !checkAuth(r) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			if mgr.Router != nil {
+				mgr.Router.ResetStageStats()
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats := map[string]int64{}
+		if mgr.Router != nil {
+			stats = mgr.Router.GetStageStats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+
+	// GET 返回屏蔽列表的加载情况，POST 立即重新下载所有订阅
+	mux.HandleFunc("/api/blocklist", func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			router.BlocklistStats
+			Updated *int   `json:"updated,omitempty"`
+			Error   string `json:"error,omitempty"`
+		}{}
+
+		switch r.Method {
+		case http.MethodGet:
+			if !mgr.Config.WebUI.GuestMode && !checkAuth(r) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		case http.MethodPost:
+			if !checkAuth(r) {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			updated, err := mgr.RefreshBlocklists(true)
+			resp.Updated = &updated
+			if err != nil {
+				resp.Error = err.Error()
+			}
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if mgr.Router != nil {
+			resp.BlocklistStats = mgr.Router.BlocklistStats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	mux.HandleFunc("/api/stats/timeseries", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !mgr.Config.WebUI.GuestMode && !checkAuth(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		window := time.Hour
+		if v := r.URL.Query().Get("window"); v != "" {
+			d, err := parseWindow(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid window", http.StatusBadRequest)
+				return
+			}
+			window = d
+		}
+
+		var interval time.Duration
+		if v := r.URL.Query().Get("interval"); v != "" {
+			d, err := parseWindow(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "Invalid interval", http.StatusBadRequest)
+				return
+			}
+			interval = d
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mgr.QueryLog.GetTimeSeries(window, interval))
+	})
+
 	uiAssets, err := fs.Sub(uiFS, "ui")
 	if err != nil {
 		log.Fatalf("Failed to embed UI: %v", err)
@@ -536,3 +1009,25 @@ func StartWebServer(mgr *manager.ServiceManager) {
 		}
 	}()
 }
+
+// parseTimeParam 解析日志查询的时间范围参数，支持 RFC3339 与 Unix 秒时间戳，空值表示不限制。
+func parseTimeParam(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
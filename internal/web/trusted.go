@@ -0,0 +1,35 @@
+package web
+
+import (
+	"net"
+	"strings"
+)
+
+// isTrustedClient 判断请求来源是否落在 web_ui.trusted_cidrs 中。
+// 只使用 TCP 连接的对端地址，不信任 X-Forwarded-For 等可伪造的请求头。
+func isTrustedClient(remoteAddr string, cidrs []string) bool {
+	if len(cidrs) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			if trusted := net.ParseIP(c); trusted != nil && trusted.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		if _, network, err := net.ParseCIDR(c); err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}